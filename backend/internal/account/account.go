@@ -0,0 +1,196 @@
+package account
+
+import (
+	"backend/internal/logging"
+	"backend/internal/mailer"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/internal/tracing"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// What happens to the messages of a deleted account, see ACCOUNT_DELETION_MESSAGES
+const (
+	// Messages keep their place in the history with their content removed
+	MessagesTombstone = "tombstone"
+	// Messages are deleted
+	MessagesDelete = "delete"
+)
+
+// Deletion settings, see Init for the environment overrides
+var (
+	// Time between a deletion request and the deletion, during which it can be cancelled
+	gracePeriod    = 14 * 24 * time.Hour
+	messagesPolicy = MessagesTombstone
+	pollInterval   = time.Minute
+	deletionLease  = 10 * time.Minute
+)
+
+// closeReason is sent in the close frame of the sockets of a deleted account
+const closeReason = "account deleted"
+
+var (
+	stop = make(chan struct{})
+	wg   sync.WaitGroup
+)
+
+// Init applies the environment overrides and starts the deletion worker
+//   - ACCOUNT_DELETION_GRACE_PERIOD, e.g. "336h"
+//   - ACCOUNT_DELETION_MESSAGES: "tombstone" (default) or "delete"
+func Init() error {
+	if err := applyEnv(); err != nil {
+		return err
+	}
+
+	wg.Add(1)
+	go worker()
+	return nil
+}
+
+func applyEnv() error {
+	gracePeriod = utils.GetEnvDuration("ACCOUNT_DELETION_GRACE_PERIOD", gracePeriod)
+	if policy := os.Getenv("ACCOUNT_DELETION_MESSAGES"); policy != "" {
+		if policy != MessagesTombstone && policy != MessagesDelete {
+			return fmt.Errorf("unsupported ACCOUNT_DELETION_MESSAGES %q", policy)
+		}
+		messagesPolicy = policy
+	}
+	return nil
+}
+
+// Shutdown stops the worker, waiting for the deletion in progress until ctx expires.
+// An interrupted deletion is resumed by another instance once its lease has passed.
+func Shutdown(ctx context.Context) error {
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func worker() {
+	defer wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			user, err := mongodb.ClaimUserDeletion(context.Background(), time.Now(), deletionLease)
+			if err != nil {
+				slog.Warn("Could not claim account deletion", logging.Err(err))
+				break
+			}
+			if user == nil {
+				break
+			}
+			deleteAccount(user)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteAccount carries out a claimed deletion. Every step can run again, so an
+// interrupted deletion is simply claimed and run once more.
+func deleteAccount(user *models.User) {
+	ctx, span := tracing.Tracer().Start(context.Background(), "account.delete")
+	defer span.End()
+	span.SetAttributes(attribute.String(logging.KeyUserID, user.ID))
+	logger := slog.With(logging.KeyUserID, user.ID)
+	ctx = logging.WithContext(ctx, logger)
+
+	if err := purge(ctx, user); err != nil {
+		tracing.RecordError(span, err)
+		logger.Error("Account deletion failed, retrying after the lease", logging.Err(err))
+		return
+	}
+	logger.Info("Account deleted", "messages", messagesPolicy)
+}
+
+func purge(ctx context.Context, user *models.User) error {
+	bots, err := mongodb.FindBotsByOwner(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	botIDs := make([]string, 0, len(bots))
+	for _, bot := range bots {
+		botIDs = append(botIDs, bot.ID)
+	}
+
+	// Credentials first, nothing may act for the account from here on
+	if err := mongodb.DeleteUserData(ctx, user.ID, botIDs); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := mongodb.SetUserDisabled(ctx, user.ID, true, now); err != nil {
+		return err
+	}
+	for _, botID := range botIDs {
+		if err := mongodb.AnonymiseUser(ctx, botID, now); err != nil {
+			return err
+		}
+		messages.DisconnectUser(ctx, botID, closeReason)
+	}
+	messages.DisconnectUser(ctx, user.ID, closeReason)
+
+	// Messages, then the chats whose last message may have changed
+	chatIDs, err := mongodb.FindChatIdsWithMessagesFrom(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if messagesPolicy == MessagesDelete {
+		_, err = mongodb.DeleteMessagesBySender(ctx, user.ID)
+	} else {
+		_, err = mongodb.TombstoneMessagesBySender(ctx, user.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if err := mongodb.RemoveUserFromChats(ctx, user.ID); err != nil {
+		return err
+	}
+	for _, chatID := range chatIDs {
+		if err := mongodb.RefreshChatSummary(ctx, chatID); err != nil {
+			return err
+		}
+	}
+
+	// The email address is about to go, say goodbye while it is still known
+	if user.Email != "" {
+		mailer.SendAsync(ctx, mailer.Message{
+			To:      user.Email,
+			Subject: "Your account has been deleted",
+			Body: fmt.Sprintf("Hi %s,\n\n"+
+				"As you requested, your account and its personal data have been deleted.\n",
+				user.Username),
+		})
+	}
+	return mongodb.AnonymiseUser(ctx, user.ID, now)
+}
@@ -0,0 +1,34 @@
+package account
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	previousGrace, previousPolicy := gracePeriod, messagesPolicy
+	t.Cleanup(func() { gracePeriod, messagesPolicy = previousGrace, previousPolicy })
+
+	t.Setenv("ACCOUNT_DELETION_GRACE_PERIOD", "72h")
+	t.Setenv("ACCOUNT_DELETION_MESSAGES", MessagesDelete)
+	if err := applyEnv(); err != nil {
+		t.Fatalf("applyEnv error: %v", err)
+	}
+	if gracePeriod != 72*time.Hour || messagesPolicy != MessagesDelete {
+		t.Errorf("grace period %v, messages %s, want 72h and delete", gracePeriod, messagesPolicy)
+	}
+
+	t.Setenv("ACCOUNT_DELETION_MESSAGES", "archive")
+	if err := applyEnv(); err == nil {
+		t.Error("applyEnv accepted an unknown messages policy")
+	}
+	if messagesPolicy != MessagesDelete {
+		t.Errorf("messages policy changed to %s by a refused value", messagesPolicy)
+	}
+}
+
+func TestMessagesAreKeptAsTombstonesByDefault(t *testing.T) {
+	if messagesPolicy != MessagesTombstone {
+		t.Errorf("default messages policy = %s, want %s", messagesPolicy, MessagesTombstone)
+	}
+}
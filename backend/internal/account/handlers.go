@@ -0,0 +1,118 @@
+package account
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/mailer"
+	"backend/internal/models"
+	"backend/mongodb"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Accounts signed in through single sign-on don't know their password, a sign-in
+// this recent confirms the request instead
+const recentSignIn = 10 * time.Minute
+
+// currentAccount loads the caller's user record, answering 401 if there is none
+func currentAccount(c *gin.Context) *models.User {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil || principal.TokenID != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return nil
+	}
+	user, err := mongodb.FindUserById(c.Request.Context(), principal.ID)
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return nil
+	}
+	return user
+}
+
+// GetDeletion reports whether a deletion of the caller's account is scheduled
+func GetDeletion(c *gin.Context) {
+	user := currentAccount(c)
+	if user == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"deletion_requested_at": user.DeletionRequestedAt,
+		"deletion_scheduled_at": user.DeletionScheduledAt,
+	})
+}
+
+// RequestDeletion schedules the deletion of the caller's account after the grace
+// period. It asks for the password (and the second factor when enabled), or a
+// recent sign-in through the identity provider for accounts linked to one.
+func RequestDeletion(c *gin.Context) {
+	user := currentAccount(c)
+	if user == nil {
+		return
+	}
+	if user.Bot {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Bot accounts are deleted with their owner"})
+		return
+	}
+	if user.DeletionScheduledAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "Deletion already scheduled", "deletion_scheduled_at": user.DeletionScheduledAt})
+		return
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	confirmedBySignIn := payload.Password == "" && len(user.OIDCIdentities) > 0 && auth.SignedInWithSSO(c, recentSignIn)
+	if !confirmedBySignIn && !auth.VerifyIdentity(c, user, payload.Password, payload.Code) {
+		return
+	}
+
+	now := time.Now()
+	scheduledAt := now.Add(gracePeriod)
+	if err := mongodb.ScheduleUserDeletion(c.Request.Context(), user.ID, now, scheduledAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not schedule deletion"})
+		return
+	}
+
+	if user.Email != "" {
+		mailer.SendAsync(c.Request.Context(), mailer.Message{
+			To:      user.Email,
+			Subject: "Your account is scheduled for deletion",
+			Body: fmt.Sprintf("Hi %s,\n\n"+
+				"Your account will be deleted on %s. Until then you can sign in and cancel the deletion.\n\n"+
+				"If you didn't ask for this, sign in, cancel it and change your password.\n",
+				user.Username, scheduledAt.UTC().Format(time.RFC1123)),
+		})
+	}
+
+	logging.FromGin(c).Info("Account deletion scheduled", "deletion_scheduled_at", scheduledAt)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Deletion scheduled", "deletion_scheduled_at": scheduledAt})
+}
+
+// CancelDeletion withdraws a scheduled deletion during the grace period
+func CancelDeletion(c *gin.Context) {
+	user := currentAccount(c)
+	if user == nil {
+		return
+	}
+
+	cancelled, err := mongodb.CancelUserDeletion(c.Request.Context(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not cancel deletion"})
+		return
+	}
+	if !cancelled {
+		c.JSON(http.StatusConflict, gin.H{"message": "No deletion can be cancelled"})
+		return
+	}
+
+	logging.FromGin(c).Info("Account deletion cancelled")
+	c.JSON(http.StatusOK, gin.H{"message": "Deletion cancelled"})
+}
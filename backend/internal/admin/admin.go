@@ -0,0 +1,292 @@
+package admin
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/mongodb"
+	"crypto/rand"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userView is what administrators see of an account, never its secrets
+type userView struct {
+	ID                string     `json:"id"`
+	Username          string     `json:"username"`
+	Email             string     `json:"email"`
+	Roles             []string   `json:"roles"`
+	Disabled          bool       `json:"disabled"`
+	DisabledAt        *time.Time `json:"disabled_at,omitempty"`
+	MutedUntil        *time.Time `json:"muted_until,omitempty"`
+	MFAEnabled        bool       `json:"mfa_enabled"`
+	Placeholder       bool       `json:"placeholder,omitempty"`
+	OnlineConnections int        `json:"online_connections"`
+}
+
+// chatView is the metadata of a chat, without any message content
+type chatView struct {
+	ID            string     `json:"id"`
+	Users         []string   `json:"users"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	CountMessages int        `json:"count_messages"`
+	LastMessageBy *string    `json:"last_message_by"`
+	LastMessageAt *time.Time `json:"last_message_at"`
+}
+
+func newUserView(user *models.User, stats messages.ConnectionStats) userView {
+	roles := user.Roles
+	if len(roles) == 0 {
+		roles = []string{auth.RoleUser}
+	}
+	return userView{
+		ID:                user.ID,
+		Username:          user.Username,
+		Email:             user.Email,
+		Roles:             roles,
+		Disabled:          user.Disabled,
+		DisabledAt:        user.DisabledAt,
+		MutedUntil:        user.MutedUntil,
+		MFAEnabled:        user.MFAEnabled,
+		Placeholder:       user.Placeholder,
+		OnlineConnections: stats.PerUser[user.ID],
+	}
+}
+
+// targetUser loads the user named by the :id parameter, answering 404 when there is none
+func targetUser(c *gin.Context) *models.User {
+	user, err := mongodb.FindUserById(c.Request.Context(), c.Param("id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return nil
+	}
+	return user
+}
+
+// ListUsers pages through the users, filtered by ?q= on username or email
+func ListUsers(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit value. Limit should be > 0 and <= 100."})
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid page value. Page should be > 0."})
+		return
+	}
+
+	users, total, err := mongodb.SearchUsers(c.Request.Context(), c.Query("q"), limit, page)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list users"})
+		return
+	}
+
+	stats := messages.Stats()
+	views := make([]userView, 0, len(users))
+	for _, user := range users {
+		views = append(views, newUserView(user, stats))
+	}
+	totalPages := (total + int64(limit) - 1) / int64(limit)
+	c.JSON(http.StatusOK, gin.H{"users": views, "total": total, "total_pages": totalPages})
+}
+
+// GetUser returns one account
+func GetUser(c *gin.Context) {
+	user := targetUser(c)
+	if user == nil {
+		return
+	}
+	c.JSON(http.StatusOK, newUserView(user, messages.Stats()))
+}
+
+// DisableUser blocks an account and closes its sockets on every instance.
+// Its tokens are refused by every instance once their user cache expires.
+func DisableUser(c *gin.Context) {
+	user := targetUser(c)
+	if user == nil {
+		return
+	}
+	if user.ID == auth.CurrentPrincipal(c).ID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You cannot disable your own account"})
+		return
+	}
+
+	if err := mongodb.SetUserDisabled(c.Request.Context(), user.ID, true, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not disable user"})
+		return
+	}
+	closed := messages.DisconnectUser(c.Request.Context(), user.ID, "account disabled")
+
+	logging.FromGin(c).Info("User disabled by admin", "target_user_id", user.ID, "closed_connections", closed)
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled", "closed_connections": closed})
+}
+
+// EnableUser lifts DisableUser
+func EnableUser(c *gin.Context) {
+	user := targetUser(c)
+	if user == nil {
+		return
+	}
+
+	if err := mongodb.SetUserDisabled(c.Request.Context(), user.ID, false, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not enable user"})
+		return
+	}
+
+	logging.FromGin(c).Info("User enabled by admin", "target_user_id", user.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "User enabled"})
+}
+
+// ResetPassword sets the password given in the body, or a generated temporary one
+// that is returned once, and lifts any login lock. The sessions of the user end: their
+// tokens are refused by every instance once their user cache expires, their sockets
+// are closed.
+func ResetPassword(c *gin.Context) {
+	user := targetUser(c)
+	if user == nil {
+		return
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+			return
+		}
+	}
+
+	password := payload.Password
+	generated := password == ""
+	if generated {
+		var err error
+		if password, err = temporaryPassword(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not generate password"})
+			return
+		}
+	} else if !auth.ValidatePassword(password) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "password must be 8+ characters with uppercase, lowercase, number, and special character", "fieldError": "password"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not hash password"})
+		return
+	}
+	if err := mongodb.SetUserPassword(c.Request.Context(), user.ID, string(hashedPassword)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not reset password"})
+		return
+	}
+	if err := auth.ClearLoginFailures(c.Request.Context(), user); err != nil {
+		logging.FromGin(c).Warn("Could not clear login failures", logging.Err(err))
+	}
+	closed := messages.DisconnectUser(c.Request.Context(), user.ID, "password reset")
+
+	logging.FromGin(c).Info("Password reset by admin", "target_user_id", user.ID, "closed_connections", closed)
+	response := gin.H{"message": "Password reset"}
+	if generated {
+		response["temporary_password"] = password
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// SetRoles replaces the roles of a user
+func SetRoles(c *gin.Context) {
+	user := targetUser(c)
+	if user == nil {
+		return
+	}
+
+	var payload struct {
+		Roles []string `json:"roles"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	hasAdmin := false
+	for _, role := range payload.Roles {
+		if !auth.IsValidRole(role) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown role: " + role, "fieldError": "roles"})
+			return
+		}
+		hasAdmin = hasAdmin || role == auth.RoleAdmin
+	}
+	// An admin demoting themselves could leave nobody able to grant roles back
+	if user.ID == auth.CurrentPrincipal(c).ID && !hasAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You cannot remove your own admin role"})
+		return
+	}
+
+	if err := mongodb.SetUserRoles(c.Request.Context(), user.ID, payload.Roles); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update roles"})
+		return
+	}
+
+	logging.FromGin(c).Info("Roles changed by admin", "target_user_id", user.ID, "roles", payload.Roles)
+	c.JSON(http.StatusOK, gin.H{"message": "Roles updated", "roles": payload.Roles})
+}
+
+// GetChat returns the metadata of any chat, never its messages
+func GetChat(c *gin.Context) {
+	chat, err := mongodb.FindChatById(c.Request.Context(), c.Param("id"))
+	if err != nil || chat == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Chat not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, chatView{
+		ID:            chat.ID,
+		Users:         chat.Users,
+		CreatedBy:     chat.CreatedBy,
+		CreatedAt:     chat.CreatedAt,
+		CountMessages: chat.CountMessages,
+		LastMessageBy: chat.LastMessageBy,
+		LastMessageAt: chat.LastMessageAt,
+	})
+}
+
+// Connections reports the live sockets of this instance
+func Connections(c *gin.Context) {
+	c.JSON(http.StatusOK, messages.Stats())
+}
+
+// temporaryPassword generates a password that passes auth.ValidatePassword
+func temporaryPassword() (string, error) {
+	classes := []string{
+		"ABCDEFGHJKLMNPQRSTUVWXYZ",
+		"abcdefghijkmnopqrstuvwxyz",
+		"23456789",
+		"!#$%*+-=?@",
+	}
+	password := make([]byte, 0, 16)
+	// Four characters of each class, then shuffled
+	for _, class := range classes {
+		for i := 0; i < 4; i++ {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(class))))
+			if err != nil {
+				return "", err
+			}
+			password = append(password, class[n.Int64()])
+		}
+	}
+	for i := len(password) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		password[i], password[j] = password[j], password[i]
+	}
+	return string(password), nil
+}
@@ -3,46 +3,104 @@ package auth
 import (
 	"backend/internal/models"
 	"backend/mongodb"
+	"context"
 	"fmt"
-	"time"
-
 	"os"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 // Define a struct for the claims we want to include in the JWT
 type Claims struct {
-	Username string `json:"username"`
-	jwt.StandardClaims
+	UserID   string   `json:"uid"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles,omitempty"`
+	// SessionID identifies the login that issued the token, it is shared by the
+	// tokens of that login only
+	SessionID string `json:"sid,omitempty"`
+	// Generation is the session generation of the user when the token was issued,
+	// tokens of an older generation are refused
+	Generation int `json:"gen,omitempty"`
+	// Purpose is empty for session tokens; restricted tokens (e.g. PurposeMFAPending)
+	// are rejected by ValidateJWT
+	Purpose string `json:"purpose,omitempty"`
+	// AuthMethod is how the user proved who they are at login, AuthMethodOIDC
+	// lets a recent single sign-on stand in for the password
+	AuthMethod string `json:"auth_method,omitempty"`
+	jwt.RegisteredClaims
 }
 
-// GenerateJWT creates a new JWT token for a user
-func GenerateJWT(username string) (string, int64, error) {
-	// Get the secret key from environment variable
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		secretKey = "defaultsecret" // fallback if not set in .env
+// PurposeMFAPending marks the token returned by Login when a second factor is still required
+const PurposeMFAPending = "mfa_pending"
+
+// Values of Claims.AuthMethod
+const (
+	AuthMethodPassword = "password"
+	AuthMethodOIDC     = "oidc"
+)
+
+const (
+	// Lifetime of session tokens, signing keys stay verifiable at least this long after rotation
+	sessionTokenTTL = 24 * time.Hour
+	// Lifetime of the restricted token between the password and the second factor
+	mfaPendingTokenTTL = 5 * time.Minute
+)
+
+// GenerateJWT creates a new JWT token for a user signed in with authMethod, starting a new session
+func GenerateJWT(user *models.User, authMethod string) (string, int64, error) {
+	sessionID, err := randomString(16)
+	if err != nil {
+		return "", 0, err
 	}
+	return generateToken(user, sessionID, "", authMethod, sessionTokenTTL)
+}
+
+// GenerateMFAPendingToken creates the short-lived token exchanged for a session
+// token once the second factor is verified, the session keeps authMethod
+func GenerateMFAPendingToken(user *models.User, authMethod string) (string, int64, error) {
+	return generateToken(user, "", PurposeMFAPending, authMethod, mfaPendingTokenTTL)
+}
+
+// jwtSecret signs tokens in HS256 mode and verifies the tokens issued before the move
+// to asymmetric keys, InitKeys refuses to start without it when either is enabled
+func jwtSecret() []byte {
+	return []byte(os.Getenv("JWT_SECRET"))
+}
+
+// checkJWTSecret rejects a missing JWT_SECRET and the placeholder older setups fell back to
+func checkJWTSecret() error {
+	switch os.Getenv("JWT_SECRET") {
+	case "":
+		return fmt.Errorf("JWT_SECRET is required with HS256 tokens")
+	case "defaultsecret":
+		return fmt.Errorf("JWT_SECRET is set to the public placeholder \"defaultsecret\"")
+	}
+	return nil
+}
 
-	// Set token expiration time (e.g., 1 hour)
-	expirationTime := time.Now().Add(24 * time.Hour)
-	//expirationTime := time.Now().Add(30 * time.Second)
+func generateToken(user *models.User, sessionID string, purpose string, authMethod string, ttl time.Duration) (string, int64, error) {
+	now := time.Now()
+	expirationTime := now.Add(ttl)
 
 	// Create JWT claims
 	claims := &Claims{
-		Username: username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+		UserID:     user.ID,
+		Username:   user.Username,
+		Roles:      user.Roles,
+		SessionID:  sessionID,
+		Generation: user.SessionGeneration,
+		Purpose:    purpose,
+		AuthMethod: authMethod,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(now),
 			Issuer:    os.Getenv("APP_NAME"),
 		},
 	}
 
-	// Create a new JWT token with the claims and secret key
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign the token with the secret key
-	signedToken, err := token.SignedString([]byte(secretKey))
+	// Sign with the current key, its kid goes in the header
+	signedToken, err := signClaims(claims)
 	if err != nil {
 		return "", 0, fmt.Errorf("could not sign token: %v", err)
 	}
@@ -52,19 +110,14 @@ func GenerateJWT(username string) (string, int64, error) {
 
 // ValidateJWT validates the JWT token and returns the claims if valid
 func ValidateJWT(tokenString string) (*Claims, error) {
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		secretKey = "defaultsecret" // fallback if not set in .env
-	}
+	return validateToken(tokenString, "")
+}
 
+// validateToken checks the signature and expiry, and that the token was issued for purpose
+func validateToken(tokenString string, purpose string) (*Claims, error) {
 	// Parse and validate the token
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secretKey), nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, verificationKey,
+		jwt.WithValidMethods(validMethods()), jwt.WithExpirationRequired())
 
 	if err != nil {
 		return nil, fmt.Errorf("could not parse token: %v", err)
@@ -76,19 +129,46 @@ func ValidateJWT(tokenString string) (*Claims, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
+	// Restricted tokens can only be used on the endpoint they were issued for
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("invalid token")
+	}
+
 	return claims, nil
 }
 
-func GetUserFromToken(tokenString string) (*models.User, error) {
+// GetUserFromToken validates the token and loads its user, through the user cache
+func GetUserFromToken(ctx context.Context, tokenString string) (*models.User, error) {
 	claims, err := ValidateJWT(tokenString)
 	if err != nil {
 		return nil, fmt.Errorf("could not validate token: %v", err)
 	}
+	user, err := userFromClaims(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	if claims.Generation != user.SessionGeneration {
+		return nil, ErrSessionRevoked
+	}
+	return user, nil
+}
 
-	user, err := mongodb.FindUserByUsername(claims.Username, true)
+func userFromClaims(ctx context.Context, claims *Claims) (*models.User, error) {
+	// Tokens issued before the user ID was added to the claims only name the user
+	if claims.UserID == "" {
+		user, err := mongodb.FindUserByUsername(ctx, claims.Username, true)
+		if err != nil {
+			return nil, fmt.Errorf("could not find user: %v", err)
+		}
+		return user, nil
+	}
+
+	user, err := mongodb.FindUserByIdCached(ctx, claims.UserID)
 	if err != nil {
 		return nil, fmt.Errorf("could not find user: %v", err)
 	}
-
 	return user, nil
 }
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+// encryptionA256GCM marks private keys sealed with AES-256-GCM under the key-encryption key
+const encryptionA256GCM = "A256GCM"
+
+// keyEncryptionKey seals the private signing keys stored in MongoDB, nil stores
+// them as plain PEM
+var keyEncryptionKey cipher.AEAD
+
+// initKeyEncryption reads JWT_KEY_ENCRYPTION_KEY, 32 bytes encoded in base64
+func initKeyEncryption() error {
+	value := os.Getenv("JWT_KEY_ENCRYPTION_KEY")
+	if value == "" {
+		keyEncryptionKey = nil
+		return nil
+	}
+	secret, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(secret) != 32 {
+		return fmt.Errorf("JWT_KEY_ENCRYPTION_KEY must be 32 bytes encoded in base64")
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return err
+	}
+	keyEncryptionKey, err = cipher.NewGCM(block)
+	return err
+}
+
+// sealPrivateKey encrypts a PEM private key, bound to its kid so a sealed key
+// can't be swapped for another one
+func sealPrivateKey(kid string, privatePEM []byte) (string, error) {
+	nonce := make([]byte, keyEncryptionKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := keyEncryptionKey.Seal(nonce, nonce, privatePEM, []byte(kid))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openPrivateKey reverses sealPrivateKey
+func openPrivateKey(kid string, sealed string) ([]byte, error) {
+	if keyEncryptionKey == nil {
+		return nil, fmt.Errorf("key is encrypted but JWT_KEY_ENCRYPTION_KEY is not set")
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < keyEncryptionKey.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted key")
+	}
+	nonce, ciphertext := data[:keyEncryptionKey.NonceSize()], data[keyEncryptionKey.NonceSize():]
+	privatePEM, err := keyEncryptionKey.Open(nil, nonce, ciphertext, []byte(kid))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt key, wrong JWT_KEY_ENCRYPTION_KEY?")
+	}
+	return privatePEM, nil
+}
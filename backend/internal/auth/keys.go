@@ -0,0 +1,417 @@
+package auth
+
+import (
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported values of JWT_SIGNING_ALG
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+const (
+	rsaKeyBits = 2048
+	// How often instances reload keys generated by the others and check for rotation
+	keyRefreshInterval = 5 * time.Minute
+	// Unknown kids trigger a reload at most this often
+	keyReloadCooldown = 10 * time.Second
+	// A new key is in the JWKS this long before it signs: verifiers cache the set
+	// for keyRefreshInterval and instances take as long to reload it
+	keyPublishLead = 2 * keyRefreshInterval
+)
+
+// signingKey is a parsed models.SigningKey
+type signingKey struct {
+	id        string
+	algorithm string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	public    crypto.PublicKey
+	activeAt  time.Time
+}
+
+// keyRing holds the current signing key, the next one if it is already published,
+// and every key still valid for verification
+type keyRing struct {
+	mu         sync.RWMutex
+	signing    *signingKey
+	next       *signingKey
+	verifying  map[string]*signingKey
+	lastReload time.Time
+}
+
+var (
+	keys = keyRing{verifying: map[string]*signingKey{}}
+
+	// Asymmetric by default; HS256 keeps the single shared JWT_SECRET
+	signingAlgorithm = AlgRS256
+	// A new key is generated once the current one is this old
+	keyRotationPeriod = 30 * 24 * time.Hour
+	// Tokens signed with JWT_SECRET before the migration are refused unless
+	// JWT_ACCEPT_HS256=true, which is meant for the transition only
+	acceptLegacyHS256 = false
+)
+
+// InitKeys reads the signing configuration, loads the keys from MongoDB (creating
+// the first one if needed) and starts the rotation loop:
+//   - JWT_SIGNING_ALG: RS256 (default), EdDSA or HS256
+//   - JWT_KEY_ROTATION: key lifetime before rotation, e.g. "720h"
+//   - JWT_ACCEPT_HS256: "true" to keep accepting the tokens signed with JWT_SECRET
+//     before the migration, for the first day after it (sessions last 24 hours)
+//   - JWT_KEY_ENCRYPTION_KEY: 32 bytes in base64 encrypting the private keys in
+//     MongoDB. Without it they are stored in plain PEM and anyone able to read the
+//     database can sign tokens for any user.
+func InitKeys(ctx context.Context) error {
+	if alg := os.Getenv("JWT_SIGNING_ALG"); alg != "" {
+		signingAlgorithm = alg
+	}
+	keyRotationPeriod = utils.GetEnvDuration("JWT_KEY_ROTATION", keyRotationPeriod)
+	acceptLegacyHS256 = os.Getenv("JWT_ACCEPT_HS256") == "true"
+
+	if signingAlgorithm == AlgHS256 || acceptLegacyHS256 {
+		if err := checkJWTSecret(); err != nil {
+			return err
+		}
+	}
+	switch signingAlgorithm {
+	case AlgHS256:
+		acceptLegacyHS256 = true
+		return nil
+	case AlgRS256, AlgEdDSA:
+	default:
+		return fmt.Errorf("unsupported JWT_SIGNING_ALG %q", signingAlgorithm)
+	}
+
+	if err := initKeyEncryption(); err != nil {
+		return err
+	}
+	if keyEncryptionKey == nil {
+		logging.FromContext(ctx).Warn("JWT private keys are stored unencrypted, set JWT_KEY_ENCRYPTION_KEY")
+	}
+
+	if err := rotateKeysIfNeeded(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(keyRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := rotateKeysIfNeeded(context.Background()); err != nil {
+				logging.FromContext(ctx).Error("JWT key refresh failed", logging.Err(err))
+			}
+		}
+	}()
+	return nil
+}
+
+// rotateKeysIfNeeded reloads the keys and, as the signing key for the configured
+// algorithm nears the end of its rotation period, adds the next one. The next key is
+// published at least keyPublishLead before it starts signing so that verifiers
+// caching the JWKS know it by then. Old keys stay in the verification set until
+// the tokens they signed have expired.
+func rotateKeysIfNeeded(ctx context.Context) error {
+	if err := reloadKeys(ctx); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	keys.mu.RLock()
+	current, next := keys.signing, keys.next
+	keys.mu.RUnlock()
+
+	activeAt, due := nextKeyActivation(current, next, now)
+	if !due {
+		return nil
+	}
+	key, err := generateSigningKey(signingAlgorithm, now, activeAt)
+	if err != nil {
+		return err
+	}
+	if err := mongodb.InsertSigningKey(ctx, key); err != nil {
+		return err
+	}
+	logging.FromContext(ctx).Info("Generated new JWT signing key", "kid", key.ID, "alg", key.Algorithm, "active_at", activeAt)
+	return reloadKeys(ctx)
+}
+
+// nextKeyActivation reports whether the next signing key is due and when it starts
+// signing: at the end of the rotation period of current, but never before it has
+// been published for keyPublishLead
+func nextKeyActivation(current *signingKey, next *signingKey, now time.Time) (time.Time, bool) {
+	// The very first key signs at once, no verifier can have cached an empty set before
+	if current == nil {
+		return now, true
+	}
+	rotateAt := current.activeAt.Add(keyRotationPeriod)
+	// Checked every keyRefreshInterval, so look that much further ahead
+	if next != nil || rotateAt.Sub(now) > keyPublishLead+keyRefreshInterval {
+		return time.Time{}, false
+	}
+	return maxTime(rotateAt, now.Add(keyPublishLead)), true
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func reloadKeys(ctx context.Context) error {
+	stored, err := mongodb.GetActiveSigningKeys(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	verifying, signing, next := selectKeys(ctx, stored, time.Now())
+	keys.mu.Lock()
+	keys.verifying = verifying
+	keys.signing = signing
+	keys.next = next
+	keys.lastReload = time.Now()
+	keys.mu.Unlock()
+	return nil
+}
+
+// selectKeys parses the stored keys, sorted newest first, into the verification set,
+// the key signing now and the next one, both for the configured algorithm
+func selectKeys(ctx context.Context, stored []*models.SigningKey, now time.Time) (map[string]*signingKey, *signingKey, *signingKey) {
+	verifying := make(map[string]*signingKey, len(stored))
+	var signing, next *signingKey
+	for _, storedKey := range stored {
+		key, err := parseSigningKey(storedKey)
+		if err != nil {
+			logging.FromContext(ctx).Error("Skipping unreadable signing key", "kid", storedKey.ID, logging.Err(err))
+			continue
+		}
+		verifying[key.id] = key
+		if key.algorithm != signingAlgorithm {
+			continue
+		}
+		// Keys are sorted newest first, the ones not active yet are only published
+		if key.activeAt.After(now) {
+			if next == nil {
+				next = key
+			}
+		} else if signing == nil {
+			signing = key
+		}
+	}
+	return verifying, signing, next
+}
+
+// generateSigningKey creates a key signing from activeAt that stays verifiable for a
+// full rotation period plus the lifetime of the last token it may sign
+func generateSigningKey(algorithm string, now time.Time, activeAt time.Time) (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode key: %v", err)
+	}
+	kid, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &models.SigningKey{
+		ID:         kid,
+		Algorithm:  algorithm,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		CreatedAt:  now,
+		ActiveAt:   activeAt,
+		ExpiresAt:  activeAt.Add(keyRotationPeriod + sessionTokenTTL + time.Hour),
+	}
+	if keyEncryptionKey != nil {
+		if key.PrivateKey, err = sealPrivateKey(kid, []byte(key.PrivateKey)); err != nil {
+			return nil, fmt.Errorf("could not encrypt key: %v", err)
+		}
+		key.Encryption = encryptionA256GCM
+	}
+	return key, nil
+}
+
+func parseSigningKey(stored *models.SigningKey) (*signingKey, error) {
+	privatePEM := []byte(stored.PrivateKey)
+	switch stored.Encryption {
+	case "":
+	case encryptionA256GCM:
+		var err error
+		if privatePEM, err = openPrivateKey(stored.ID, stored.PrivateKey); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key encryption %q", stored.Encryption)
+	}
+	block, _ := pem.Decode(privatePEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{id: stored.ID, algorithm: stored.Algorithm, activeAt: stored.ActiveAt}
+	if key.activeAt.IsZero() {
+		key.activeAt = stored.CreatedAt
+	}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodRS256, private, private.Public()
+	case ed25519.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodEdDSA, private, private.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	if key.method.Alg() != stored.Algorithm {
+		return nil, fmt.Errorf("key type does not match algorithm %s", stored.Algorithm)
+	}
+	return key, nil
+}
+
+// signClaims signs with the current key, or with JWT_SECRET in HS256 mode
+func signClaims(claims jwt.Claims) (string, error) {
+	if signingAlgorithm == AlgHS256 {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret())
+	}
+
+	keys.mu.RLock()
+	key := keys.signing
+	keys.mu.RUnlock()
+	if key == nil {
+		return "", fmt.Errorf("no signing key available")
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// verificationKey is the jwt.Keyfunc: it picks the key named by the kid header and
+// checks the token uses that key's algorithm
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if token.Method.Alg() == AlgHS256 && acceptLegacyHS256 {
+			return jwtSecret(), nil
+		}
+		return nil, fmt.Errorf("missing key id")
+	}
+
+	key := lookupKey(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown key id")
+	}
+	if token.Method.Alg() != key.algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// lookupKey finds a verification key, reloading once if another instance may have rotated
+func lookupKey(kid string) *signingKey {
+	keys.mu.RLock()
+	key := keys.verifying[kid]
+	stale := time.Since(keys.lastReload) > keyReloadCooldown
+	keys.mu.RUnlock()
+
+	if key == nil && stale && signingAlgorithm != AlgHS256 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := reloadKeys(ctx); err != nil {
+			logging.FromContext(ctx).Warn("Could not reload signing keys", logging.Err(err))
+			return nil
+		}
+		keys.mu.RLock()
+		key = keys.verifying[kid]
+		keys.mu.RUnlock()
+	}
+	return key
+}
+
+// jwk is a public key in JSON Web Key format (RFC 7517)
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS publishes the public verification keys so other services can validate
+// tokens without holding any secret
+func JWKS(c *gin.Context) {
+	keys.mu.RLock()
+	published := make([]jwk, 0, len(keys.verifying))
+	for _, key := range keys.verifying {
+		entry := jwk{KeyID: key.id, Use: "sig", Algorithm: key.algorithm}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			entry.KeyType = "RSA"
+			entry.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			entry.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			entry.KeyType = "OKP"
+			entry.Curve = "Ed25519"
+			entry.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		published = append(published, entry)
+	}
+	keys.mu.RUnlock()
+
+	// Verifiers may cache the set, a new key is published well before it signs anything
+	c.Header("Cache-Control", "public, max-age="+fmt.Sprint(int(keyRefreshInterval.Seconds())))
+	c.JSON(http.StatusOK, gin.H{"keys": published})
+}
+
+// validMethods are the algorithms accepted when parsing tokens
+func validMethods() []string {
+	methods := []string{AlgRS256, AlgEdDSA}
+	if acceptLegacyHS256 {
+		methods = append(methods, AlgHS256)
+	}
+	return methods
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"backend/internal/logging"
+	"backend/internal/mailer"
+	"backend/internal/models"
+	"backend/internal/ratelimit"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Brute-force protection settings, see InitLockout for the environment overrides
+var (
+	// Failed logins on one account before it is locked
+	accountLockThreshold = 5
+	// Failed logins from one address before it is locked
+	ipLockThreshold = 20
+	// How long a lock lasts
+	lockDuration = 15 * time.Minute
+	// Failures older than this are forgotten
+	failureWindow = 15 * time.Minute
+	// The delay imposed after the first failure, doubled with every further failure up to maxDelay
+	baseDelay = 500 * time.Millisecond
+	maxDelay  = 30 * time.Second
+)
+
+// dummyHash is compared against when the user doesn't exist, so that a
+// missing account takes as long to reject as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+// InitLockout applies the environment overrides once the environment file is loaded
+func InitLockout() {
+	accountLockThreshold = lockThreshold("LOGIN_LOCK_THRESHOLD", accountLockThreshold)
+	ipLockThreshold = lockThreshold("LOGIN_IP_LOCK_THRESHOLD", ipLockThreshold)
+	lockDuration = utils.GetEnvDuration("LOGIN_LOCK_DURATION", lockDuration)
+	failureWindow = utils.GetEnvDuration("LOGIN_FAILURE_WINDOW", failureWindow)
+	baseDelay = utils.GetEnvDuration("LOGIN_DELAY_BASE", baseDelay)
+	maxDelay = utils.GetEnvDuration("LOGIN_DELAY_MAX", maxDelay)
+}
+
+// lockThreshold reads a lock threshold, a threshold below one would never lock
+// (or divide by zero) so it keeps the default
+func lockThreshold(key string, fallback int) int {
+	threshold := utils.GetEnvInt(key, fallback)
+	if threshold < 1 {
+		slog.Warn("Invalid login lock threshold, keeping default", "variable", key, "value", threshold)
+		return fallback
+	}
+	return threshold
+}
+
+// loginAttemptsKey tracks an account by the ID of the user the identifier resolves
+// to, so the username and the email share one counter. Identifiers matching nobody
+// are tracked too, so that unknown and real accounts behave the same way.
+func loginAttemptsKey(user *models.User, identifier string) string {
+	if user != nil {
+		return "user:" + user.ID
+	}
+	return "account:" + strings.ToLower(strings.TrimSpace(identifier))
+}
+
+func ipAttemptsKey(ip string) string {
+	return "ip:" + ip
+}
+
+// progressiveDelay is the wait imposed after the given number of consecutive failures
+func progressiveDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := baseDelay
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// loginAttempt is an attempt on an account from an address, counted as a failure
+// until it is released or succeeds. The records are nil when the store failed.
+type loginAttempt struct {
+	now        time.Time
+	accountKey string
+	ip         string
+	account    *models.LoginAttempts
+	address    *models.LoginAttempts
+}
+
+// reserveLoginAttempt counts an attempt against accountKey and the address before
+// the credentials are checked. It returns how long the caller must wait instead
+// when either is locked or throttled. The store failing doesn't block logins.
+func reserveLoginAttempt(ctx context.Context, now time.Time, accountKey string, ip string) (*loginAttempt, time.Duration) {
+	attempt := &loginAttempt{now: now, accountKey: accountKey, ip: ip}
+	var wait time.Duration
+	if attempt.account, wait = reserve(ctx, accountKey, now); wait > 0 {
+		return nil, wait
+	}
+	if attempt.address, wait = reserve(ctx, ipAttemptsKey(ip), now); wait > 0 {
+		release(ctx, accountKey, attempt.account, now)
+		return nil, wait
+	}
+	return attempt, 0
+}
+
+func reserve(ctx context.Context, key string, now time.Time) (*models.LoginAttempts, time.Duration) {
+	attempts, reserved, err := mongodb.ReserveLoginAttempt(ctx, key, now, failureWindow, baseDelay, maxDelay)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not reserve login attempt", logging.Err(err))
+		return nil, 0
+	}
+	if reserved {
+		return attempts, 0
+	}
+	return nil, refusedWait(attempts, now)
+}
+
+// refusedWait is how long a refused attempt must wait, until both the progressive
+// delay and the lock are over
+func refusedWait(attempts *models.LoginAttempts, now time.Time) time.Duration {
+	var nextAttempt time.Time
+	if attempts.NextAttemptAt != nil {
+		nextAttempt = *attempts.NextAttemptAt
+	}
+	if attempts.LockedUntil != nil && attempts.LockedUntil.After(nextAttempt) {
+		nextAttempt = *attempts.LockedUntil
+	}
+	// Never answer "retry now" to a refused attempt
+	return max(nextAttempt.Sub(now), time.Millisecond)
+}
+
+// locks reports whether a failure count reaches a lock, every threshold failures
+// within the window lock again
+func locks(failures int, threshold int) bool {
+	return failures > 0 && failures%threshold == 0
+}
+
+// release takes a reserved attempt back, the delay returns to what the earlier failures imposed
+func release(ctx context.Context, key string, attempts *models.LoginAttempts, now time.Time) {
+	if attempts == nil {
+		return
+	}
+	if err := mongodb.ReleaseLoginAttempt(ctx, key, now.Add(progressiveDelay(attempts.Failures-1))); err != nil {
+		logging.FromContext(ctx).Warn("Could not release login attempt", logging.Err(err))
+	}
+}
+
+// recordLoginFailure keeps the attempt as a failure and locks the account and the
+// address once their threshold is reached. user is nil for unknown accounts.
+func recordLoginFailure(ctx context.Context, attempt *loginAttempt, user *models.User) {
+	if attempt == nil {
+		return
+	}
+	logger := logging.FromContext(ctx)
+
+	if accountAttempts := attempt.account; accountAttempts != nil && locks(accountAttempts.Failures, accountLockThreshold) {
+		until := attempt.now.Add(lockDuration)
+		if err := mongodb.LockLogin(ctx, accountAttempts.Key, until); err != nil {
+			logger.Warn("Could not lock account", logging.Err(err))
+		} else if user != nil {
+			logger.Warn("Account locked after failed logins", logging.KeyUserID, user.ID, "failures", accountAttempts.Failures)
+			notifyAccountLocked(ctx, user, accountAttempts.Failures, until)
+		}
+	}
+
+	if ipAttempts := attempt.address; ipAttempts != nil && locks(ipAttempts.Failures, ipLockThreshold) {
+		logger.Warn("Client address locked after failed logins", "client_ip", attempt.ip, "failures", ipAttempts.Failures)
+		if err := mongodb.LockLogin(ctx, ipAttempts.Key, attempt.now.Add(lockDuration)); err != nil {
+			logger.Warn("Could not lock client address", logging.Err(err))
+		}
+	}
+}
+
+// releaseLoginAttempt takes back an attempt whose credentials were right but that
+// doesn't complete the login yet, e.g. a password awaiting the second factor.
+// Earlier failures are kept.
+func releaseLoginAttempt(ctx context.Context, attempt *loginAttempt) {
+	if attempt == nil {
+		return
+	}
+	release(ctx, attempt.accountKey, attempt.account, attempt.now)
+	release(ctx, ipAttemptsKey(attempt.ip), attempt.address, attempt.now)
+}
+
+// recordLoginSuccess clears the account failures, the address keeps its history
+func recordLoginSuccess(ctx context.Context, attempt *loginAttempt) {
+	if attempt == nil {
+		return
+	}
+	if err := mongodb.ResetLoginAttempts(ctx, attempt.accountKey); err != nil {
+		logging.FromContext(ctx).Warn("Could not reset login attempts", logging.Err(err))
+	}
+	release(ctx, ipAttemptsKey(attempt.ip), attempt.address, attempt.now)
+}
+
+func notifyAccountLocked(ctx context.Context, user *models.User, failures int, until time.Time) {
+	if user.Email == "" {
+		return
+	}
+	mailer.SendAsync(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your account has been temporarily locked",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"We locked your account after %d failed login attempts. You can try again after %s.\n\n"+
+			"If these attempts weren't you, someone may be trying to guess your password: "+
+			"consider changing it once you're back in.\n",
+			user.Username, failures, until.UTC().Format(time.RFC1123)),
+	})
+}
+
+// rejectLocked answers a throttled or locked login without revealing whether the account exists
+func rejectLocked(c *gin.Context, retryAfter time.Duration) {
+	seconds := ratelimit.RetryAfterSeconds(retryAfter)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"message":     "Too many failed attempts, try again later",
+		"fieldError":  "unauthorized",
+		"retry_after": seconds,
+	})
+}
+
+// ClearLoginFailures lifts the lock and forgets the failed logins of a user
+func ClearLoginFailures(ctx context.Context, user *models.User) error {
+	return mongodb.ResetLoginAttempts(ctx, loginAttemptsKey(user, ""))
+}
+
+// UnlockUser clears the failed logins and lock of a user, for admins
+func UnlockUser(c *gin.Context) {
+	user, err := mongodb.FindUserById(c.Request.Context(), c.Param("id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	if err := ClearLoginFailures(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not unlock user"})
+		return
+	}
+
+	logging.FromGin(c).Info("User unlocked by admin", "target_user_id", user.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+}
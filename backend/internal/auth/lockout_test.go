@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"backend/internal/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProgressiveDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		-1: 0,
+		0:  0,
+		1:  500 * time.Millisecond,
+		2:  time.Second,
+		3:  2 * time.Second,
+		7:  30 * time.Second,
+		8:  30 * time.Second,
+		60: 30 * time.Second,
+	}
+	for failures, want := range tests {
+		if got := progressiveDelay(failures); got != want {
+			t.Errorf("progressiveDelay(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestLocks(t *testing.T) {
+	for failures, want := range map[int]bool{0: false, 1: false, 4: false, 5: true, 6: false, 10: true} {
+		if got := locks(failures, 5); got != want {
+			t.Errorf("locks(%d, 5) = %v, want %v", failures, got, want)
+		}
+	}
+	if !locks(1, 1) {
+		t.Error("a threshold of one must lock on the first failure")
+	}
+}
+
+func TestLockThresholdRejectsValuesBelowOne(t *testing.T) {
+	tests := map[string]int{"": 5, "3": 3, "1": 1, "0": 5, "-2": 5, "many": 5}
+	for value, want := range tests {
+		t.Setenv("LOGIN_LOCK_THRESHOLD", value)
+		if got := lockThreshold("LOGIN_LOCK_THRESHOLD", 5); got != want {
+			t.Errorf("LOGIN_LOCK_THRESHOLD=%q gives %d, want %d", value, got, want)
+		}
+	}
+}
+
+func TestLoginAttemptsKey(t *testing.T) {
+	user := &models.User{ID: "64b7f0c2a1b2c3d4e5f60718", Username: "Alice", Email: "alice@example.com"}
+	byUsername := loginAttemptsKey(user, "Alice")
+	if byEmail := loginAttemptsKey(user, "alice@example.com"); byEmail != byUsername {
+		t.Errorf("username and email keys differ: %q, %q", byUsername, byEmail)
+	}
+	if byUsername != "user:"+user.ID {
+		t.Errorf("key = %q, want the user ID", byUsername)
+	}
+
+	// Unknown accounts are tracked by identifier, however it is typed
+	if got, want := loginAttemptsKey(nil, "  Mallory "), loginAttemptsKey(nil, "mallory"); got != want {
+		t.Errorf("unknown identifiers %q and %q differ", got, want)
+	}
+	// An identifier can't be chosen to land on a user's counter
+	if loginAttemptsKey(nil, "user:"+user.ID) == byUsername {
+		t.Error("an unknown identifier shares the counter of a user")
+	}
+}
+
+func TestRefusedWait(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	at := func(d time.Duration) *time.Time {
+		when := now.Add(d)
+		return &when
+	}
+	tests := []struct {
+		name     string
+		attempts models.LoginAttempts
+		want     time.Duration
+	}{
+		{"throttled", models.LoginAttempts{NextAttemptAt: at(2 * time.Second)}, 2 * time.Second},
+		{"locked", models.LoginAttempts{LockedUntil: at(15 * time.Minute)}, 15 * time.Minute},
+		{"lock outlasts the delay", models.LoginAttempts{NextAttemptAt: at(time.Second), LockedUntil: at(time.Minute)}, time.Minute},
+		{"delay outlasts the lock", models.LoginAttempts{NextAttemptAt: at(time.Minute), LockedUntil: at(time.Second)}, time.Minute},
+		// A reservation refused by a racing attempt still waits a little
+		{"already over", models.LoginAttempts{NextAttemptAt: at(-time.Second)}, time.Millisecond},
+		{"nothing recorded", models.LoginAttempts{}, time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := refusedWait(&tt.attempts, now); got != tt.want {
+			t.Errorf("%s: refusedWait = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRejectLocked(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+
+	rejectLocked(c, 1500*time.Millisecond)
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", recorder.Code)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	// The answer is the same whether or not the account exists
+	if body["fieldError"] != "unauthorized" || body["retry_after"] != float64(2) {
+		t.Errorf("body = %v", body)
+	}
+}
@@ -0,0 +1,411 @@
+package auth
+
+import (
+	"backend/internal/logging"
+	"backend/internal/metrics"
+	"backend/internal/models"
+	"backend/mongodb"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpPeriod = 30
+	// Codes from the previous and next period are accepted to absorb clock drift
+	totpSkew          = 1
+	recoveryCodeCount = 10
+	qrCodeSize        = 256
+)
+
+var totpOptions = totp.ValidateOpts{
+	Period:    totpPeriod,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// currentUser loads the caller's full record, answering 401 when there is none.
+// It bypasses the user cache, MFA changes must start from the stored state.
+func currentUser(c *gin.Context) *models.User {
+	principal := CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return nil
+	}
+	user, err := mongodb.FindUserById(c.Request.Context(), principal.ID)
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return nil
+	}
+	return user
+}
+
+// EnrollMFA creates a new TOTP secret for the user and returns it as an otpauth://
+// URI and a QR code. The secret is only active once confirmed with ConfirmMFA.
+func EnrollMFA(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		return
+	}
+	if user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"message": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	issuer := os.Getenv("APP_NAME")
+	if issuer == "" {
+		issuer = "Chat"
+	}
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: user.Username,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not generate secret"})
+		return
+	}
+
+	if err := mongodb.SetUserMFAPendingSecret(c.Request.Context(), user.ID, key.Secret()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not save secret"})
+		return
+	}
+
+	qrCode, err := qrCodeDataURI(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not generate QR code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"otpauth_url": key.URL(), "secret": key.Secret(), "qr_code": qrCode})
+}
+
+// ConfirmMFA enables two-factor authentication once the user proves their app
+// generates valid codes, and returns the recovery codes. They are shown only once.
+func ConfirmMFA(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		return
+	}
+
+	var payload mfaCodeRequest
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Code is required", "fieldError": "code"})
+		return
+	}
+	if user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"message": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.MFAPendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Start the enrolment first"})
+		return
+	}
+
+	step, ok := matchTOTP(user.MFAPendingSecret, payload.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid code", "fieldError": "code"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not generate recovery codes"})
+		return
+	}
+	if err := mongodb.EnableUserMFA(c.Request.Context(), user.ID, user.MFAPendingSecret, hashes, step); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not enable two-factor authentication"})
+		return
+	}
+
+	logging.FromGin(c).Info("Two-factor authentication enabled")
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// DisableMFA turns two-factor authentication off. The user must re-authenticate
+// with their password, or a recent sign-in through single sign-on, and a current
+// code or a recovery code.
+func DisableMFA(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		return
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Password and code are required"})
+		return
+	}
+	if !user.MFAEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	if !reauthenticate(c, user, payload.Password, payload.Code) {
+		return
+	}
+
+	if err := mongodb.DisableUserMFA(c.Request.Context(), user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not disable two-factor authentication"})
+		return
+	}
+
+	logging.FromGin(c).Info("Two-factor authentication disabled")
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces every recovery code after re-authentication
+func RegenerateRecoveryCodes(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		return
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Password and code are required"})
+		return
+	}
+	if !user.MFAEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	if !reauthenticate(c, user, payload.Password, payload.Code) {
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not generate recovery codes"})
+		return
+	}
+	if err := mongodb.ReplaceUserRecoveryCodes(c.Request.Context(), user.ID, hashes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not save recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// VerifyMFALogin completes a two-step login: it exchanges the mfa pending token
+// returned by Login and a TOTP or recovery code for a session token
+func VerifyMFALogin(c *gin.Context) {
+	var payload struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.MFAToken == "" || payload.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Token and code are required", "fieldError": "code"})
+		return
+	}
+
+	claims, err := validateToken(payload.MFAToken, PurposeMFAPending)
+	if err != nil {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidToken).Inc()
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Login expired, please sign in again", "fieldError": "unauthorized"})
+		return
+	}
+
+	user, err := mongodb.FindUserByIdCached(c.Request.Context(), claims.UserID)
+	if err != nil || user == nil || !user.MFAEnabled || user.Disabled || claims.Generation != user.SessionGeneration {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Login expired, please sign in again", "fieldError": "unauthorized"})
+		return
+	}
+
+	// Code guesses count against the same lockout as passwords
+	now := time.Now()
+	attempt, retryAfter := reserveLoginAttempt(c.Request.Context(), now, loginAttemptsKey(user, ""), c.ClientIP())
+	if retryAfter > 0 {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthLocked).Inc()
+		rejectLocked(c, retryAfter)
+		return
+	}
+
+	if !verifySecondFactor(c.Request.Context(), user, payload.Code, now) {
+		recordLoginFailure(c.Request.Context(), attempt, user)
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidCredentials).Inc()
+		c.JSON(http.StatusForbidden, gin.H{"message": "Invalid code", "fieldError": "code"})
+		return
+	}
+	recordLoginSuccess(c.Request.Context(), attempt)
+
+	token, expiration, err := GenerateJWT(user, claims.AuthMethod)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "expiration": expiration, "id": user.ID, "user": user.Username})
+}
+
+// recentSignIn is how fresh the session of an account signing in through single
+// sign-on must be to stand in for the password it doesn't know
+const recentSignIn = 10 * time.Minute
+
+// reauthenticate checks the password and second factor of a signed-in user
+// before a sensitive change, answering 403 when either is wrong. Accounts linked
+// to an identity provider may leave the password out right after signing in through it.
+// Failures count against the login lockout of the account and the address.
+func reauthenticate(c *gin.Context, user *models.User, password string, code string) bool {
+	return confirmIdentity(c, user, password, func(now time.Time) bool {
+		return verifySecondFactor(c.Request.Context(), user, code, now)
+	}, "Invalid password or code")
+}
+
+// VerifyIdentity re-checks the password, and the second factor when two-factor
+// authentication is enabled, before a sensitive change. It answers 403 on failure
+// and counts it like reauthenticate.
+func VerifyIdentity(c *gin.Context, user *models.User, password string, code string) bool {
+	if user.MFAEnabled {
+		return reauthenticate(c, user, password, code)
+	}
+	return confirmIdentity(c, user, password, nil, "Invalid password")
+}
+
+func confirmIdentity(c *gin.Context, user *models.User, password string, secondFactor func(now time.Time) bool, failure string) bool {
+	ctx := c.Request.Context()
+	now := time.Now()
+	attempt, retryAfter := reserveLoginAttempt(ctx, now, loginAttemptsKey(user, ""), c.ClientIP())
+	if retryAfter > 0 {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthLocked).Inc()
+		rejectLocked(c, retryAfter)
+		return false
+	}
+
+	confirmed := password == "" && len(user.OIDCIdentities) > 0 && SignedInWithSSO(c, recentSignIn)
+	if !confirmed {
+		confirmed = password != "" && bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+	}
+	if !confirmed || (secondFactor != nil && !secondFactor(now)) {
+		recordLoginFailure(ctx, attempt, user)
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidCredentials).Inc()
+		c.JSON(http.StatusForbidden, gin.H{"message": failure, "fieldError": "unauthorized"})
+		return false
+	}
+	recordLoginSuccess(ctx, attempt)
+	return true
+}
+
+// SignedInWithSSO reports whether the caller's session token was issued by the
+// OpenID Connect login less than d ago, i.e. the user has just signed in at their
+// identity provider. Password sessions and API tokens never qualify.
+func SignedInWithSSO(c *gin.Context, d time.Duration) bool {
+	claims, ok := c.Get("user")
+	if !ok {
+		return false
+	}
+	sessionClaims, ok := claims.(*Claims)
+	return ok && sessionClaims.AuthMethod == AuthMethodOIDC &&
+		sessionClaims.IssuedAt != nil && time.Since(sessionClaims.IssuedAt.Time) < d
+}
+
+// verifySecondFactor accepts a TOTP code not used before or an unused recovery code
+func verifySecondFactor(ctx context.Context, user *models.User, code string, now time.Time) bool {
+	if step, ok := matchTOTP(user.MFASecret, code, now); ok {
+		advanced, err := mongodb.AdvanceUserMFAStep(ctx, user.ID, step)
+		if err != nil {
+			logging.FromContext(ctx).Error("Could not record mfa step", logging.Err(err))
+			return false
+		}
+		return advanced
+	}
+
+	consumed, err := mongodb.ConsumeUserRecoveryCode(ctx, user.ID, hashRecoveryCode(code))
+	if err != nil {
+		logging.FromContext(ctx).Error("Could not consume recovery code", logging.Err(err))
+		return false
+	}
+	if consumed {
+		logging.FromContext(ctx).Info("Recovery code used", logging.KeyUserID, user.ID)
+	}
+	return consumed
+}
+
+// matchTOTP returns the time step the code belongs to, within the allowed skew
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if secret == "" || len(code) != otp.DigitsSix.Length() {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+		step := current + offset
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totpOptions)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes returns codes formatted for the user and their hashes for storage
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("could not generate recovery code: %v", err)
+		}
+		raw := strings.ToLower(encoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Recovery codes carry enough entropy that a plain SHA-256 is sufficient;
+// formatting is ignored so "ABCD EFGH" matches "abcd-efgh"
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func qrCodeDataURI(key *otp.Key) (string, error) {
+	image, err := key.Image(qrCodeSize, qrCodeSize)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
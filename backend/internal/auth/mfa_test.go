@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp/totp"
+)
+
+func newTOTPSecret(t *testing.T) string {
+	t.Helper()
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: "chat", AccountName: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.Secret()
+}
+
+func codeAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(secret, at, totpOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestMatchTOTPAcceptsTheSkewWindow(t *testing.T) {
+	secret := newTOTPSecret(t)
+	now := time.Unix(1700000010, 0)
+	step := now.Unix() / totpPeriod
+
+	for offset := int64(-1); offset <= 1; offset++ {
+		code := codeAt(t, secret, now.Add(time.Duration(offset*totpPeriod)*time.Second))
+		got, ok := matchTOTP(secret, code, now)
+		if !ok {
+			t.Errorf("code of step %+d refused", offset)
+			continue
+		}
+		// The step is what stops a code from being used twice
+		if got != step+offset {
+			t.Errorf("code of step %+d matched step %d, want %d", offset, got, step+offset)
+		}
+	}
+	for _, offset := range []int64{-2, 2} {
+		code := codeAt(t, secret, now.Add(time.Duration(offset*totpPeriod)*time.Second))
+		if _, ok := matchTOTP(secret, code, now); ok {
+			t.Errorf("code of step %+d accepted", offset)
+		}
+	}
+}
+
+func TestMatchTOTPRejectsMalformedInput(t *testing.T) {
+	secret := newTOTPSecret(t)
+	now := time.Unix(1700000010, 0)
+	code := codeAt(t, secret, now)
+
+	if _, ok := matchTOTP(secret, " "+code+"\n", now); !ok {
+		t.Error("surrounding whitespace not ignored")
+	}
+	if _, ok := matchTOTP("", code, now); ok {
+		t.Error("accepted without a secret")
+	}
+	for _, bad := range []string{"", code[:5], code + "0", "abcdef"} {
+		if _, ok := matchTOTP(secret, bad, now); ok {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+	if _, ok := matchTOTP(newTOTPSecret(t), code, now); ok {
+		t.Error("accepted the code of another secret")
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}$`)
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q is not formatted as xxxx-xxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q generated twice", code)
+		}
+		seen[code] = true
+		if hashes[i] != hashRecoveryCode(code) {
+			t.Errorf("hash %d doesn't match its code", i)
+		}
+		// Only the hash is stored
+		if strings.Contains(hashes[i], strings.ReplaceAll(code, "-", "")) {
+			t.Errorf("hash %d contains its code", i)
+		}
+	}
+}
+
+func TestHashRecoveryCodeIgnoresFormatting(t *testing.T) {
+	want := hashRecoveryCode("abcd-efgh")
+	for _, typed := range []string{"ABCD-EFGH", "abcdefgh", " abcd efgh ", "AbCd EfGh"} {
+		if got := hashRecoveryCode(typed); got != want {
+			t.Errorf("hashRecoveryCode(%q) differs from abcd-efgh", typed)
+		}
+	}
+	if hashRecoveryCode("abcd-efgi") == want {
+		t.Error("different codes share a hash")
+	}
+}
+
+func TestSignedInWithSSO(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	request := func(claims interface{}) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		if claims != nil {
+			c.Set("user", claims)
+		}
+		return c
+	}
+	issued := func(authMethod string, ago time.Duration) *Claims {
+		return &Claims{AuthMethod: authMethod, RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now().Add(-ago))}}
+	}
+
+	if !SignedInWithSSO(request(issued(AuthMethodOIDC, time.Minute)), recentSignIn) {
+		t.Error("a single sign-on from a minute ago is not recent")
+	}
+	if SignedInWithSSO(request(issued(AuthMethodOIDC, time.Hour)), recentSignIn) {
+		t.Error("a single sign-on from an hour ago is recent")
+	}
+	// A fresh password session of an account linked to a provider doesn't count
+	if SignedInWithSSO(request(issued(AuthMethodPassword, time.Minute)), recentSignIn) {
+		t.Error("a password session counts as single sign-on")
+	}
+	if SignedInWithSSO(request(issued("", time.Minute)), recentSignIn) {
+		t.Error("a token without an auth method counts as single sign-on")
+	}
+	if SignedInWithSSO(request(&Claims{AuthMethod: AuthMethodOIDC}), recentSignIn) {
+		t.Error("a token without iat is recent")
+	}
+	// API tokens don't set session claims
+	if SignedInWithSSO(request(nil), recentSignIn) {
+		t.Error("a request without a session is recent")
+	}
+}
+
+func TestQRCodeDataURI(t *testing.T) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: "chat", AccountName: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := qrCodeDataURI(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "data:image/png;base64,iVBORw0KGgo") {
+		t.Errorf("not a PNG data URI: %.40s", uri)
+	}
+}
@@ -1,6 +1,9 @@
 package auth
 
 import (
+	"backend/internal/logging"
+	"backend/internal/metrics"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -8,16 +11,37 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// publicRoutes are the route patterns served without a JWT.
+// WS Route have a custom auth token checker, login and registration are public
+// and the probes must answer before any user exists.
+var publicRoutes = map[string]struct{}{
+	"/login":     {},
+	"/login/mfa": {},
+	"/register":  {},
+	"/ws":        {},
+	"/healthz":   {},
+	"/readyz":    {},
+	"/metrics":   {},
+
+	// Public keys for services verifying our tokens
+	"/.well-known/jwks.json": {},
+
+	// Incoming webhooks, the secret token in the URL is the credential
+	"/hooks/:token": {},
+
+	// Single sign-on, the browser arrives without a token
+	"/auth/oidc/login":    {},
+	"/auth/oidc/callback": {},
+}
+
 // JWTMiddleware checks the token for authentication
 func JWTMiddleware(c *gin.Context) {
 	if c.Request.Method == http.MethodOptions {
 		c.Next()
 		return
 	}
-	// Skip the routes that don't require authentication
-	// WS Route have a custom auth token checker
-	// login and registration are public
-	if c.Request.URL.Path == "/login" || c.Request.URL.Path == "/register" || c.Request.URL.Path == "/ws" {
+	// Skip the routes that don't require authentication, matched on the route pattern
+	if _, public := publicRoutes[c.FullPath()]; public {
 		c.Next()
 		return
 	}
@@ -25,6 +49,7 @@ func JWTMiddleware(c *gin.Context) {
 	// Extract the token from the Authorization header
 	tokenString := c.GetHeader("Authorization")
 	if tokenString == "" {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthMissingToken).Inc()
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "Missing token"})
 		c.Abort()
 		return
@@ -32,6 +57,7 @@ func JWTMiddleware(c *gin.Context) {
 
 	// Bearer token extraction
 	if !strings.HasPrefix(tokenString, "Bearer ") {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidToken).Inc()
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid token format"})
 		c.Abort()
 		return
@@ -40,21 +66,55 @@ func JWTMiddleware(c *gin.Context) {
 	// Remove "Bearer " prefix and validate the token
 	tokenString = tokenString[7:]
 
+	// Personal access tokens only reach the routes their scopes cover
+	if IsAPIToken(tokenString) {
+		principal, err := principalFromAPIToken(c.Request.Context(), tokenString)
+		if err != nil {
+			rejectToken(c, err)
+			return
+		}
+		if !principal.AllowsRoute(c.Request.Method, c.FullPath()) {
+			metrics.AuthFailures.WithLabelValues(metrics.AuthForbidden).Inc()
+			c.JSON(http.StatusForbidden, gin.H{"message": "Token scope does not allow this request"})
+			c.Abort()
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Set(logging.KeyUserID, principal.ID)
+		c.Next()
+		return
+	}
+
 	// Validate the token
 	claims, err := ValidateJWT(tokenString)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": fmt.Sprintf("Invalid token: %v", err)})
-		c.Abort()
+		rejectToken(c, err)
 		return
 	}
 
-	user, err := GetUserFromToken(tokenString)
-	if user == nil || err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": fmt.Sprintf("Invalid token: %v", err)})
-		c.Abort()
+	principal, err := principalFromClaims(c.Request.Context(), claims)
+	if err != nil {
+		rejectToken(c, err)
 		return
 	}
 
 	c.Set("user", claims)
+	c.Set(principalKey, principal)
+	c.Set(logging.KeyUserID, principal.ID)
 	c.Next()
 }
+
+// rejectToken answers 403 for disabled accounts and 401 for any other invalid token
+func rejectToken(c *gin.Context, err error) {
+	if errors.Is(err, ErrAccountDisabled) {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthForbidden).Inc()
+		c.JSON(http.StatusForbidden, gin.H{"message": "Account disabled"})
+		c.Abort()
+		return
+	}
+
+	metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidToken).Inc()
+	c.JSON(http.StatusUnauthorized, gin.H{"message": fmt.Sprintf("Invalid token: %v", err)})
+	c.Abort()
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"backend/internal/models"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveAuthenticated runs a request with the Authorization header through JWTMiddleware
+func serveAuthenticated(route string, target string, authorization string) int {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(JWTMiddleware)
+	r.GET(route, func(c *gin.Context) { c.Status(http.StatusOK) })
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestJWTMiddlewareSkipsPublicRoutes(t *testing.T) {
+	for _, route := range []string{"/healthz", "/login", "/.well-known/jwks.json"} {
+		if code := serveAuthenticated(route, route, ""); code != http.StatusOK {
+			t.Errorf("%s answered %d without a token", route, code)
+		}
+	}
+	// Public routes are matched on their pattern, not on a prefix of the path
+	if code := serveAuthenticated("/hooks/:token", "/hooks/abc", ""); code != http.StatusOK {
+		t.Errorf("incoming webhook answered %d without a token", code)
+	}
+	if code := serveAuthenticated("/healthz/:detail", "/healthz/db", ""); code != http.StatusUnauthorized {
+		t.Errorf("route below a public one answered %d without a token", code)
+	}
+}
+
+func TestJWTMiddlewareRejectsBadTokens(t *testing.T) {
+	now := time.Now()
+	current := newStoredKey(t, AlgRS256, now.Add(-time.Hour))
+	useKeys(t, AlgRS256, current)
+
+	user := &models.User{ID: "64b7f0c2a1b2c3d4e5f60718", Username: "alice"}
+	pending, _, err := GenerateMFAPendingToken(user, AuthMethodPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"no token":         "",
+		"not a bearer":     "Token abc",
+		"not a JWT":        "Bearer abc",
+		"mfa pending only": "Bearer " + pending,
+	}
+	for name, authorization := range tests {
+		if code := serveAuthenticated("/getChats", "/getChats", authorization); code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want 401", name, code)
+		}
+	}
+}
+
+func TestSessionClaims(t *testing.T) {
+	now := time.Now()
+	current := newStoredKey(t, AlgRS256, now.Add(-time.Hour))
+	useKeys(t, AlgRS256, current)
+
+	user := &models.User{ID: "64b7f0c2a1b2c3d4e5f60718", Username: "alice", Roles: []string{RoleModerator}, SessionGeneration: 3}
+	first, _, err := GenerateJWT(user, AuthMethodPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, _ := GenerateJWT(user, AuthMethodPassword)
+
+	claims, err := ValidateJWT(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != user.ID || claims.Username != "alice" || claims.Generation != 3 {
+		t.Errorf("claims = %+v", claims)
+	}
+	if len(claims.Roles) != 1 || claims.Roles[0] != RoleModerator {
+		t.Errorf("roles = %v", claims.Roles)
+	}
+	// Every login is its own session
+	if other, _ := ValidateJWT(second); other == nil || other.SessionID == "" || other.SessionID == claims.SessionID {
+		t.Errorf("two logins share session %q", claims.SessionID)
+	}
+}
+
+func TestRejectToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := map[error]int{
+		ErrAccountDisabled:             http.StatusForbidden,
+		ErrSessionRevoked:              http.StatusUnauthorized,
+		errors.New("token is expired"): http.StatusUnauthorized,
+	}
+	for err, want := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		rejectToken(c, err)
+		if recorder.Code != want || !c.IsAborted() {
+			t.Errorf("%v: status = %d, aborted %v, want %d", err, recorder.Code, c.IsAborted(), want)
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package auth
 
 import (
+	"backend/internal/metrics"
 	"backend/internal/models"
+	"backend/internal/ratelimit"
 	"backend/mongodb"
+	"context"
 	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/gin-gonic/gin"
@@ -33,7 +37,7 @@ func Register(c *gin.Context) {
 	}
 
 	// Check if the email or username is already registered
-	if fieldError, err := checkIfUserExists(user.Email, user.Username); err != nil {
+	if fieldError, err := checkIfUserExists(c.Request.Context(), user.Email, user.Username); err != nil {
 		c.JSON(http.StatusConflict, gin.H{"message": err.Error(), "fieldError": fieldError})
 		return
 	}
@@ -45,7 +49,7 @@ func Register(c *gin.Context) {
 		return
 	}
 	user.Password = string(hashedPassword)
-	userId, err := mongodb.CreateUser(user)
+	userId, err := mongodb.CreateUser(c.Request.Context(), user)
 
 	// Create the user in the database
 	if err != nil {
@@ -54,7 +58,8 @@ func Register(c *gin.Context) {
 	}
 
 	// Generate JWT token for the newly created user
-	token, expiration, err := GenerateJWT(user.Username)
+	user.ID = userId
+	token, expiration, err := GenerateJWT(&user, AuthMethodPassword)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create token : " + err.Error()})
 		return
@@ -64,15 +69,15 @@ func Register(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"token": token, "expiration": expiration, "id": userId, "user": user.Username})
 }
 
-func checkIfUserExists(email, username string) (string, error) {
+func checkIfUserExists(ctx context.Context, email, username string) (string, error) {
 	// Check if the email is already in use
-	userEmail, err := mongodb.FindUserByEmailRegistration(email)
+	userEmail, err := mongodb.FindUserByEmailRegistration(ctx, email)
 	if err == nil && userEmail != nil {
 		return "email", fmt.Errorf("this email is already registered")
 	}
 
 	// Check if the username is already in use
-	existingUser, err := mongodb.FindUserByUsername(username, false)
+	existingUser, err := mongodb.FindUserByUsername(ctx, username, false)
 	if err == nil && existingUser != nil {
 		return "username", fmt.Errorf("username already exists")
 	}
@@ -96,14 +101,15 @@ func checkValidUser(user *models.User) (bool, string, error) {
 	if !validateEmail(user.Email) {
 		return false, "email", fmt.Errorf("invalid email format")
 	}
-	if !validatePassword(user.Password) {
+	if !ValidatePassword(user.Password) {
 		return false, "password", fmt.Errorf("password must be 8+ characters with uppercase, lowercase, number, and special character")
 	}
 
 	return true, "", nil
 }
 
-func validatePassword(password string) bool {
+// ValidatePassword reports whether password meets the registration rules
+func ValidatePassword(password string) bool {
 	var (
 		hasMinLen  = false
 		hasUpper   = false
@@ -184,23 +190,73 @@ func Login(c *gin.Context) {
 		emailOrUsername = user.Email
 	}
 
+	// Limit guesses against a single account, whichever address they come from
+	if decision := ratelimit.Allow(c.Request.Context(), ratelimit.AuthAccount, emailOrUsername); !decision.Allowed {
+		ratelimit.Reject(c, decision.RetryAfter)
+		return
+	}
+
 	// Find the user by username in the database
-	storedUser, err := mongodb.FindUserByUsernameOrEmail(emailOrUsername)
-	if err != nil || storedUser == nil {
+	storedUser, err := mongodb.FindUserByUsernameOrEmail(c.Request.Context(), emailOrUsername)
+	if err != nil {
+		storedUser = nil
+	}
+
+	// Refuse attempts on a locked or throttled account or address before checking the password
+	now := time.Now()
+	attempt, retryAfter := reserveLoginAttempt(c.Request.Context(), now, loginAttemptsKey(storedUser, emailOrUsername), c.ClientIP())
+	if retryAfter > 0 {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthLocked).Inc()
+		rejectLocked(c, retryAfter)
+		return
+	}
+
+	if storedUser == nil {
+		// Spend the same time as a password check so unknown accounts can't be told apart
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(user.Password))
+		recordLoginFailure(c.Request.Context(), attempt, nil)
+
 		// If user is not found or any DB error occurs, return Unauthorized error
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidCredentials).Inc()
 		c.JSON(http.StatusForbidden, gin.H{"message": "Invalid credentials", "fieldError": "unauthorized"})
 		return
 	}
 
 	// Compare the stored hashed password with the provided password
 	if err := bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(user.Password)); err != nil {
+		recordLoginFailure(c.Request.Context(), attempt, storedUser)
+
 		// If password doesn't match, return Unauthorized error
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidCredentials).Inc()
 		c.JSON(http.StatusForbidden, gin.H{"message": "Invalid credentials", "fieldError": "unauthorized"})
 		return
 	}
 
+	// Only tell a disabled account apart once the password proved who is asking
+	if storedUser.Disabled {
+		releaseLoginAttempt(c.Request.Context(), attempt)
+		metrics.AuthFailures.WithLabelValues(metrics.AuthForbidden).Inc()
+		c.JSON(http.StatusForbidden, gin.H{"message": "Account disabled", "fieldError": "unauthorized"})
+		return
+	}
+
+	// With two-factor authentication the password only earns a short-lived token
+	// that VerifyMFALogin exchanges for a session token. Failures are kept until
+	// then so that code guesses can't be reset by logging in again.
+	if storedUser.MFAEnabled {
+		releaseLoginAttempt(c.Request.Context(), attempt)
+		mfaToken, expiration, err := GenerateMFAPendingToken(storedUser, AuthMethodPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": mfaToken, "expiration": expiration})
+		return
+	}
+	recordLoginSuccess(c.Request.Context(), attempt)
+
 	// Generate JWT token for the logged-in user
-	token, expiration, err := GenerateJWT(storedUser.Username)
+	token, expiration, err := GenerateJWT(storedUser, AuthMethodPassword)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create token"})
 		return
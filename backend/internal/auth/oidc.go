@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"backend/internal/logging"
+	"backend/internal/metrics"
+	"backend/internal/models"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// How long the user has to complete the login at the provider
+	oidcFlowTTL = 10 * time.Minute
+	// Binds the callback to the browser that started the flow
+	oidcStateCookie = "oidc_state"
+)
+
+// oidcClient is discovered lazily on the first login, so the server starts even if the provider is down
+type oidcClient struct {
+	mu       sync.Mutex
+	provider *oidc.Provider
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var oidcState oidcClient
+
+// oidcClaims are the ID token claims used for account linking
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+var usernameSanitizer = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// OIDCEnabled reports whether an OpenID Connect provider is configured:
+//   - OIDC_ISSUER_URL: issuer used for discovery
+//   - OIDC_CLIENT_ID, OIDC_CLIENT_SECRET: client registered at the provider
+//   - OIDC_REDIRECT_URL: public URL of /auth/oidc/callback
+//   - OIDC_FRONTEND_REDIRECT_URL: where the browser lands with the token, JSON is returned when unset
+//   - OIDC_SCOPES: extra scopes, comma separated
+//   - OIDC_AUTO_CREATE: "false" to refuse users without an existing account
+func OIDCEnabled() bool {
+	return os.Getenv("OIDC_ISSUER_URL") != "" && os.Getenv("OIDC_CLIENT_ID") != ""
+}
+
+func (o *oidcClient) get(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider != nil {
+		return o.config, o.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, os.Getenv("OIDC_ISSUER_URL"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery failed: %v", err)
+	}
+
+	scopes := append([]string{oidc.ScopeOpenID, "email", "profile"}, utils.GetEnvList("OIDC_SCOPES")...)
+	o.config = &oauth2.Config{
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.config.ClientID})
+	o.provider = provider
+	return o.config, o.verifier, nil
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OIDCLogin starts an authorization code flow with PKCE and redirects to the provider
+func OIDCLogin(c *gin.Context) {
+	if !OIDCEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Single sign-on is not configured"})
+		return
+	}
+
+	config, _, err := oidcState.get(c.Request.Context())
+	if err != nil {
+		logging.FromGin(c).Error("OIDC provider unavailable", logging.Err(err))
+		c.JSON(http.StatusBadGateway, gin.H{"message": "Identity provider unavailable"})
+		return
+	}
+
+	state, errState := randomString(32)
+	nonce, errNonce := randomString(32)
+	if errState != nil || errNonce != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not start login"})
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	now := time.Now()
+	flow := &models.OIDCFlow{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(oidcFlowTTL),
+	}
+	if err := mongodb.SaveOIDCFlow(c.Request.Context(), flow); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not start login"})
+		return
+	}
+
+	secure := strings.HasPrefix(config.RedirectURL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(oidcFlowTTL.Seconds()), "/auth/oidc", "", secure, true)
+
+	authURL := config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback completes the flow: it validates state and nonce, exchanges the code,
+// links or creates the local user and issues the project's own JWT, or the mfa pending
+// token of a password login when the user has two-factor authentication enabled
+func OIDCCallback(c *gin.Context) {
+	if !OIDCEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Single sign-on is not configured"})
+		return
+	}
+	ctx := c.Request.Context()
+	logger := logging.FromGin(c)
+
+	if errorCode := c.Query("error"); errorCode != "" {
+		logger.Info("OIDC login refused by provider", "oidc_error", errorCode)
+		oidcFail(c, http.StatusUnauthorized, "Login was cancelled or refused")
+		return
+	}
+
+	// The state must match both the cookie of this browser and a pending flow
+	state := c.Query("state")
+	cookieState, err := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, "/auth/oidc", "", false, true)
+	if state == "" || err != nil || cookieState != state {
+		oidcFail(c, http.StatusBadRequest, "Invalid login state")
+		return
+	}
+	flow, err := mongodb.ConsumeOIDCFlow(ctx, state)
+	if err != nil || flow == nil || time.Now().After(flow.ExpiresAt) {
+		oidcFail(c, http.StatusBadRequest, "Login expired, please try again")
+		return
+	}
+
+	config, verifier, err := oidcState.get(ctx)
+	if err != nil {
+		logger.Error("OIDC provider unavailable", logging.Err(err))
+		oidcFail(c, http.StatusBadGateway, "Identity provider unavailable")
+		return
+	}
+
+	oauthToken, err := config.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(flow.CodeVerifier))
+	if err != nil {
+		logger.Warn("OIDC code exchange failed", logging.Err(err))
+		oidcFail(c, http.StatusUnauthorized, "Login failed")
+		return
+	}
+
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		oidcFail(c, http.StatusUnauthorized, "Login failed")
+		return
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		logger.Warn("OIDC id token rejected", logging.Err(err))
+		oidcFail(c, http.StatusUnauthorized, "Login failed")
+		return
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil || claims.Nonce != flow.Nonce {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidToken).Inc()
+		oidcFail(c, http.StatusUnauthorized, "Login failed")
+		return
+	}
+
+	user, err := resolveOIDCUser(ctx, idToken.Issuer, idToken.Subject, claims)
+	if err != nil {
+		logger.Warn("OIDC account linking failed", logging.Err(err))
+		oidcFail(c, http.StatusForbidden, err.Error())
+		return
+	}
+	if user.Disabled {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthForbidden).Inc()
+		oidcFail(c, http.StatusForbidden, "Account disabled")
+		return
+	}
+
+	frontend := os.Getenv("OIDC_FRONTEND_REDIRECT_URL")
+
+	// The provider stands in for the password only, with two-factor authentication
+	// the login continues at /login/mfa exactly like a password login
+	if user.MFAEnabled {
+		mfaToken, expiration, err := GenerateMFAPendingToken(user, AuthMethodOIDC)
+		if err != nil {
+			oidcFail(c, http.StatusInternalServerError, "Could not create token")
+			return
+		}
+		logger.Info("OIDC login awaiting second factor", logging.KeyUserID, user.ID)
+		if frontend == "" {
+			c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": mfaToken, "expiration": expiration})
+			return
+		}
+		fragment := url.Values{
+			"mfa_required": {"true"},
+			"mfa_token":    {mfaToken},
+			"expiration":   {fmt.Sprint(expiration)},
+		}
+		c.Redirect(http.StatusFound, frontend+"#"+fragment.Encode())
+		return
+	}
+
+	token, expiration, err := GenerateJWT(user, AuthMethodOIDC)
+	if err != nil {
+		oidcFail(c, http.StatusInternalServerError, "Could not create token")
+		return
+	}
+	logger.Info("OIDC login", logging.KeyUserID, user.ID)
+
+	if frontend == "" {
+		c.JSON(http.StatusOK, gin.H{"token": token, "expiration": expiration, "id": user.ID, "user": user.Username})
+		return
+	}
+
+	// The token travels in the fragment so it never reaches server logs or referrers
+	fragment := url.Values{
+		"token":      {token},
+		"expiration": {fmt.Sprint(expiration)},
+		"id":         {user.ID},
+		"user":       {user.Username},
+	}
+	c.Redirect(http.StatusFound, frontend+"#"+fragment.Encode())
+}
+
+// resolveOIDCUser finds the local user for an external identity: an already linked
+// account first, then an account with the same verified email, which gets linked,
+// and finally a new account when auto-creation is allowed
+func resolveOIDCUser(ctx context.Context, issuer string, subject string, claims oidcClaims) (*models.User, error) {
+	user, err := mongodb.FindUserByOIDCIdentity(ctx, issuer, subject)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up account")
+	}
+	if user != nil {
+		return user, nil
+	}
+
+	// An unverified email could belong to anyone, never link on it
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, fmt.Errorf("your identity provider did not share a verified email")
+	}
+	email := strings.ToLower(claims.Email)
+	identity := models.OIDCIdentity{Issuer: issuer, Subject: subject, LinkedAt: time.Now()}
+
+	user, err = mongodb.FindUserByEmailRegistration(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up account")
+	}
+	if user != nil {
+		if err := mongodb.LinkUserOIDCIdentity(ctx, user.ID, identity); err != nil {
+			return nil, fmt.Errorf("could not link account")
+		}
+		logging.FromContext(ctx).Info("Linked OIDC identity to existing user", logging.KeyUserID, user.ID)
+		return user, nil
+	}
+
+	if os.Getenv("OIDC_AUTO_CREATE") == "false" {
+		return nil, fmt.Errorf("no account matches your email")
+	}
+	return createOIDCUser(ctx, email, claims.PreferredUsername, identity)
+}
+
+// createOIDCUser registers a user that can only sign in through the provider:
+// the password is random and never disclosed
+func createOIDCUser(ctx context.Context, email string, preferredUsername string, identity models.OIDCIdentity) (*models.User, error) {
+	base := preferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(email, "@")
+	}
+	base = usernameSanitizer.ReplaceAllString(strings.ToLower(base), "")
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	for i := 0; ; i++ {
+		existing, err := mongodb.FindUserByUsername(ctx, username, false)
+		if err != nil {
+			return nil, fmt.Errorf("could not create account")
+		}
+		if existing == nil {
+			break
+		}
+		suffix, err := randomString(3)
+		if err != nil || i >= 5 {
+			return nil, fmt.Errorf("could not create account")
+		}
+		username = base + "-" + strings.ToLower(suffix)
+	}
+
+	password, err := randomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("could not create account")
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("could not create account")
+	}
+
+	user := models.User{
+		Username:       username,
+		Email:          email,
+		Password:       string(hashedPassword),
+		OIDCIdentities: []models.OIDCIdentity{identity},
+	}
+	userID, err := mongodb.CreateUser(ctx, user)
+	if err != nil {
+		return nil, fmt.Errorf("could not create account")
+	}
+	user.ID = userID
+
+	logging.FromContext(ctx).Info("Created user from OIDC login", logging.KeyUserID, userID)
+	return &user, nil
+}
+
+// oidcFail sends the browser back to the frontend with an error, or answers JSON
+func oidcFail(c *gin.Context, status int, message string) {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidCredentials).Inc()
+	}
+	frontend := os.Getenv("OIDC_FRONTEND_REDIRECT_URL")
+	if frontend == "" {
+		c.JSON(status, gin.H{"message": message})
+		return
+	}
+	c.Redirect(http.StatusFound, frontend+"#"+url.Values{"error": {message}}.Encode())
+}
@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+// mockProvider is an OpenID Connect provider serving discovery, its keys and a
+// token endpoint that checks the PKCE verifier of the codes it issued
+type mockProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+// mockGrant is what the provider remembers of an authorization
+type mockGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key, clientID: "chat-client", codes: map[string]mockGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "provider-key",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// authorize plays the user signing in at the provider: it reads the authorization
+// URL built by the client and returns the code the provider redirects back with
+func (p *mockProvider) authorize(t *testing.T, authURL string, subject string, extra jwt.MapClaims) string {
+	t.Helper()
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization URL without a PKCE challenge: %s", authURL)
+	}
+	if query.Get("client_id") != p.clientID {
+		t.Fatalf("client_id = %q", query.Get("client_id"))
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   p.server.URL,
+		"sub":   subject,
+		"aud":   p.clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	code := "code-" + subject
+	p.mu.Lock()
+	p.codes[code] = mockGrant{challenge: query.Get("code_challenge"), claims: claims}
+	p.mu.Unlock()
+	return code
+}
+
+func (p *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	grant, ok := p.codes[r.Form.Get("code")]
+	delete(p.codes, r.Form.Get("code"))
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = "provider-key"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (p *mockProvider) configure(t *testing.T) {
+	t.Setenv("OIDC_ISSUER_URL", p.server.URL)
+	t.Setenv("OIDC_CLIENT_ID", p.clientID)
+	t.Setenv("OIDC_CLIENT_SECRET", "secret")
+	t.Setenv("OIDC_REDIRECT_URL", "https://chat.example.com/auth/oidc/callback")
+	t.Setenv("OIDC_SCOPES", "groups")
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.configure(t)
+
+	var client oidcClient
+	config, _, err := client.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Endpoint.TokenURL != provider.server.URL+"/token" {
+		t.Errorf("token URL = %q", config.Endpoint.TokenURL)
+	}
+	if got := strings.Join(config.Scopes, " "); got != "openid email profile groups" {
+		t.Errorf("scopes = %q", got)
+	}
+
+	// Discovery happens once, later logins reuse it
+	provider.server.Close()
+	if _, _, err := client.get(context.Background()); err != nil {
+		t.Errorf("second get rediscovered: %v", err)
+	}
+}
+
+func TestOIDCDiscoveryFailure(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.configure(t)
+	provider.server.Close()
+
+	var client oidcClient
+	if _, _, err := client.get(context.Background()); err == nil {
+		t.Fatal("discovery against a provider that is down succeeded")
+	}
+}
+
+// login runs the authorization code flow against the provider up to the verified ID token claims
+func login(t *testing.T, provider *mockProvider, subject string, extra jwt.MapClaims, tamper func(verifier string) string) (oidcClaims, string, error) {
+	t.Helper()
+	var client oidcClient
+	config, verifier, err := client.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce, _ := randomString(32)
+	codeVerifier := oauth2.GenerateVerifier()
+	code := provider.authorize(t, config.AuthCodeURL("state", oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier)), subject, extra)
+	if tamper != nil {
+		codeVerifier = tamper(codeVerifier)
+	}
+
+	token, err := config.Exchange(context.Background(), code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return oidcClaims{}, nonce, err
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := verifier.Verify(context.Background(), rawIDToken)
+	if err != nil {
+		return oidcClaims{}, nonce, err
+	}
+	if idToken.Subject != subject || idToken.Issuer != provider.server.URL {
+		t.Errorf("identity = %s at %s", idToken.Subject, idToken.Issuer)
+	}
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims, nonce, nil
+}
+
+func TestOIDCCodeExchange(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.configure(t)
+
+	claims, nonce, err := login(t, provider, "alice-sub", jwt.MapClaims{
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "Alice",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The callback compares the nonce with the one of the flow it started
+	if claims.Nonce != nonce {
+		t.Errorf("nonce = %q, want %q", claims.Nonce, nonce)
+	}
+	if claims.Email != "alice@example.com" || !claims.EmailVerified || claims.PreferredUsername != "Alice" {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+func TestOIDCCodeExchangeRequiresTheVerifier(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.configure(t)
+
+	_, _, err := login(t, provider, "alice-sub", nil, func(string) string { return oauth2.GenerateVerifier() })
+	if err == nil {
+		t.Fatal("code exchanged with another PKCE verifier")
+	}
+}
+
+func TestOIDCRejectsInvalidIDTokens(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.configure(t)
+
+	tests := map[string]jwt.MapClaims{
+		"another audience": {"aud": "someone-else"},
+		"another issuer":   {"iss": "https://evil.example.com"},
+		"expired":          {"exp": time.Now().Add(-time.Minute).Unix()},
+	}
+	for name, extra := range tests {
+		if _, _, err := login(t, provider, "alice-sub", extra, nil); err == nil {
+			t.Errorf("%s: ID token accepted", name)
+		}
+	}
+}
+
+func oidcCallback(t *testing.T, query string, cookieState string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+query, nil)
+	if cookieState != "" {
+		c.Request.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: cookieState})
+	}
+	OIDCCallback(c)
+	return recorder
+}
+
+func TestOIDCCallbackChecksStateFirst(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.configure(t)
+	t.Setenv("OIDC_FRONTEND_REDIRECT_URL", "")
+
+	tests := []struct {
+		name        string
+		query       string
+		cookieState string
+		status      int
+	}{
+		{"refused at the provider", "error=access_denied&state=abc", "abc", http.StatusUnauthorized},
+		{"no cookie", "code=x&state=abc", "", http.StatusBadRequest},
+		{"another browser", "code=x&state=abc", "xyz", http.StatusBadRequest},
+		{"no state", "code=x", "abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		recorder := oidcCallback(t, tt.query, tt.cookieState)
+		if recorder.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, recorder.Code, tt.status)
+		}
+		if strings.Contains(recorder.Body.String(), "token") {
+			t.Errorf("%s: answered a token: %s", tt.name, recorder.Body)
+		}
+	}
+}
+
+func TestOIDCCallbackRedirectsErrorsToTheFrontend(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.configure(t)
+	t.Setenv("OIDC_FRONTEND_REDIRECT_URL", "https://chat.example.com/sso")
+
+	recorder := oidcCallback(t, "error=access_denied", "")
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("status = %d, want 302", recorder.Code)
+	}
+	location := recorder.Header().Get("Location")
+	if !strings.HasPrefix(location, "https://chat.example.com/sso#error=") {
+		t.Errorf("Location = %q", location)
+	}
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	t.Setenv("OIDC_ISSUER_URL", "")
+	if OIDCEnabled() {
+		t.Fatal("enabled without an issuer")
+	}
+	if code := oidcCallback(t, "code=x&state=abc", "abc").Code; code != http.StatusNotFound {
+		t.Errorf("callback answered %d, want 404", code)
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrAccountDisabled is returned for the tokens of a disabled account
+var ErrAccountDisabled = errors.New("account disabled")
+
+// ErrSessionRevoked is returned for the tokens issued before the sessions of the user were ended
+var ErrSessionRevoked = errors.New("session revoked")
+
+// principalKey is where JWTMiddleware stores the *Principal in the Gin context
+const principalKey = "principal"
+
+// Principal is the authenticated caller, built once per request from the token
+// claims so that handlers don't parse the token or load the user again
+type Principal struct {
+	ID        string
+	Username  string
+	Roles     []string
+	SessionID string
+
+	// Set when authenticated with a personal access token instead of a session
+	TokenID string
+	Scopes  []string
+	Bot     bool
+}
+
+// HasRole reports whether the caller was granted role when the token was issued
+func (p *Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// CurrentPrincipal returns the caller set by JWTMiddleware, or nil on public routes
+func CurrentPrincipal(c *gin.Context) *Principal {
+	value, ok := c.Get(principalKey)
+	if !ok {
+		return nil
+	}
+	principal, _ := value.(*Principal)
+	return principal
+}
+
+// principalFromClaims builds the principal of a session token. The roles and
+// the disabled flag come from the cached user record, so a demotion, a disabled
+// account or ended sessions take effect without waiting for the token to expire.
+func principalFromClaims(ctx context.Context, claims *Claims) (*Principal, error) {
+	user, err := userFromClaims(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	if claims.Generation != user.SessionGeneration {
+		return nil, ErrSessionRevoked
+	}
+
+	roles := user.Roles
+	if len(roles) == 0 {
+		roles = []string{RoleUser}
+	}
+	return &Principal{ID: user.ID, Username: user.Username, Roles: roles, SessionID: claims.SessionID}, nil
+}
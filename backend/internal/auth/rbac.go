@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"backend/internal/logging"
+	"backend/internal/metrics"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles, a user without any role is a plain RoleUser
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permission is an action guarded by RequirePermission
+type Permission string
+
+const (
+	PermViewUsers       Permission = "users:read"
+	PermManageUsers     Permission = "users:manage"
+	PermManageRoles     Permission = "roles:manage"
+	PermInspectChats    Permission = "chats:inspect"
+	PermViewConnections Permission = "connections:read"
+	PermManageWebhooks  Permission = "webhooks:manage"
+	PermImportChats     Permission = "chats:import"
+	PermModerate        Permission = "reports:moderate"
+)
+
+// rolePermissions lists what each role may do on top of the regular user routes
+var rolePermissions = map[string][]Permission{
+	RoleUser:      {},
+	RoleModerator: {PermViewUsers, PermInspectChats, PermViewConnections, PermModerate},
+	RoleAdmin:     {PermViewUsers, PermManageUsers, PermManageRoles, PermInspectChats, PermViewConnections, PermManageWebhooks, PermImportChats, PermModerate},
+}
+
+// IsValidRole reports whether role is one of the known roles
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Can reports whether any of the caller's roles grants perm
+func (p *Principal) Can(perm Permission) bool {
+	for _, role := range p.Roles {
+		if slices.Contains(rolePermissions[role], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission lets through only the callers holding perm. It must run after JWTMiddleware.
+func RequirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if principal := CurrentPrincipal(c); principal != nil && principal.Can(perm) {
+			c.Next()
+			return
+		}
+
+		metrics.AuthFailures.WithLabelValues(metrics.AuthForbidden).Inc()
+		c.JSON(http.StatusForbidden, gin.H{"message": "Forbidden"})
+		c.Abort()
+	}
+}
+
+// InitRoles grants the admin role so that a fresh deployment has someone able to
+// grant roles through the admin API: to the user IDs listed in ADMIN_USER_IDS on
+// every start, and to the usernames listed in ADMIN_USERS only while nobody is an
+// admin yet. Usernames can be registered by anyone, granting them on every start
+// would hand the role to whoever takes a listed name that is free.
+func InitRoles(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	for _, userID := range utils.GetEnvList("ADMIN_USER_IDS") {
+		found, err := mongodb.AddUserRole(ctx, userID, RoleAdmin)
+		if err != nil {
+			logger.Warn("Could not grant admin role", logging.KeyUserID, userID, logging.Err(err))
+		} else if !found {
+			logger.Warn("ADMIN_USER_IDS lists an unknown user", logging.KeyUserID, userID)
+		}
+	}
+
+	usernames := utils.GetEnvList("ADMIN_USERS")
+	if len(usernames) == 0 {
+		return
+	}
+	hasAdmin, err := mongodb.HasUserWithRole(ctx, RoleAdmin)
+	if err != nil {
+		logger.Warn("Could not look up admins", logging.Err(err))
+		return
+	}
+	if hasAdmin {
+		logger.Info("ADMIN_USERS ignored, an admin already exists")
+		return
+	}
+	for _, username := range usernames {
+		found, err := mongodb.AddUserRoleByUsername(ctx, username, RoleAdmin)
+		if err != nil {
+			logger.Warn("Could not grant admin role", "username", username, logging.Err(err))
+		} else if !found {
+			logger.Warn("ADMIN_USERS lists an unknown user", "username", username)
+		}
+	}
+}
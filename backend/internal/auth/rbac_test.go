@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// guarded serves a route behind RequirePermission(perm) as principal
+func guarded(principal *Principal, perm Permission) int {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if principal != nil {
+			c.Set(principalKey, principal)
+		}
+	})
+	r.GET("/admin", RequirePermission(perm), func(c *gin.Context) { c.Status(http.StatusOK) })
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	return recorder.Code
+}
+
+func TestRequirePermission(t *testing.T) {
+	user := &Principal{ID: "u", Roles: []string{RoleUser}}
+	moderator := &Principal{ID: "m", Roles: []string{RoleUser, RoleModerator}}
+	admin := &Principal{ID: "a", Roles: []string{RoleAdmin}}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		perm      Permission
+		status    int
+	}{
+		{"user moderating", user, PermModerate, http.StatusForbidden},
+		{"user listing users", user, PermViewUsers, http.StatusForbidden},
+		{"moderator moderating", moderator, PermModerate, http.StatusOK},
+		{"moderator inspecting chats", moderator, PermInspectChats, http.StatusOK},
+		{"moderator managing users", moderator, PermManageUsers, http.StatusForbidden},
+		{"moderator granting roles", moderator, PermManageRoles, http.StatusForbidden},
+		{"moderator importing", moderator, PermImportChats, http.StatusForbidden},
+		{"admin granting roles", admin, PermManageRoles, http.StatusOK},
+		{"admin managing webhooks", admin, PermManageWebhooks, http.StatusOK},
+		{"no roles", &Principal{ID: "x"}, PermViewUsers, http.StatusForbidden},
+		{"unknown role", &Principal{ID: "x", Roles: []string{"superuser"}}, PermViewUsers, http.StatusForbidden},
+		{"no principal", nil, PermViewUsers, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := guarded(tt.principal, tt.perm); got != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.status)
+		}
+	}
+}
+
+func TestAdminHoldsEveryPermission(t *testing.T) {
+	admin := &Principal{Roles: []string{RoleAdmin}}
+	for role, perms := range rolePermissions {
+		for _, perm := range perms {
+			if !admin.Can(perm) {
+				t.Errorf("admin lacks %s granted to %s", perm, role)
+			}
+		}
+	}
+}
+
+func TestIsValidRole(t *testing.T) {
+	for role, want := range map[string]bool{RoleUser: true, RoleModerator: true, RoleAdmin: true, "": false, "Admin": false, "root": false} {
+		if got := IsValidRole(role); got != want {
+			t.Errorf("IsValidRole(%q) = %v, want %v", role, got, want)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package auth
+
+import (
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/mongodb"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Scopes an API token can be granted
+const (
+	ScopeChatsRead     = "chats:read"
+	ScopeMessagesWrite = "messages:write"
+)
+
+// apiTokenPrefix tells API tokens apart from JWTs, and makes leaked tokens easy to scan for
+const apiTokenPrefix = "pat_"
+
+const (
+	maxBotsPerOwner = 10
+	// Last use is recorded at most this often per token
+	apiTokenTouchInterval = time.Minute
+)
+
+// tokenRouteScopes are the only routes API tokens are accepted on, with the scope each requires.
+// Keys are the method and the Gin route pattern.
+var tokenRouteScopes = map[string]string{
+	"GET /getChats":             ScopeChatsRead,
+	"GET /getChatById":          ScopeChatsRead,
+	"GET /getMessageChat":       ScopeChatsRead,
+	"POST /chats/:id/messages":  ScopeMessagesWrite,
+	"POST /chats/:id/scheduled": ScopeMessagesWrite,
+}
+
+// IsAPIToken reports whether a bearer token is an API token rather than a JWT
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// AllowsRoute reports whether the principal may call the route. Sessions may call
+// any route, API tokens only those covered by their scopes.
+func (p *Principal) AllowsRoute(method string, route string) bool {
+	if p.TokenID == "" {
+		return true
+	}
+	scope, ok := tokenRouteScopes[method+" "+route]
+	return ok && slices.Contains(p.Scopes, scope)
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// principalFromAPIToken authenticates a personal access token
+func principalFromAPIToken(ctx context.Context, token string) (*Principal, error) {
+	stored, err := mongodb.FindAPITokenByHash(ctx, hashAPIToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("could not look up token")
+	}
+	now := time.Now()
+	// Expired tokens linger until the TTL monitor removes them
+	if stored == nil || (stored.ExpiresAt != nil && now.After(*stored.ExpiresAt)) {
+		return nil, fmt.Errorf("unknown or revoked token")
+	}
+
+	user, err := mongodb.FindUserByIdCached(ctx, stored.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("could not find user: %v", err)
+	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	if err := mongodb.TouchAPIToken(ctx, stored.ID, now, apiTokenTouchInterval); err != nil {
+		logging.FromContext(ctx).Warn("Could not record token use", logging.Err(err))
+	}
+
+	return &Principal{
+		ID:       user.ID,
+		Username: user.Username,
+		TokenID:  stored.ID,
+		Scopes:   stored.Scopes,
+		Bot:      user.Bot,
+	}, nil
+}
+
+// sessionPrincipal returns the caller if they authenticated with a session,
+// answering 403 otherwise: tokens can't manage tokens or bots
+func sessionPrincipal(c *gin.Context) *Principal {
+	principal := CurrentPrincipal(c)
+	if principal == nil || principal.TokenID != "" {
+		c.JSON(http.StatusForbidden, gin.H{"message": "A session is required"})
+		return nil
+	}
+	return principal
+}
+
+// ownedUserIDs are the accounts whose tokens the caller manages: themselves and their bots
+func ownedUserIDs(ctx context.Context, ownerID string) ([]string, error) {
+	bots, err := mongodb.FindBotsByOwner(ctx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	userIDs := []string{ownerID}
+	for _, bot := range bots {
+		userIDs = append(userIDs, bot.ID)
+	}
+	return userIDs, nil
+}
+
+// CreateAPIToken issues a token for the caller, or for one of their bots with bot_id.
+// The token is only ever returned by this call.
+func CreateAPIToken(c *gin.Context) {
+	principal := sessionPrincipal(c)
+	if principal == nil {
+		return
+	}
+
+	var payload struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		BotID         string   `json:"bot_id"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" || len(payload.Name) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Name is required (64 characters at most)", "fieldError": "name"})
+		return
+	}
+	if len(payload.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "At least one scope is required", "fieldError": "scopes"})
+		return
+	}
+	for _, scope := range payload.Scopes {
+		if scope != ScopeChatsRead && scope != ScopeMessagesWrite {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown scope: " + scope, "fieldError": "scopes"})
+			return
+		}
+	}
+	if payload.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid expiration", "fieldError": "expires_in_days"})
+		return
+	}
+
+	userID := principal.ID
+	if payload.BotID != "" {
+		bot, err := mongodb.FindUserById(c.Request.Context(), payload.BotID)
+		if err != nil || bot == nil || !bot.Bot || bot.BotOwner != principal.ID {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Bot not found", "fieldError": "bot_id"})
+			return
+		}
+		userID = bot.ID
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create token"})
+		return
+	}
+	plain := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	now := time.Now()
+	token := &models.APIToken{
+		UserID:    userID,
+		CreatedBy: principal.ID,
+		Name:      payload.Name,
+		Prefix:    plain[:len(apiTokenPrefix)+6],
+		Hash:      hashAPIToken(plain),
+		Scopes:    payload.Scopes,
+		CreatedAt: now,
+	}
+	if payload.ExpiresInDays > 0 {
+		expiresAt := now.AddDate(0, 0, payload.ExpiresInDays)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := mongodb.InsertAPIToken(c.Request.Context(), token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create token"})
+		return
+	}
+
+	logging.FromGin(c).Info("API token created", "token_id", token.ID, "token_user_id", userID)
+	c.JSON(http.StatusCreated, gin.H{"token": plain, "api_token": token})
+}
+
+// ListAPITokens lists the tokens of the caller and of their bots, without the secrets
+func ListAPITokens(c *gin.Context) {
+	principal := sessionPrincipal(c)
+	if principal == nil {
+		return
+	}
+
+	userIDs, err := ownedUserIDs(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list tokens"})
+		return
+	}
+	tokens, err := mongodb.ListAPITokens(c.Request.Context(), userIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// RevokeAPIToken deletes a token of the caller or of one of their bots
+func RevokeAPIToken(c *gin.Context) {
+	principal := sessionPrincipal(c)
+	if principal == nil {
+		return
+	}
+
+	userIDs, err := ownedUserIDs(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not revoke token"})
+		return
+	}
+	deleted, err := mongodb.DeleteAPIToken(c.Request.Context(), c.Param("id"), userIDs)
+	if err != nil || !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Token not found"})
+		return
+	}
+
+	logging.FromGin(c).Info("API token revoked", "token_id", c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
+
+// CreateBot creates a bot account owned by the caller. Bots can't log in, they
+// act through the API tokens their owner creates for them.
+func CreateBot(c *gin.Context) {
+	principal := sessionPrincipal(c)
+	if principal == nil {
+		return
+	}
+
+	var payload struct {
+		Username string `json:"username"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	username := strings.ToLower(stripSpaces(payload.Username))
+	if username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "username is required", "fieldError": "username"})
+		return
+	}
+
+	bots, err := mongodb.FindBotsByOwner(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create bot"})
+		return
+	}
+	if len(bots) >= maxBotsPerOwner {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("You can own at most %d bots", maxBotsPerOwner)})
+		return
+	}
+	if existing, err := mongodb.FindUserByUsername(c.Request.Context(), username, false); err != nil || existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "username already exists", "fieldError": "username"})
+		return
+	}
+
+	// The password is random and never revealed, so password logins always fail
+	password, err := randomString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create bot"})
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create bot"})
+		return
+	}
+
+	bot := models.User{Username: username, Password: string(hashedPassword), Bot: true, BotOwner: principal.ID}
+	botID, err := mongodb.CreateUser(c.Request.Context(), bot)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create bot"})
+		return
+	}
+
+	logging.FromGin(c).Info("Bot created", "bot_id", botID)
+	c.JSON(http.StatusCreated, models.UserResponse{ID: botID, Username: username})
+}
+
+// ListBots lists the bots owned by the caller
+func ListBots(c *gin.Context) {
+	principal := sessionPrincipal(c)
+	if principal == nil {
+		return
+	}
+
+	bots, err := mongodb.FindBotsByOwner(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list bots"})
+		return
+	}
+	response := make([]models.UserResponse, 0, len(bots))
+	for _, bot := range bots {
+		response = append(response, models.UserResponse{ID: bot.ID, Username: bot.Username})
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllowsRoute(t *testing.T) {
+	session := &Principal{ID: "alice"}
+	reader := &Principal{ID: "alice", TokenID: "token-1", Scopes: []string{ScopeChatsRead}}
+	writer := &Principal{ID: "bot", TokenID: "token-2", Scopes: []string{ScopeMessagesWrite}, Bot: true}
+	unscoped := &Principal{ID: "alice", TokenID: "token-3"}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		method    string
+		route     string
+		want      bool
+	}{
+		{"session on any route", session, http.MethodPost, "/admin/users/:id/roles", true},
+		{"session on a token route", session, http.MethodGet, "/getChats", true},
+		{"read scope reads chats", reader, http.MethodGet, "/getChats", true},
+		{"read scope reads messages", reader, http.MethodGet, "/getMessageChat", true},
+		{"read scope can't post", reader, http.MethodPost, "/chats/:id/messages", false},
+		{"write scope posts", writer, http.MethodPost, "/chats/:id/messages", true},
+		{"write scope schedules", writer, http.MethodPost, "/chats/:id/scheduled", true},
+		{"write scope can't read", writer, http.MethodGet, "/getChats", false},
+		{"the method is part of the route", writer, http.MethodGet, "/chats/:id/messages", false},
+		{"routes are matched on their pattern", writer, http.MethodPost, "/chats/64b7f0c2a1b2c3d4e5f60718/messages", false},
+		{"token on a session route", reader, http.MethodPost, "/tokens", false},
+		{"token on an admin route", writer, http.MethodGet, "/admin/users", false},
+		{"token without scopes", unscoped, http.MethodGet, "/getChats", false},
+	}
+	for _, tt := range tests {
+		if got := tt.principal.AllowsRoute(tt.method, tt.route); got != tt.want {
+			t.Errorf("%s: AllowsRoute(%s %s) = %v, want %v", tt.name, tt.method, tt.route, got, tt.want)
+		}
+	}
+}
+
+func TestEveryTokenRouteHasAKnownScope(t *testing.T) {
+	for route, scope := range tokenRouteScopes {
+		if scope != ScopeChatsRead && scope != ScopeMessagesWrite {
+			t.Errorf("%s requires unknown scope %q", route, scope)
+		}
+		if method, _, _ := strings.Cut(route, " "); method != http.MethodGet && scope == ScopeChatsRead {
+			t.Errorf("%s changes data with a read scope", route)
+		}
+	}
+}
+
+func TestSessionPrincipalRefusesTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, tt := range []struct {
+		principal *Principal
+		allowed   bool
+	}{
+		{&Principal{ID: "alice", SessionID: "s1"}, true},
+		{&Principal{ID: "alice", TokenID: "token-1", Scopes: []string{ScopeChatsRead, ScopeMessagesWrite}}, false},
+		{nil, false},
+	} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		if tt.principal != nil {
+			c.Set(principalKey, tt.principal)
+		}
+		got := sessionPrincipal(c)
+		if (got != nil) != tt.allowed {
+			t.Errorf("sessionPrincipal(%+v) = %v, want allowed %v", tt.principal, got, tt.allowed)
+		}
+		if !tt.allowed && recorder.Code != http.StatusForbidden {
+			t.Errorf("refused with %d, want 403", recorder.Code)
+		}
+	}
+}
+
+func TestAPITokenFormat(t *testing.T) {
+	if !IsAPIToken("pat_abc") || IsAPIToken("eyJhbGciOiJSUzI1NiJ9.e30.sig") {
+		t.Error("API tokens are told apart from JWTs by their prefix")
+	}
+	token := "pat_0123456789abcdef"
+	hash := hashAPIToken(token)
+	if hash != hashAPIToken(token) || hash == hashAPIToken(token+"0") {
+		t.Error("the hash must identify the token")
+	}
+	if strings.Contains(hash, "0123456789abcdef") {
+		t.Error("the stored hash holds the token")
+	}
+}
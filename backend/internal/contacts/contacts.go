@@ -0,0 +1,330 @@
+package contacts
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/internal/privacy"
+	"backend/mongodb"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Frames sent to the sockets of the users concerned by a request
+const (
+	// FrameContactRequest tells the addressee about a new request
+	FrameContactRequest = "contact.request"
+	// FrameContactAccepted tells the requester their request was accepted
+	FrameContactAccepted = "contact.accepted"
+	// FrameContactRequestCancelled tells the addressee the requester withdrew a request
+	FrameContactRequestCancelled = "contact.request_cancelled"
+)
+
+// ContactFrame carries a request and the other user of it
+type ContactFrame struct {
+	Type      string               `json:"type"`
+	RequestID string               `json:"request_id"`
+	User      *models.UserResponse `json:"user"`
+}
+
+// contactView is an accepted contact as listed to one of its two users
+type contactView struct {
+	User   *models.UserResponse `json:"user"`
+	Online bool                 `json:"online"`
+	Since  time.Time            `json:"since"`
+}
+
+// requestView is a pending request as listed to one of its two users
+type requestView struct {
+	ID        string               `json:"id"`
+	User      *models.UserResponse `json:"user"`
+	CreatedAt time.Time            `json:"created_at"`
+}
+
+// otherID returns the user of a contact who isn't userID
+func otherID(contact *models.Contact, userID string) string {
+	if contact.RequesterID == userID {
+		return contact.AddresseeID
+	}
+	return contact.RequesterID
+}
+
+// usersByID loads the users of ids, users that no longer exist are shown by ID only
+func usersByID(ctx context.Context, ids []string) (map[string]*models.UserResponse, error) {
+	users, err := mongodb.GetUserByIds(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*models.UserResponse, len(ids))
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+	for _, id := range ids {
+		if byID[id] == nil {
+			byID[id] = &models.UserResponse{ID: id}
+		}
+	}
+	return byID, nil
+}
+
+// ListContacts lists the caller's contacts, newest first. online is only true when
+// the contact is connected to this instance and lets the caller see it.
+func ListContacts(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	contacts, err := mongodb.ListContacts(ctx, principal.ID, mongodb.ContactAccepted)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list contacts"})
+		return
+	}
+	ids := make([]string, 0, len(contacts))
+	for _, contact := range contacts {
+		ids = append(ids, otherID(contact, principal.ID))
+	}
+	users, err := usersByID(ctx, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list contacts"})
+		return
+	}
+	presence, err := privacy.NewPresenceFilter(ctx, append(ids, principal.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list contacts"})
+		return
+	}
+
+	views := make([]contactView, 0, len(contacts))
+	for i, contact := range contacts {
+		view := contactView{User: users[ids[i]], Online: messages.IsOnline(ids[i]) && presence.Visible(principal.ID, ids[i]), Since: contact.CreatedAt}
+		if contact.AcceptedAt != nil {
+			view.Since = *contact.AcceptedAt
+		}
+		views = append(views, view)
+	}
+	c.JSON(http.StatusOK, gin.H{"contacts": views})
+}
+
+// ListRequests lists the caller's pending requests, split into the ones they
+// received and the ones they sent
+func ListRequests(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	requests, err := mongodb.ListContacts(ctx, principal.ID, mongodb.ContactPending)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list contact requests"})
+		return
+	}
+	ids := make([]string, 0, len(requests))
+	for _, request := range requests {
+		ids = append(ids, otherID(request, principal.ID))
+	}
+	users, err := usersByID(ctx, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list contact requests"})
+		return
+	}
+
+	incoming, outgoing := []requestView{}, []requestView{}
+	for i, request := range requests {
+		view := requestView{ID: request.ID, User: users[ids[i]], CreatedAt: request.CreatedAt}
+		if request.AddresseeID == principal.ID {
+			incoming = append(incoming, view)
+		} else {
+			outgoing = append(outgoing, view)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"incoming": incoming, "outgoing": outgoing})
+}
+
+// SendRequest asks the user in the body's user_id to become a contact of the caller.
+// When that user already asked the caller, their request is accepted instead.
+func SendRequest(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		UserID string `json:"user_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	if payload.UserID == principal.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You can't add yourself as a contact", "fieldError": "user_id"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	addressee, err := mongodb.FindUserById(ctx, payload.UserID)
+	if err != nil || addressee == nil || addressee.Disabled || addressee.Placeholder {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if addressee.Bot || principal.Bot {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Bots can't have contacts", "fieldError": "user_id"})
+		return
+	}
+	blocks, err := mongodb.FindBlocksBetween(ctx, principal.ID, []string{addressee.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not send contact request"})
+		return
+	}
+	if len(blocks) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"message": "You can't send a contact request to this user"})
+		return
+	}
+
+	existing, err := mongodb.FindContactByPair(ctx, principal.ID, addressee.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not send contact request"})
+		return
+	}
+	switch {
+	case existing == nil:
+	case existing.Status == mongodb.ContactAccepted:
+		c.JSON(http.StatusOK, gin.H{"message": "Already a contact"})
+		return
+	case existing.RequesterID == principal.ID:
+		c.JSON(http.StatusOK, gin.H{"message": "Contact request already sent"})
+		return
+	default:
+		accept(c, principal, existing.ID)
+		return
+	}
+
+	request := &models.Contact{RequesterID: principal.ID, AddresseeID: addressee.ID, Status: mongodb.ContactPending, CreatedAt: time.Now()}
+	err = mongodb.InsertContactRequest(ctx, request)
+	if errors.Is(err, mongodb.ErrContactExists) {
+		c.JSON(http.StatusConflict, gin.H{"message": "A contact request between you already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not send contact request"})
+		return
+	}
+
+	messages.SendToUser(ctx, addressee.ID, ContactFrame{Type: FrameContactRequest, RequestID: request.ID,
+		User: &models.UserResponse{ID: principal.ID, Username: principal.Username}})
+	logging.FromGin(c).Info("Contact request sent", "request_id", request.ID, "addressee_id", addressee.ID)
+	c.JSON(http.StatusCreated, gin.H{"message": "Contact request sent",
+		"request": requestView{ID: request.ID, User: &models.UserResponse{ID: addressee.ID, Username: addressee.Username}, CreatedAt: request.CreatedAt}})
+}
+
+// AcceptRequest accepts the request :id sent to the caller
+func AcceptRequest(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+	accept(c, principal, c.Param("id"))
+}
+
+// accept turns a request sent to the principal into a contact and tells the requester
+func accept(c *gin.Context, principal *auth.Principal, requestID string) {
+	ctx := c.Request.Context()
+	contact, err := mongodb.AcceptContactRequest(ctx, requestID, principal.ID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not accept contact request"})
+		return
+	}
+	if contact == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Contact request not found"})
+		return
+	}
+
+	messages.SendToUser(ctx, contact.RequesterID, ContactFrame{Type: FrameContactAccepted, RequestID: contact.ID,
+		User: &models.UserResponse{ID: principal.ID, Username: principal.Username}})
+	logging.FromGin(c).Info("Contact request accepted", "request_id", contact.ID, "requester_id", contact.RequesterID)
+	c.JSON(http.StatusOK, gin.H{"message": "Contact request accepted"})
+}
+
+// DeclineRequest drops the request :id sent to the caller, the requester isn't told
+// and may ask again
+func DeclineRequest(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	request, err := mongodb.DeleteContactRequest(c.Request.Context(), c.Param("id"), principal.ID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not decline contact request"})
+		return
+	}
+	if request == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Contact request not found"})
+		return
+	}
+	logging.FromGin(c).Info("Contact request declined", "request_id", request.ID, "requester_id", request.RequesterID)
+	c.JSON(http.StatusOK, gin.H{"message": "Contact request declined"})
+}
+
+// CancelRequest withdraws the request :id sent by the caller
+func CancelRequest(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	request, err := mongodb.DeleteContactRequest(ctx, c.Param("id"), principal.ID, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not cancel contact request"})
+		return
+	}
+	if request == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Contact request not found"})
+		return
+	}
+
+	messages.SendToUser(ctx, request.AddresseeID, ContactFrame{Type: FrameContactRequestCancelled, RequestID: request.ID,
+		User: &models.UserResponse{ID: principal.ID, Username: principal.Username}})
+	logging.FromGin(c).Info("Contact request cancelled", "request_id", request.ID, "addressee_id", request.AddresseeID)
+	c.JSON(http.StatusOK, gin.H{"message": "Contact request cancelled"})
+}
+
+// RemoveContact removes the user :id from the caller's contacts, for both of them
+func RemoveContact(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	contact, err := mongodb.FindContactByPair(ctx, principal.ID, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not remove contact"})
+		return
+	}
+	if contact == nil || contact.Status != mongodb.ContactAccepted {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Contact not found"})
+		return
+	}
+	if _, err := mongodb.DeleteContact(ctx, principal.ID, c.Param("id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not remove contact"})
+		return
+	}
+	logging.FromGin(c).Info("Contact removed", "contact_id", c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "Contact removed"})
+}
@@ -0,0 +1,249 @@
+package directory
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/internal/privacy"
+	"backend/mongodb"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	minQueryLen       = 2
+	maxQueryLen       = 64
+	maxDisplayNameLen = 64
+	// maxCandidates bounds the users ranked as near matches of one query, exact names
+	// and prefixes are all listed
+	maxCandidates = 500
+)
+
+// entry is a user as listed by Search
+type entry struct {
+	models.UserResponse
+	Online bool `json:"online"`
+}
+
+// Search finds the users whose username, display name or a word of it starts with
+// q, or nearly does: a typo or two is forgiven past the first two characters. Exact
+// names come first, then prefixes, then the closest matches. Disabled users, bots
+// and the users blocked either way are left out. online is only true when the user
+// is connected to this instance and lets the caller see it.
+func Search(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	query := strings.ToLower(strings.Join(strings.Fields(c.Query("q")), " "))
+	if length := utf8.RuneCountInString(query); length < minQueryLen || length > maxQueryLen {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The search must be 2 to 64 characters long", "fieldError": "q"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > 50 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit value. Limit should be > 0 and <= 50."})
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid page value. Page should be > 0."})
+		return
+	}
+
+	ctx := c.Request.Context()
+	excluded, err := mongodb.FindBlockedUserIDs(ctx, principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not search users"})
+		return
+	}
+	excluded = append(excluded, principal.ID)
+	exactCount, prefixCount, err := mongodb.CountDirectoryMatches(ctx, query, excluded)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not search users"})
+		return
+	}
+
+	type match struct {
+		user  *models.User
+		score int
+	}
+	near := []match{}
+	if allowedTypos(query) > 0 {
+		// Typos in the first characters aren't forgiven so the candidates come from the index
+		candidates, err := mongodb.FindDirectoryCandidates(ctx, string([]rune(query)[:minQueryLen]), query, excluded, maxCandidates)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not search users"})
+			return
+		}
+		for _, user := range candidates {
+			if score, ok := matchScore(query, user.SearchNames); ok {
+				near = append(near, match{user: user, score: score})
+			}
+		}
+		sort.SliceStable(near, func(i, j int) bool { return near[i].score < near[j].score })
+	}
+
+	// The exact names, the prefixes and the near matches follow each other, only
+	// the part of each on the page is loaded
+	total := int(exactCount+prefixCount) + len(near)
+	start, end := (page-1)*limit, page*limit
+	users := []*models.User{}
+	offset := 0
+	for _, part := range []struct {
+		exact bool
+		count int
+	}{{true, int(exactCount)}, {false, int(prefixCount)}} {
+		if from, to := max(start, offset), min(end, offset+part.count); from < to {
+			found, err := mongodb.FindDirectoryMatches(ctx, query, part.exact, excluded, int64(from-offset), int64(to-from))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not search users"})
+				return
+			}
+			users = append(users, found...)
+		}
+		offset += part.count
+	}
+	for i, m := range near {
+		if offset+i >= start && offset+i < end {
+			users = append(users, m.user)
+		}
+	}
+
+	ids := make([]string, 0, len(users)+1)
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	presence, err := privacy.NewPresenceFilter(ctx, append(ids, principal.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not search users"})
+		return
+	}
+
+	entries := make([]entry, 0, len(users))
+	for _, user := range users {
+		entries = append(entries, entry{
+			UserResponse: models.UserResponse{ID: user.ID, Username: user.Username, DisplayName: user.DisplayName},
+			Online:       messages.IsOnline(user.ID) && presence.Visible(principal.ID, user.ID),
+		})
+	}
+	totalPages := (total + limit - 1) / limit
+	c.JSON(http.StatusOK, gin.H{"users": entries, "total": total, "total_pages": totalPages})
+}
+
+// matchScore ranks how well the best of names matches query: 0 for an exact name,
+// 1 for a prefix and 1 plus the number of typos for a near prefix
+func matchScore(query string, names []string) (int, bool) {
+	q := []rune(query)
+	typos := allowedTypos(query)
+
+	best, found := 0, false
+	for _, name := range names {
+		score := -1
+		switch {
+		case name == query:
+			score = 0
+		case strings.HasPrefix(name, query):
+			score = 1
+		case typos > 0:
+			// Compare with the start of the name, one character shorter or longer
+			// than the query to allow for a missing or extra character
+			n := []rune(name)
+			for length := len(q) - 1; length <= len(q)+1; length++ {
+				if length > len(n) {
+					break
+				}
+				if d := distance(q, n[:length]); d <= typos && (score < 0 || 1+d < score) {
+					score = 1 + d
+				}
+			}
+		}
+		if score >= 0 && (!found || score < best) {
+			best, found = score, true
+		}
+	}
+	return best, found
+}
+
+// allowedTypos is how many typos a near match of query may have
+func allowedTypos(query string) int {
+	switch length := utf8.RuneCountInString(query); {
+	case length >= 8:
+		return 2
+	case length >= 4:
+		return 1
+	}
+	return 0
+}
+
+// distance is the edit distance between a and b, counting two swapped
+// neighbouring characters as a single edit
+func distance(a []rune, b []rune) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(a)][len(b)]
+}
+
+// UpdateProfile changes the caller's display_name, an empty name removes it
+func UpdateProfile(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		DisplayName *string `json:"display_name"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.DisplayName == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	displayName := strings.Join(strings.Fields(*payload.DisplayName), " ")
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLen {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The display name can be at most 64 characters", "fieldError": "display_name"})
+		return
+	}
+
+	user, err := mongodb.FindUserById(c.Request.Context(), principal.ID)
+	if err != nil || user == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update profile"})
+		return
+	}
+	if user.Bot {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Bots have no display name"})
+		return
+	}
+	if err := mongodb.SetDisplayName(c.Request.Context(), user, displayName); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update profile"})
+		return
+	}
+	logging.FromGin(c).Info("Display name updated")
+	c.JSON(http.StatusOK, models.UserResponse{ID: user.ID, Username: user.Username, DisplayName: displayName})
+}
@@ -0,0 +1,68 @@
+package directory
+
+import "testing"
+
+func TestAllowedTypos(t *testing.T) {
+	tests := map[string]int{"": 0, "bob": 0, "anna": 1, "charlie": 1, "jonathan": 2, "élodie": 1, "åsa": 0}
+	for query, want := range tests {
+		if got := allowedTypos(query); got != want {
+			t.Errorf("allowedTypos(%q) = %d, want %d", query, got, want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"alice", "alice", 0},
+		{"alice", "alica", 1},
+		{"alice", "alce", 1},
+		{"alice", "allice", 1},
+		// Two swapped neighbours are one typo
+		{"alice", "laice", 1},
+		{"jonathan", "jonahtan", 1},
+		{"alice", "bob", 5},
+		{"zoë", "zoe", 1},
+	}
+	for _, tt := range tests {
+		if got := distance([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("distance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := distance([]rune(tt.b), []rune(tt.a)); got != tt.want {
+			t.Errorf("distance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		names []string
+		score int
+		found bool
+	}{
+		{"exact", "alice", []string{"alice"}, 0, true},
+		{"prefix", "ali", []string{"alice"}, 1, true},
+		{"one typo", "alcie", []string{"alice"}, 2, true},
+		{"missing character", "alce", []string{"alice"}, 2, true},
+		{"typo in a prefix", "alcie", []string{"alicelle"}, 2, true},
+		{"two typos are too many for a short query", "aelcy", []string{"alice"}, 0, false},
+		{"two typos in a long query", "jontahen", []string{"jonathan"}, 3, true},
+		{"no typos below four characters", "bbo", []string{"bob"}, 0, false},
+		{"best of the names", "alice", []string{"alcie", "alice.smith"}, 1, true},
+		{"exact beats prefix", "alice", []string{"alice.smith", "alice"}, 0, true},
+		{"no match", "alice", []string{"bob", "charlie"}, 0, false},
+		{"no names", "alice", nil, 0, false},
+	}
+	for _, tt := range tests {
+		score, found := matchScore(tt.query, tt.names)
+		if found != tt.found || (found && score != tt.score) {
+			t.Errorf("%s: matchScore(%q, %q) = %d, %v, want %d, %v", tt.name, tt.query, tt.names, score, found, tt.score, tt.found)
+		}
+	}
+}
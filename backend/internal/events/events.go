@@ -0,0 +1,71 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	MessageNew      = "message.new"
+	MessagesExpired = "messages.expired"
+	MessageDeleted  = "message.deleted"
+	ChatCreated     = "chat.created"
+	ChatMemberAdded = "chat.member_added"
+	PresenceOnline  = "presence.online"
+	PresenceOffline = "presence.offline"
+)
+
+// Event is something that happened in a chat (or to a user, when ChatID is empty)
+type Event struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	ChatID     string      `json:"chat_id,omitempty"`
+	ActorID    string      `json:"actor_id,omitempty"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// Handler receives published events
+type Handler func(ctx context.Context, event Event)
+
+var (
+	handlersMu sync.RWMutex
+	handlers   []Handler
+)
+
+// Subscribe registers a handler for every event published from now on
+func Subscribe(handler Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers = append(handlers, handler)
+}
+
+// Publish hands the event to every subscriber in the background, so that
+// a slow subscriber never delays the chat itself
+func Publish(ctx context.Context, event Event) {
+	if event.ID == "" {
+		event.ID = newID()
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+
+	// Subscribers outlive the request that published the event
+	ctx = context.WithoutCancel(ctx)
+
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	for _, handler := range handlers {
+		go handler(ctx, event)
+	}
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,212 @@
+package export
+
+import (
+	"archive/zip"
+	"backend/internal/auth"
+	"backend/internal/models"
+	"backend/mongodb"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accountReadme is the first file of an account archive
+const accountReadme = `This archive holds the data stored about your account:
+
+  profile.json             your account details
+  chats.json               the chats you are a member of
+  messages.jsonl           every message you sent, one JSON object per line
+  api_tokens.json          your personal access tokens (names and scopes, never the tokens)
+  bots.json                the bot accounts you own
+  webhooks.json            the outgoing webhooks you created
+  incoming_webhooks.json   the incoming webhooks you created
+  scheduled_messages.json  your scheduled messages
+  blocked_users.json       the users you blocked
+  contacts.json            your contacts and pending contact requests
+  reports.json             the reports you sent to the moderators
+
+Sign-ins use self-contained tokens, so no list of sessions is kept on the server.
+`
+
+// accountProfile is the profile part of an account archive. Secrets such as the
+// password hash and the two-factor secret are left out.
+type accountProfile struct {
+	ID                  string                 `json:"id"`
+	Username            string                 `json:"username"`
+	DisplayName         string                 `json:"display_name,omitempty"`
+	Email               string                 `json:"email"`
+	Roles               []string               `json:"roles,omitempty"`
+	MFAEnabled          bool                   `json:"mfa_enabled"`
+	OIDCIdentities      []models.OIDCIdentity  `json:"oidc_identities,omitempty"`
+	Privacy             models.PrivacySettings `json:"privacy"`
+	DeletionScheduledAt *time.Time             `json:"deletion_scheduled_at,omitempty"`
+}
+
+func newAccountProfile(user *models.User) accountProfile {
+	return accountProfile{
+		ID:                  user.ID,
+		Username:            user.Username,
+		DisplayName:         user.DisplayName,
+		Email:               user.Email,
+		Roles:               user.Roles,
+		MFAEnabled:          user.MFAEnabled,
+		OIDCIdentities:      user.OIDCIdentities,
+		Privacy:             user.Privacy,
+		DeletionScheduledAt: user.DeletionScheduledAt,
+	}
+}
+
+// accountMessage is one line of messages.jsonl
+type accountMessage struct {
+	ID          string                     `json:"id"`
+	ChatID      string                     `json:"chat_id"`
+	SentAt      time.Time                  `json:"sent_at"`
+	Type        string                     `json:"type"`
+	Content     string                     `json:"content"`
+	Attachments []models.MessageAttachment `json:"attachments,omitempty"`
+}
+
+// buildAccountExport writes the zip of everything stored about job.UserID
+func buildAccountExport(ctx context.Context, job *models.ExportJob, w io.Writer) (string, error) {
+	user, err := mongodb.FindUserById(ctx, job.UserID)
+	if err != nil || user == nil {
+		return "", fmt.Errorf("user not available: %v", err)
+	}
+	archive := zip.NewWriter(w)
+
+	readme, err := archive.Create("README.txt")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(readme, accountReadme); err != nil {
+		return "", err
+	}
+
+	if err := writeJSONFile(archive, "profile.json", newAccountProfile(user)); err != nil {
+		return "", err
+	}
+
+	chats, err := mongodb.FindChatsOfUser(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := writeJSONFile(archive, "chats.json", chats); err != nil {
+		return "", err
+	}
+
+	messagesFile, err := archive.Create("messages.jsonl")
+	if err != nil {
+		return "", err
+	}
+	encoder := json.NewEncoder(messagesFile)
+	err = mongodb.StreamMessagesBySender(ctx, user.ID, func(message *models.Message) error {
+		messageType := "message"
+		if message.Type != nil {
+			messageType = *message.Type
+		}
+		return encoder.Encode(accountMessage{
+			ID:          message.ID,
+			ChatID:      message.ChatID,
+			SentAt:      message.SentAt,
+			Type:        messageType,
+			Content:     message.Content,
+			Attachments: message.Attachments,
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	tokens, err := mongodb.ListAPITokens(ctx, []string{user.ID})
+	if err != nil {
+		return "", err
+	}
+	bots, err := mongodb.FindBotsByOwner(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+	botList := make([]models.UserResponse, 0, len(bots))
+	for _, bot := range bots {
+		botList = append(botList, models.UserResponse{ID: bot.ID, Username: bot.Username})
+	}
+	webhooks, err := mongodb.ListWebhooks(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+	incomingWebhooks, err := mongodb.ListIncomingWebhooksCreatedBy(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+	scheduled, err := mongodb.ListScheduledMessages(ctx, user.ID, "", "")
+	if err != nil {
+		return "", err
+	}
+	blocks, err := mongodb.ListBlocks(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+	contacts, err := mongodb.ListContacts(ctx, user.ID, mongodb.ContactAccepted)
+	if err != nil {
+		return "", err
+	}
+	requests, err := mongodb.ListContacts(ctx, user.ID, mongodb.ContactPending)
+	if err != nil {
+		return "", err
+	}
+	reports, err := mongodb.ListReportsByReporter(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	files := []struct {
+		name  string
+		value interface{}
+	}{
+		{"api_tokens.json", tokens},
+		{"bots.json", botList},
+		{"webhooks.json", webhooks},
+		{"incoming_webhooks.json", incomingWebhooks},
+		{"scheduled_messages.json", scheduled},
+		{"blocked_users.json", blocks},
+		{"contacts.json", append(contacts, requests...)},
+		{"reports.json", reports},
+	}
+	for _, file := range files {
+		if err := writeJSONFile(archive, file.name, file.value); err != nil {
+			return "", err
+		}
+	}
+
+	return "account-" + user.ID + ".zip", archive.Close()
+}
+
+func writeJSONFile(archive *zip.Writer, name string, value interface{}) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// ExportAccount starts building the archive of everything stored about the caller.
+// It always runs in the background; the job is polled under /exports/:id.
+func ExportAccount(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	job := &models.ExportJob{Kind: KindAccount, UserID: principal.ID, Format: "zip", Zip: true}
+	if !queueJob(c, job) {
+		return
+	}
+	c.JSON(http.StatusAccepted, exportResponse(job))
+}
@@ -0,0 +1,38 @@
+package export
+
+import (
+	"backend/internal/models"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAccountProfileLeavesSecretsOut(t *testing.T) {
+	user := &models.User{
+		ID:               "u1",
+		Username:         "alice",
+		Email:            "alice@example.com",
+		Password:         "$2a$10$hash",
+		MFAEnabled:       true,
+		MFASecret:        "JBSWY3DPEHPK3PXP",
+		MFAPendingSecret: "KRSXG5CTMVRXEZLU",
+		MFARecoveryCodes: []string{"recovery-code"},
+		Privacy:          models.PrivacySettings{AllowMessagesFrom: "contacts"},
+	}
+	raw, err := json.Marshal(newAccountProfile(user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := string(raw)
+
+	for _, want := range []string{`"username":"alice"`, `"email":"alice@example.com"`, `"mfa_enabled":true`, `"allow_messages_from":"contacts"`} {
+		if !strings.Contains(profile, want) {
+			t.Errorf("profile lacks %s: %s", want, profile)
+		}
+	}
+	for _, secret := range []string{user.Password, user.MFASecret, user.MFAPendingSecret, "recovery-code"} {
+		if strings.Contains(profile, secret) {
+			t.Errorf("profile holds the secret %s: %s", secret, profile)
+		}
+	}
+}
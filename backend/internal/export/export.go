@@ -0,0 +1,226 @@
+package export
+
+import (
+	"backend/internal/logging"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/internal/tracing"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Kinds of export job
+const (
+	KindChat    = "chat"
+	KindAccount = "account"
+)
+
+// FrameExportReady tells the owner of a job that its archive can be downloaded
+const FrameExportReady = "export.ready"
+
+// ExportReadyFrame is sent to the owner's sockets when a job finishes
+type ExportReadyFrame struct {
+	Type        string `json:"type"`
+	ExportID    string `json:"export_id"`
+	Status      string `json:"status"`
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// Export settings, see Init for the environment overrides
+var (
+	// Chats with more messages are exported in the background
+	syncLimit int64 = 5000
+	// How long a finished archive can be downloaded
+	retention = 7 * 24 * time.Hour
+	// Pending or running jobs one user may have
+	maxActiveJobs int64 = 3
+
+	pollInterval = 5 * time.Second
+	// A job running this long was interrupted by a crash and is queued again
+	staleAfter = time.Hour
+)
+
+// builder writes the archive of a job and returns its file name
+type builder func(ctx context.Context, job *models.ExportJob, w io.Writer) (string, error)
+
+var builders = map[string]builder{
+	KindChat:    buildChatExport,
+	KindAccount: buildAccountExport,
+}
+
+var (
+	stop = make(chan struct{})
+	wg   sync.WaitGroup
+)
+
+// Init applies the environment overrides and starts the export worker
+//   - EXPORT_SYNC_LIMIT: message count above which chat exports run in the background
+//   - EXPORT_RETENTION: how long finished archives are kept
+func Init() {
+	syncLimit = int64(utils.GetEnvInt("EXPORT_SYNC_LIMIT", int(syncLimit)))
+	retention = utils.GetEnvDuration("EXPORT_RETENTION", retention)
+
+	wg.Add(1)
+	go worker()
+}
+
+// Shutdown stops the worker, waiting for the job in progress until ctx expires.
+// An interrupted job is picked up again by another instance.
+func Shutdown(ctx context.Context) error {
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func worker() {
+	defer wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		ctx := context.Background()
+		now := time.Now()
+		if removed, err := mongodb.DeleteExpiredExportJobs(ctx, now); err != nil {
+			slog.Warn("Could not remove expired exports", logging.Err(err))
+		} else if removed > 0 {
+			slog.Info("Removed expired exports", "count", removed)
+		}
+		if requeued, err := mongodb.RequeueStaleExportJobs(ctx, now.Add(-staleAfter)); err != nil {
+			slog.Warn("Could not requeue interrupted exports", logging.Err(err))
+		} else if requeued > 0 {
+			slog.Warn("Requeued interrupted exports", "count", requeued)
+		}
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			job, err := mongodb.ClaimExportJob(ctx, time.Now())
+			if err != nil {
+				slog.Warn("Could not claim export job", logging.Err(err))
+				break
+			}
+			if job == nil {
+				break
+			}
+			run(job)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run builds the archive of a claimed job into GridFS and records the outcome
+func run(job *models.ExportJob) {
+	ctx, span := tracing.Tracer().Start(context.Background(), "export.run")
+	defer span.End()
+	span.SetAttributes(attribute.String("export.id", job.ID), attribute.String("export.kind", job.Kind))
+	logger := slog.With("export_id", job.ID, "kind", job.Kind)
+	ctx = logging.WithContext(ctx, logger)
+
+	job.Status = mongodb.ExportFailed
+	if err := build(ctx, job); err != nil {
+		tracing.RecordError(span, err)
+		logger.Error("Export failed", logging.Err(err))
+		job.Error = "export failed"
+	} else {
+		job.Status = mongodb.ExportReady
+		logger.Info("Export ready", "bytes", job.Size)
+	}
+
+	now := time.Now()
+	job.ExpiresAt = now.Add(retention)
+	if err := mongodb.CompleteExportJob(ctx, job, now); err != nil {
+		logger.Error("Could not record export outcome", logging.Err(err))
+		return
+	}
+
+	frame := ExportReadyFrame{Type: FrameExportReady, ExportID: job.ID, Status: job.Status}
+	if job.Status == mongodb.ExportReady {
+		frame.DownloadURL = downloadURL(job)
+	}
+	messages.SendToUser(ctx, job.UserID, frame)
+}
+
+func build(ctx context.Context, job *models.ExportJob) error {
+	builder, ok := builders[job.Kind]
+	if !ok {
+		return fmt.Errorf("unknown export kind %q", job.Kind)
+	}
+
+	upload, fileID, err := mongodb.CreateExportFile(ctx, job.Kind+"-"+job.ID)
+	if err != nil {
+		return err
+	}
+	counter := &countingWriter{w: upload}
+	fileName, err := builder(ctx, job, counter)
+	if err != nil {
+		_ = upload.Abort()
+		return err
+	}
+	if err := upload.Close(); err != nil {
+		return fmt.Errorf("could not store export: %v", err)
+	}
+
+	job.FileID = fileID
+	job.FileName = fileName
+	job.Size = counter.n
+	return nil
+}
+
+func downloadURL(job *models.ExportJob) string {
+	return "/exports/" + job.ID + "/download"
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// buildChatExport writes the transcript of job.ChatID, zipped when asked
+func buildChatExport(ctx context.Context, job *models.ExportJob, w io.Writer) (string, error) {
+	chat, err := mongodb.FindUserChat(ctx, job.ChatID, job.UserID)
+	if err != nil {
+		return "", fmt.Errorf("chat not available: %v", err)
+	}
+	if job.Zip {
+		return chatFileName(chat, "zip"), writeArchive(ctx, w, chat, job.UserID, job.Format)
+	}
+	return chatFileName(chat, job.Format), writeTranscript(ctx, w, chat, job.UserID, job.Format)
+}
+
+func chatFileName(chat *models.Chat, extension string) string {
+	return "chat-" + chat.ID + "." + extension
+}
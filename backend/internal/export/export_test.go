@@ -0,0 +1,20 @@
+package export
+
+import (
+	"backend/internal/models"
+	"backend/mongodb"
+	"testing"
+)
+
+func TestExportResponseLinksFinishedJobsOnly(t *testing.T) {
+	for _, status := range []string{mongodb.ExportPending, mongodb.ExportRunning, mongodb.ExportFailed, mongodb.ExportReady} {
+		response := exportResponse(&models.ExportJob{ID: "job1", Status: status})
+		url, linked := response["download_url"]
+		if linked != (status == mongodb.ExportReady) {
+			t.Errorf("%s job linked: %v", status, linked)
+		}
+		if linked && url != "/exports/job1/download" {
+			t.Errorf("download_url = %v", url)
+		}
+	}
+}
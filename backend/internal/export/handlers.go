@@ -0,0 +1,188 @@
+package export
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/mongodb"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// transferTimeout replaces the server's write timeout for export downloads
+const transferTimeout = 30 * time.Minute
+
+// extendWriteDeadline lets a long download outlive the server's WriteTimeout
+func extendWriteDeadline(c *gin.Context) {
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(transferTimeout)); err != nil {
+		logging.FromGin(c).Debug("Could not extend write deadline", logging.Err(err))
+	}
+}
+
+// ownExportJob loads the job named by :id if the caller requested it, answering 404 otherwise
+func ownExportJob(c *gin.Context) *models.ExportJob {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return nil
+	}
+	job, err := mongodb.FindExportJobById(c.Request.Context(), c.Param("id"))
+	if err != nil || job == nil || job.UserID != principal.ID {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Export not found"})
+		return nil
+	}
+	return job
+}
+
+// exportResponse adds the download link of a finished job
+func exportResponse(job *models.ExportJob) gin.H {
+	response := gin.H{"export": job}
+	if job.Status == mongodb.ExportReady {
+		response["download_url"] = downloadURL(job)
+	}
+	return response
+}
+
+// queueJob stores a pending job for the worker, answering 429 when the user already
+// has too many in progress
+func queueJob(c *gin.Context, job *models.ExportJob) bool {
+	active, err := mongodb.CountActiveExportJobs(c.Request.Context(), job.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not start export"})
+		return false
+	}
+	if active >= maxActiveJobs {
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": fmt.Sprintf("You can have at most %d exports in progress", maxActiveJobs)})
+		return false
+	}
+
+	now := time.Now()
+	job.Status = mongodb.ExportPending
+	job.CreatedAt = now
+	// Until the job finishes, expiry only bounds how long a forgotten job is kept
+	job.ExpiresAt = now.Add(retention)
+	if err := mongodb.InsertExportJob(c.Request.Context(), job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not start export"})
+		return false
+	}
+	logging.FromGin(c).Info("Export queued", "export_id", job.ID, "kind", job.Kind)
+	return true
+}
+
+// ExportChat exports the whole history of the chat :id.
+// Query: format=jsonl|html|txt (default jsonl), zip=true to add the attachments list
+// in a zip, async=true to always run in the background. Small chats are streamed in
+// the response; larger ones answer 202 with a job to poll under /exports/:id.
+func ExportChat(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	format := c.DefaultQuery("format", FormatJSONL)
+	contentType, ok := formatContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "format must be jsonl, html or txt"})
+		return
+	}
+	zipped := c.Query("zip") == "true"
+
+	ctx := c.Request.Context()
+	chat, err := mongodb.FindUserChat(ctx, c.Param("id"), principal.ID)
+	if err != nil || chat == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Chat not found"})
+		return
+	}
+	count, err := mongodb.CountChatMessages(ctx, chat.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not export chat"})
+		return
+	}
+
+	if c.Query("async") == "true" || count > syncLimit {
+		job := &models.ExportJob{Kind: KindChat, UserID: principal.ID, ChatID: chat.ID, Format: format, Zip: zipped}
+		if !queueJob(c, job) {
+			return
+		}
+		c.JSON(http.StatusAccepted, exportResponse(job))
+		return
+	}
+
+	fileName := chatFileName(chat, format)
+	if zipped {
+		fileName, contentType = chatFileName(chat, "zip"), "application/zip"
+	}
+	extendWriteDeadline(c)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+fileName+`"`)
+	c.Status(http.StatusOK)
+
+	// Headers are sent by now, a failure can only cut the download short
+	if zipped {
+		err = writeArchive(ctx, c.Writer, chat, principal.ID, format)
+	} else {
+		err = writeTranscript(ctx, c.Writer, chat, principal.ID, format)
+	}
+	if err != nil {
+		logging.FromGin(c).Error("Chat export interrupted", logging.KeyChatID, chat.ID, logging.Err(err))
+	}
+}
+
+// ListExports lists the caller's export jobs
+func ListExports(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	jobs, err := mongodb.ListExportJobs(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list exports"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"exports": jobs})
+}
+
+// GetExport reports the status of an export job
+func GetExport(c *gin.Context) {
+	job := ownExportJob(c)
+	if job == nil {
+		return
+	}
+	c.JSON(http.StatusOK, exportResponse(job))
+}
+
+// DownloadExport streams the archive of a finished export job
+func DownloadExport(c *gin.Context) {
+	job := ownExportJob(c)
+	if job == nil {
+		return
+	}
+	if job.Status != mongodb.ExportReady {
+		c.JSON(http.StatusConflict, gin.H{"message": "The export is not ready", "status": job.Status})
+		return
+	}
+
+	file, size, err := mongodb.OpenExportFile(c.Request.Context(), job.FileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Export not found"})
+		return
+	}
+	defer file.Close()
+
+	extendWriteDeadline(c)
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", `attachment; filename="`+job.FileName+`"`)
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, file); err != nil {
+		logging.FromGin(c).Warn("Export download interrupted", "export_id", job.ID, logging.Err(err))
+	}
+}
@@ -0,0 +1,239 @@
+package export
+
+import (
+	"archive/zip"
+	"backend/internal/models"
+	"backend/mongodb"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+)
+
+// Transcript formats
+const (
+	FormatJSONL = "jsonl"
+	FormatHTML  = "html"
+	FormatText  = "txt"
+)
+
+var formatContentTypes = map[string]string{
+	FormatJSONL: "application/x-ndjson",
+	FormatHTML:  "text/html; charset=utf-8",
+	FormatText:  "text/plain; charset=utf-8",
+}
+
+// transcriptMessage is one line of a JSON lines export
+type transcriptMessage struct {
+	ID          string                     `json:"id"`
+	SentAt      time.Time                  `json:"sent_at"`
+	SenderID    string                     `json:"sender_id"`
+	Sender      string                     `json:"sender"`
+	Type        string                     `json:"type"`
+	Content     string                     `json:"content"`
+	Attachments []models.MessageAttachment `json:"attachments,omitempty"`
+}
+
+// senderNames resolves user IDs to usernames, loading the users it hasn't seen yet
+type senderNames struct {
+	names map[string]string
+}
+
+func newSenderNames(ctx context.Context, userIDs []string) (*senderNames, error) {
+	names := &senderNames{names: map[string]string{}}
+	if err := names.load(ctx, userIDs); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (n *senderNames) load(ctx context.Context, userIDs []string) error {
+	users, err := mongodb.GetUserByIds(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		n.names[userID] = "unknown user"
+	}
+	for _, user := range users {
+		n.names[user.ID] = user.Username
+	}
+	return nil
+}
+
+// of names the author of a message, webhook posts show the name they were posted with
+func (n *senderNames) of(ctx context.Context, message *models.Message) (string, error) {
+	if message.DisplayName != "" {
+		return message.DisplayName, nil
+	}
+	if name, ok := n.names[message.Sender]; ok {
+		return name, nil
+	}
+	// Former members are looked up one at a time as they appear
+	if err := n.load(ctx, []string{message.Sender}); err != nil {
+		return "", err
+	}
+	return n.names[message.Sender], nil
+}
+
+// writeTranscript writes the history of a chat as seen by userID in one of the
+// transcript formats
+func writeTranscript(ctx context.Context, w io.Writer, chat *models.Chat, userID string, format string) error {
+	names, err := newSenderNames(ctx, chat.Users)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(w)
+
+	if format == FormatHTML {
+		members := make([]string, 0, len(chat.Users))
+		for _, userID := range chat.Users {
+			members = append(members, names.names[userID])
+		}
+		title := "Chat with " + strings.Join(members, ", ")
+		fmt.Fprintf(buffered, htmlHeader, html.EscapeString(title), html.EscapeString(title), html.EscapeString(chat.Topic), time.Now().UTC().Format(time.RFC1123))
+	}
+
+	err = mongodb.StreamChatMessages(ctx, chat.ID, chat.HistoryStart(userID), false, func(message *models.Message) error {
+		sender, err := names.of(ctx, message)
+		if err != nil {
+			return err
+		}
+		messageType := "message"
+		if message.Type != nil {
+			messageType = *message.Type
+		}
+
+		switch format {
+		case FormatJSONL:
+			line, err := json.Marshal(transcriptMessage{
+				ID:          message.ID,
+				SentAt:      message.SentAt,
+				SenderID:    message.Sender,
+				Sender:      sender,
+				Type:        messageType,
+				Content:     message.Content,
+				Attachments: message.Attachments,
+			})
+			if err != nil {
+				return err
+			}
+			buffered.Write(line)
+			buffered.WriteByte('\n')
+		case FormatHTML:
+			writeHTMLMessage(buffered, message, sender, messageType)
+		default:
+			writeTextMessage(buffered, message, sender, messageType)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if format == FormatHTML {
+		buffered.WriteString(htmlFooter)
+	}
+	return buffered.Flush()
+}
+
+func writeTextMessage(w *bufio.Writer, message *models.Message, sender string, messageType string) {
+	timestamp := message.SentAt.UTC().Format("2006-01-02 15:04:05")
+	switch messageType {
+	case "me":
+		fmt.Fprintf(w, "[%s] * %s %s\n", timestamp, sender, message.Content)
+	case "topic":
+		fmt.Fprintf(w, "[%s] %s set the topic: %s\n", timestamp, sender, message.Content)
+	default:
+		fmt.Fprintf(w, "[%s] %s: %s\n", timestamp, sender, message.Content)
+	}
+	for _, attachment := range message.Attachments {
+		fmt.Fprintf(w, "    [attachment] %s %s %s\n", attachment.Title, attachment.TitleLink, attachment.Text)
+	}
+}
+
+func writeHTMLMessage(w *bufio.Writer, message *models.Message, sender string, messageType string) {
+	fmt.Fprintf(w, `<div class="message %s"><span class="time">%s</span> <span class="sender">%s</span> <span class="content">%s</span>`,
+		html.EscapeString(messageType),
+		message.SentAt.UTC().Format("2006-01-02 15:04"),
+		html.EscapeString(sender),
+		strings.ReplaceAll(html.EscapeString(message.Content), "\n", "<br>"))
+	for _, attachment := range message.Attachments {
+		w.WriteString(`<div class="attachment">`)
+		title := html.EscapeString(attachment.Title)
+		if isWebLink(attachment.TitleLink) {
+			title = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(attachment.TitleLink), title)
+		}
+		fmt.Fprintf(w, "<strong>%s</strong> %s", title, html.EscapeString(attachment.Text))
+		// Images stay links, the file must open without network access
+		if isWebLink(attachment.ImageURL) {
+			fmt.Fprintf(w, ` <a href="%s">[image]</a>`, html.EscapeString(attachment.ImageURL))
+		}
+		w.WriteString("</div>")
+	}
+	w.WriteString("</div>\n")
+}
+
+func isWebLink(link string) bool {
+	return strings.HasPrefix(link, "https://") || strings.HasPrefix(link, "http://")
+}
+
+// writeArchive writes a zip holding the transcript and attachments.jsonl, the
+// attachments of every message. Attachments are links to external content, they
+// are listed rather than downloaded.
+func writeArchive(ctx context.Context, w io.Writer, chat *models.Chat, userID string, format string) error {
+	archive := zip.NewWriter(w)
+
+	transcript, err := archive.Create("chat-" + chat.ID + "." + format)
+	if err != nil {
+		return err
+	}
+	if err := writeTranscript(ctx, transcript, chat, userID, format); err != nil {
+		return err
+	}
+
+	attachments, err := archive.Create("attachments.jsonl")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(attachments)
+	err = mongodb.StreamChatMessages(ctx, chat.ID, chat.HistoryStart(userID), true, func(message *models.Message) error {
+		return encoder.Encode(struct {
+			MessageID   string                     `json:"message_id"`
+			SentAt      time.Time                  `json:"sent_at"`
+			Attachments []models.MessageAttachment `json:"attachments"`
+		}{message.ID, message.SentAt, message.Attachments})
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+const htmlHeader = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; color: #222; }
+.message { padding: .25rem 0; border-bottom: 1px solid #eee; }
+.time { color: #888; font-size: .8rem; }
+.sender { font-weight: bold; }
+.me .content, .topic .content { font-style: italic; }
+.attachment { margin: .25rem 0 .25rem 1.5rem; padding-left: .5rem; border-left: 3px solid #ccc; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<p>%s</p>
+<p><small>Exported %s</small></p>
+`
+
+const htmlFooter = `</body>
+</html>
+`
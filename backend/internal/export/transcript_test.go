@@ -0,0 +1,101 @@
+package export
+
+import (
+	"backend/internal/models"
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+var sentAt = time.Date(2024, 3, 12, 9, 15, 30, 0, time.FixedZone("CET", 3600))
+
+func render(write func(w *bufio.Writer)) string {
+	var out strings.Builder
+	buffered := bufio.NewWriter(&out)
+	write(buffered)
+	buffered.Flush()
+	return out.String()
+}
+
+func TestWriteTextMessage(t *testing.T) {
+	tests := []struct {
+		messageType string
+		content     string
+		want        string
+	}{
+		{"message", "hello", "[2024-03-12 08:15:30] alice: hello\n"},
+		{"me", "waves", "[2024-03-12 08:15:30] * alice waves\n"},
+		{"topic", "Plans", "[2024-03-12 08:15:30] alice set the topic: Plans\n"},
+	}
+	for _, tt := range tests {
+		message := &models.Message{Content: tt.content, SentAt: sentAt}
+		if got := render(func(w *bufio.Writer) { writeTextMessage(w, message, "alice", tt.messageType) }); got != tt.want {
+			t.Errorf("%s message written as %q, want %q", tt.messageType, got, tt.want)
+		}
+	}
+
+	message := &models.Message{Content: "see", SentAt: sentAt, Attachments: []models.MessageAttachment{{Title: "Report", TitleLink: "https://example.com/r", Text: "Q1"}}}
+	got := render(func(w *bufio.Writer) { writeTextMessage(w, message, "alice", "message") })
+	if !strings.HasSuffix(got, "    [attachment] Report https://example.com/r Q1\n") {
+		t.Errorf("attachment written as %q", got)
+	}
+}
+
+func TestWriteHTMLMessageEscapes(t *testing.T) {
+	message := &models.Message{
+		Content: "<script>alert(1)</script>\nbye",
+		SentAt:  sentAt,
+		Attachments: []models.MessageAttachment{
+			{Title: "safe", TitleLink: "https://example.com/a?x=1&y=2", ImageURL: "http://example.com/i.png"},
+			{Title: "<b>unsafe</b>", TitleLink: "javascript:alert(1)", ImageURL: "data:image/png;base64,AAAA"},
+		},
+	}
+	got := render(func(w *bufio.Writer) { writeHTMLMessage(w, message, "<eve>", "message") })
+
+	for _, want := range []string{
+		`<span class="sender">&lt;eve&gt;</span>`,
+		`&lt;script&gt;alert(1)&lt;/script&gt;<br>bye`,
+		`<a href="https://example.com/a?x=1&amp;y=2">safe</a>`,
+		`<a href="http://example.com/i.png">[image]</a>`,
+		`<strong>&lt;b&gt;unsafe&lt;/b&gt;</strong>`,
+		`<span class="time">2024-03-12 08:15</span>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("HTML message lacks %s:\n%s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"<script>", "javascript:", "data:image"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("HTML message contains %s:\n%s", unwanted, got)
+		}
+	}
+}
+
+func TestSenderNamesPreferTheNamePostedWith(t *testing.T) {
+	names := &senderNames{names: map[string]string{"u1": "alice"}}
+	tests := []struct {
+		message models.Message
+		want    string
+	}{
+		{models.Message{Sender: "u1"}, "alice"},
+		{models.Message{Sender: "u1", DisplayName: "Deploy bot"}, "Deploy bot"},
+	}
+	for _, tt := range tests {
+		got, err := names.of(context.Background(), &tt.message)
+		if err != nil || got != tt.want {
+			t.Errorf("of(%+v) = %q, %v, want %q", tt.message, got, err, tt.want)
+		}
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+	var out strings.Builder
+	counter := &countingWriter{w: &out}
+	counter.Write([]byte("hello "))
+	counter.Write([]byte("world"))
+	if counter.n != 11 || out.String() != "hello world" {
+		t.Errorf("countingWriter counted %d bytes of %q", counter.n, out.String())
+	}
+}
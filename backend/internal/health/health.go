@@ -0,0 +1,124 @@
+package health
+
+import (
+	"backend/internal/logging"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CheckFunc reports whether a dependency is usable, returning nil when healthy
+type CheckFunc func(ctx context.Context) error
+
+// DependencyStatus is the per-dependency detail returned by /readyz. The endpoint
+// is public, why a check failed is only logged.
+type DependencyStatus struct {
+	Status string `json:"status"`
+}
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+
+	// Maximum time a single readiness check may take
+	checkTimeout = 2 * time.Second
+)
+
+var (
+	startedAt    = time.Now()
+	shuttingDown atomic.Bool
+
+	checksMu sync.RWMutex
+	checks   = map[string]CheckFunc{}
+)
+
+// RegisterCheck adds a named dependency check to the readiness probe.
+// Registering a name twice replaces the previous check.
+func RegisterCheck(name string, check CheckFunc) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+	checks[name] = check
+}
+
+// SetShuttingDown marks the process as draining so /readyz stops routing traffic here
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+// IsShuttingDown reports whether SetShuttingDown has been called
+func IsShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// Healthz reports that the process is alive; it never touches dependencies
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":         StatusOK,
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+	})
+}
+
+// Readyz runs every registered check concurrently and returns 503 if any fails
+// or if the server is shutting down
+func Readyz(c *gin.Context) {
+	checksMu.RLock()
+	registered := make(map[string]CheckFunc, len(checks))
+	for name, check := range checks {
+		registered[name] = check
+	}
+	checksMu.RUnlock()
+
+	results := make(map[string]DependencyStatus, len(registered)+1)
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range registered {
+		wg.Add(1)
+		go func(name string, check CheckFunc) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.Request.Context(), checkTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			status := DependencyStatus{Status: StatusOK}
+			if err != nil {
+				status.Status = StatusFail
+				logging.FromContext(ctx).Warn("Readiness check failed", "check", name,
+					"latency_ms", time.Since(start).Milliseconds(), logging.Err(err))
+			}
+
+			resultsMu.Lock()
+			results[name] = status
+			resultsMu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, status := range results {
+		if status.Status != StatusOK {
+			ready = false
+		}
+	}
+
+	shutdownStatus := DependencyStatus{Status: StatusOK}
+	if IsShuttingDown() {
+		ready = false
+		shutdownStatus = DependencyStatus{Status: StatusFail}
+	}
+	results["shutdown"] = shutdownStatus
+
+	code := http.StatusOK
+	overall := StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+		overall = StatusFail
+	}
+
+	c.JSON(code, gin.H{"status": overall, "checks": results})
+}
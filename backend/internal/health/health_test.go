@@ -0,0 +1,92 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useChecks replaces the registered checks for the test
+func useChecks(t *testing.T, registered map[string]CheckFunc) {
+	t.Helper()
+	checksMu.Lock()
+	previous := checks
+	checks = registered
+	checksMu.Unlock()
+	t.Cleanup(func() {
+		checksMu.Lock()
+		checks = previous
+		checksMu.Unlock()
+		shuttingDown.Store(false)
+	})
+}
+
+func readyz(t *testing.T) (int, string, map[string]map[string]string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	Readyz(c)
+
+	var body struct {
+		Status string                       `json:"status"`
+		Checks map[string]map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code, recorder.Body.String(), body.Checks
+}
+
+func TestReadyz(t *testing.T) {
+	useChecks(t, map[string]CheckFunc{
+		"mongodb": func(context.Context) error { return nil },
+	})
+	code, _, results := readyz(t)
+	if code != http.StatusOK {
+		t.Errorf("status = %d, want 200", code)
+	}
+	if results["mongodb"]["status"] != StatusOK || results["shutdown"]["status"] != StatusOK {
+		t.Errorf("checks = %v", results)
+	}
+}
+
+func TestReadyzHidesWhyAChecksFails(t *testing.T) {
+	useChecks(t, map[string]CheckFunc{
+		"mongodb": func(context.Context) error { return nil },
+		"mailer": func(context.Context) error {
+			return errors.New("dial tcp 10.0.3.7:587: auth failed for smtp-user")
+		},
+	})
+	code, raw, results := readyz(t)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", code)
+	}
+	if results["mailer"]["status"] != StatusFail || results["mongodb"]["status"] != StatusOK {
+		t.Errorf("checks = %v", results)
+	}
+	if strings.Contains(raw, "10.0.3.7") || strings.Contains(raw, "smtp-user") {
+		t.Errorf("answer holds the check error: %s", raw)
+	}
+	for name, result := range results {
+		if len(result) != 1 {
+			t.Errorf("%s answers more than its status: %v", name, result)
+		}
+	}
+}
+
+func TestReadyzWhileShuttingDown(t *testing.T) {
+	useChecks(t, map[string]CheckFunc{})
+	SetShuttingDown()
+	code, _, results := readyz(t)
+	if code != http.StatusServiceUnavailable || results["shutdown"]["status"] != StatusFail {
+		t.Errorf("status = %d, checks = %v", code, results)
+	}
+}
@@ -0,0 +1,427 @@
+package importer
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/metrics"
+	"backend/internal/models"
+	"backend/internal/utils"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sources an archive can be imported from
+const (
+	SourceSlack    = "slack"
+	SourceWhatsApp = "whatsapp"
+)
+
+const (
+	// Messages are written in batches of this size
+	importBatchSize = 1000
+	// The import replaces the server's write timeout, large archives take a while
+	importTimeout = 30 * time.Minute
+)
+
+var (
+	// Largest archive accepted, IMPORT_MAX_SIZE_MB
+	maxArchiveSize int64 = 200 << 20
+	// Largest single file read from a zip archive, zip bombs stop here
+	maxEntrySize int64 = 64 << 20
+
+	usernameSanitizer = regexp.MustCompile(`[^a-z0-9._-]+`)
+)
+
+// Init applies the environment overrides once the environment file is loaded
+func Init() {
+	maxArchiveSize = int64(utils.GetEnvInt("IMPORT_MAX_SIZE_MB", int(maxArchiveSize>>20))) << 20
+}
+
+// participant is someone who wrote or was a member of an imported conversation
+type participant struct {
+	// Key is unique per source, e.g. "slack:U024BE7LH" or "whatsapp:Alice"
+	Key string
+	// Name is how the source displays the participant, it is what mappings refer to
+	Name string
+	// Email is known for Slack users only
+	Email string
+}
+
+// conversation is a chat read from an archive
+type conversation struct {
+	SourceID string
+	Topic    string
+	// Members are participant keys, senders are added to them
+	Members  []string
+	Messages []importedMessage
+}
+
+// importedMessage is a message read from an archive, Sender is a participant key
+type importedMessage struct {
+	SourceID    string
+	Sender      string
+	Content     string
+	Type        string
+	SentAt      time.Time
+	Attachments []models.MessageAttachment
+}
+
+// archive is the parsed content of an uploaded export
+type archive struct {
+	Participants  []*participant
+	Conversations []*conversation
+
+	byKey map[string]*participant
+}
+
+// participant returns the participant with key, adding it on first use. Every
+// sender and member of a conversation must be added this way.
+func (a *archive) participant(key, name, email string) *participant {
+	if a.byKey == nil {
+		a.byKey = map[string]*participant{}
+	}
+	if p, ok := a.byKey[key]; ok {
+		return p
+	}
+	p := &participant{Key: key, Name: name, Email: email}
+	a.byKey[key] = p
+	a.Participants = append(a.Participants, p)
+	return p
+}
+
+// resolvedParticipant is the user a participant was mapped to
+type resolvedParticipant struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	UserID      string `json:"user_id,omitempty"`
+	Username    string `json:"username,omitempty"`
+	MatchedBy   string `json:"matched_by"`
+	Placeholder bool   `json:"placeholder"`
+}
+
+// How a participant was matched, see resolveParticipants
+const (
+	matchMapping  = "mapping"
+	matchEmail    = "email"
+	matchPrevious = "previous_import"
+	matchNew      = "new_placeholder"
+)
+
+// chatResult summarises the import of one conversation
+type chatResult struct {
+	ChatID           string `json:"chat_id,omitempty"`
+	SourceID         string `json:"source_id"`
+	Topic            string `json:"topic,omitempty"`
+	Members          int    `json:"members"`
+	Messages         int    `json:"messages"`
+	MessagesImported int    `json:"messages_imported"`
+}
+
+// Import ingests a Slack export zip or a WhatsApp chat export (.txt, or the .zip
+// with media) uploaded as the multipart field "file". Form fields:
+//   - source: slack or whatsapp
+//   - mapping: optional JSON object from participant name (or Slack user ID) to username
+//   - timezone: IANA zone the WhatsApp export was written in, default UTC
+//   - date_order: dmy or mdy for ambiguous WhatsApp dates, detected when possible
+//   - chat_key, topic: identify and name a WhatsApp chat, see parseWhatsApp
+//   - dry_run: true to only report how participants would be mapped
+//
+// Participants are mapped to an existing user through the mapping, then their
+// Slack email; the others get a disabled placeholder account. Importing the same
+// archive again adds nothing: chats, messages and placeholders are keyed by their
+// source ID. Imported messages are not broadcast, nor sent to webhooks or bots.
+func Import(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	ctx := c.Request.Context()
+	logger := logging.FromGin(c)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxArchiveSize+1<<20)
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(importTimeout)); err != nil {
+		logger.Debug("Could not extend write deadline", logging.Err(err))
+	}
+
+	source := c.PostForm("source")
+	if source != SourceSlack && source != SourceWhatsApp {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The source must be slack or whatsapp", "fieldError": "source"})
+		return
+	}
+	mapping := map[string]string{}
+	if raw := c.PostForm("mapping"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "The mapping must be a JSON object of usernames", "fieldError": "mapping"})
+			return
+		}
+	}
+	dryRun := c.PostForm("dry_run") == "true"
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "An export file is required", "fieldError": "file"})
+		return
+	}
+	if header.Size > maxArchiveSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("The file can be at most %d MB", maxArchiveSize>>20), "fieldError": "file"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Could not read the file", "fieldError": "file"})
+		return
+	}
+	defer file.Close()
+
+	var parsed *archive
+	switch source {
+	case SourceSlack:
+		parsed, err = parseSlack(file, header.Size)
+	case SourceWhatsApp:
+		var options whatsAppOptions
+		options, err = newWhatsAppOptions(c.PostForm("timezone"), c.PostForm("date_order"), c.PostForm("chat_key"), c.PostForm("topic"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		parsed, err = parseWhatsApp(file, header.Filename, header.Size, options)
+	}
+	if err != nil {
+		logger.Info("Rejected chat import", "source", source, logging.Err(err))
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid " + source + " export: " + err.Error(), "fieldError": "file"})
+		return
+	}
+
+	participants, err := resolveParticipants(ctx, parsed.Participants, mapping, dryRun)
+	if err != nil {
+		if _, invalid := err.(mappingError); invalid {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "fieldError": "mapping"})
+			return
+		}
+		logger.Error("Could not map imported participants", logging.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not import chats"})
+		return
+	}
+
+	results := make([]chatResult, 0, len(parsed.Conversations))
+	imported := 0
+	for _, conversation := range parsed.Conversations {
+		result, err := importConversation(ctx, conversation, participants, principal.ID, dryRun)
+		if err != nil {
+			logger.Error("Chat import failed", "source_id", conversation.SourceID, logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not import chats, the import can be re-run safely", "chats": results})
+			return
+		}
+		imported += result.MessagesImported
+		results = append(results, result)
+	}
+	metrics.ImportedMessages.WithLabelValues(source).Add(float64(imported))
+
+	resolved := make([]*resolvedParticipant, 0, len(participants))
+	for _, participant := range participants {
+		resolved = append(resolved, participant)
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].Key < resolved[j].Key })
+
+	if !dryRun {
+		logger.Info("Chat history imported", "source", source, "chats", len(results), "messages_imported", imported)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":           dryRun,
+		"chats":             results,
+		"participants":      resolved,
+		"messages_imported": imported,
+	})
+}
+
+// mappingError is a mapping naming a user that doesn't exist
+type mappingError string
+
+func (e mappingError) Error() string { return string(e) }
+
+// resolveParticipants maps every participant to a user. Placeholders are created
+// unless dryRun is set, in which case they are reported without a user ID.
+func resolveParticipants(ctx context.Context, participants []*participant, mapping map[string]string, dryRun bool) (map[string]*resolvedParticipant, error) {
+	now := time.Now()
+	resolved := make(map[string]*resolvedParticipant, len(participants))
+	for _, p := range participants {
+		result := &resolvedParticipant{Key: p.Key, Name: p.Name}
+		resolved[p.Key] = result
+
+		// The mapping may refer to a Slack user by name or by ID
+		username, mapped := mapping[p.Name]
+		if !mapped {
+			_, id, _ := strings.Cut(p.Key, ":")
+			username, mapped = mapping[id]
+		}
+		if mapped {
+			user, err := store.FindUserByUsername(ctx, strings.ToLower(username))
+			if err != nil {
+				return nil, err
+			}
+			if user == nil || user.Bot || user.Placeholder || user.DeletedAt != nil {
+				return nil, mappingError(fmt.Sprintf("The mapping of %q names no user %q", p.Name, username))
+			}
+			result.UserID, result.Username, result.MatchedBy = user.ID, user.Username, matchMapping
+			continue
+		}
+
+		if p.Email != "" {
+			user, err := store.FindUserByEmail(ctx, strings.ToLower(p.Email))
+			if err != nil {
+				return nil, err
+			}
+			if user != nil && !user.Bot && !user.Placeholder && user.DeletedAt == nil {
+				result.UserID, result.Username, result.MatchedBy = user.ID, user.Username, matchEmail
+				continue
+			}
+		}
+
+		user, err := store.FindUserByImportKey(ctx, p.Key)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil {
+			result.UserID, result.Username, result.MatchedBy, result.Placeholder = user.ID, user.Username, matchPrevious, true
+			continue
+		}
+
+		result.MatchedBy, result.Placeholder = matchNew, true
+		if dryRun {
+			continue
+		}
+		username, err = placeholderUsername(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		user, err = store.UpsertPlaceholderUser(ctx, p.Key, username, now)
+		if err != nil {
+			return nil, err
+		}
+		result.UserID, result.Username = user.ID, user.Username
+	}
+	return resolved, nil
+}
+
+// placeholderUsername derives a free username from the participant's name,
+// suffixed with the source so that it doesn't take the name a person would register
+func placeholderUsername(ctx context.Context, p *participant) (string, error) {
+	source, _, _ := strings.Cut(p.Key, ":")
+	base := usernameSanitizer.ReplaceAllString(strings.ToLower(strings.ReplaceAll(p.Name, " ", ".")), "")
+	if base == "" {
+		base = "user"
+	}
+	base += "-" + source
+
+	username := base
+	for i := 0; ; i++ {
+		existing, err := store.FindUserByUsername(ctx, username)
+		if err != nil {
+			return "", err
+		}
+		if existing == nil {
+			return username, nil
+		}
+		if i >= 5 {
+			return "", fmt.Errorf("no free username for %q", p.Name)
+		}
+		suffix := make([]byte, 2)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		username = base + "-" + hex.EncodeToString(suffix)
+	}
+}
+
+// importConversation creates or completes the chat of a conversation and stores its
+// messages that weren't imported before
+func importConversation(ctx context.Context, conversation *conversation, participants map[string]*resolvedParticipant, importerID string, dryRun bool) (chatResult, error) {
+	result := chatResult{SourceID: conversation.SourceID, Topic: conversation.Topic, Messages: len(conversation.Messages)}
+
+	members := make([]string, 0, len(conversation.Members))
+	seen := map[string]bool{}
+	addMember := func(key string) {
+		if p := participants[key]; p != nil && !seen[key] {
+			seen[key] = true
+			members = append(members, p.UserID)
+		}
+	}
+	for _, key := range conversation.Members {
+		addMember(key)
+	}
+	for _, message := range conversation.Messages {
+		addMember(message.Sender)
+	}
+	result.Members = len(members)
+	if dryRun || len(conversation.Messages) == 0 {
+		return result, nil
+	}
+
+	sort.SliceStable(conversation.Messages, func(i, j int) bool {
+		return conversation.Messages[i].SentAt.Before(conversation.Messages[j].SentAt)
+	})
+	firstAt := conversation.Messages[0].SentAt
+
+	chat, err := store.UpsertImportedChat(ctx, &models.Chat{
+		SourceID:  conversation.SourceID,
+		CreatedBy: importerID,
+		CreatedAt: firstAt,
+		Topic:     conversation.Topic,
+		Users:     members,
+	})
+	if err != nil {
+		return result, err
+	}
+	result.ChatID = chat.ID
+	// A later export of the same chat may reach further back
+	if firstAt.Before(chat.CreatedAt) {
+		if err := store.SetChatCreatedAt(ctx, chat.ID, firstAt); err != nil {
+			return result, err
+		}
+	}
+
+	batch := make([]models.Message, 0, importBatchSize)
+	flush := func() error {
+		inserted, err := store.InsertImportedMessages(ctx, batch)
+		result.MessagesImported += inserted
+		batch = batch[:0]
+		return err
+	}
+	for _, message := range conversation.Messages {
+		messageType := message.Type
+		if messageType == "" {
+			messageType = "message"
+		}
+		batch = append(batch, models.Message{
+			ChatID:      chat.ID,
+			Sender:      participants[message.Sender].UserID,
+			Content:     message.Content,
+			SentAt:      message.SentAt,
+			Type:        &messageType,
+			Attachments: message.Attachments,
+			SourceID:    message.SourceID,
+		})
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+
+	if result.MessagesImported > 0 {
+		if err := store.RefreshChatSummary(ctx, chat.ID); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,303 @@
+package importer
+
+import (
+	"archive/zip"
+	"backend/internal/models"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryStore keeps what an import writes, unique by source ID like the indexes of MongoDB
+type memoryStore struct {
+	users    []*models.User
+	chats    map[string]*models.Chat
+	messages map[string]models.Message
+	// refreshed counts the summary refreshes per chat
+	refreshed map[string]int
+}
+
+func useMemoryStore(t *testing.T, users ...*models.User) *memoryStore {
+	t.Helper()
+	s := &memoryStore{users: users, chats: map[string]*models.Chat{}, messages: map[string]models.Message{}, refreshed: map[string]int{}}
+	previous := store
+	store = s
+	t.Cleanup(func() { store = previous })
+	return s
+}
+
+func (s *memoryStore) findUser(match func(*models.User) bool) (*models.User, error) {
+	for _, user := range s.users {
+		if match(user) {
+			found := *user
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) FindUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	return s.findUser(func(u *models.User) bool { return u.Username == username })
+}
+
+func (s *memoryStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return s.findUser(func(u *models.User) bool { return u.Email == email })
+}
+
+func (s *memoryStore) FindUserByImportKey(ctx context.Context, importKey string) (*models.User, error) {
+	return s.findUser(func(u *models.User) bool { return u.ImportKey == importKey })
+}
+
+func (s *memoryStore) UpsertPlaceholderUser(ctx context.Context, importKey string, username string, now time.Time) (*models.User, error) {
+	if user, _ := s.FindUserByImportKey(ctx, importKey); user != nil {
+		return user, nil
+	}
+	user := &models.User{ID: fmt.Sprintf("user%d", len(s.users)), Username: username, ImportKey: importKey, Placeholder: true, Disabled: true}
+	s.users = append(s.users, user)
+	found := *user
+	return &found, nil
+}
+
+func (s *memoryStore) UpsertImportedChat(ctx context.Context, chat *models.Chat) (*models.Chat, error) {
+	stored, ok := s.chats[chat.SourceID]
+	if !ok {
+		stored = &models.Chat{ID: fmt.Sprintf("chat%d", len(s.chats)), SourceID: chat.SourceID, CreatedBy: chat.CreatedBy, CreatedAt: chat.CreatedAt, Topic: chat.Topic}
+		s.chats[chat.SourceID] = stored
+	}
+	for _, member := range chat.Users {
+		if !contains(stored.Users, member) {
+			stored.Users = append(stored.Users, member)
+		}
+	}
+	found := *stored
+	return &found, nil
+}
+
+func (s *memoryStore) SetChatCreatedAt(ctx context.Context, chatID string, at time.Time) error {
+	for _, chat := range s.chats {
+		if chat.ID == chatID && at.Before(chat.CreatedAt) {
+			chat.CreatedAt = at
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) InsertImportedMessages(ctx context.Context, messages []models.Message) (int, error) {
+	inserted := 0
+	for _, message := range messages {
+		if _, ok := s.messages[message.SourceID]; !ok {
+			s.messages[message.SourceID] = message
+			inserted++
+		}
+	}
+	return inserted, nil
+}
+
+func (s *memoryStore) RefreshChatSummary(ctx context.Context, chatID string) error {
+	s.refreshed[chatID]++
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// runImport does what Import does once the archive is parsed
+func runImport(t *testing.T, parsed *archive, mapping map[string]string) (map[string]*resolvedParticipant, []chatResult) {
+	t.Helper()
+	participants, err := resolveParticipants(context.Background(), parsed.Participants, mapping, false)
+	if err != nil {
+		t.Fatalf("resolveParticipants error: %v", err)
+	}
+	var results []chatResult
+	for _, conversation := range parsed.Conversations {
+		result, err := importConversation(context.Background(), conversation, participants, "importer", false)
+		if err != nil {
+			t.Fatalf("importConversation(%s) error: %v", conversation.SourceID, err)
+		}
+		results = append(results, result)
+	}
+	return participants, results
+}
+
+func slackArchive(t *testing.T, files map[string]any) *archive {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.NewEncoder(f).Encode(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseSlack(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("parseSlack error: %v", err)
+	}
+	return parsed
+}
+
+func slackExport(t *testing.T) *archive {
+	return slackArchive(t, map[string]any{
+		"users.json": []map[string]any{
+			{"id": "U1", "name": "alice", "profile": map[string]string{"email": "Alice@example.com"}},
+			{"id": "U2", "name": "bob", "profile": map[string]string{"display_name": "Bob Smith"}},
+		},
+		"channels.json": []map[string]any{{"id": "C1", "name": "general", "members": []string{"U1", "U2"}}},
+		"general/2021-03-04.json": []map[string]string{
+			{"type": "message", "user": "U1", "text": "hello <@U2>", "ts": "1614859200.000100"},
+			{"type": "message", "user": "U2", "text": "hi", "ts": "1614859260.000200"},
+			{"type": "message", "subtype": "channel_join", "user": "U2", "text": "joined", "ts": "1614859000.000000"},
+		},
+	})
+}
+
+func TestRepeatedSlackImportAddsNothing(t *testing.T) {
+	s := useMemoryStore(t, &models.User{ID: "alice", Username: "alice", Email: "alice@example.com"})
+
+	participants, results := runImport(t, slackExport(t), nil)
+	if len(results) != 1 || results[0].MessagesImported != 2 || results[0].Messages != 2 || results[0].Members != 2 {
+		t.Fatalf("first import = %+v, want 2 of 2 messages imported for 2 members", results)
+	}
+	if p := participants["slack:U1"]; p.UserID != "alice" || p.MatchedBy != matchEmail || p.Placeholder {
+		t.Errorf("U1 resolved to %+v, want alice by email", p)
+	}
+	bob := participants["slack:U2"]
+	if bob.MatchedBy != matchNew || !bob.Placeholder || bob.Username != "bob.smith-slack" {
+		t.Errorf("U2 resolved to %+v, want a new placeholder bob.smith-slack", bob)
+	}
+	chatID := results[0].ChatID
+
+	participants, results = runImport(t, slackExport(t), nil)
+	if len(results) != 1 || results[0].MessagesImported != 0 || results[0].ChatID != chatID {
+		t.Errorf("second import = %+v, want no message imported into %s", results, chatID)
+	}
+	if p := participants["slack:U2"]; p.UserID != bob.UserID || p.MatchedBy != matchPrevious {
+		t.Errorf("U2 resolved again to %+v, want the placeholder %s of the previous import", p, bob.UserID)
+	}
+	if len(s.users) != 2 || len(s.chats) != 1 || len(s.messages) != 2 {
+		t.Errorf("store holds %d users, %d chats, %d messages, want 2, 1, 2", len(s.users), len(s.chats), len(s.messages))
+	}
+	if s.refreshed[chatID] != 1 {
+		t.Errorf("chat summary refreshed %d times, want once: the re-run imported nothing", s.refreshed[chatID])
+	}
+	if users := s.chats["slack:C1"].Users; len(users) != 2 {
+		t.Errorf("chat members = %v, want alice and the placeholder once each", users)
+	}
+}
+
+func TestSlackImportMapping(t *testing.T) {
+	useMemoryStore(t,
+		&models.User{ID: "robert", Username: "robert"},
+		&models.User{ID: "ghost", Username: "ghost", Placeholder: true},
+	)
+
+	participants, _ := runImport(t, slackExport(t), map[string]string{"U2": "Robert"})
+	if p := participants["slack:U2"]; p.UserID != "robert" || p.MatchedBy != matchMapping {
+		t.Errorf("U2 resolved to %+v, want robert by mapping", p)
+	}
+
+	for _, username := range []string{"nobody", "ghost"} {
+		_, err := resolveParticipants(context.Background(), slackExport(t).Participants, map[string]string{"Bob Smith": username}, false)
+		if _, invalid := err.(mappingError); !invalid {
+			t.Errorf("mapping to %q: error %v, want a mappingError", username, err)
+		}
+	}
+}
+
+func TestImportDryRunWritesNothing(t *testing.T) {
+	s := useMemoryStore(t)
+	parsed := slackExport(t)
+
+	participants, err := resolveParticipants(context.Background(), parsed.Participants, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := participants["slack:U1"]; p.MatchedBy != matchNew || p.UserID != "" {
+		t.Errorf("U1 resolved to %+v, want a placeholder without a user", p)
+	}
+	result, err := importConversation(context.Background(), parsed.Conversations[0], participants, "importer", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ChatID != "" || result.Messages != 2 || result.MessagesImported != 0 {
+		t.Errorf("dry run result = %+v, want 2 messages reported and none imported", result)
+	}
+	if len(s.users) != 0 || len(s.chats) != 0 || len(s.messages) != 0 {
+		t.Errorf("dry run stored %d users, %d chats, %d messages", len(s.users), len(s.chats), len(s.messages))
+	}
+}
+
+func parseWhatsAppText(t *testing.T, text string) *archive {
+	t.Helper()
+	options, err := newWhatsAppOptions("Europe/Paris", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseWhatsApp(strings.NewReader(text), "WhatsApp Chat with Bob.txt", int64(len(text)), options)
+	if err != nil {
+		t.Fatalf("parseWhatsApp error: %v", err)
+	}
+	return parsed
+}
+
+func TestWhatsAppReExportImportsOnlyNewMessages(t *testing.T) {
+	s := useMemoryStore(t)
+	first := "12/03/2024, 09:15 - Alice: Good morning\n" +
+		"12/03/2024, 09:16 - Bob: Morning\n" +
+		"12/03/2024, 09:16 - Bob: Morning\n" +
+		"25/03/2024, 18:02 - Alice: See you\nat six\n"
+	later := "11/03/2024, 22:00 - Bob: Are you up?\n" + first + "26/03/2024, 07:45 - Bob: Running late\n"
+
+	_, results := runImport(t, parseWhatsAppText(t, first), nil)
+	if results[0].MessagesImported != 4 {
+		t.Fatalf("first import imported %d messages, want 4: repeated lines are distinct messages", results[0].MessagesImported)
+	}
+	chatID := results[0].ChatID
+
+	_, results = runImport(t, parseWhatsAppText(t, later), nil)
+	if results[0].ChatID != chatID || results[0].MessagesImported != 2 {
+		t.Errorf("re-export import = %+v, want the 2 new messages imported into %s", results[0], chatID)
+	}
+	if len(s.users) != 2 {
+		t.Errorf("store holds %d users, want the 2 placeholders of the first import", len(s.users))
+	}
+	want := time.Date(2024, 3, 11, 21, 0, 0, 0, time.UTC)
+	if got := s.chats[results[0].SourceID].CreatedAt; !got.Equal(want) {
+		t.Errorf("chat created at %v, want it moved back to the earliest message %v", got, want)
+	}
+}
+
+func TestWhatsAppSourceIDsAreStable(t *testing.T) {
+	text := "3/12/24, 9:15 PM - Alice: Hello\n3/12/24, 9:16 PM - Bob: Hi\n"
+	a, b := parseWhatsAppText(t, text), parseWhatsAppText(t, text)
+	if a.Conversations[0].SourceID != b.Conversations[0].SourceID {
+		t.Errorf("chat source IDs differ: %s, %s", a.Conversations[0].SourceID, b.Conversations[0].SourceID)
+	}
+	for i, message := range a.Conversations[0].Messages {
+		if other := b.Conversations[0].Messages[i]; message.SourceID != other.SourceID {
+			t.Errorf("message %d source IDs differ: %s, %s", i, message.SourceID, other.SourceID)
+		}
+	}
+
+	// The chat of the same people is the same chat, whoever wrote first
+	swapped := parseWhatsAppText(t, "3/12/24, 9:16 PM - Bob: Hi\n3/12/24, 9:17 PM - Alice: Hello\n")
+	if swapped.Conversations[0].SourceID != a.Conversations[0].SourceID {
+		t.Errorf("chat source ID depends on the order of the participants")
+	}
+}
@@ -0,0 +1,291 @@
+package importer
+
+import (
+	"archive/zip"
+	"backend/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// slackUser is an entry of users.json
+type slackUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Profile  struct {
+		DisplayName string `json:"display_name"`
+		RealName    string `json:"real_name"`
+		Email       string `json:"email"`
+	} `json:"profile"`
+}
+
+func (u slackUser) displayName() string {
+	for _, name := range []string{u.Profile.DisplayName, u.Profile.RealName, u.RealName, u.Name} {
+		if name != "" {
+			return name
+		}
+	}
+	return u.ID
+}
+
+// slackConversation is an entry of channels.json, groups.json, mpims.json or dms.json
+type slackConversation struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// slackMessage is an entry of the daily files, e.g. general/2021-03-04.json
+type slackMessage struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype"`
+	User        string `json:"user"`
+	BotID       string `json:"bot_id"`
+	Username    string `json:"username"`
+	Text        string `json:"text"`
+	TS          string `json:"ts"`
+	UserProfile *struct {
+		DisplayName string `json:"display_name"`
+		RealName    string `json:"real_name"`
+	} `json:"user_profile"`
+	Files []struct {
+		Name      string `json:"name"`
+		Title     string `json:"title"`
+		Permalink string `json:"permalink"`
+	} `json:"files"`
+}
+
+// Subtypes imported as messages, the others (joins, renames, ...) are channel noise
+var slackMessageSubtypes = map[string]bool{
+	"":                 true,
+	"me_message":       true,
+	"bot_message":      true,
+	"file_share":       true,
+	"thread_broadcast": true,
+}
+
+// Mentions, channel links and URLs are written as <...> in Slack's markup
+var slackMarkup = regexp.MustCompile(`<([^<>]+)>`)
+
+// parseSlack reads a workspace export as downloaded from Slack's admin pages:
+// users.json, the conversation lists and a folder of daily files per conversation.
+// Public and private channels get the topic "#name"; direct messages have no topic.
+func parseSlack(file io.ReaderAt, size int64) (*archive, error) {
+	reader, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("not a zip archive")
+	}
+	files := map[string]*zip.File{}
+	for _, f := range reader.File {
+		files[f.Name] = f
+	}
+
+	var users []slackUser
+	if f := files["users.json"]; f != nil {
+		if err := readZipJSON(f, &users); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("users.json is missing")
+	}
+
+	parsed := &archive{}
+	usersByID := make(map[string]slackUser, len(users))
+	for _, user := range users {
+		usersByID[user.ID] = user
+		parsed.participant("slack:"+user.ID, user.displayName(), user.Profile.Email)
+	}
+	userKey := func(id string) string {
+		if user, ok := usersByID[id]; ok {
+			return parsed.participant("slack:"+id, user.displayName(), user.Profile.Email).Key
+		}
+		return parsed.participant("slack:"+id, id, "").Key
+	}
+
+	// The folder of a conversation is its name, direct messages have no name
+	byFolder := map[string]*conversation{}
+	for _, list := range []struct {
+		file    string
+		channel bool
+	}{{"channels.json", true}, {"groups.json", true}, {"mpims.json", false}, {"dms.json", false}} {
+		f := files[list.file]
+		if f == nil {
+			continue
+		}
+		var entries []slackConversation
+		if err := readZipJSON(f, &entries); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			imported := &conversation{SourceID: "slack:" + entry.ID}
+			if list.channel {
+				imported.Topic = "#" + entry.Name
+			}
+			for _, member := range entry.Members {
+				imported.Members = append(imported.Members, userKey(member))
+			}
+			folder := entry.Name
+			if folder == "" {
+				folder = entry.ID
+			}
+			byFolder[folder] = imported
+			parsed.Conversations = append(parsed.Conversations, imported)
+		}
+	}
+	if len(parsed.Conversations) == 0 {
+		return nil, fmt.Errorf("the archive lists no channels or conversations")
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		folder, day := path.Split(name)
+		imported := byFolder[strings.TrimSuffix(folder, "/")]
+		if imported == nil || path.Ext(day) != ".json" {
+			continue
+		}
+		var messages []slackMessage
+		if err := readZipJSON(files[name], &messages); err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			if message.Type != "message" || !slackMessageSubtypes[message.Subtype] {
+				continue
+			}
+			sentAt, err := parseSlackTimestamp(message.TS)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+
+			var sender string
+			switch {
+			case message.User != "":
+				sender = userKey(message.User)
+				// Users missing from users.json, e.g. from a shared channel, carry their profile
+				if p := parsed.byKey[sender]; p.Name == message.User && message.UserProfile != nil {
+					if p.Name = message.UserProfile.DisplayName; p.Name == "" {
+						p.Name = message.UserProfile.RealName
+					}
+					if p.Name == "" {
+						p.Name = message.User
+					}
+				}
+			case message.BotID != "":
+				botName := message.Username
+				if botName == "" {
+					botName = message.BotID
+				}
+				sender = parsed.participant("slack:"+message.BotID, botName, "").Key
+			default:
+				continue
+			}
+
+			importedMessage := importedMessage{
+				SourceID: imported.SourceID + ":" + message.TS,
+				Sender:   sender,
+				Content:  formatSlackText(message.Text, usersByID),
+				SentAt:   sentAt,
+			}
+			if message.Subtype == "me_message" {
+				importedMessage.Type = "me"
+			}
+			for _, f := range message.Files {
+				title := f.Title
+				if title == "" {
+					title = f.Name
+				}
+				importedMessage.Attachments = append(importedMessage.Attachments, models.MessageAttachment{Title: title, TitleLink: f.Permalink})
+			}
+			if importedMessage.Content == "" && len(importedMessage.Attachments) == 0 {
+				continue
+			}
+			imported.Messages = append(imported.Messages, importedMessage)
+		}
+	}
+	return parsed, nil
+}
+
+// readZipJSON decodes a JSON file of the archive, refusing files over maxEntrySize
+func readZipJSON(f *zip.File, v any) error {
+	if f.UncompressedSize64 > uint64(maxEntrySize) {
+		return fmt.Errorf("%s is too large", f.Name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Name, err)
+	}
+	defer r.Close()
+
+	// The declared size can lie, the reader is limited as well
+	limited := &io.LimitedReader{R: r, N: maxEntrySize + 1}
+	if err := json.NewDecoder(limited).Decode(v); err != nil {
+		if limited.N <= 0 {
+			return fmt.Errorf("%s is too large", f.Name)
+		}
+		return fmt.Errorf("%s: %v", f.Name, err)
+	}
+	return nil
+}
+
+// parseSlackTimestamp converts a message ts such as "1614868923.000200", which is
+// also the message's unique ID within its conversation
+func parseSlackTimestamp(ts string) (time.Time, error) {
+	seconds, fraction, _ := strings.Cut(ts, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid message timestamp " + strconv.Quote(ts))
+	}
+	var micro int64
+	if fraction != "" {
+		if micro, err = strconv.ParseInt((fraction + "000000")[:6], 10, 64); err != nil {
+			return time.Time{}, errors.New("invalid message timestamp " + strconv.Quote(ts))
+		}
+	}
+	return time.Unix(sec, micro*int64(time.Microsecond)).UTC(), nil
+}
+
+// formatSlackText turns Slack's markup into plain text: <@U123> becomes @name,
+// <#C123|general> #general and <https://example.com|label> "label (https://example.com)"
+func formatSlackText(text string, users map[string]slackUser) string {
+	text = slackMarkup.ReplaceAllStringFunc(text, func(match string) string {
+		target, label, _ := strings.Cut(match[1:len(match)-1], "|")
+		switch {
+		case strings.HasPrefix(target, "@"):
+			if user, ok := users[target[1:]]; ok {
+				return "@" + user.displayName()
+			}
+			if label != "" {
+				return "@" + label
+			}
+			return target
+		case strings.HasPrefix(target, "#"):
+			if label != "" {
+				return "#" + label
+			}
+			return target
+		case strings.HasPrefix(target, "!"):
+			// <!here>, <!channel>, <!subteam^ID|@team>
+			if label != "" {
+				return label
+			}
+			return "@" + strings.TrimPrefix(target, "!")
+		case label != "":
+			return label + " (" + target + ")"
+		default:
+			return strings.TrimPrefix(target, "mailto:")
+		}
+	})
+	return strings.TrimSpace(html.UnescapeString(text))
+}
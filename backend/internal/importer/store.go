@@ -0,0 +1,59 @@
+package importer
+
+import (
+	"backend/internal/models"
+	"backend/mongodb"
+	"context"
+	"time"
+)
+
+// importStore reads the users an import maps participants to and writes what it imports.
+// Writes are keyed by source ID so that a re-run adds nothing twice.
+type importStore interface {
+	FindUserByUsername(ctx context.Context, username string) (*models.User, error)
+	FindUserByEmail(ctx context.Context, email string) (*models.User, error)
+	FindUserByImportKey(ctx context.Context, importKey string) (*models.User, error)
+	UpsertPlaceholderUser(ctx context.Context, importKey string, username string, now time.Time) (*models.User, error)
+	UpsertImportedChat(ctx context.Context, chat *models.Chat) (*models.Chat, error)
+	SetChatCreatedAt(ctx context.Context, chatID string, at time.Time) error
+	InsertImportedMessages(ctx context.Context, messages []models.Message) (int, error)
+	RefreshChatSummary(ctx context.Context, chatID string) error
+}
+
+// mongoStore is the importStore of the server
+type mongoStore struct{}
+
+func (mongoStore) FindUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	return mongodb.FindUserByUsername(ctx, username, false)
+}
+
+func (mongoStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return mongodb.FindUserByEmailRegistration(ctx, email)
+}
+
+func (mongoStore) FindUserByImportKey(ctx context.Context, importKey string) (*models.User, error) {
+	return mongodb.FindUserByImportKey(ctx, importKey)
+}
+
+func (mongoStore) UpsertPlaceholderUser(ctx context.Context, importKey string, username string, now time.Time) (*models.User, error) {
+	return mongodb.UpsertPlaceholderUser(ctx, importKey, username, now)
+}
+
+func (mongoStore) UpsertImportedChat(ctx context.Context, chat *models.Chat) (*models.Chat, error) {
+	return mongodb.UpsertImportedChat(ctx, chat)
+}
+
+func (mongoStore) SetChatCreatedAt(ctx context.Context, chatID string, at time.Time) error {
+	return mongodb.SetChatCreatedAt(ctx, chatID, at)
+}
+
+func (mongoStore) InsertImportedMessages(ctx context.Context, messages []models.Message) (int, error) {
+	return mongodb.InsertImportedMessages(ctx, messages)
+}
+
+func (mongoStore) RefreshChatSummary(ctx context.Context, chatID string) error {
+	return mongodb.RefreshChatSummary(ctx, chatID)
+}
+
+// store is replaced by tests
+var store importStore = mongoStore{}
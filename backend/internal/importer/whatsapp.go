@@ -0,0 +1,272 @@
+package importer
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Day and month orders of WhatsApp dates, which follow the phone's locale
+const (
+	dateOrderDMY = "dmy"
+	dateOrderMDY = "mdy"
+)
+
+// whatsAppLine matches the first line of a message in both export layouts:
+//
+//	31/12/2020, 21:41 - Alice: Happy new year      (Android)
+//	[31.12.20, 9:41:05 PM] Alice: Happy new year   (iOS)
+var whatsAppLine = regexp.MustCompile(`^\[?(\d{1,4})[./-](\d{1,2})[./-](\d{1,4}),?\s+(\d{1,2})[:.](\d{2})(?:[:.](\d{2}))?\s*([AaPp]\.?\s?[Mm]\.?)?\]?\s+(?:-\s+)?(.*)$`)
+
+// Exports are named "WhatsApp Chat with <name>.txt", or .zip when media is included
+var whatsAppFileName = regexp.MustCompile(`^WhatsApp Chat (?:with|-) (.+)\.(?:txt|zip)$`)
+
+// whatsAppOptions are the details a WhatsApp export doesn't carry
+type whatsAppOptions struct {
+	// Location is the time zone of the phone, timestamps are written in local time
+	Location *time.Location
+	// DateOrder is dateOrderDMY or dateOrderMDY, empty to detect it
+	DateOrder string
+	// ChatKey identifies the chat across imports, the participants are used otherwise
+	ChatKey string
+	Topic   string
+}
+
+func newWhatsAppOptions(timezone, dateOrder, chatKey, topic string) (whatsAppOptions, error) {
+	options := whatsAppOptions{Location: time.UTC, DateOrder: dateOrder, ChatKey: chatKey, Topic: topic}
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return options, fmt.Errorf("unknown timezone %q", timezone)
+		}
+		options.Location = location
+	}
+	if dateOrder != "" && dateOrder != dateOrderDMY && dateOrder != dateOrderMDY {
+		return options, fmt.Errorf("the date_order must be dmy or mdy")
+	}
+	if len(chatKey) > 100 {
+		return options, fmt.Errorf("the chat_key can be at most 100 characters")
+	}
+	if len([]rune(topic)) > 250 {
+		return options, fmt.Errorf("the topic can be at most 250 characters")
+	}
+	return options, nil
+}
+
+// whatsAppEntry is a message before its date is interpreted
+type whatsAppEntry struct {
+	date    [3]string
+	hour    int
+	minute  int
+	second  int
+	ampm    string
+	sender  string
+	content string
+}
+
+// parseWhatsApp reads the export of a single chat, as a .txt file or as the .zip
+// containing it. Messages are identified by their time, sender and text, so the same
+// chat exported again later can be imported over the first import; this needs the
+// same timezone and chat_key as the first import.
+func parseWhatsApp(file io.ReaderAt, fileName string, size int64, options whatsAppOptions) (*archive, error) {
+	text, err := readWhatsAppText(file, fileName, size)
+	if err != nil {
+		return nil, err
+	}
+	if options.Topic == "" {
+		if match := whatsAppFileName.FindStringSubmatch(path.Base(fileName)); match != nil {
+			options.Topic = match[1]
+		}
+	}
+
+	// Phones write invisible marks around names and before AM/PM
+	text = strings.NewReplacer("\u200e", "", "\u200f", "", "\ufeff", "", "\u202f", " ", "\u00a0", " ", "\r\n", "\n").Replace(text)
+
+	var entries []*whatsAppEntry
+	var last *whatsAppEntry
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 0, 64<<10), int(maxEntrySize))
+	for scanner.Scan() {
+		line := scanner.Text()
+		match := whatsAppLine.FindStringSubmatch(line)
+		if match == nil {
+			// Messages spanning several lines continue without a header
+			if last != nil {
+				last.content += "\n" + line
+			}
+			continue
+		}
+		sender, content, found := strings.Cut(match[8], ": ")
+		if !found {
+			// Notices such as "Alice added Bob" or the encryption notice
+			last = nil
+			continue
+		}
+		entry := &whatsAppEntry{date: [3]string{match[1], match[2], match[3]}, ampm: strings.ToLower(strings.NewReplacer(".", "", " ", "").Replace(match[7])), sender: strings.TrimSpace(sender), content: content}
+		entry.hour, _ = strconv.Atoi(match[4])
+		entry.minute, _ = strconv.Atoi(match[5])
+		entry.second, _ = strconv.Atoi(match[6])
+		entries = append(entries, entry)
+		last = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no messages found")
+	}
+
+	order := options.DateOrder
+	if order == "" {
+		order = detectDateOrder(entries)
+	}
+
+	parsed := &archive{}
+	imported := &conversation{Topic: options.Topic}
+	for _, entry := range entries {
+		sentAt, err := entry.time(order, options.Location)
+		if err != nil {
+			return nil, err
+		}
+		imported.Messages = append(imported.Messages, importedMessage{
+			Sender:  parsed.participant("whatsapp:"+entry.sender, entry.sender, "").Key,
+			Content: strings.TrimSpace(entry.content),
+			SentAt:  sentAt,
+		})
+	}
+
+	if options.ChatKey != "" {
+		imported.SourceID = "whatsapp:" + options.ChatKey
+	} else {
+		names := make([]string, 0, len(parsed.Participants))
+		for _, p := range parsed.Participants {
+			names = append(names, p.Name)
+		}
+		sort.Strings(names)
+		imported.SourceID = "whatsapp:" + hashParts(names...)[:32]
+	}
+
+	// Identical messages sent within the same second are told apart by their rank
+	seen := map[string]int{}
+	for i := range imported.Messages {
+		message := &imported.Messages[i]
+		key := hashParts(imported.SourceID, message.SentAt.UTC().Format(time.RFC3339), message.Sender, message.Content)
+		message.SourceID = imported.SourceID + ":" + key[:32] + "-" + strconv.Itoa(seen[key])
+		seen[key]++
+	}
+	parsed.Conversations = append(parsed.Conversations, imported)
+	return parsed, nil
+}
+
+// readWhatsAppText returns the chat text of a .txt export, or of the .txt inside a .zip export
+func readWhatsAppText(file io.ReaderAt, fileName string, size int64) (string, error) {
+	if size > maxEntrySize && !strings.HasSuffix(strings.ToLower(fileName), ".zip") {
+		return "", fmt.Errorf("the chat file is too large")
+	}
+	head := make([]byte, 4)
+	if n, _ := file.ReadAt(head, 0); n < 4 || !bytes.Equal(head, []byte("PK\x03\x04")) {
+		raw, err := io.ReadAll(io.NewSectionReader(file, 0, size))
+		return string(raw), err
+	}
+
+	reader, err := zip.NewReader(file, size)
+	if err != nil {
+		return "", fmt.Errorf("not a zip archive")
+	}
+	var chat *zip.File
+	for _, f := range reader.File {
+		if strings.HasSuffix(strings.ToLower(f.Name), ".txt") && (chat == nil || path.Base(f.Name) == "_chat.txt") {
+			chat = f
+		}
+	}
+	if chat == nil {
+		return "", fmt.Errorf("the archive contains no chat .txt file")
+	}
+	if chat.UncompressedSize64 > uint64(maxEntrySize) {
+		return "", fmt.Errorf("the chat file is too large")
+	}
+	r, err := chat.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(io.LimitReader(r, maxEntrySize+1))
+	if int64(len(raw)) > maxEntrySize {
+		return "", fmt.Errorf("the chat file is too large")
+	}
+	return string(raw), err
+}
+
+// detectDateOrder looks for a day over 12 to tell 03/04 (3 April) from 03/04 (March 4).
+// Exports that never show one are read day first, the more common order.
+func detectDateOrder(entries []*whatsAppEntry) string {
+	for _, entry := range entries {
+		first, _ := strconv.Atoi(entry.date[0])
+		second, _ := strconv.Atoi(entry.date[1])
+		if first > 12 && len(entry.date[0]) <= 2 {
+			return dateOrderDMY
+		}
+		if second > 12 {
+			return dateOrderMDY
+		}
+	}
+	return dateOrderDMY
+}
+
+// time interprets the entry's date and time, year first dates are recognised by their four digits
+func (e *whatsAppEntry) time(order string, location *time.Location) (time.Time, error) {
+	var year, month, day int
+	first, _ := strconv.Atoi(e.date[0])
+	second, _ := strconv.Atoi(e.date[1])
+	third, _ := strconv.Atoi(e.date[2])
+	switch {
+	case len(e.date[0]) == 4:
+		year, month, day = first, second, third
+	case order == dateOrderMDY:
+		month, day, year = first, second, third
+	default:
+		day, month, year = first, second, third
+	}
+	if year < 100 {
+		year += 2000
+	}
+
+	hour := e.hour
+	switch e.ampm {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+
+	at := time.Date(year, time.Month(month), day, hour, e.minute, e.second, 0, location)
+	// time.Date normalises 31/02 into March, such dates mean the order is wrong
+	if at.Day() != day || int(at.Month()) != month || hour > 23 || e.minute > 59 || e.second > 59 {
+		return time.Time{}, fmt.Errorf("invalid date %s/%s/%s, check the date_order", e.date[0], e.date[1], e.date[2])
+	}
+	return at.UTC(), nil
+}
+
+// hashParts is the hex SHA-256 of parts separated by NUL bytes
+func hashParts(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
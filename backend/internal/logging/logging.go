@@ -0,0 +1,200 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader is read from incoming requests and echoed on every response
+const RequestIDHeader = "X-Request-ID"
+
+// Common attribute keys, kept identical across packages so logs can be filtered on them
+const (
+	KeyRequestID = "request_id"
+	KeyConnID    = "conn_id"
+	KeyUserID    = "user_id"
+	KeyChatID    = "chat_id"
+	KeyTraceID   = "trace_id"
+	KeyError     = "error"
+)
+
+const redactedValue = "[REDACTED]"
+
+// sensitiveKeys are redacted wherever they appear, unless LOG_REDACT=false
+var sensitiveKeys = map[string]struct{}{
+	"content":       {},
+	"message_body":  {},
+	"raw":           {},
+	"token":         {},
+	"authorization": {},
+	"password":      {},
+	"secret":        {},
+}
+
+var redact = true
+
+type contextKey struct{}
+
+// Init configures the default slog logger from the environment:
+//   - LOG_LEVEL:  debug, info (default), warn, error
+//   - LOG_FORMAT: json (default) or text
+//   - LOG_REDACT: false to log message bodies and tokens, for local debugging only
+func Init() {
+	slog.SetDefault(New(os.Stdout, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"), os.Getenv("LOG_REDACT") != "false"))
+}
+
+// New builds a logger writing to w with the given level, format and redaction policy
+func New(w io.Writer, level, format string, redactSensitive bool) *slog.Logger {
+	redact = redactSensitive
+
+	opts := &slog.HandlerOptions{
+		Level:       parseLevel(level),
+		ReplaceAttr: replaceAttr,
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(format, "text") {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(handler)
+}
+
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// replaceAttr masks sensitive attributes before they reach the output
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if !redact {
+		return a
+	}
+	if _, sensitive := sensitiveKeys[strings.ToLower(a.Key)]; sensitive {
+		return slog.String(a.Key, redactedValue)
+	}
+	return a
+}
+
+// Redact returns an attribute that is masked unless redaction is disabled.
+// Use it for values whose key isn't in the sensitive list.
+func Redact(key, value string) slog.Attr {
+	if redact {
+		return slog.String(key, redactedValue)
+	}
+	return slog.String(key, value)
+}
+
+// Err is a shorthand for the error attribute
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.String(KeyError, "")
+	}
+	return slog.String(KeyError, err.Error())
+}
+
+// Fatal logs at error level and exits, replacing log.Fatal
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// WithContext stores logger in ctx
+func WithContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+// NewRequestID returns a random hex identifier
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Middleware assigns a request ID (reusing a sane incoming X-Request-ID), attaches a
+// request-scoped logger to the request context and writes one access log line per request
+func Middleware(c *gin.Context) {
+	start := time.Now()
+
+	requestID := c.GetHeader(RequestIDHeader)
+	if requestID == "" || len(requestID) > 64 {
+		requestID = NewRequestID()
+	}
+	c.Header(RequestIDHeader, requestID)
+
+	logger := slog.Default().With(KeyRequestID, requestID)
+	if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.HasTraceID() {
+		logger = logger.With(KeyTraceID, spanContext.TraceID().String())
+	}
+	c.Request = c.Request.WithContext(WithContext(c.Request.Context(), logger))
+
+	c.Next()
+
+	attrs := []any{
+		"method", c.Request.Method,
+		"route", c.FullPath(),
+		"status", c.Writer.Status(),
+		"latency_ms", time.Since(start).Milliseconds(),
+		"client_ip", c.ClientIP(),
+	}
+	// Paths can hold secrets (incoming webhook tokens), matched requests are
+	// logged and traced by their route only
+	if route := c.FullPath(); route == "" {
+		attrs = append(attrs, "path", c.Request.URL.Path)
+	} else {
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("http.target", route))
+	}
+	if userID := c.GetString(KeyUserID); userID != "" {
+		attrs = append(attrs, KeyUserID, userID)
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, KeyError, c.Errors.String())
+	}
+
+	level := slog.LevelInfo
+	if c.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	logger.Log(c.Request.Context(), level, "http request", attrs...)
+}
+
+// FromGin returns the request-scoped logger, enriched with the authenticated user if known
+func FromGin(c *gin.Context) *slog.Logger {
+	logger := FromContext(c.Request.Context())
+	if userID := c.GetString(KeyUserID); userID != "" {
+		logger = logger.With(KeyUserID, userID)
+	}
+	return logger
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// serve runs a request through Middleware inside a span and returns the access log and the span
+func serve(t *testing.T, method string, target string) (string, sdktrace.ReadOnlySpan) {
+	t.Helper()
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		ctx, span := provider.Tracer("test").Start(c.Request.Context(), "request")
+		span.SetAttributes(attribute.String("http.target", c.Request.URL.Path))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		span.End()
+	})
+	r.Use(Middleware)
+	r.POST("/hooks/:token", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	return logs.String(), spans[0]
+}
+
+func target(span sdktrace.ReadOnlySpan) string {
+	for _, kv := range span.Attributes() {
+		if kv.Key == "http.target" {
+			return kv.Value.AsString()
+		}
+	}
+	return ""
+}
+
+func TestMiddlewareLogsRoutesNotPaths(t *testing.T) {
+	logs, span := serve(t, http.MethodPost, "/hooks/s3cret-token")
+	if strings.Contains(logs, "s3cret-token") {
+		t.Errorf("access log holds the path secret: %s", logs)
+	}
+	if !strings.Contains(logs, "route=/hooks/:token") {
+		t.Errorf("access log without the route: %s", logs)
+	}
+	if got := target(span); got != "/hooks/:token" {
+		t.Errorf("span http.target = %q, want the route", got)
+	}
+}
+
+func TestMiddlewareLogsThePathOfUnmatchedRequests(t *testing.T) {
+	logs, _ := serve(t, http.MethodGet, "/no/such/route")
+	if !strings.Contains(logs, "path=/no/such/route") {
+		t.Errorf("unmatched request logged without its path: %s", logs)
+	}
+}
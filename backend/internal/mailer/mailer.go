@@ -0,0 +1,140 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"backend/internal/health"
+	"backend/internal/logging"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email notifications
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+var current Mailer = LogMailer{}
+
+// Init selects the SMTP mailer when SMTP_HOST is set, otherwise notifications are
+// only logged. The SMTP server is added to the readiness checks.
+//   - SMTP_HOST, SMTP_PORT (default 587)
+//   - SMTP_USERNAME, SMTP_PASSWORD: optional PLAIN authentication
+//   - SMTP_FROM: sender address
+func Init() {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		slog.Info("SMTP_HOST not set, email notifications will only be logged")
+		return
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	smtpMailer := &SMTPMailer{
+		Addr:     net.JoinHostPort(host, port),
+		Host:     host,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+	current = smtpMailer
+	health.RegisterCheck("mailer", smtpMailer.Ping)
+}
+
+// Set replaces the mailer, e.g. with a fake in tests
+func Set(m Mailer) {
+	current = m
+}
+
+// Send delivers message with the configured mailer
+func Send(ctx context.Context, message Message) error {
+	return current.Send(ctx, message)
+}
+
+// SendAsync delivers message in the background so the caller's latency doesn't
+// depend on the mail server, logging failures
+func SendAsync(ctx context.Context, message Message) {
+	logger := logging.FromContext(ctx)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if err := current.Send(ctx, message); err != nil {
+			logger.Error("Failed to send email", "subject", message.Subject, logging.Err(err))
+		}
+	}()
+}
+
+// LogMailer only logs that a message would have been sent; the body may contain
+// personal data so it is never logged
+type LogMailer struct{}
+
+// Send implements Mailer
+func (LogMailer) Send(ctx context.Context, message Message) error {
+	logging.FromContext(ctx).Info("Email not sent, no SMTP server configured", "subject", message.Subject)
+	return nil
+}
+
+// SMTPMailer sends through an SMTP server using STARTTLS when offered
+type SMTPMailer struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send implements Mailer
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	// Reject header injection through the recipient or subject
+	if strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(message.Subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.From, message.To, message.Subject, message.Body)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- smtp.SendMail(m.Addr, auth, m.From, []string{message.To}, []byte(body))
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			return fmt.Errorf("could not send email: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ping checks that the SMTP server accepts connections
+func (m *SMTPMailer) Ping(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
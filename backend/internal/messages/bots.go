@@ -0,0 +1,274 @@
+package messages
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/internal/outbound"
+	"backend/mongodb"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bot is an in-process bot acting as a bot account (see auth.CreateBot). It sees
+// every new message of the chats its account is a member of, apart from messages
+// sent by in-process bots, which keeps two bots from talking to each other forever.
+type Bot interface {
+	// UserID is the bot account the bot posts as
+	UserID() string
+	// OnMessage runs in its own goroutine for each new message, reply posts to
+	// the same chat as the bot
+	OnMessage(ctx context.Context, message models.Message, reply func(content string) error)
+}
+
+// Bot command callbacks must answer within this time
+const botCallbackTimeout = 5 * time.Second
+
+// Values of botCallbackResponse.ResponseType
+const (
+	ResponseEphemeral = "ephemeral"
+	ResponseInChannel = "in_channel"
+)
+
+var (
+	botsMu sync.RWMutex
+	bots   = map[string]Bot{}
+
+	botClient = outbound.NewClient(botCallbackTimeout)
+
+	commandNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+)
+
+// RegisterBot starts delivering messages to bot, replacing any bot registered for the same account
+func RegisterBot(bot Bot) {
+	botsMu.Lock()
+	defer botsMu.Unlock()
+	bots[bot.UserID()] = bot
+}
+
+// notifyBots hands a saved message to the in-process bots that are members of its chat
+func notifyBots(ctx context.Context, members []string, message models.Message) {
+	botsMu.RLock()
+	defer botsMu.RUnlock()
+	if len(bots) == 0 {
+		return
+	}
+	if _, fromBot := bots[message.Sender]; fromBot {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	for _, member := range members {
+		bot, ok := bots[member]
+		if !ok || member == message.Sender {
+			continue
+		}
+		reply := func(content string) error {
+			_, err := SendMessage(ctx, message.ChatID, models.Message{Sender: bot.UserID(), Content: content})
+			return err
+		}
+		go bot.OnMessage(ctx, message, reply)
+	}
+}
+
+// botCallbackRequest is POSTed to a bot command's callback URL, signed with the
+// command's secret in the outbound.HeaderSignature header
+type botCallbackRequest struct {
+	Command  string `json:"command"`
+	Text     string `json:"text"`
+	ChatID   string `json:"chat_id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// botCallbackResponse is the optional JSON answer of a callback. Ephemeral answers
+// are shown to the invoker only, in_channel ones are posted to the chat as the bot.
+type botCallbackResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// callBotCommand forwards a command to its bot and turns the answer into a response
+func callBotCommand(ctx context.Context, botCommand *models.BotCommand, command Command) (*CommandResponse, error) {
+	body, err := json.Marshal(botCallbackRequest{
+		Command:  botCommand.Name,
+		Text:     command.Args,
+		ChatID:   command.ChatID,
+		UserID:   command.UserID,
+		Username: command.Username,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, botCommand.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "chat-commands/1.0")
+	request.Header.Set(outbound.HeaderSignature, outbound.Sign(botCommand.Secret, time.Now(), body))
+
+	response, err := botClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("bot answered %s", response.Status)
+	}
+
+	var answer botCallbackResponse
+	raw, err := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	// An empty body means the bot has nothing to say
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(raw, &answer); err != nil {
+		return nil, fmt.Errorf("invalid bot answer: %v", err)
+	}
+	if answer.ResponseType != "" && answer.ResponseType != ResponseEphemeral && answer.ResponseType != ResponseInChannel {
+		return nil, fmt.Errorf("invalid bot response_type %q", answer.ResponseType)
+	}
+	if answer.Text == "" {
+		return nil, nil
+	}
+	if len(answer.Text) > MaxMessageLength {
+		return nil, fmt.Errorf("bot answer longer than %d characters", MaxMessageLength)
+	}
+
+	if answer.ResponseType == ResponseInChannel {
+		return &CommandResponse{Message: &models.Message{Sender: botCommand.BotID, Content: answer.Text}}, nil
+	}
+	return &CommandResponse{Ephemeral: answer.Text}, nil
+}
+
+// ownedBot loads the bot named by :id if the caller owns it, answering 404 otherwise
+func ownedBot(c *gin.Context) *models.User {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return nil
+	}
+	bot, err := mongodb.FindUserById(c.Request.Context(), c.Param("id"))
+	if err != nil || bot == nil || !bot.Bot || bot.BotOwner != principal.ID {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Bot not found"})
+		return nil
+	}
+	return bot
+}
+
+// CreateBotCommand registers a slash command served by the bot's HTTP callback. The
+// command only runs in the chats the bot is a member of. The signing secret is only
+// returned here.
+func CreateBotCommand(c *gin.Context) {
+	bot := ownedBot(c)
+	if bot == nil {
+		return
+	}
+
+	var payload struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		CallbackURL string `json:"callback_url"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	if !commandNamePattern.MatchString(payload.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The name must be 2-32 lower case letters, digits, - or _", "fieldError": "name"})
+		return
+	}
+	if IsRegisteredCommand(payload.Name) {
+		c.JSON(http.StatusConflict, gin.H{"message": "This command is built in", "fieldError": "name"})
+		return
+	}
+	target, err := url.Parse(payload.CallbackURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "A valid http(s) URL is required", "fieldError": "callback_url"})
+		return
+	}
+	if len(payload.Description) > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The description can be at most 200 characters", "fieldError": "description"})
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create command"})
+		return
+	}
+
+	command := &models.BotCommand{
+		Name:        payload.Name,
+		Description: payload.Description,
+		BotID:       bot.ID,
+		CallbackURL: target.String(),
+		Secret:      "cmdsec_" + hex.EncodeToString(secret),
+		CreatedBy:   auth.CurrentPrincipal(c).ID,
+		CreatedAt:   time.Now(),
+	}
+	if err := mongodb.InsertBotCommand(c.Request.Context(), command); err != nil {
+		if errors.Is(err, mongodb.ErrCommandTaken) {
+			c.JSON(http.StatusConflict, gin.H{"message": "This bot already has a command with this name", "fieldError": "name"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create command"})
+		return
+	}
+
+	logging.FromGin(c).Info("Bot command created", "bot_id", bot.ID, "command", command.Name)
+	c.JSON(http.StatusCreated, gin.H{"command": command, "secret": command.Secret})
+}
+
+// ListBotCommands lists the commands of one of the caller's bots
+func ListBotCommands(c *gin.Context) {
+	bot := ownedBot(c)
+	if bot == nil {
+		return
+	}
+
+	commands, err := mongodb.ListBotCommands(c.Request.Context(), []string{bot.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list commands"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": commands})
+}
+
+// DeleteBotCommand unregisters a command of one of the caller's bots
+func DeleteBotCommand(c *gin.Context) {
+	bot := ownedBot(c)
+	if bot == nil {
+		return
+	}
+
+	deleted, err := mongodb.DeleteBotCommand(c.Request.Context(), bot.ID, c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete command"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Command not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Command deleted"})
+}
@@ -0,0 +1,406 @@
+package messages
+
+import (
+	"backend/internal/events"
+	"backend/internal/logging"
+	"backend/internal/metrics"
+	"backend/internal/models"
+	"backend/internal/privacy"
+	"backend/mongodb"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// FrameEphemeral is a message shown only to the user who ran a command, it is never stored
+const FrameEphemeral = "ephemeral"
+
+// Types of the messages posted by the built-in commands
+const (
+	MessageTypeMe          = "me"
+	MessageTypeTopic       = "topic"
+	MessageTypeMemberAdded = "member_added"
+)
+
+const (
+	maxTopicLength = 250
+	// Reminders live in memory, a restart forgets them
+	maxReminderDelay = 24 * time.Hour
+	// Reminders a user can have pending on an instance
+	maxPendingReminders = 10
+)
+
+var (
+	remindersMu sync.Mutex
+	// pendingReminders counts the scheduled reminders of each user
+	pendingReminders = map[string]int{}
+)
+
+// EphemeralMessage is the frame carrying a command's private answer
+type EphemeralMessage struct {
+	Type    string    `json:"type"`
+	ChatID  string    `json:"chat_id"`
+	Sender  string    `json:"sender,omitempty"`
+	Content string    `json:"content"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// Command is a slash command typed in a chat, e.g. "/topic Release planning"
+type Command struct {
+	// Name is lower case, without the slash
+	Name string
+	// Args is the rest of the line, trimmed
+	Args     string
+	ChatID   string
+	UserID   string
+	Username string
+}
+
+// CommandResponse is the outcome of a command: Ephemeral is shown to the invoker
+// only, Message is posted to the chat (as the invoker unless its Sender is set)
+type CommandResponse struct {
+	Ephemeral string
+	Message   *models.Message
+}
+
+// CommandHandler runs a command. Mistakes of the user are answered with an ephemeral
+// response, errors are reserved for failures of the server.
+type CommandHandler func(ctx context.Context, command Command) (*CommandResponse, error)
+
+type commandSpec struct {
+	usage       string
+	description string
+	handler     CommandHandler
+}
+
+var (
+	commandsMu sync.RWMutex
+	commands   = map[string]commandSpec{}
+)
+
+func init() {
+	RegisterCommand("help", "/help", "List the available commands", helpCommand)
+	RegisterCommand("me", "/me <action>", "Post an action, e.g. /me waves", meCommand)
+	RegisterCommand("shrug", "/shrug [message]", `Append ¯\_(ツ)_/¯ to your message`, shrugCommand)
+	RegisterCommand("topic", "/topic [topic]", "Show or set the topic of the chat", topicCommand)
+	RegisterCommand("invite", "/invite @username", "Add a user to the group, or start a group from a direct chat", inviteCommand)
+	RegisterCommand("remind", "/remind <duration> <text>", "Remind yourself, e.g. /remind 10m stand-up", remindCommand)
+}
+
+// RegisterCommand adds an in-process command, replacing any command with the same
+// name. Registered commands take precedence over the commands of external bots.
+func RegisterCommand(name, usage, description string, handler CommandHandler) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	commands[strings.ToLower(name)] = commandSpec{usage: usage, description: description, handler: handler}
+}
+
+// IsRegisteredCommand reports whether name is served in-process
+func IsRegisteredCommand(name string) bool {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	_, ok := commands[strings.ToLower(name)]
+	return ok
+}
+
+// parseCommand splits "/name args" and reports whether content is a command at all.
+// "//text" escapes the slash and is sent as the message "/text".
+func parseCommand(content string) (name, args string, ok bool) {
+	if !strings.HasPrefix(content, "/") || strings.HasPrefix(content, "//") {
+		return "", "", false
+	}
+	name, args, _ = strings.Cut(strings.TrimPrefix(content, "/"), " ")
+	if name == "" {
+		return "", "", false
+	}
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+// handleCommand runs a slash command received on conn. Built-in and registered
+// commands answer right away; bot commands are called in the background so a slow
+// bot doesn't hold up the socket.
+func handleCommand(ctx context.Context, conn *websocket.Conn, userID string, message models.Message) {
+	logger := logging.FromContext(ctx)
+	name, args, _ := parseCommand(message.Content)
+	reply := func(text string) {
+		enqueue(ctx, conn, EphemeralMessage{Type: FrameEphemeral, ChatID: message.ChatID, Content: text, SentAt: time.Now()})
+	}
+
+	chat, err := mongodb.FindUserChat(ctx, message.ChatID, userID)
+	if err != nil || chat == nil {
+		reply("Chat not found")
+		return
+	}
+	user, err := mongodb.FindUserByIdCached(ctx, userID)
+	if err != nil || user == nil {
+		reply("Command failed, try again later")
+		return
+	}
+	command := Command{Name: name, Args: args, ChatID: message.ChatID, UserID: userID, Username: user.Username}
+
+	commandsMu.RLock()
+	spec, builtin := commands[name]
+	commandsMu.RUnlock()
+	if !builtin {
+		// Bot commands only reach the bots that are members of the chat
+		botCommand, err := mongodb.FindBotCommandByName(ctx, name, chat.Users)
+		if err != nil {
+			logger.Error("Could not look up bot command", "command", name, logging.Err(err))
+			reply("Command failed, try again later")
+			return
+		}
+		if botCommand == nil {
+			metrics.SlashCommands.WithLabelValues(metrics.CommandUnknown, metrics.CommandFailed).Inc()
+			reply(fmt.Sprintf("Unknown command /%s, type /help for the list of commands", name))
+			return
+		}
+		go func() {
+			ctx := context.WithoutCancel(ctx)
+			response, err := callBotCommand(ctx, botCommand, command)
+			deliverCommandResponse(ctx, metrics.CommandBot, command, response, err, reply)
+		}()
+		return
+	}
+
+	response, err := spec.handler(ctx, command)
+	deliverCommandResponse(ctx, metrics.CommandBuiltin, command, response, err, reply)
+}
+
+// deliverCommandResponse posts the public part of a response and sends the private part
+func deliverCommandResponse(ctx context.Context, kind string, command Command, response *CommandResponse, err error, reply func(string)) {
+	if err != nil {
+		logging.FromContext(ctx).Error("Command failed", "command", command.Name, logging.Err(err))
+		metrics.SlashCommands.WithLabelValues(kind, metrics.CommandFailed).Inc()
+		reply(fmt.Sprintf("/%s failed, try again later", command.Name))
+		return
+	}
+	metrics.SlashCommands.WithLabelValues(kind, metrics.CommandOK).Inc()
+	if response == nil {
+		return
+	}
+
+	if response.Message != nil {
+		posted := *response.Message
+		if posted.Sender == "" {
+			posted.Sender = command.UserID
+		}
+		if _, err := SendMessage(ctx, command.ChatID, posted); err != nil {
+			switch {
+			case errors.Is(err, ErrChatNotFound) && posted.Sender != command.UserID:
+				reply("The bot is not a member of this chat, add it with /invite first")
+			case errors.Is(err, ErrNoRecipients):
+				reply("There is nobody else in this chat")
+			case errors.Is(err, ErrBlocked):
+				reply("You can't send messages to this chat")
+			case errors.Is(err, ErrMuted):
+				reply("This message can't be sent, its sender is muted")
+			case errors.Is(err, ErrSenderDisabled):
+				reply("This message can't be sent, its sender is disabled")
+			default:
+				reply("Your message could not be sent")
+			}
+			return
+		}
+	}
+	if response.Ephemeral != "" {
+		reply(response.Ephemeral)
+	}
+}
+
+func ephemeral(text string) (*CommandResponse, error) {
+	return &CommandResponse{Ephemeral: text}, nil
+}
+
+func messageOfType(messageType, content string) *models.Message {
+	return &models.Message{Type: &messageType, Content: content}
+}
+
+func helpCommand(ctx context.Context, command Command) (*CommandResponse, error) {
+	commandsMu.RLock()
+	lines := make([]string, 0, len(commands))
+	for _, spec := range commands {
+		lines = append(lines, spec.usage+" - "+spec.description)
+	}
+	commandsMu.RUnlock()
+	sort.Strings(lines)
+
+	chat, err := mongodb.FindChatById(ctx, command.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	if chat == nil {
+		return ephemeral("This chat no longer exists")
+	}
+	botCommands, err := mongodb.ListBotCommands(ctx, chat.Users)
+	if err != nil {
+		return nil, err
+	}
+	for _, botCommand := range botCommands {
+		lines = append(lines, "/"+botCommand.Name+" - "+botCommand.Description)
+	}
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+func meCommand(_ context.Context, command Command) (*CommandResponse, error) {
+	if command.Args == "" {
+		return ephemeral("Usage: /me <action>")
+	}
+	return &CommandResponse{Message: messageOfType(MessageTypeMe, command.Args)}, nil
+}
+
+func shrugCommand(_ context.Context, command Command) (*CommandResponse, error) {
+	content := strings.TrimSpace(command.Args + ` ¯\_(ツ)_/¯`)
+	return &CommandResponse{Message: messageOfType("message", content)}, nil
+}
+
+// topicCommand shows the topic without arguments and sets it otherwise, the change
+// is announced with a "topic" message carrying the new topic
+func topicCommand(ctx context.Context, command Command) (*CommandResponse, error) {
+	if command.Args == "" {
+		chat, err := mongodb.FindUserChat(ctx, command.ChatID, command.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if chat.Topic == "" {
+			return ephemeral("This chat has no topic, set one with /topic <topic>")
+		}
+		return ephemeral("Topic: " + chat.Topic)
+	}
+
+	if len([]rune(command.Args)) > maxTopicLength {
+		return ephemeral(fmt.Sprintf("The topic can be at most %d characters", maxTopicLength))
+	}
+	if err := mongodb.SetChatTopic(ctx, command.ChatID, command.Args); err != nil {
+		return nil, err
+	}
+	return &CommandResponse{Message: messageOfType(MessageTypeTopic, command.Args)}, nil
+}
+
+// inviteCommand adds a user to the chat, which turns a direct chat into a group
+func inviteCommand(ctx context.Context, command Command) (*CommandResponse, error) {
+	username := strings.ToLower(strings.TrimPrefix(command.Args, "@"))
+	if username == "" || strings.ContainsAny(username, " \t") {
+		return ephemeral("Usage: /invite @username")
+	}
+
+	invited, err := mongodb.FindUserByUsername(ctx, username, false)
+	if err != nil {
+		return nil, err
+	}
+	if invited == nil || invited.Disabled {
+		return ephemeral("No user named @" + username)
+	}
+	if isUserInChat(ctx, invited.ID, command.ChatID) {
+		return ephemeral("@" + username + " is already in this chat")
+	}
+	chat, err := mongodb.FindChatById(ctx, command.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	if chat == nil {
+		return ephemeral("This chat no longer exists")
+	}
+
+	// The invited user must be reachable by the inviter and not blocked either way
+	// by any member, they would share the chat otherwise
+	switch err := privacy.CanReach(ctx, command.UserID, invited.ID); {
+	case errors.Is(err, privacy.ErrBlocked), errors.Is(err, privacy.ErrContactsOnly):
+		return ephemeral("You can't add @" + username + " to this chat")
+	case err != nil:
+		return nil, err
+	}
+	blockedBy, blocking, err := privacy.Blocks(ctx, invited.ID, chat.Users)
+	if err != nil {
+		return nil, err
+	}
+	if len(blockedBy) > 0 || len(blocking) > 0 {
+		return ephemeral("You can't add @" + username + " to this chat")
+	}
+
+	// Direct chats stay between their two members, a group is started instead
+	if !chat.IsGroup() {
+		group := &models.Chat{
+			Users:     append(slices.Clone(chat.Users), invited.ID),
+			Group:     true,
+			CreatedBy: command.UserID,
+			CreatedAt: time.Now(),
+		}
+		if _, err := mongodb.CreateChat(ctx, group); err != nil {
+			return nil, err
+		}
+		logging.FromContext(ctx).Info("Group started from direct chat", logging.KeyChatID, group.ID, "invited_id", invited.ID)
+		events.Publish(ctx, events.Event{Type: events.ChatCreated, ChatID: group.ID, ActorID: command.UserID, Data: *group})
+		return ephemeral("Started a new group with @" + username + ", this chat stays private")
+	}
+
+	// Members added later only see the messages sent from now on
+	if err := mongodb.AddChatMember(ctx, command.ChatID, invited.ID, time.Now()); err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Info("User invited to chat", logging.KeyChatID, command.ChatID, "invited_id", invited.ID)
+	events.Publish(ctx, events.Event{Type: events.ChatMemberAdded, ChatID: command.ChatID, ActorID: command.UserID,
+		Data: models.UserResponse{ID: invited.ID, Username: invited.Username}})
+	return &CommandResponse{Message: messageOfType(MessageTypeMemberAdded, invited.Username)}, nil
+}
+
+// remindCommand schedules an ephemeral reminder for the invoker, "/remind 10m text"
+// or "/remind in 1h30m text". Reminders are kept in memory by the instance the
+// command ran on: they are lost on restart and only reach the invoker's connections
+// to that instance. A user has at most maxPendingReminders at a time.
+func remindCommand(ctx context.Context, command Command) (*CommandResponse, error) {
+	args := strings.TrimPrefix(command.Args, "in ")
+	when, text, _ := strings.Cut(args, " ")
+	delay, err := time.ParseDuration(when)
+	text = strings.TrimSpace(text)
+	if err != nil || delay <= 0 || text == "" {
+		return ephemeral("Usage: /remind <duration> <text>, e.g. /remind 10m stand-up")
+	}
+	if delay > maxReminderDelay {
+		return ephemeral(fmt.Sprintf("Reminders can be at most %s away", maxReminderDelay))
+	}
+
+	if !reserveReminder(command.UserID) {
+		return ephemeral(fmt.Sprintf("You already have %d pending reminders", maxPendingReminders))
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	time.AfterFunc(delay, func() {
+		releaseReminder(command.UserID)
+		SendToUser(ctx, command.UserID, EphemeralMessage{
+			Type:    FrameEphemeral,
+			ChatID:  command.ChatID,
+			Content: "Reminder: " + text,
+			SentAt:  time.Now(),
+		})
+	})
+	return ephemeral(fmt.Sprintf("I will remind you in %s", delay))
+}
+
+// reserveReminder counts a new reminder of userID, unless they have too many pending
+func reserveReminder(userID string) bool {
+	remindersMu.Lock()
+	defer remindersMu.Unlock()
+	if pendingReminders[userID] >= maxPendingReminders {
+		return false
+	}
+	pendingReminders[userID]++
+	return true
+}
+
+// releaseReminder forgets a reminder of userID once it fired
+func releaseReminder(userID string) {
+	remindersMu.Lock()
+	defer remindersMu.Unlock()
+	if pendingReminders[userID] <= 1 {
+		delete(pendingReminders, userID)
+		return
+	}
+	pendingReminders[userID]--
+}
@@ -0,0 +1,79 @@
+package messages
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		content    string
+		name, args string
+		ok         bool
+	}{
+		{"/topic Release planning", "topic", "Release planning", true},
+		{"/ME  waves ", "me", "waves", true},
+		{"/help", "help", "", true},
+		{"//not a command", "", "", false},
+		{"/", "", "", false},
+		{"hello /topic", "", "", false},
+	}
+	for _, tt := range tests {
+		name, args, ok := parseCommand(tt.content)
+		if name != tt.name || args != tt.args || ok != tt.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %v, want %q, %q, %v", tt.content, name, args, ok, tt.name, tt.args, tt.ok)
+		}
+	}
+}
+
+func TestRemindCommandLimitsPendingReminders(t *testing.T) {
+	t.Cleanup(func() {
+		remindersMu.Lock()
+		pendingReminders = map[string]int{}
+		remindersMu.Unlock()
+	})
+	remind := func(userID string) string {
+		response, err := remindCommand(context.Background(), Command{Name: "remind", Args: "1h stand-up", ChatID: "chat-1", UserID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.Ephemeral
+	}
+
+	for i := 0; i < maxPendingReminders; i++ {
+		if got := remind("alice"); !strings.HasPrefix(got, "I will remind you") {
+			t.Fatalf("reminder %d refused: %q", i+1, got)
+		}
+	}
+	if got := remind("alice"); !strings.Contains(got, "pending reminders") {
+		t.Errorf("reminder over the limit answered %q", got)
+	}
+	// The limit is per user
+	if got := remind("bob"); !strings.HasPrefix(got, "I will remind you") {
+		t.Errorf("another user's reminder refused: %q", got)
+	}
+
+	// A reminder that fired frees its place
+	releaseReminder("alice")
+	if got := remind("alice"); !strings.HasPrefix(got, "I will remind you") {
+		t.Errorf("reminder after one fired refused: %q", got)
+	}
+}
+
+func TestRemindCommandUsage(t *testing.T) {
+	for _, args := range []string{"", "10m", "soon stand-up", "-5m stand-up", "48h stand-up"} {
+		response, err := remindCommand(context.Background(), Command{Name: "remind", Args: args, UserID: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(response.Ephemeral, "I will remind you") {
+			t.Errorf("/remind %s scheduled a reminder", args)
+		}
+	}
+	remindersMu.Lock()
+	defer remindersMu.Unlock()
+	if pendingReminders["alice"] != 0 {
+		t.Errorf("refused reminders counted: %d", pendingReminders["alice"])
+	}
+}
@@ -0,0 +1,80 @@
+package messages
+
+import (
+	"backend/internal/logging"
+	"backend/internal/models"
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnectionStats is a snapshot of the sockets open on this instance
+type ConnectionStats struct {
+	OnlineUsers int            `json:"online_users"`
+	Connections int            `json:"connections"`
+	PerUser     map[string]int `json:"per_user"`
+	Draining    bool           `json:"draining"`
+}
+
+// Stats counts the users and sockets connected to this instance
+func Stats() ConnectionStats {
+	stats := ConnectionStats{PerUser: map[string]int{}, Draining: draining.Load()}
+	clients.Range(func(key, value interface{}) bool {
+		userID, ok := key.(string)
+		if !ok {
+			return true
+		}
+		count := len(value.(*ClientInfo).GetConnections())
+		stats.OnlineUsers++
+		stats.Connections += count
+		stats.PerUser[userID] = count
+		return true
+	})
+	return stats
+}
+
+// IsOnline reports whether a user has a socket open on this instance
+func IsOnline(userID string) bool {
+	_, ok := clients.Load(userID)
+	return ok
+}
+
+// SendToUser delivers a frame to every socket of a user on this instance
+func SendToUser(ctx context.Context, userID string, frame interface{}) {
+	clientInfoRaw, ok := clients.Load(userID)
+	if !ok {
+		return
+	}
+	for _, conn := range clientInfoRaw.(*ClientInfo).GetConnections() {
+		enqueue(ctx, conn, frame)
+	}
+}
+
+// DisconnectUser closes every socket of a user, on every instance, with a policy
+// violation close frame and returns how many were closed on this instance. The
+// read loop of each socket then cleans up as for any other disconnection.
+func DisconnectUser(ctx context.Context, userID string, reason string) int {
+	relay(ctx, &models.RelayedFrame{UserIDs: []string{userID}, CloseReason: reason})
+	return disconnectLocalUser(userID, reason)
+}
+
+// disconnectLocalUser closes the sockets of a user on this instance
+func disconnectLocalUser(userID string, reason string) int {
+	clientInfoRaw, ok := clients.Load(userID)
+	if !ok {
+		return 0
+	}
+
+	conns := clientInfoRaw.(*ClientInfo).GetConnections()
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	deadline := time.Now().Add(time.Second)
+	for _, conn := range conns {
+		if err := conn.WriteControl(websocket.CloseMessage, closeMessage, deadline); err != nil && err != websocket.ErrCloseSent {
+			slog.Debug("Error sending close frame", logging.KeyUserID, userID, logging.Err(err))
+		}
+		conn.Close()
+	}
+	return len(conns)
+}
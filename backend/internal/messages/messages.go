@@ -2,22 +2,35 @@ package messages
 
 import (
 	"backend/internal/auth"
+	"backend/internal/events"
+	"backend/internal/logging"
+	"backend/internal/metrics"
 	"backend/internal/models"
+	"backend/internal/privacy"
+	"backend/internal/ratelimit"
+	"backend/internal/tracing"
 	"backend/internal/utils"
 	"backend/mongodb"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	mathrand "math/rand"
 	"net/http"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var upgrader = websocket.Upgrader{
@@ -30,13 +43,33 @@ var upgrader = websocket.Upgrader{
 
 // Broadcast job for sending messages
 type broadcastJob struct {
-	message interface{}
-	conn    *websocket.Conn
+	ctx        context.Context // carries the span of the pipeline that produced the job
+	message    interface{}
+	conn       *websocket.Conn
+	enqueuedAt time.Time
 }
 
 // Broadcast queue with buffer
 var broadcastQueue = make(chan broadcastJob, 1000)
 
+var (
+	// queueMu guards queueClosed so no job is sent on a closed broadcastQueue
+	queueMu     sync.RWMutex
+	queueClosed bool
+	// queueClosing is closed by Shutdown before it takes queueMu, it wakes the
+	// senders waiting on a full queue so they let go of the lock
+	queueClosing = make(chan struct{})
+
+	// How long a worker waits on a socket before giving up on the frame
+	writeWait = 10 * time.Second
+
+	// workersWg tracks the broadcast workers so shutdown can wait for the queue to flush
+	workersWg sync.WaitGroup
+
+	// draining is set once shutdown starts; new upgrades are rejected from then on
+	draining atomic.Bool
+)
+
 // ClientInfo stores multiple WebSocket connections for a single user
 type ClientInfo struct {
 	mu          sync.RWMutex
@@ -46,6 +79,26 @@ type ClientInfo struct {
 const (
 	ConnectionStatusConnect    = "connect"
 	ConnectionStatusDisconnect = "disconnect"
+	ServerShutdown             = "server.shutdown"
+	FrameError                 = "error"
+)
+
+// MaxMessageLength is the longest message accepted over REST and the socket
+const MaxMessageLength = 4000
+
+// Error codes sent in error frames
+const (
+	ErrorCodeRateLimited = "rate_limited"
+	ErrorCodeBlocked     = "blocked"
+	ErrorCodeMuted       = "muted"
+	ErrorCodeInvalid     = "invalid_message"
+)
+
+// Clients are told to wait between these bounds before reconnecting,
+// so that a rolling deploy doesn't receive every socket at the same instant
+const (
+	reconnectMinDelay = 1 * time.Second
+	reconnectMaxDelay = 5 * time.Second
 )
 
 // New struct for connection status message
@@ -54,6 +107,43 @@ type ConnectionStatusMessage struct {
 	OnlineUsers []*models.UserResponse `json:"online_users"`
 }
 
+// ShutdownMessage is sent to every connection before the server closes it
+type ShutdownMessage struct {
+	Type             string `json:"type"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
+// ErrorFrame reports a rejected inbound frame back to the connection that sent it
+type ErrorFrame struct {
+	Type         string `json:"type"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	ChatID       string `json:"chat_id,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
+
+// inboundMessage is what a client may send over the socket, everything else
+// about the message (sender, type, webhook identity, attachments) is set here
+type inboundMessage struct {
+	ChatID       string            `json:"chat_id"`
+	Content      string            `json:"content"`
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// readFrame decodes a client frame, only the chat, the content and the trace context are read from it
+func readFrame(p []byte) (models.Message, map[string]string, error) {
+	var inbound inboundMessage
+	if err := json.Unmarshal(p, &inbound); err != nil {
+		return models.Message{}, nil, err
+	}
+	return models.Message{ChatID: inbound.ChatID, Content: inbound.Content}, inbound.TraceContext, nil
+}
+
+// validContent reports whether content can be sent as a message
+func validContent(content string) bool {
+	return strings.TrimSpace(content) != "" && len(content) <= MaxMessageLength
+}
+
 // Clients map to store multiple connections per user
 var clients = sync.Map{}
 
@@ -85,11 +175,16 @@ func (ci *ClientInfo) RemoveConnection(clientID string) {
 	delete(ci.Connections, clientID)
 }
 
-// GetConnections returns all connections for a user
+// GetConnections returns a copy of all connections for a user, safe to range
+// over while connections come and go
 func (ci *ClientInfo) GetConnections() map[string]*websocket.Conn {
 	ci.mu.RLock()
 	defer ci.mu.RUnlock()
-	return ci.Connections
+	connections := make(map[string]*websocket.Conn, len(ci.Connections))
+	for clientID, conn := range ci.Connections {
+		connections[clientID] = conn
+	}
+	return connections
 }
 
 // IsEmpty checks if the user has no active connections
@@ -104,29 +199,86 @@ func init() {
 	// Start workers based on available CPU cores
 	numWorkers := runtime.NumCPU()
 	for i := 0; i < numWorkers; i++ {
+		workersWg.Add(1)
 		go broadcastWorker()
 	}
+
+	metrics.RegisterGaugeFunc("broadcast", "queue_depth", "Jobs waiting in the broadcast queue.", func() float64 {
+		return float64(len(broadcastQueue))
+	})
+	metrics.RegisterGaugeFunc("websocket", "online_users", "Distinct users with at least one open WebSocket.", func() float64 {
+		count := 0
+		clients.Range(func(key, value interface{}) bool {
+			count++
+			return true
+		})
+		return float64(count)
+	})
+}
+
+// enqueue hands a message to the broadcast workers, waiting while the queue is full.
+// It reports false when ctx is done first or the queue has been closed by Shutdown.
+func enqueue(ctx context.Context, conn *websocket.Conn, message interface{}) bool {
+	queueMu.RLock()
+	defer queueMu.RUnlock()
+	if queueClosed {
+		metrics.BroadcastDropped.WithLabelValues(metrics.DropQueueClosed).Inc()
+		return false
+	}
+	job := broadcastJob{
+		ctx:        ctx,
+		message:    message,
+		conn:       conn,
+		enqueuedAt: time.Now(),
+	}
+	select {
+	case broadcastQueue <- job:
+		return true
+	case <-ctx.Done():
+		metrics.BroadcastDropped.WithLabelValues(metrics.DropCanceled).Inc()
+	case <-queueClosing:
+		metrics.BroadcastDropped.WithLabelValues(metrics.DropQueueClosed).Inc()
+	}
+	return false
 }
 
 // Broadcast worker to send messages
 func broadcastWorker() {
-	log.Println("Broadcasting worker started...")
+	defer workersWg.Done()
+	slog.Debug("Broadcasting worker started")
 	for job := range broadcastQueue {
-		if err := job.conn.WriteJSON(job.message); err != nil {
+		_, span := tracing.Tracer().Start(job.ctx, "ws.write",
+			trace.WithAttributes(attribute.Int64("queue.wait_ms", time.Since(job.enqueuedAt).Milliseconds())))
+		// A stalled client must not hold the worker up for the others
+		err := job.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err == nil {
+			err = job.conn.WriteJSON(job.message)
+		}
+		tracing.RecordError(span, err)
+		span.End()
+
+		if err != nil {
+			metrics.BroadcastDropped.WithLabelValues(metrics.DropWriteError).Inc()
 			if websocket.IsUnexpectedCloseError(err) {
-				log.Printf("Connection closed unexpectedly: %v", err)
+				slog.Info("Connection closed unexpectedly", logging.Err(err))
 				continue
 			}
-			log.Println("Error broadcasting message:", err)
+			slog.Warn("Error broadcasting message", logging.Err(err))
 		}
 	}
 }
 
 // HandleWebSocket manages WebSocket connection for users
 func HandleWebSocket(c *gin.Context) {
+	// Refuse new sockets while draining, the client will retry on another instance
+	if draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Server is shutting down"})
+		return
+	}
+
 	// Generate a unique client ID for this connection
 	clientID := GenerateUniqueID()
-	log.Println("ClientID", clientID)
+	logger := logging.FromGin(c).With(logging.KeyConnID, clientID)
 	// Retrieve token from request
 	token := utils.RetriveTokenFromRequestHttp(c)
 
@@ -147,13 +299,15 @@ func HandleWebSocket(c *gin.Context) {
 
 	// Validate token
 	if token == nil || *token == "" {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthMissingToken).Inc()
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "Authorization token is required"})
 		return
 	}
 
 	// Authenticate user
-	user, err := auth.GetUserFromToken(*token)
+	user, err := auth.GetUserFromToken(c.Request.Context(), *token)
 	if err != nil || user == nil {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidToken).Inc()
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
 		return
 	}
@@ -161,27 +315,42 @@ func HandleWebSocket(c *gin.Context) {
 	// Upgrade to WebSocket connection
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Printf("Error upgrading websocket connection: %v\n", err)
+		logger.Warn("Error upgrading websocket connection", logging.KeyUserID, user.ID, logging.Err(err))
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
+	logger = logger.With(logging.KeyUserID, user.ID)
+	logger.Info("WebSocket connected")
+
+	// The socket outlives the upgrade request: keep its values (logger, span) but not its cancellation
+	connCtx := logging.WithContext(context.WithoutCancel(c.Request.Context()), logger)
+
 	// Retrieve or create ClientInfo for the user
 	clientInfoRaw, _ := clients.LoadOrStore(user.ID, &ClientInfo{})
 	clientInfo := clientInfoRaw.(*ClientInfo)
 
 	// Add this specific connection to the user's connections
+	firstConnection := clientInfo.IsEmpty()
 	clientInfo.AddConnection(clientID, conn)
+	metrics.WebSocketConnections.Inc()
+	if firstConnection {
+		events.Publish(connCtx, events.Event{Type: events.PresenceOnline, ActorID: user.ID})
+	}
 
 	// Broadcasting message on Connection User
-	broadcastConnectionStatus(ConnectionStatusConnect)
+	broadcastConnectionStatus(connCtx, ConnectionStatusConnect)
 
 	// Start message handling goroutine
-	go handleMessages(user.ID, clientID, conn)
+	go handleMessages(connCtx, user.ID, clientID, conn)
 }
 
-// handleMessages processes incoming WebSocket messages
-func handleMessages(userID, clientID string, conn *websocket.Conn) {
+// handleMessages processes incoming WebSocket messages.
+// connCtx carries the connection logger and the span of the upgrade request.
+func handleMessages(connCtx context.Context, userID, clientID string, conn *websocket.Conn) {
+	logger := logging.FromContext(connCtx)
+	upgradeSpan := trace.SpanContextFromContext(connCtx)
+
 	defer func() {
 		// Retrieve the client info
 		clientInfoRaw, ok := clients.Load(userID)
@@ -192,19 +361,21 @@ func handleMessages(userID, clientID string, conn *websocket.Conn) {
 
 		// Remove this specific connection
 		clientInfo.RemoveConnection(clientID)
+		metrics.WebSocketConnections.Dec()
 
 		// If no more connections, remove the user from clients
 		if clientInfo.IsEmpty() {
 			clients.Delete(userID)
-			log.Printf("Broadcasting connection status disconnect")
-			broadcastConnectionStatus(ConnectionStatusDisconnect)
+			logger.Debug("Broadcasting connection status disconnect")
+			broadcastConnectionStatus(connCtx, ConnectionStatusDisconnect)
+			events.Publish(connCtx, events.Event{Type: events.PresenceOffline, ActorID: userID})
 		}
 
-		// Close the connection if it's still open
-		if conn != nil {
+		// Close the connection if it's still open, Shutdown already closed it while draining
+		if conn != nil && !draining.Load() {
 			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
-				log.Printf("Error sending close frame for user %s: %v", userID, err)
+				logger.Debug("Error sending close frame", logging.Err(err))
 			}
 			conn.Close()
 		}
@@ -213,27 +384,80 @@ func handleMessages(userID, clientID string, conn *websocket.Conn) {
 	for {
 		// Read raw message first
 		_, p, err := conn.ReadMessage() // Read the raw message bytes
-		log.Printf("Raw JSON message received: %s", p)
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				log.Printf("Connection closed for user %s: %v", userID, err)
+				logger.Info("Connection closed", logging.Err(err))
 				break
 			}
-			log.Printf("Error reading message from user %s: %v", userID, err)
+			logger.Warn("Error reading message", logging.Err(err))
 			break
 		}
 
-		// Log the raw JSON message to inspect it
-		log.Printf("Raw JSON message received: %s", p)
+		// The raw frame contains the message body, only its size is logged unless redaction is off
+		logger.Debug("Raw JSON message received", "bytes", len(p), logging.Redact("raw", string(p)))
 
-		// Now unmarshal the raw JSON into your message struct
-		var message models.Message
-		err = json.Unmarshal(p, &message)
+		message, traceContext, err := readFrame(p)
 		if err != nil {
-			log.Printf("Error unmarshalling JSON for user %s: %v", userID, err)
+			logger.Warn("Error unmarshalling JSON", logging.Err(err))
 			break
 		}
 
+		// Each frame is its own trace, continuing the client's trace when the envelope carries one
+		// and linked to the upgrade request so the connection can still be found
+		frameCtx := tracing.Extract(logging.WithContext(context.Background(), logger), traceContext)
+		frameCtx, span := tracing.Tracer().Start(frameCtx, "ws.frame",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithLinks(trace.Link{SpanContext: upgradeSpan}),
+			trace.WithAttributes(
+				attribute.String(logging.KeyChatID, message.ChatID),
+				attribute.String(logging.KeyConnID, clientID),
+			))
+
+		// Flood protection: every frame costs several MongoDB round trips
+		if decision := ratelimit.Allow(frameCtx, ratelimit.SocketMessage, userID+":"+message.ChatID); !decision.Allowed {
+			logger.Info("Socket message rate limited", logging.KeyChatID, message.ChatID)
+			enqueue(frameCtx, conn, ErrorFrame{
+				Type:         FrameError,
+				Code:         ErrorCodeRateLimited,
+				Message:      "You are sending messages too fast",
+				ChatID:       message.ChatID,
+				RetryAfterMs: decision.RetryAfter.Milliseconds(),
+			})
+			span.End()
+			continue
+		}
+
+		// Same limits as PostMessage
+		if !validContent(message.Content) {
+			enqueue(frameCtx, conn, ErrorFrame{
+				Type:    FrameError,
+				Code:    ErrorCodeInvalid,
+				Message: fmt.Sprintf("Content is required (%d characters at most)", MaxMessageLength),
+				ChatID:  message.ChatID,
+			})
+			span.End()
+			continue
+		}
+
+		// Muted users can neither post nor run commands
+		if until := MutedUntil(frameCtx, userID); until != nil {
+			enqueue(frameCtx, conn, mutedFrame(message.ChatID, *until))
+			span.End()
+			continue
+		}
+
+		// Slash commands are answered here and only what they post reaches the chat
+		if _, _, isCommand := parseCommand(message.Content); isCommand {
+			logger.Debug("Running command", logging.KeyChatID, message.ChatID)
+			handleCommand(frameCtx, conn, userID, message)
+			span.End()
+			continue
+		}
+		// "//text" escapes the slash and is sent as "/text"
+		if strings.HasPrefix(message.Content, "//") {
+			message.Content = message.Content[1:]
+		}
+
 		// Process the message
 		message.SentAt = time.Now()
 		message.Sender = userID
@@ -241,12 +465,23 @@ func handleMessages(userID, clientID string, conn *websocket.Conn) {
 		message.Type = &messageType
 
 		// Broadcast the message to other users in the chat
-		log.Printf("Broadcasting message from user %s in chat %s", userID, message.ChatID)
-		broadcastMessageToChat(message.ChatID, message)
+		logger.Debug("Broadcasting message", logging.KeyChatID, message.ChatID)
+		if _, err := SendMessage(frameCtx, message.ChatID, message); err != nil {
+			tracing.RecordError(span, err)
+			if errors.Is(err, ErrBlocked) {
+				enqueue(frameCtx, conn, ErrorFrame{
+					Type:    FrameError,
+					Code:    ErrorCodeBlocked,
+					Message: "You can't send messages to this chat",
+					ChatID:  message.ChatID,
+				})
+			}
+		}
+		span.End()
 	}
 }
 
-func broadcastConnectionStatus(statusType string) {
+func broadcastConnectionStatus(ctx context.Context, statusType string) {
 	// Get online users
 	var userIDs []string
 
@@ -254,7 +489,7 @@ func broadcastConnectionStatus(statusType string) {
 	clients.Range(func(key, value interface{}) bool {
 		userID, ok := key.(string)
 		if !ok {
-			log.Println("Error: Invalid key type")
+			slog.Error("Invalid key type in clients map")
 			return true
 		}
 		userIDs = append(userIDs, userID)
@@ -264,46 +499,94 @@ func broadcastConnectionStatus(statusType string) {
 	// Retrieve user details
 	var onlineUsers []*models.UserResponse
 	if len(userIDs) > 0 {
-		onlineUsers, _ = mongodb.GetUserByIds(userIDs)
-		log.Printf("%d", len(onlineUsers))
+		onlineUsers, _ = mongodb.GetUserByIds(ctx, userIDs)
 		if onlineUsers == nil {
-			log.Printf("Error retrieving online users")
+			slog.Error("Error retrieving online users")
 			return
 		}
 	}
 
-	// Prepare connection status message
-	connectionStatus := ConnectionStatusMessage{
-		Type:        statusType,
-		OnlineUsers: onlineUsers,
+	// Each user only sees who their blocks and the others' privacy settings allow
+	presence, err := privacy.NewPresenceFilter(ctx, userIDs)
+	if err != nil {
+		slog.Error("Error loading presence settings", logging.Err(err))
+		return
 	}
 
 	// Broadcast to all connected clients
 	clients.Range(func(key, value interface{}) bool {
+		viewerID := key.(string)
 		clientInfo := value.(*ClientInfo)
 
+		// Prepare connection status message
+		connectionStatus := ConnectionStatusMessage{
+			Type:        statusType,
+			OnlineUsers: visibleUsers(presence, viewerID, onlineUsers),
+		}
+
 		// Get all connections for this user
 		connections := clientInfo.GetConnections()
 
 		// Broadcast to all of the user's connections
 		for _, conn := range connections {
-			broadcastQueue <- broadcastJob{
-				message: connectionStatus,
-				conn:    conn,
-			}
+			enqueue(ctx, conn, connectionStatus)
 		}
 
 		return true
 	})
 }
 
-// broadcastMessageToChat sends a message to all users in a specific chat
-func broadcastMessageToChat(chatID string, message models.Message) {
+// visibleUsers keeps the users viewerID may see online
+func visibleUsers(presence *privacy.PresenceFilter, viewerID string, users []*models.UserResponse) []*models.UserResponse {
+	visible := make([]*models.UserResponse, 0, len(users))
+	for _, user := range users {
+		if presence.Visible(viewerID, user.ID) {
+			visible = append(visible, user)
+		}
+	}
+	return visible
+}
+
+// Errors returned by SendMessage
+var (
+	ErrChatNotFound     = errors.New("chat not found")
+	ErrNoRecipients     = errors.New("no other users in chat")
+	ErrMessageNotStored = errors.New("message could not be saved")
+	ErrBlocked          = errors.New("direct chat closed by a block")
+)
+
+// SendMessage saves a message sent by message.Sender to chatID, updates the chat and
+// delivers it to every connected member. It is the single path for socket frames
+// and REST posts alike. Members who blocked the sender don't get the message; in a
+// direct chat a block on either side refuses it with ErrBlocked. Messages of a
+// disabled sender are refused with ErrSenderDisabled, those of a muted one with ErrMuted.
+func SendMessage(ctx context.Context, chatID string, message models.Message) (*models.Message, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "messages.broadcast")
+	defer span.End()
+
+	message.ChatID = chatID
+	if message.SentAt.IsZero() {
+		message.SentAt = time.Now()
+	}
+	if message.Type == nil {
+		messageType := "message"
+		message.Type = &messageType
+	}
+
+	sender, err := mongodb.FindSenderState(ctx, message.Sender)
+	if err != nil {
+		slog.Error("Error reading sender", logging.KeyUserID, message.Sender, logging.Err(err))
+		return nil, ErrMessageNotStored
+	}
+	if err := senderRefusal(sender); err != nil {
+		return nil, err
+	}
+
 	// Get all users in the chat
-	chat, err := mongodb.GetChatByIdAndSender(chatID, message.Sender)
+	chat, err := mongodb.GetChatByIdAndSender(ctx, chatID, message.Sender)
 	if err != nil || chat == nil {
-		log.Printf("Error retrieving users for chat %s: %v", chatID, err)
-		return
+		slog.Warn("Error retrieving users for chat", logging.KeyChatID, chatID, logging.KeyUserID, message.Sender, logging.Err(err))
+		return nil, ErrChatNotFound
 	}
 
 	filteredUsers := []string{}
@@ -314,21 +597,30 @@ func broadcastMessageToChat(chatID string, message models.Message) {
 	}
 
 	if len(filteredUsers) == 0 {
-		log.Printf("Error retrieving users for chat %s, something went wrong, no users in chat.", chatID)
-		return
+		slog.Error("No other users in chat", logging.KeyChatID, chatID)
+		return nil, ErrNoRecipients
+	}
+
+	blockedBy, blocking, err := privacy.Blocks(ctx, message.Sender, filteredUsers)
+	if err != nil {
+		slog.Error("Error loading blocks", logging.KeyChatID, chatID, logging.Err(err))
+		return nil, ErrMessageNotStored
+	}
+	if blocksCloseChat(chat, blockedBy, blocking) {
+		return nil, ErrBlocked
 	}
 
-	usersInChat, err := mongodb.GetUserByIds(filteredUsers)
+	usersInChat, err := mongodb.GetUserByIds(ctx, filteredUsers)
 	if err != nil || usersInChat == nil || len(usersInChat) == 0 {
-		log.Printf("Error retrieving users for chat %s, something went wrong, no users in chat found on DB.", chatID)
-		return
+		slog.Error("No users of chat found on DB", logging.KeyChatID, chatID, logging.Err(err))
+		return nil, ErrNoRecipients
 	}
 
 	// Save the message
-	savedMessage, err := mongodb.SaveMessage(&message)
+	savedMessage, err := mongodb.SaveMessage(ctx, &message)
 	if err != nil || savedMessage == nil {
-		log.Printf("Error saving message from user %s: %v", message.Sender, err)
-		return
+		slog.Error("Error saving message", logging.KeyChatID, chatID, logging.KeyUserID, message.Sender, logging.Err(err))
+		return nil, ErrMessageNotStored
 	}
 
 	// Update chat details
@@ -338,23 +630,27 @@ func broadcastMessageToChat(chatID string, message models.Message) {
 	chat.LastMessageAt = &timeNow
 	chat.LastMessageId = &savedMessage.ID
 	chat.CountMessages += 1
-	if err := mongodb.UpdateChat(chat); err != nil {
-		log.Printf("Error updating chat %s: %v", message.Sender, err)
-		return
+	if err := mongodb.UpdateChatLastMessage(ctx, savedMessage, timeNow); err != nil {
+		slog.Error("Error updating chat", logging.KeyChatID, chatID, logging.Err(err))
+		return nil, ErrMessageNotStored
 	}
+	metrics.MessagesSent.Inc()
+	// Subscribers get their own copy, the message is still modified below
+	published := *savedMessage
+	events.Publish(ctx, events.Event{Type: events.MessageNew, ChatID: chatID, ActorID: message.Sender, Data: published})
+	notifyBots(ctx, chat.Users, published)
 
-	// Map of userIDs in the chat for fast lookup
-	userIDsInChat := make(map[string]struct{}, len(chat.Users))
-	for _, userID := range chat.Users {
-		userIDsInChat[userID] = struct{}{}
-	}
+	// Recipients can correlate the delivered frame with this trace
+	message.TraceContext = tracing.Inject(ctx)
+
+	recipients := deliveredTo(chat, blockedBy)
 
 	// Broadcast to all clients of users in the chat
 	clients.Range(func(key, value interface{}) bool {
 		userID := key.(string)
 
-		// Check if this user is in the chat
-		if _, exists := userIDsInChat[userID]; exists {
+		// Check if this user is in the chat and hasn't blocked the sender
+		if _, exists := recipients[userID]; exists {
 			// Get the client info for this user
 			clientInfo := value.(*ClientInfo)
 
@@ -363,33 +659,114 @@ func broadcastMessageToChat(chatID string, message models.Message) {
 
 			// Broadcast to all of the user's connections
 			for _, conn := range connections {
-				broadcastQueue <- broadcastJob{
-					message: message,
-					conn:    conn,
-				}
+				enqueue(ctx, conn, message)
 			}
 		}
 
 		return true
 	})
+
+	return &message, nil
+}
+
+// blocksCloseChat reports whether blocks between the sender and the other members
+// refuse a message: a block on either side closes a direct chat, while in a group
+// only the members who blocked the sender miss it
+func blocksCloseChat(chat *models.Chat, blockedBy map[string]bool, blocking map[string]bool) bool {
+	return !chat.IsGroup() && (len(blockedBy) > 0 || len(blocking) > 0)
+}
+
+// deliveredTo is the set of members whose connections get a message: everyone in
+// the chat, the sender's other connections included, but those who blocked the sender
+func deliveredTo(chat *models.Chat, blockedBy map[string]bool) map[string]struct{} {
+	recipients := make(map[string]struct{}, len(chat.Users))
+	for _, userID := range chat.Users {
+		if !blockedBy[userID] {
+			recipients[userID] = struct{}{}
+		}
+	}
+	return recipients
+}
+
+// Shutdown drains every WebSocket client: it stops accepting upgrades, tells each
+// connection to reconnect elsewhere, flushes the broadcast queue and finally closes
+// the sockets with CloseGoingAway. It returns ctx.Err() if the deadline expires
+// before the queue is flushed; the sockets are closed either way.
+func Shutdown(ctx context.Context) error {
+	if !draining.CompareAndSwap(false, true) {
+		return nil
+	}
+	stopRetention()
+	stopRelay()
+
+	// Snapshot every open connection
+	var conns []*websocket.Conn
+	clients.Range(func(key, value interface{}) bool {
+		for _, conn := range value.(*ClientInfo).GetConnections() {
+			conns = append(conns, conn)
+		}
+		return true
+	})
+	slog.Info("Draining WebSocket connections", "connections", len(conns))
+
+	// Tell every client to reconnect, spreading the reconnections over a window
+	spread := int64(reconnectMaxDelay - reconnectMinDelay)
+	for _, conn := range conns {
+		delay := reconnectMinDelay + time.Duration(mathrand.Int63n(spread))
+		enqueue(ctx, conn, ShutdownMessage{Type: ServerShutdown, ReconnectAfterMs: delay.Milliseconds()})
+	}
+
+	// No more jobs after this point, workers exit once the queue is empty
+	close(queueClosing)
+	queueMu.Lock()
+	queueClosed = true
+	close(broadcastQueue)
+	queueMu.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		workersWg.Wait()
+		close(flushed)
+	}()
+
+	var err error
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		err = ctx.Err()
+		slog.Warn("Broadcast queue not flushed before deadline", logging.Err(err))
+	}
+
+	// Close every socket, WriteControl is safe to call concurrently with the workers
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	for _, conn := range conns {
+		if err := conn.WriteControl(websocket.CloseMessage, closeMessage, deadline); err != nil && err != websocket.ErrCloseSent {
+			slog.Debug("Error sending close frame", logging.Err(err))
+		}
+		conn.Close()
+	}
+
+	return err
 }
 
-func isUserInChat(userID, chatID string) bool {
+func isUserInChat(ctx context.Context, userID, chatID string) bool {
 	// This function checks if a user is part of the chat (using chatID and userID)
-	chat, err := mongodb.FindUserChat(chatID, userID)
+	chat, err := mongodb.FindUserChat(ctx, chatID, userID)
 	return err == nil && chat != nil
 }
 
 func GetChats(c *gin.Context) {
-	token := utils.RetriveTokenFromRequestHttp(c)
-
-	user, err_user := auth.GetUserFromToken(*token)
-	if err_user != nil || user == nil {
+	user := auth.CurrentPrincipal(c)
+	if user == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
 		return
 	}
 
-	chats, err_chats := mongodb.GetUserChatsWithMessages(user.ID)
+	chats, err_chats := mongodb.GetUserChatsWithMessages(c.Request.Context(), user.ID)
 	if err_chats != nil || chats == nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Something went wrong: %v", err_chats)})
 		return
@@ -400,7 +777,7 @@ func GetChats(c *gin.Context) {
 		return
 	}
 
-	err := setUsersDataMultipleChats(user.ID, chats)
+	err := setUsersDataMultipleChats(c.Request.Context(), user.ID, chats)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Something went wrong: %v", err)})
 		return
@@ -410,10 +787,8 @@ func GetChats(c *gin.Context) {
 }
 
 func GetChatsById(c *gin.Context) {
-	token := utils.RetriveTokenFromRequestHttp(c)
-
-	user, err_user := auth.GetUserFromToken(*token)
-	if err_user != nil || user == nil {
+	user := auth.CurrentPrincipal(c)
+	if user == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
 		return
 	}
@@ -424,13 +799,13 @@ func GetChatsById(c *gin.Context) {
 		return
 	}
 
-	chat, err_chats := mongodb.GetUserChatById(user.ID, chatID)
+	chat, err_chats := mongodb.GetUserChatById(c.Request.Context(), user.ID, chatID)
 	if err_chats != nil || chat == nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Something went wrong: %v", err_chats)})
 		return
 	}
 
-	err := setUsersDataSingleChat(user.ID, chat)
+	err := setUsersDataSingleChat(c.Request.Context(), user.ID, chat)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Something went wrong: %v", err)})
 		return
@@ -439,7 +814,7 @@ func GetChatsById(c *gin.Context) {
 	c.JSON(http.StatusOK, chat)
 }
 
-func setUsersDataSingleChat(userId string, chat *models.Chat) error {
+func setUsersDataSingleChat(ctx context.Context, userId string, chat *models.Chat) error {
 	userIDSet := make(map[string]struct{})
 	for _, uid := range chat.Users {
 		if uid != userId {
@@ -452,7 +827,7 @@ func setUsersDataSingleChat(userId string, chat *models.Chat) error {
 		userIDs = append(userIDs, uid)
 	}
 
-	userResponses, err := mongodb.GetUserByIds(userIDs)
+	userResponses, err := mongodb.GetUserByIds(ctx, userIDs)
 	if err != nil {
 		return fmt.Errorf("failed to get user responses: %w", err)
 	}
@@ -473,7 +848,7 @@ func setUsersDataSingleChat(userId string, chat *models.Chat) error {
 	return nil
 }
 
-func setUsersDataMultipleChats(userId string, chats []*models.Chat) error {
+func setUsersDataMultipleChats(ctx context.Context, userId string, chats []*models.Chat) error {
 	// Create a set (map) to store unique user IDs from all chats
 	userIDSet := make(map[string]struct{})
 
@@ -493,7 +868,7 @@ func setUsersDataMultipleChats(userId string, chats []*models.Chat) error {
 	}
 
 	// Call the MongoDB function to get user details for the collected user IDs
-	userResponses, err := mongodb.GetUserByIds(userIDs)
+	userResponses, err := mongodb.GetUserByIds(ctx, userIDs)
 	if err != nil {
 		return fmt.Errorf("failed to get user responses: %w", err)
 	}
@@ -518,9 +893,8 @@ func setUsersDataMultipleChats(userId string, chats []*models.Chat) error {
 }
 
 func GetMessageChat(c *gin.Context) {
-	token := utils.RetriveTokenFromRequestHttp(c)
-	user, err := auth.GetUserFromToken(*token)
-	if err != nil || user == nil {
+	user := auth.CurrentPrincipal(c)
+	if user == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
 		return
 	}
@@ -531,7 +905,7 @@ func GetMessageChat(c *gin.Context) {
 		return
 	}
 
-	chat, err := mongodb.GetChatByIdAndSender(chatID, user.ID)
+	chat, err := mongodb.GetChatByIdAndSender(c.Request.Context(), chatID, user.ID)
 	if err != nil || chat == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "There are no chat with this ID or ID is malformed"})
 		return
@@ -552,7 +926,17 @@ func GetMessageChat(c *gin.Context) {
 		return
 	}
 
-	messages, total_pages, err := mongodb.GetChatMessages(chatID, limit, page)
+	// Group chats hide the messages of the users the caller blocked, direct chats
+	// with them don't receive new messages anyway
+	var excludeSenders []string
+	if chat.IsGroup() {
+		if excludeSenders, err = privacy.BlockedIDs(c.Request.Context(), user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong"})
+			return
+		}
+	}
+
+	messages, total_pages, err := mongodb.GetChatMessages(c.Request.Context(), chatID, chat.HistoryStart(user.ID), limit, page, excludeSenders)
 	if err != nil || messages == nil {
 		c.JSON(http.StatusNotFound, gin.H{"message": "There are no messages"})
 		return
@@ -562,9 +946,8 @@ func GetMessageChat(c *gin.Context) {
 }
 
 func CreateChat(c *gin.Context) {
-	token := utils.RetriveTokenFromRequestHttp(c)
-	user, err := auth.GetUserFromToken(*token)
-	if err != nil || user == nil {
+	user := auth.CurrentPrincipal(c)
+	if user == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
 		return
 	}
@@ -588,16 +971,29 @@ func CreateChat(c *gin.Context) {
 	}
 
 	//Check if user exists
-	user_to_invite, err := mongodb.FindUserById(payload.UserID)
+	user_to_invite, err := mongodb.FindUserById(c.Request.Context(), payload.UserID)
 	if err != nil || user_to_invite == nil {
 		c.JSON(http.StatusNotFound, gin.H{"message": "Cannot find User to create chat with!"})
 		return
 	}
 
+	// Blocks and the other user's privacy settings decide who may open a chat
+	switch err := privacy.CanReach(c.Request.Context(), user.ID, payload.UserID); {
+	case errors.Is(err, privacy.ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"message": "You can't start a chat with this user"})
+		return
+	case errors.Is(err, privacy.ErrContactsOnly):
+		c.JSON(http.StatusForbidden, gin.H{"message": "This user only accepts chats from their contacts"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create chat"})
+		return
+	}
+
 	// Check if chat already exists
-	existingChat, err := mongodb.FindChatByUsers([]string{user.ID, payload.UserID})
+	existingChat, err := mongodb.FindChatByUsers(c.Request.Context(), []string{user.ID, payload.UserID})
 	if err == nil && existingChat != nil {
-		setUsersDataSingleChat(user.ID, existingChat)
+		setUsersDataSingleChat(c.Request.Context(), user.ID, existingChat)
 		c.JSON(http.StatusOK, existingChat)
 		return
 	}
@@ -610,22 +1006,70 @@ func CreateChat(c *gin.Context) {
 		CreatedAt:     time.Now(),
 	}
 
-	newChat, err = mongodb.CreateChat(newChat)
+	newChat, err = mongodb.CreateChat(c.Request.Context(), newChat)
 	if err != nil || newChat == nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create chat"})
 		return
 	}
 
-	setUsersDataSingleChat(user.ID, newChat)
+	published := *newChat
+	events.Publish(c.Request.Context(), events.Event{Type: events.ChatCreated, ChatID: newChat.ID, ActorID: user.ID, Data: published})
+
+	setUsersDataSingleChat(c.Request.Context(), user.ID, newChat)
 	c.JSON(http.StatusCreated, newChat)
 }
 
+// PostMessage sends a message to a chat over REST, for bots and integrations.
+// It goes through the same persistence and broadcast path as socket messages.
+func PostMessage(c *gin.Context) {
+	user := auth.CurrentPrincipal(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	if !validContent(payload.Content) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Content is required (%d characters at most)", MaxMessageLength), "fieldError": "content"})
+		return
+	}
+
+	chatID := c.Param("id")
+	// Same flood protection as socket messages
+	if decision := ratelimit.Allow(c.Request.Context(), ratelimit.SocketMessage, user.ID+":"+chatID); !decision.Allowed {
+		ratelimit.Reject(c, decision.RetryAfter)
+		return
+	}
+
+	message, err := SendMessage(c.Request.Context(), chatID, models.Message{Sender: user.ID, Content: payload.Content})
+	switch {
+	case errors.Is(err, ErrChatNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "There are no chat with this ID or ID is malformed"})
+	case errors.Is(err, ErrNoRecipients):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "No other users in chat"})
+	case errors.Is(err, ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"message": "You can't send messages to this chat"})
+	case errors.Is(err, ErrMuted):
+		c.JSON(http.StatusForbidden, gin.H{"message": "You are muted and can't send messages for now"})
+	case errors.Is(err, ErrSenderDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"message": "Account disabled"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to send message"})
+	default:
+		c.JSON(http.StatusCreated, message)
+	}
+}
+
 // OnlineUsers returns a list of currently connected users
 func OnlineUsers(c *gin.Context) {
-	token := utils.RetriveTokenFromRequestHttp(c)
-
-	user, err_user := auth.GetUserFromToken(*token)
-	if err_user != nil || user == nil {
+	user := auth.CurrentPrincipal(c)
+	if user == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
 		return
 	}
@@ -636,7 +1080,7 @@ func OnlineUsers(c *gin.Context) {
 	clients.Range(func(key, value interface{}) bool {
 		userID, ok := key.(string)
 		if !ok {
-			log.Println("Error: Invalid key type")
+			slog.Error("Invalid key type in clients map")
 			return true
 		}
 
@@ -649,13 +1093,18 @@ func OnlineUsers(c *gin.Context) {
 	})
 
 	if len(userIDs) > 0 {
-		users, err := mongodb.GetUserByIds(userIDs)
+		users, err := mongodb.GetUserByIds(c.Request.Context(), userIDs)
 		if err != nil || users == nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong on getUsersOnline"})
 			return
 		}
+		presence, err := privacy.NewPresenceFilter(c.Request.Context(), append(userIDs, user.ID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong on getUsersOnline"})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
-			"online_users": users,
+			"online_users": visibleUsers(presence, user.ID, users),
 		})
 		return
 	}
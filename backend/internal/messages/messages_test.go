@@ -0,0 +1,104 @@
+package messages
+
+import (
+	"backend/internal/models"
+	"strings"
+	"testing"
+)
+
+func TestReadFrameKeepsOnlyWhatTheClientMaySet(t *testing.T) {
+	frame := `{
+		"chat_id": "chat-1",
+		"content": "hello",
+		"sender": "someone-else",
+		"type": "system",
+		"sent_at": "2001-01-01T00:00:00Z",
+		"webhook_id": "webhook-1",
+		"display_name": "Deploy bot",
+		"avatar_url": "https://example.com/bot.png",
+		"attachments": [{"title": "click", "title_link": "javascript:alert(1)"}],
+		"trace_context": {"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	}`
+	message, traceContext, err := readFrame([]byte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ChatID != "chat-1" || message.Content != "hello" {
+		t.Errorf("chat and content = %q, %q", message.ChatID, message.Content)
+	}
+	if message.Sender != "" || message.Type != nil || !message.SentAt.IsZero() {
+		t.Errorf("sender, type or time read from the frame: %+v", message)
+	}
+	if message.WebhookID != "" || message.DisplayName != "" || message.AvatarURL != "" || message.Attachments != nil {
+		t.Errorf("webhook identity or attachments read from the frame: %+v", message)
+	}
+	if traceContext["traceparent"] == "" {
+		t.Error("trace context dropped")
+	}
+}
+
+func TestReadFrameRejectsInvalidJSON(t *testing.T) {
+	if _, _, err := readFrame([]byte(`{"chat_id": `)); err == nil {
+		t.Error("truncated frame decoded")
+	}
+}
+
+func TestValidContent(t *testing.T) {
+	tests := map[string]bool{
+		"hello":                                 true,
+		"":                                      false,
+		" \n\t":                                 false,
+		strings.Repeat("a", MaxMessageLength):   true,
+		strings.Repeat("a", MaxMessageLength+1): false,
+	}
+	for content, want := range tests {
+		if got := validContent(content); got != want {
+			t.Errorf("validContent(%.20q, %d bytes) = %v, want %v", content, len(content), got, want)
+		}
+	}
+}
+
+func TestBlocksCloseDirectChatsOnly(t *testing.T) {
+	direct := &models.Chat{Users: []string{"alice", "bob"}}
+	group := &models.Chat{Users: []string{"alice", "bob", "carol"}}
+	// A group keeps its flag when members leave
+	smallGroup := &models.Chat{Users: []string{"alice", "bob"}, Group: true}
+	none := map[string]bool{}
+	bob := map[string]bool{"bob": true}
+
+	tests := []struct {
+		name                string
+		chat                *models.Chat
+		blockedBy, blocking map[string]bool
+		want                bool
+	}{
+		{"direct chat without blocks", direct, none, none, false},
+		{"direct chat, recipient blocked the sender", direct, bob, none, true},
+		{"direct chat, sender blocked the recipient", direct, none, bob, true},
+		{"group, a member blocked the sender", group, bob, none, false},
+		{"group, sender blocked a member", group, none, bob, false},
+		{"group of two", smallGroup, bob, none, false},
+	}
+	for _, tt := range tests {
+		if got := blocksCloseChat(tt.chat, tt.blockedBy, tt.blocking); got != tt.want {
+			t.Errorf("%s: blocksCloseChat = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveredToSkipsMembersWhoBlockedTheSender(t *testing.T) {
+	chat := &models.Chat{Users: []string{"alice", "bob", "carol"}}
+	recipients := deliveredTo(chat, map[string]bool{"bob": true})
+	if _, ok := recipients["bob"]; ok {
+		t.Error("the message reaches a member who blocked the sender")
+	}
+	for _, userID := range []string{"alice", "carol"} {
+		if _, ok := recipients[userID]; !ok {
+			t.Errorf("%s doesn't get the message", userID)
+		}
+	}
+	// Without blocks every member gets it
+	if len(deliveredTo(chat, map[string]bool{})) != 3 {
+		t.Error("members missing without blocks")
+	}
+}
@@ -0,0 +1,87 @@
+package messages
+
+import (
+	"backend/internal/events"
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/mongodb"
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// FrameMessageDeleted tells the members of a chat that a moderator removed a message
+const FrameMessageDeleted = "message.deleted"
+
+// MessageDeletedFrame is sent to the connected members of the chat of a removed message
+type MessageDeletedFrame struct {
+	Type      string `json:"type"`
+	ChatID    string `json:"chat_id"`
+	MessageID string `json:"message_id"`
+}
+
+// ErrMuted is returned by SendMessage when a moderator muted the sender
+var ErrMuted = errors.New("sender is muted")
+
+// ErrSenderDisabled is returned by SendMessage when the sender's account is disabled or gone
+var ErrSenderDisabled = errors.New("sender is disabled")
+
+// MutedUntil returns when the mute of a user ends, nil when they aren't muted.
+// It reads past the user cache so a mute takes effect on every instance at once.
+func MutedUntil(ctx context.Context, userID string) *time.Time {
+	user, err := mongodb.FindSenderState(ctx, userID)
+	if err != nil || user == nil {
+		return nil
+	}
+	return activeMute(user)
+}
+
+// activeMute returns when the mute of user ends, nil when it is over or there is none
+func activeMute(user *models.User) *time.Time {
+	if user.MutedUntil == nil || !user.MutedUntil.After(time.Now()) {
+		return nil
+	}
+	return user.MutedUntil
+}
+
+// senderRefusal is why sender, as read by FindSenderState, may not send messages,
+// nil when they may
+func senderRefusal(sender *models.User) error {
+	if sender == nil || sender.Disabled {
+		return ErrSenderDisabled
+	}
+	if activeMute(sender) != nil {
+		return ErrMuted
+	}
+	return nil
+}
+
+// mutedFrame is the error frame answering a muted user on the socket
+func mutedFrame(chatID string, until time.Time) ErrorFrame {
+	return ErrorFrame{
+		Type:         FrameError,
+		Code:         ErrorCodeMuted,
+		Message:      "You are muted until " + until.UTC().Format(time.RFC3339),
+		ChatID:       chatID,
+		RetryAfterMs: time.Until(until).Milliseconds(),
+	}
+}
+
+// RemoveMessage empties a message on behalf of a moderator and tells the connected
+// members of its chat, on every instance
+func RemoveMessage(ctx context.Context, message *models.Message) error {
+	if _, err := mongodb.TombstoneMessage(ctx, message.ID); err != nil {
+		return err
+	}
+	if err := mongodb.RefreshChatSummary(ctx, message.ChatID); err != nil {
+		slog.Warn("Could not refresh chat after message removal", logging.KeyChatID, message.ChatID, logging.Err(err))
+	}
+
+	frame := MessageDeletedFrame{Type: FrameMessageDeleted, ChatID: message.ChatID, MessageID: message.ID}
+	if chat, err := mongodb.FindChatById(ctx, message.ChatID); err == nil && chat != nil {
+		SendToUsers(ctx, chat.Users, frame)
+	}
+	events.Publish(ctx, events.Event{Type: events.MessageDeleted, ChatID: message.ChatID, Data: frame})
+	return nil
+}
@@ -0,0 +1,39 @@
+package messages
+
+import (
+	"backend/internal/models"
+	"testing"
+	"time"
+)
+
+func TestSenderRefusal(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name   string
+		sender *models.User
+		want   error
+	}{
+		{"unknown", nil, ErrSenderDisabled},
+		{"active", &models.User{}, nil},
+		{"disabled", &models.User{Disabled: true}, ErrSenderDisabled},
+		{"disabled and muted", &models.User{Disabled: true, MutedUntil: &future}, ErrSenderDisabled},
+		{"muted", &models.User{MutedUntil: &future}, ErrMuted},
+		{"mute over", &models.User{MutedUntil: &past}, nil},
+	}
+	for _, tt := range tests {
+		if got := senderRefusal(tt.sender); got != tt.want {
+			t.Errorf("%s sender: senderRefusal = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMutedFrame(t *testing.T) {
+	until := time.Now().Add(time.Hour)
+	frame := mutedFrame("c1", until)
+	if frame.Type != FrameError || frame.Code != ErrorCodeMuted || frame.ChatID != "c1" {
+		t.Errorf("mutedFrame = %+v", frame)
+	}
+	if frame.RetryAfterMs <= 59*60*1000 || frame.RetryAfterMs > 60*60*1000 {
+		t.Errorf("RetryAfterMs = %d, want about an hour", frame.RetryAfterMs)
+	}
+}
@@ -0,0 +1,110 @@
+package messages
+
+import (
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Relay settings, see InitRelay for the environment overrides
+var (
+	// How often the frames queued by the other instances are picked up
+	relayInterval = time.Second
+	// How far back frames are looked up, it covers clock drift between instances
+	relayWindow = 30 * time.Second
+
+	// instanceID tells the frames queued by this instance apart, they are already delivered
+	instanceID = GenerateUniqueID()
+	// The frames already delivered on this instance, by ID, nil until the first poll
+	relayedFrames map[string]bool
+
+	relayStop     = make(chan struct{})
+	relayStopOnce sync.Once
+	relayWg       sync.WaitGroup
+)
+
+// InitRelay starts delivering the frames other instances queue for the sockets of
+// this one, so that moderation reaches a user wherever they are connected.
+//   - RELAY_POLL_INTERVAL: how often the queue is read, frames reach the other
+//     instances this much later
+func InitRelay() {
+	relayInterval = utils.GetEnvDuration("RELAY_POLL_INTERVAL", relayInterval)
+
+	relayWg.Add(1)
+	go func() {
+		defer relayWg.Done()
+		ticker := time.NewTicker(relayInterval)
+		defer ticker.Stop()
+		for {
+			deliverRelayedFrames(context.Background(), time.Now())
+			select {
+			case <-relayStop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopRelay stops the relay and waits for the delivery in progress
+func stopRelay() {
+	relayStopOnce.Do(func() { close(relayStop) })
+	relayWg.Wait()
+}
+
+// SendToUsers delivers a frame to every socket of the users, on every instance
+func SendToUsers(ctx context.Context, userIDs []string, frame interface{}) {
+	for _, userID := range userIDs {
+		SendToUser(ctx, userID, frame)
+	}
+	encoded, err := json.Marshal(frame)
+	if err != nil {
+		slog.Warn("Could not encode relayed frame", logging.Err(err))
+		return
+	}
+	relay(ctx, &models.RelayedFrame{UserIDs: userIDs, Frame: string(encoded)})
+}
+
+// relay queues a frame for the other instances, they deliver it on their next poll
+func relay(ctx context.Context, frame *models.RelayedFrame) {
+	frame.Origin = instanceID
+	frame.CreatedAt = time.Now()
+	frame.ExpiresAt = frame.CreatedAt.Add(2 * relayWindow)
+	if err := mongodb.InsertRelayedFrame(ctx, frame); err != nil {
+		slog.Warn("Could not relay frame to the other instances", logging.Err(err))
+	}
+}
+
+// deliverRelayedFrames hands the frames queued by the other instances to the
+// sockets of this one, each once. The frames queued before this instance started
+// are skipped, they are about sockets it didn't have.
+func deliverRelayedFrames(ctx context.Context, now time.Time) {
+	frames, err := mongodb.FindRelayedFramesSince(ctx, now.Add(-relayWindow))
+	if err != nil {
+		slog.Warn("Could not read relayed frames", logging.Err(err))
+		return
+	}
+
+	delivered := make(map[string]bool, len(frames))
+	for _, frame := range frames {
+		delivered[frame.ID] = true
+		if relayedFrames == nil || relayedFrames[frame.ID] || frame.Origin == instanceID {
+			continue
+		}
+		for _, userID := range frame.UserIDs {
+			if frame.CloseReason != "" {
+				disconnectLocalUser(userID, frame.CloseReason)
+			} else {
+				SendToUser(ctx, userID, json.RawMessage(frame.Frame))
+			}
+		}
+	}
+	// Frames out of the lookup window can't come up again, they are forgotten
+	relayedFrames = delivered
+}
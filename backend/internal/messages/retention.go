@@ -0,0 +1,224 @@
+package messages
+
+import (
+	"backend/internal/auth"
+	"backend/internal/events"
+	"backend/internal/logging"
+	"backend/internal/metrics"
+	"backend/internal/models"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FrameMessagesExpired tells the members of a chat to drop the messages sent before ExpiredBefore
+const FrameMessagesExpired = "messages.expired"
+
+// MessageTypeRetention announces a change of the chat's disappearing messages setting
+const MessageTypeRetention = "retention"
+
+// MessagesExpiredFrame is sent to the connected members of a chat after a purge
+type MessagesExpiredFrame struct {
+	Type          string    `json:"type"`
+	ChatID        string    `json:"chat_id"`
+	ExpiredBefore time.Time `json:"expired_before"`
+}
+
+// messageTTLOptions are the disappearing message settings a chat can choose from
+var messageTTLOptions = map[string]time.Duration{
+	"off": 0,
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+	"90d": 90 * 24 * time.Hour,
+}
+
+// Retention settings, see InitRetention for the environment overrides
+var (
+	// Workspace-wide maximum age of any message, 0 keeps messages forever
+	messageRetention time.Duration
+	// How often expired messages are purged, messages may outlive their expiry by this much
+	purgeInterval = time.Minute
+
+	// The purge cutoffs already announced to this instance's sockets, by chat
+	announcedExpiries = map[string]time.Time{}
+
+	retentionStop     = make(chan struct{})
+	retentionStopOnce sync.Once
+	retentionWg       sync.WaitGroup
+)
+
+// InitRetention applies the environment overrides and starts the purger
+//   - MESSAGE_RETENTION: workspace-wide maximum message age, e.g. "8760h"; unset keeps messages
+//   - RETENTION_PURGE_INTERVAL
+//
+// Every instance purges; deleting is idempotent. The instance that deleted the
+// messages records the cutoff on the chat and every instance then tells its own
+// sockets about it. Clients should also hide messages older than their chat's
+// message_ttl on their own.
+func InitRetention() {
+	messageRetention = utils.GetEnvDuration("MESSAGE_RETENTION", messageRetention)
+	purgeInterval = utils.GetEnvDuration("RETENTION_PURGE_INTERVAL", purgeInterval)
+
+	retentionWg.Add(1)
+	go func() {
+		defer retentionWg.Done()
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+		for {
+			purgeExpiredMessages(context.Background(), time.Now())
+			announceExpiredMessages(context.Background(), time.Now())
+			select {
+			case <-retentionStop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopRetention stops the purger and waits for the purge in progress
+func stopRetention() {
+	retentionStopOnce.Do(func() { close(retentionStop) })
+	retentionWg.Wait()
+}
+
+// purgeExpiredMessages deletes the messages past their chat's expiry or the
+// workspace retention, then fixes up the affected chats
+func purgeExpiredMessages(ctx context.Context, now time.Time) {
+	if messageRetention > 0 {
+		cutoff := now.Add(-messageRetention)
+		chatIDs, err := mongodb.FindChatIdsWithMessagesBefore(ctx, cutoff)
+		if err != nil {
+			slog.Warn("Could not find chats with expired messages", logging.Err(err))
+		} else if len(chatIDs) > 0 {
+			deleted, err := mongodb.DeleteMessagesBefore(ctx, "", cutoff)
+			if err != nil {
+				slog.Warn("Could not purge messages past retention", logging.Err(err))
+			} else if deleted > 0 {
+				slog.Info("Purged messages past retention", "count", deleted, "chats", len(chatIDs))
+				metrics.MessagesExpired.Add(float64(deleted))
+				for _, chatID := range chatIDs {
+					chatPurged(ctx, chatID, cutoff)
+				}
+			}
+		}
+	}
+
+	chats, err := mongodb.FindChatsWithMessageTTL(ctx)
+	if err != nil {
+		slog.Warn("Could not find chats with disappearing messages", logging.Err(err))
+		return
+	}
+	for _, chat := range chats {
+		cutoff := now.Add(-time.Duration(chat.MessageTTL) * time.Second)
+		deleted, err := mongodb.DeleteMessagesBefore(ctx, chat.ID, cutoff)
+		if err != nil {
+			slog.Warn("Could not purge expired messages", logging.KeyChatID, chat.ID, logging.Err(err))
+			continue
+		}
+		if deleted > 0 {
+			metrics.MessagesExpired.Add(float64(deleted))
+			chatPurged(ctx, chat.ID, cutoff)
+		}
+	}
+}
+
+// chatPurged updates the chat summary, records the purge for every instance to
+// announce and publishes it once
+func chatPurged(ctx context.Context, chatID string, cutoff time.Time) {
+	if err := mongodb.RefreshChatSummary(ctx, chatID); err != nil {
+		slog.Warn("Could not refresh chat after purge", logging.KeyChatID, chatID, logging.Err(err))
+	}
+	if err := mongodb.MarkChatPurged(ctx, chatID, cutoff, time.Now()); err != nil {
+		slog.Warn("Could not record chat purge", logging.KeyChatID, chatID, logging.Err(err))
+	}
+	frame := MessagesExpiredFrame{Type: FrameMessagesExpired, ChatID: chatID, ExpiredBefore: cutoff}
+	events.Publish(ctx, events.Event{Type: events.MessagesExpired, ChatID: chatID, Data: frame})
+}
+
+// announceExpiredMessages tells the members connected to this instance about the
+// recent purges of their chats, whichever instance carried them out. Purges are
+// looked up over a few intervals so that clock drift between instances doesn't
+// hide any, and each cutoff is announced once.
+func announceExpiredMessages(ctx context.Context, now time.Time) {
+	chats, err := mongodb.FindChatsPurgedSince(ctx, now.Add(-3*purgeInterval))
+	if err != nil {
+		slog.Warn("Could not find purged chats", logging.Err(err))
+		return
+	}
+
+	for _, chat := range unannouncedPurges(chats) {
+		frame := MessagesExpiredFrame{Type: FrameMessagesExpired, ChatID: chat.ID, ExpiredBefore: *chat.ExpiredBefore}
+		for _, userID := range chat.Users {
+			SendToUser(ctx, userID, frame)
+		}
+	}
+}
+
+// unannouncedPurges returns the chats whose cutoff wasn't announced yet and
+// remembers the cutoffs of chats, the purges recently looked up
+func unannouncedPurges(chats []*models.Chat) []*models.Chat {
+	var unannounced []*models.Chat
+	announced := make(map[string]time.Time, len(chats))
+	for _, chat := range chats {
+		if chat.ExpiredBefore == nil {
+			continue
+		}
+		announced[chat.ID] = *chat.ExpiredBefore
+		if previous, ok := announcedExpiries[chat.ID]; ok && !chat.ExpiredBefore.After(previous) {
+			continue
+		}
+		unannounced = append(unannounced, chat)
+	}
+	// Chats out of the lookup window can't come up again, they are forgotten
+	announcedExpiries = announced
+	return unannounced
+}
+
+// SetChatRetention sets how long the messages of the chat :id are kept, one of
+// messageTTLOptions. Any member can change it; the change is announced in the chat.
+func SetChatRetention(c *gin.Context) {
+	user := auth.CurrentPrincipal(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		MessageTTL string `json:"message_ttl"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	ttl, ok := messageTTLOptions[payload.MessageTTL]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "message_ttl must be one of off, 1h, 24h, 7d, 30d, 90d", "fieldError": "message_ttl"})
+		return
+	}
+
+	chatID := c.Param("id")
+	if !isUserInChat(c.Request.Context(), user.ID, chatID) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Chat not found"})
+		return
+	}
+	if err := mongodb.SetChatMessageTTL(c.Request.Context(), chatID, ttl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update chat"})
+		return
+	}
+
+	logging.FromGin(c).Info("Chat retention changed", logging.KeyChatID, chatID, "message_ttl", payload.MessageTTL)
+	messageType := MessageTypeRetention
+	if _, err := SendMessage(c.Request.Context(), chatID, models.Message{Sender: user.ID, Type: &messageType, Content: payload.MessageTTL}); err != nil {
+		logging.FromGin(c).Warn("Could not announce retention change", logging.KeyChatID, chatID, logging.Err(err))
+	}
+	c.JSON(http.StatusOK, gin.H{"message_ttl": int64(ttl.Seconds())})
+}
@@ -0,0 +1,62 @@
+package messages
+
+import (
+	"backend/internal/models"
+	"testing"
+	"time"
+)
+
+func purgedChat(id string, cutoff time.Time) *models.Chat {
+	return &models.Chat{ID: id, ExpiredBefore: &cutoff}
+}
+
+func chatIDs(chats []*models.Chat) []string {
+	ids := make([]string, 0, len(chats))
+	for _, chat := range chats {
+		ids = append(ids, chat.ID)
+	}
+	return ids
+}
+
+func TestUnannouncedPurgesAnnouncesEachCutoffOnce(t *testing.T) {
+	previous := announcedExpiries
+	announcedExpiries = map[string]time.Time{}
+	t.Cleanup(func() { announcedExpiries = previous })
+
+	first := time.Date(2024, 3, 12, 9, 0, 0, 0, time.UTC)
+	later := first.Add(time.Minute)
+
+	got := chatIDs(unannouncedPurges([]*models.Chat{purgedChat("a", first), purgedChat("b", first), {ID: "c"}}))
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("first lookup announced %v, want a and b", got)
+	}
+
+	// The same purges come up again in the next lookups, until they leave the window
+	if got := unannouncedPurges([]*models.Chat{purgedChat("a", first), purgedChat("b", first)}); len(got) != 0 {
+		t.Errorf("second lookup announced %v again", chatIDs(got))
+	}
+	got = chatIDs(unannouncedPurges([]*models.Chat{purgedChat("a", later), purgedChat("b", first)}))
+	if len(got) != 1 || got[0] != "a" {
+		t.Errorf("lookup after a new purge of a announced %v, want a", got)
+	}
+
+	// b left the window and is forgotten
+	unannouncedPurges([]*models.Chat{purgedChat("a", later)})
+	if _, ok := announcedExpiries["b"]; ok {
+		t.Error("chat b is still remembered out of the lookup window")
+	}
+}
+
+func TestMessageTTLOptions(t *testing.T) {
+	want := map[string]time.Duration{"off": 0, "1h": time.Hour, "7d": 7 * 24 * time.Hour, "90d": 90 * 24 * time.Hour}
+	for option, ttl := range want {
+		if got, ok := messageTTLOptions[option]; !ok || got != ttl {
+			t.Errorf("messageTTLOptions[%q] = %v, %v, want %v", option, got, ok, ttl)
+		}
+	}
+	for _, option := range []string{"", "0", "2h", "1y"} {
+		if _, ok := messageTTLOptions[option]; ok {
+			t.Errorf("messageTTLOptions accepts %q", option)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chat"
+
+var (
+	// HTTP
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by Gin route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// WebSocket
+	WebSocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "active_connections",
+		Help:      "Number of open WebSocket connections.",
+	})
+	BroadcastDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "broadcast",
+		Name:      "dropped_total",
+		Help:      "Broadcast jobs that were not delivered, by reason.",
+	}, []string{"reason"})
+	MessagesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "messages",
+		Name:      "sent_total",
+		Help:      "Chat messages persisted and broadcast; use rate() for messages per second.",
+	})
+	MessagesExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "messages",
+		Name:      "expired_total",
+		Help:      "Chat messages deleted by the retention purger.",
+	})
+	ImportedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "messages",
+		Name:      "imported_total",
+		Help:      "Chat messages imported from other platforms, by source.",
+	}, []string{"source"})
+
+	// MongoDB
+	mongoOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mongodb",
+		Name:      "operation_duration_seconds",
+		Help:      "MongoDB latency by repository function.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+
+	// Auth
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Rejected authentication attempts, by reason.",
+	}, []string{"reason"})
+
+	// Rate limiting
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ratelimit",
+		Name:      "rejected_total",
+		Help:      "Requests and socket messages rejected by the rate limiter, by policy.",
+	}, []string{"policy"})
+
+	// Webhooks
+	WebhookAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhooks",
+		Name:      "attempts_total",
+		Help:      "Outgoing webhook delivery attempts, by result.",
+	}, []string{"result"})
+
+	// Slash commands
+	SlashCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "commands",
+		Name:      "invocations_total",
+		Help:      "Slash commands received over WebSocket, by kind and result.",
+	}, []string{"kind", "result"})
+)
+
+// Drop reasons for BroadcastDropped
+const (
+	DropQueueClosed = "queue_closed"
+	DropCanceled    = "canceled"
+	DropWriteError  = "write_error"
+)
+
+// Results for WebhookAttempts
+const (
+	WebhookDelivered = "delivered"
+	WebhookRetried   = "retried"
+	WebhookFailed    = "failed"
+)
+
+// Kinds and results for SlashCommands
+const (
+	CommandBuiltin = "builtin"
+	CommandBot     = "bot"
+	CommandUnknown = "unknown"
+
+	CommandOK     = "ok"
+	CommandFailed = "failed"
+)
+
+// Reasons for AuthFailures
+const (
+	AuthMissingToken       = "missing_token"
+	AuthInvalidToken       = "invalid_token"
+	AuthInvalidCredentials = "invalid_credentials"
+	AuthLocked             = "locked"
+	AuthForbidden          = "forbidden"
+)
+
+// RegisterGaugeFunc exposes a gauge whose value is computed on scrape.
+// Used for values owned by other packages, like the broadcast queue depth.
+func RegisterGaugeFunc(subsystem, name, help string, value func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, value)
+}
+
+// ObserveMongo records the latency of a MongoDB repository call started at start.
+// Typical use: defer metrics.ObserveMongo("SaveMessage", time.Now())
+func ObserveMongo(operation string, start time.Time) {
+	mongoOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// GinMiddleware records request latency labelled with the matched route template,
+// so /getChatById?chat_id=... is a single series
+func GinMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequestDuration.
+		WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).
+		Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the Prometheus exposition format
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
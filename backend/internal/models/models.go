@@ -8,11 +8,146 @@ type User struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Email    string `json:"email"`
+
+	// Roles are granted by administrators, never bound from JSON
+	Roles []string `json:"-" bson:"roles,omitempty"`
+	// Disabled accounts can't log in and their tokens are refused
+	Disabled   bool       `json:"-" bson:"disabled,omitempty"`
+	DisabledAt *time.Time `json:"-" bson:"disabled_at,omitempty"`
+	// SessionGeneration is copied into tokens, bumping it ends every session of the user
+	SessionGeneration int `json:"-" bson:"session_generation,omitempty"`
+
+	// Bots have no password and act only through API tokens created by their owner
+	Bot      bool   `json:"-" bson:"bot,omitempty"`
+	BotOwner string `json:"-" bson:"bot_owner,omitempty"`
+
+	// Two-factor authentication, never bound from or written to JSON
+	MFAEnabled       bool     `json:"-" bson:"mfa_enabled"`
+	MFASecret        string   `json:"-" bson:"mfa_secret,omitempty"`
+	MFAPendingSecret string   `json:"-" bson:"mfa_pending_secret,omitempty"`
+	MFARecoveryCodes []string `json:"-" bson:"mfa_recovery_codes,omitempty"`
+	MFALastStep      int64    `json:"-" bson:"mfa_last_step,omitempty"`
+
+	// Accounts at external identity providers linked to this user
+	OIDCIdentities []OIDCIdentity `json:"-" bson:"oidc_identities,omitempty"`
+
+	// Account deletion: requested by the user, carried out at DeletionScheduledAt
+	// unless cancelled. Deleted accounts are kept anonymised so IDs still resolve.
+	DeletionRequestedAt  *time.Time `json:"-" bson:"deletion_requested_at,omitempty"`
+	DeletionScheduledAt  *time.Time `json:"-" bson:"deletion_scheduled_at,omitempty"`
+	DeletionClaimedUntil *time.Time `json:"-" bson:"deletion_claimed_until,omitempty"`
+	DeletedAt            *time.Time `json:"-" bson:"deleted_at,omitempty"`
+
+	// Placeholders stand in for the participants of imported chats that have no
+	// account, they are disabled. ImportKey identifies the participant at its source.
+	Placeholder bool   `json:"-" bson:"placeholder,omitempty"`
+	ImportKey   string `json:"-" bson:"import_key,omitempty"`
+
+	// Privacy controls who may start a chat with the user and see them online
+	Privacy PrivacySettings `json:"-" bson:"privacy,omitempty"`
+
+	// DisplayName is chosen by the user and shown next to the username.
+	// SearchNames are the lowercased names the directory search matches.
+	DisplayName string   `json:"-" bson:"display_name,omitempty"`
+	SearchNames []string `json:"-" bson:"search_names,omitempty"`
+
+	// Set by a moderator, the user can't send messages until then
+	MutedUntil *time.Time `json:"-" bson:"muted_until,omitempty"`
+}
+
+// PrivacySettings are chosen by each user, the zero value lets everyone in
+type PrivacySettings struct {
+	// AllowMessagesFrom is "everyone" or "contacts"
+	AllowMessagesFrom string `json:"allow_messages_from" bson:"allow_messages_from,omitempty"`
+	// ShowPresenceTo is "everyone", "contacts" or "nobody"
+	ShowPresenceTo string `json:"show_presence_to" bson:"show_presence_to,omitempty"`
+}
+
+// Contact links two users, first as a request from RequesterID to AddresseeID
+// and, once accepted, as a contact of both. Pair is unique to the two users.
+type Contact struct {
+	ID          string     `json:"id" bson:"_id,omitempty"`
+	Pair        string     `json:"-" bson:"pair"`
+	RequesterID string     `json:"requester_id" bson:"requester_id"`
+	AddresseeID string     `json:"addressee_id" bson:"addressee_id"`
+	Status      string     `json:"status" bson:"status"`
+	CreatedAt   time.Time  `json:"created_at" bson:"created_at"`
+	AcceptedAt  *time.Time `json:"accepted_at,omitempty" bson:"accepted_at,omitempty"`
+}
+
+// Report flags a message, or a user when MessageID is empty, to the moderators.
+// MessageContent keeps the reported text in case the message is deleted or expires.
+type Report struct {
+	ID             string     `json:"id" bson:"_id,omitempty"`
+	ReporterID     string     `json:"reporter_id" bson:"reporter_id"`
+	ReportedUserID string     `json:"reported_user_id" bson:"reported_user_id"`
+	MessageID      string     `json:"message_id,omitempty" bson:"message_id,omitempty"`
+	ChatID         string     `json:"chat_id,omitempty" bson:"chat_id,omitempty"`
+	MessageContent string     `json:"message_content,omitempty" bson:"message_content,omitempty"`
+	Reason         string     `json:"reason" bson:"reason"`
+	Details        string     `json:"details,omitempty" bson:"details,omitempty"`
+	Status         string     `json:"status" bson:"status"`
+	CreatedAt      time.Time  `json:"created_at" bson:"created_at"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty" bson:"resolved_at,omitempty"`
+	ResolvedBy     string     `json:"resolved_by,omitempty" bson:"resolved_by,omitempty"`
+	Action         string     `json:"action,omitempty" bson:"action,omitempty"`
+}
+
+// ModerationAction is an entry of the moderation audit trail
+type ModerationAction struct {
+	ID           string     `json:"id" bson:"_id,omitempty"`
+	ModeratorID  string     `json:"moderator_id" bson:"moderator_id"`
+	Action       string     `json:"action" bson:"action"`
+	TargetUserID string     `json:"target_user_id" bson:"target_user_id"`
+	ReportID     string     `json:"report_id,omitempty" bson:"report_id,omitempty"`
+	MessageID    string     `json:"message_id,omitempty" bson:"message_id,omitempty"`
+	ChatID       string     `json:"chat_id,omitempty" bson:"chat_id,omitempty"`
+	Note         string     `json:"note,omitempty" bson:"note,omitempty"`
+	Until        *time.Time `json:"until,omitempty" bson:"until,omitempty"`
+	CreatedAt    time.Time  `json:"created_at" bson:"created_at"`
+}
+
+// RelayedFrame is a frame for the sockets of users on every instance, or when
+// CloseReason is set the closing of those sockets
+type RelayedFrame struct {
+	ID          string    `bson:"_id,omitempty"`
+	UserIDs     []string  `bson:"user_ids"`
+	Frame       string    `bson:"frame,omitempty"`
+	CloseReason string    `bson:"close_reason,omitempty"`
+	Origin      string    `bson:"origin"`
+	CreatedAt   time.Time `bson:"created_at"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// Block stops BlockedID from starting chats with BlockerID, reaching them with
+// messages and seeing them online
+type Block struct {
+	ID        string    `json:"id" bson:"_id,omitempty"`
+	BlockerID string    `json:"blocker_id" bson:"blocker_id"`
+	BlockedID string    `json:"blocked_id" bson:"blocked_id"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// OIDCIdentity is the stable identifier of a user at an OpenID Connect provider
+type OIDCIdentity struct {
+	Issuer   string    `json:"issuer" bson:"issuer"`
+	Subject  string    `json:"subject" bson:"subject"`
+	LinkedAt time.Time `json:"linked_at" bson:"linked_at"`
+}
+
+// OIDCFlow is the server side state of an authorization code request, keyed by its state parameter
+type OIDCFlow struct {
+	State        string    `bson:"_id"`
+	Nonce        string    `bson:"nonce"`
+	CodeVerifier string    `bson:"code_verifier"`
+	CreatedAt    time.Time `bson:"created_at"`
+	ExpiresAt    time.Time `bson:"expires_at"`
 }
 
 type UserResponse struct {
-	ID       string `json:"id" bson:"_id,omitempty"`
-	Username string `json:"username"`
+	ID          string `json:"id" bson:"_id,omitempty"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty" bson:"display_name,omitempty"`
 }
 
 type Message struct {
@@ -22,17 +157,200 @@ type Message struct {
 	Content string    `json:"content" bson:"content"`
 	SentAt  time.Time `json:"sent_at" bson:"sent_at"`
 	Type    *string   `json:"type" bson:"type"`
+
+	// Set on messages posted through an incoming webhook
+	WebhookID   string              `json:"webhook_id,omitempty" bson:"webhook_id,omitempty"`
+	DisplayName string              `json:"display_name,omitempty" bson:"display_name,omitempty"`
+	AvatarURL   string              `json:"avatar_url,omitempty" bson:"avatar_url,omitempty"`
+	Attachments []MessageAttachment `json:"attachments,omitempty" bson:"attachments,omitempty"`
+
+	// SourceID identifies an imported message at its source, so a re-run skips it
+	SourceID string `json:"-" bson:"source_id,omitempty"`
+
+	// TraceContext is the W3C trace context of the frame (traceparent, tracestate), never stored
+	TraceContext map[string]string `json:"trace_context,omitempty" bson:"-"`
+}
+
+// MessageAttachment is a simple rich block shown under a message
+type MessageAttachment struct {
+	Title     string `json:"title,omitempty" bson:"title,omitempty"`
+	TitleLink string `json:"title_link,omitempty" bson:"title_link,omitempty"`
+	Text      string `json:"text,omitempty" bson:"text,omitempty"`
+	Color     string `json:"color,omitempty" bson:"color,omitempty"`
+	ImageURL  string `json:"image_url,omitempty" bson:"image_url,omitempty"`
+}
+
+// IncomingWebhook lets an external service post into a chat through a secret
+// URL, only the SHA-256 hash of its token is stored
+type IncomingWebhook struct {
+	ID         string     `json:"id" bson:"_id,omitempty"`
+	ChatID     string     `json:"chat_id" bson:"chat_id"`
+	Name       string     `json:"name" bson:"name"`
+	TokenHash  string     `json:"-" bson:"token_hash"`
+	CreatedBy  string     `json:"created_by" bson:"created_by"`
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+}
+
+// ScheduledMessage is a message a user wrote to be sent to a chat at SendAt
+type ScheduledMessage struct {
+	ID            string     `json:"id" bson:"_id,omitempty"`
+	ChatID        string     `json:"chat_id" bson:"chat_id"`
+	Sender        string     `json:"sender" bson:"sender"`
+	Content       string     `json:"content" bson:"content"`
+	SendAt        time.Time  `json:"send_at" bson:"send_at"`
+	Status        string     `json:"status" bson:"status"`
+	Attempts      int        `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time  `json:"-" bson:"next_attempt_at"`
+	ClaimedAt     *time.Time `json:"-" bson:"claimed_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	MessageID     string     `json:"message_id,omitempty" bson:"message_id,omitempty"`
+	CreatedAt     time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" bson:"updated_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty" bson:"sent_at,omitempty"`
+	ExpiresAt     *time.Time `json:"-" bson:"expires_at,omitempty"`
+}
+
+// ExportJob is an archive built in the background and downloadable until ExpiresAt
+type ExportJob struct {
+	ID          string     `json:"id" bson:"_id,omitempty"`
+	Kind        string     `json:"kind" bson:"kind"`
+	UserID      string     `json:"user_id" bson:"user_id"`
+	ChatID      string     `json:"chat_id,omitempty" bson:"chat_id,omitempty"`
+	Format      string     `json:"format" bson:"format"`
+	Zip         bool       `json:"zip" bson:"zip"`
+	Status      string     `json:"status" bson:"status"`
+	FileID      string     `json:"-" bson:"file_id,omitempty"`
+	FileName    string     `json:"file_name,omitempty" bson:"file_name,omitempty"`
+	Size        int64      `json:"size,omitempty" bson:"size,omitempty"`
+	Error       string     `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" bson:"created_at"`
+	ClaimedAt   *time.Time `json:"-" bson:"claimed_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at" bson:"expires_at"`
+}
+
+// BotCommand routes a slash command to a bot's HTTP callback, the callback
+// verifies the signature of each call with Secret
+type BotCommand struct {
+	ID          string    `json:"id" bson:"_id,omitempty"`
+	Name        string    `json:"name" bson:"name"`
+	Description string    `json:"description,omitempty" bson:"description,omitempty"`
+	BotID       string    `json:"bot_id" bson:"bot_id"`
+	CallbackURL string    `json:"callback_url" bson:"callback_url"`
+	Secret      string    `json:"-" bson:"secret"`
+	CreatedBy   string    `json:"created_by" bson:"created_by"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
 }
 
 type Chat struct {
-	ID            string        `json:"id" bson:"_id,omitempty"`
-	CountMessages int           `json:"count_messages" bson:"count_messages"`
-	CreatedBy     string        `json:"created_by" bson:"created_by"`
-	Users         []string      `json:"users" bson:"users"`
-	LastMessage   *string       `json:"last_message" bson:"last_message"`
-	LastMessageId *string       `json:"last_message_id" bson:"last_message_id"`
-	LastMessageBy *string       `json:"last_message_by" bson:"last_message_by"`
-	LastMessageAt *time.Time    `json:"last_message_at" bson:"last_message_at"`
-	CreatedAt     time.Time     `json:"created_at" bson:"created_at"`
-	UserData      *UserResponse `json:"user_data" bson:"user_data"`
+	ID            string     `json:"id" bson:"_id,omitempty"`
+	CountMessages int        `json:"count_messages" bson:"count_messages"`
+	CreatedBy     string     `json:"created_by" bson:"created_by"`
+	Users         []string   `json:"users" bson:"users"`
+	LastMessage   *string    `json:"last_message" bson:"last_message"`
+	LastMessageId *string    `json:"last_message_id" bson:"last_message_id"`
+	LastMessageBy *string    `json:"last_message_by" bson:"last_message_by"`
+	LastMessageAt *time.Time `json:"last_message_at" bson:"last_message_at"`
+	Topic         string     `json:"topic,omitempty" bson:"topic,omitempty"`
+	// MessageTTL is the age in seconds at which messages disappear, 0 keeps them
+	MessageTTL int64 `json:"message_ttl,omitempty" bson:"message_ttl,omitempty"`
+	// SourceID identifies an imported chat at its source, e.g. "slack:C024BE91L"
+	SourceID string `json:"-" bson:"source_id,omitempty"`
+	// ExpiredBefore is the latest purge cutoff of the chat, set at PurgedAt, every
+	// instance tells its own sockets about it
+	ExpiredBefore *time.Time `json:"-" bson:"expired_before,omitempty"`
+	PurgedAt      *time.Time `json:"-" bson:"purged_at,omitempty"`
+	// Group is set on chats started as groups, direct chats never gain members
+	Group bool `json:"group,omitempty" bson:"group,omitempty"`
+	// JoinedAt holds when members added later joined, they don't see older messages
+	JoinedAt  map[string]time.Time `json:"-" bson:"joined_at,omitempty"`
+	CreatedAt time.Time            `json:"created_at" bson:"created_at"`
+	UserData  *UserResponse        `json:"user_data" bson:"user_data"`
+}
+
+// IsGroup reports whether members can be added to the chat. Chats with more than
+// two members are groups even if they predate the Group flag.
+func (c *Chat) IsGroup() bool {
+	return c.Group || len(c.Users) > 2
+}
+
+// HistoryStart returns the time from which userID sees the messages of the chat,
+// the zero time for its founding members
+func (c *Chat) HistoryStart(userID string) time.Time {
+	return c.JoinedAt[userID]
+}
+
+// LoginAttempts tracks failed logins for one account or one client address
+type LoginAttempts struct {
+	Key           string     `json:"key" bson:"_id"`
+	Failures      int        `json:"failures" bson:"failures"`
+	Lockouts      int        `json:"lockouts" bson:"lockouts"`
+	LastFailureAt time.Time  `json:"last_failure_at" bson:"last_failure_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at" bson:"next_attempt_at,omitempty"`
+	LockedUntil   *time.Time `json:"locked_until" bson:"locked_until,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at" bson:"expires_at"`
+}
+
+// APIToken is a long-lived personal access token, only its SHA-256 hash is stored
+type APIToken struct {
+	ID         string     `json:"id" bson:"_id,omitempty"`
+	UserID     string     `json:"user_id" bson:"user_id"`
+	CreatedBy  string     `json:"created_by" bson:"created_by"`
+	Name       string     `json:"name" bson:"name"`
+	Prefix     string     `json:"prefix" bson:"prefix"` // first characters of the token, to recognize it
+	Hash       string     `json:"-" bson:"hash"`
+	Scopes     []string   `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at" bson:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at" bson:"expires_at,omitempty"`
+}
+
+// Webhook posts chat events to an external URL. ChatID is empty for a
+// workspace-wide webhook receiving every chat's events.
+type Webhook struct {
+	ID                  string     `json:"id" bson:"_id,omitempty"`
+	ChatID              string     `json:"chat_id,omitempty" bson:"chat_id"`
+	URL                 string     `json:"url" bson:"url"`
+	Secret              string     `json:"-" bson:"secret"` // HMAC key, only shown on creation
+	Events              []string   `json:"events" bson:"events"`
+	CreatedBy           string     `json:"created_by" bson:"created_by"`
+	CreatedAt           time.Time  `json:"created_at" bson:"created_at"`
+	Active              bool       `json:"active" bson:"active"`
+	ConsecutiveFailures int        `json:"consecutive_failures" bson:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty" bson:"disabled_at,omitempty"`
+	DisabledReason      string     `json:"disabled_reason,omitempty" bson:"disabled_reason,omitempty"`
+}
+
+// WebhookDelivery is one event queued for one webhook, kept as the delivery log
+type WebhookDelivery struct {
+	ID             string     `json:"id" bson:"_id,omitempty"`
+	WebhookID      string     `json:"webhook_id" bson:"webhook_id"`
+	EventID        string     `json:"event_id" bson:"event_id"`
+	EventType      string     `json:"event_type" bson:"event_type"`
+	Payload        string     `json:"-" bson:"payload"`
+	Status         string     `json:"status" bson:"status"`
+	Attempts       int        `json:"attempts" bson:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at" bson:"next_attempt_at"`
+	LockedUntil    *time.Time `json:"-" bson:"locked_until,omitempty"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty" bson:"last_attempt_at,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty" bson:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at" bson:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+	ExpiresAt      time.Time  `json:"-" bson:"expires_at"`
+}
+
+// SigningKey is an asymmetric JWT signing key, identified in tokens by its kid
+type SigningKey struct {
+	ID         string `json:"kid" bson:"_id"`
+	Algorithm  string `json:"alg" bson:"algorithm"`
+	PrivateKey string `json:"-" bson:"private_key"` // PKCS#8, PEM encoded, then sealed if Encryption is set
+	// Encryption names how PrivateKey is sealed, empty for plain PEM
+	Encryption string    `json:"-" bson:"encryption,omitempty"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	// ActiveAt is when the key starts signing, it is published for verification
+	// before then. Zero for keys that signed from their creation.
+	ActiveAt  time.Time `json:"active_at" bson:"active_at,omitempty"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"` // end of verification
 }
@@ -0,0 +1,341 @@
+package moderation
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/mongodb"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions recorded in the audit trail, all but ActionUnmute close a report
+const (
+	ActionDismiss       = "dismiss"
+	ActionDeleteMessage = "delete_message"
+	ActionWarn          = "warn"
+	ActionMute          = "mute"
+	ActionSuspend       = "suspend"
+	ActionUnmute        = "unmute"
+)
+
+// FrameModerationNotice tells a user about a warning, a mute or its end
+const FrameModerationNotice = "moderation.notice"
+
+// NoticeFrame is sent to the sockets of the user a moderator acted on
+type NoticeFrame struct {
+	Type   string     `json:"type"`
+	Action string     `json:"action"`
+	Note   string     `json:"note,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+const (
+	// contextMessages is how many messages before and after a reported one are shown
+	contextMessages = 5
+	// recentActions is how many past actions against the reported user are shown
+	recentActions = 10
+	maxNoteLen    = 1000
+	maxMute       = 365 * 24 * time.Hour
+)
+
+// reportedUserView is the reported user as shown with a report
+type reportedUserView struct {
+	models.UserResponse
+	Disabled     bool       `json:"disabled"`
+	MutedUntil   *time.Time `json:"muted_until,omitempty"`
+	ReportsCount int64      `json:"reports_count"`
+}
+
+// pageParams reads the limit and page query parameters, answering 400 when invalid
+func pageParams(c *gin.Context) (int, int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit value. Limit should be > 0 and <= 100."})
+		return 0, 0, false
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid page value. Page should be > 0."})
+		return 0, 0, false
+	}
+	return limit, page, true
+}
+
+// canSanction tells whether action may be taken against target: warnings, mutes
+// and suspensions can't be used on users holding the moderation permission
+func canSanction(action string, target *models.User) bool {
+	if action != ActionWarn && action != ActionMute && action != ActionSuspend {
+		return true
+	}
+	return !(&auth.Principal{Roles: target.Roles}).Can(auth.PermModerate)
+}
+
+// muteDuration parses the duration of a mute, false when it is out of bounds
+func muteDuration(value string) (time.Duration, bool) {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < time.Minute || duration > maxMute {
+		return 0, false
+	}
+	return duration, true
+}
+
+// ListReports pages through the moderation queue, oldest first. status is open
+// by default, or resolved or dismissed.
+func ListReports(c *gin.Context) {
+	status := c.DefaultQuery("status", mongodb.ReportOpen)
+	if status != mongodb.ReportOpen && status != mongodb.ReportResolved && status != mongodb.ReportDismissed {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "status must be open, resolved or dismissed"})
+		return
+	}
+	limit, page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	reports, total, err := mongodb.ListReports(c.Request.Context(), status, limit, page)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list reports"})
+		return
+	}
+	totalPages := (total + int64(limit) - 1) / int64(limit)
+	c.JSON(http.StatusOK, gin.H{"reports": reports, "total": total, "total_pages": totalPages})
+}
+
+// GetReport returns a report with what a moderator needs to decide on it: the
+// reporter, the reported user and their record, the message as it is now with the
+// messages around it, and the past actions against the reported user
+func GetReport(c *gin.Context) {
+	ctx := c.Request.Context()
+	report, err := mongodb.FindReportById(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not load report"})
+		return
+	}
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Report not found"})
+		return
+	}
+
+	reporter := &models.UserResponse{ID: report.ReporterID}
+	if user, err := mongodb.FindUserById(ctx, report.ReporterID); err == nil && user != nil {
+		reporter = &models.UserResponse{ID: user.ID, Username: user.Username, DisplayName: user.DisplayName}
+	}
+	reported := reportedUserView{UserResponse: models.UserResponse{ID: report.ReportedUserID}}
+	if user, err := mongodb.FindUserById(ctx, report.ReportedUserID); err == nil && user != nil {
+		reported.UserResponse = models.UserResponse{ID: user.ID, Username: user.Username, DisplayName: user.DisplayName}
+		reported.Disabled, reported.MutedUntil = user.Disabled, user.MutedUntil
+	}
+	if reported.ReportsCount, err = mongodb.CountReportsAgainst(ctx, report.ReportedUserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not load report"})
+		return
+	}
+	actions, _, err := mongodb.ListModerationActions(ctx, report.ReportedUserID, "", recentActions, 1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not load report"})
+		return
+	}
+
+	response := gin.H{"report": report, "reporter": reporter, "reported_user": reported, "actions": actions}
+	if report.MessageID != "" {
+		// The message may have been deleted or may have expired since
+		message, err := mongodb.FindMessageById(ctx, report.MessageID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not load report"})
+			return
+		}
+		at := report.CreatedAt
+		if message != nil {
+			at = message.SentAt
+		}
+		before, after, err := mongodb.FindMessagesAround(ctx, report.ChatID, at, contextMessages)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not load report"})
+			return
+		}
+		response["message"] = message
+		response["context"] = gin.H{"before": before, "after": after}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ResolveReport closes the open report :id with an action:
+//   - dismiss: nothing was wrong
+//   - delete_message: empty the reported message, other open reports on it are resolved too
+//   - warn: send the user a warning with the note
+//   - mute: stop the user from sending messages for duration, e.g. "30m" or "72h"
+//   - suspend: disable the account and close its sockets, admins can enable it again
+//
+// Every action is recorded in the audit trail. Users holding the moderation
+// permission can only be acted on by dismissing or deleting a message.
+func ResolveReport(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	var payload struct {
+		Action   string `json:"action" binding:"required"`
+		Duration string `json:"duration"`
+		Note     string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	if len([]rune(payload.Note)) > maxNoteLen {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "note can be at most 1000 characters", "fieldError": "note"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	report, err := mongodb.FindReportById(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not resolve report"})
+		return
+	}
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Report not found"})
+		return
+	}
+	if report.Status != mongodb.ReportOpen {
+		c.JSON(http.StatusConflict, gin.H{"message": "Report already closed"})
+		return
+	}
+	target, err := mongodb.FindUserById(ctx, report.ReportedUserID)
+	if err != nil || target == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Reported user not found"})
+		return
+	}
+
+	now := time.Now()
+	action := &models.ModerationAction{ModeratorID: principal.ID, Action: payload.Action, TargetUserID: target.ID, ReportID: report.ID,
+		MessageID: report.MessageID, ChatID: report.ChatID, Note: payload.Note, CreatedAt: now}
+	if !canSanction(payload.Action, target) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Moderators can't warn, mute or suspend each other"})
+		return
+	}
+
+	switch payload.Action {
+	case ActionDismiss:
+	case ActionDeleteMessage:
+		if report.MessageID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "This report is about a user, not a message", "fieldError": "action"})
+			return
+		}
+		message, err := mongodb.FindMessageById(ctx, report.MessageID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete message"})
+			return
+		}
+		if message == nil {
+			c.JSON(http.StatusGone, gin.H{"message": "The message no longer exists, dismiss the report instead"})
+			return
+		}
+		if err := messages.RemoveMessage(ctx, message); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete message"})
+			return
+		}
+	case ActionWarn:
+		messages.SendToUsers(ctx, []string{target.ID}, NoticeFrame{Type: FrameModerationNotice, Action: ActionWarn, Note: payload.Note})
+	case ActionMute:
+		duration, ok := muteDuration(payload.Duration)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "duration must be between 1m and 8760h, e.g. 24h", "fieldError": "duration"})
+			return
+		}
+		until := now.Add(duration)
+		if err := mongodb.SetUserMutedUntil(ctx, target.ID, &until); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not mute user"})
+			return
+		}
+		action.Until = &until
+		messages.SendToUsers(ctx, []string{target.ID}, NoticeFrame{Type: FrameModerationNotice, Action: ActionMute, Note: payload.Note, Until: &until})
+	case ActionSuspend:
+		if err := mongodb.SetUserDisabled(ctx, target.ID, true, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not suspend user"})
+			return
+		}
+		messages.DisconnectUser(ctx, target.ID, "account suspended")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "action must be dismiss, delete_message, warn, mute or suspend", "fieldError": "action"})
+		return
+	}
+
+	status := mongodb.ReportResolved
+	if payload.Action == ActionDismiss {
+		status = mongodb.ReportDismissed
+	}
+	if _, err := mongodb.CloseReport(ctx, report.ID, status, principal.ID, payload.Action, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not resolve report"})
+		return
+	}
+	if payload.Action == ActionDeleteMessage {
+		if err := mongodb.CloseReportsOnMessage(ctx, report.MessageID, principal.ID, payload.Action, now); err != nil {
+			logging.FromGin(c).Warn("Could not close the other reports on the message", "message_id", report.MessageID, logging.Err(err))
+		}
+	}
+	record(c, action)
+	c.JSON(http.StatusOK, gin.H{"message": "Report " + status, "action": action})
+}
+
+// Unmute lifts the mute of the user :id
+func Unmute(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	var payload struct {
+		Note string `json:"note"`
+	}
+	// The body is optional
+	_ = c.ShouldBindJSON(&payload)
+	if len([]rune(payload.Note)) > maxNoteLen {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "note can be at most 1000 characters", "fieldError": "note"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := mongodb.FindUserById(ctx, c.Param("id"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if user.MutedUntil == nil || !user.MutedUntil.After(time.Now()) {
+		c.JSON(http.StatusOK, gin.H{"message": "User is not muted"})
+		return
+	}
+	if err := mongodb.SetUserMutedUntil(ctx, user.ID, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not unmute user"})
+		return
+	}
+	messages.SendToUsers(ctx, []string{user.ID}, NoticeFrame{Type: FrameModerationNotice, Action: ActionUnmute, Note: payload.Note})
+
+	action := &models.ModerationAction{ModeratorID: principal.ID, Action: ActionUnmute, TargetUserID: user.ID, Note: payload.Note, CreatedAt: time.Now()}
+	record(c, action)
+	c.JSON(http.StatusOK, gin.H{"message": "User unmuted", "action": action})
+}
+
+// record appends an action that was carried out to the audit trail. The action
+// stands even when it can't be recorded, which is logged as an error.
+func record(c *gin.Context, action *models.ModerationAction) {
+	logger := logging.FromGin(c)
+	if err := mongodb.InsertModerationAction(c.Request.Context(), action); err != nil {
+		logger.Error("Could not record moderation action", "action", action.Action, "target_user_id", action.TargetUserID, logging.Err(err))
+		return
+	}
+	logger.Info("Moderation action", "action", action.Action, "target_user_id", action.TargetUserID, "report_id", action.ReportID)
+}
+
+// ListActions pages through the audit trail, newest first, optionally for one
+// user (user_id) or one moderator (moderator_id)
+func ListActions(c *gin.Context) {
+	limit, page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	actions, total, err := mongodb.ListModerationActions(c.Request.Context(), c.Query("user_id"), c.Query("moderator_id"), limit, page)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list moderation actions"})
+		return
+	}
+	totalPages := (total + int64(limit) - 1) / int64(limit)
+	c.JSON(http.StatusOK, gin.H{"actions": actions, "total": total, "total_pages": totalPages})
+}
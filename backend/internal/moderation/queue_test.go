@@ -0,0 +1,74 @@
+package moderation
+
+import (
+	"backend/internal/auth"
+	"backend/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCanSanctionSparesModerators(t *testing.T) {
+	user := &models.User{Roles: []string{auth.RoleUser}}
+	for _, target := range []*models.User{{Roles: []string{auth.RoleModerator}}, {Roles: []string{auth.RoleAdmin}}} {
+		for _, action := range []string{ActionWarn, ActionMute, ActionSuspend} {
+			if canSanction(action, target) {
+				t.Errorf("%s allowed against %v", action, target.Roles)
+			}
+			if !canSanction(action, user) {
+				t.Errorf("%s refused against a user", action)
+			}
+		}
+		// Their messages can still be removed, and their reports dismissed
+		for _, action := range []string{ActionDismiss, ActionDeleteMessage} {
+			if !canSanction(action, target) {
+				t.Errorf("%s refused against %v", action, target.Roles)
+			}
+		}
+	}
+}
+
+func TestMuteDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{"1m": time.Minute, "24h": 24 * time.Hour, "8760h": maxMute} {
+		if got, ok := muteDuration(value); !ok || got != want {
+			t.Errorf("muteDuration(%q) = %v, %v, want %v", value, got, ok, want)
+		}
+	}
+	for _, value := range []string{"", "30s", "-1h", "8761h", "1d", "forever"} {
+		if _, ok := muteDuration(value); ok {
+			t.Errorf("muteDuration accepted %q", value)
+		}
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		query       string
+		limit, page int
+		ok          bool
+	}{
+		{"", 20, 1, true},
+		{"?limit=100&page=3", 100, 3, true},
+		{"?limit=0", 0, 0, false},
+		{"?limit=101", 0, 0, false},
+		{"?page=0", 0, 0, false},
+		{"?page=x", 0, 0, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/moderation/reports"+tt.query, nil)
+
+		limit, page, ok := pageParams(c)
+		if limit != tt.limit || page != tt.page || ok != tt.ok {
+			t.Errorf("pageParams(%q) = %d, %d, %v, want %d, %d, %v", tt.query, limit, page, ok, tt.limit, tt.page, tt.ok)
+		}
+		if !ok && w.Code != http.StatusBadRequest {
+			t.Errorf("pageParams(%q) answered %d, want 400", tt.query, w.Code)
+		}
+	}
+}
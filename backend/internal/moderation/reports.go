@@ -0,0 +1,100 @@
+package moderation
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/mongodb"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reasons a report can give
+var reportReasons = []string{"spam", "harassment", "hate", "violence", "sexual", "self_harm", "impersonation", "other"}
+
+const maxDetailsLen = 1000
+
+// CreateReport flags a message (message_id) or a user (user_id) to the moderators
+// with one of reportReasons and optional details. Only messages of chats the caller
+// is a member of can be reported.
+func CreateReport(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		MessageID string `json:"message_id"`
+		UserID    string `json:"user_id"`
+		Reason    string `json:"reason" binding:"required"`
+		Details   string `json:"details"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	if (payload.MessageID == "") == (payload.UserID == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Report either a message_id or a user_id"})
+		return
+	}
+	if !slices.Contains(reportReasons, payload.Reason) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "reason must be one of " + strings.Join(reportReasons, ", "), "fieldError": "reason"})
+		return
+	}
+	details := strings.TrimSpace(payload.Details)
+	if utf8.RuneCountInString(details) > maxDetailsLen {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "details can be at most 1000 characters", "fieldError": "details"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	report := &models.Report{ReporterID: principal.ID, ReportedUserID: payload.UserID, Reason: payload.Reason, Details: details, CreatedAt: time.Now()}
+	if payload.MessageID != "" {
+		message, err := mongodb.FindMessageById(ctx, payload.MessageID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not file report"})
+			return
+		}
+		if message == nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Message not found"})
+			return
+		}
+		if chat, err := mongodb.FindUserChat(ctx, message.ChatID, principal.ID); err != nil || chat == nil || message.SentAt.Before(chat.HistoryStart(principal.ID)) {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Message not found"})
+			return
+		}
+		if message.Sender == principal.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "You can't report your own message", "fieldError": "message_id"})
+			return
+		}
+		report.MessageID, report.ChatID, report.MessageContent, report.ReportedUserID = message.ID, message.ChatID, message.Content, message.Sender
+	} else {
+		if payload.UserID == principal.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "You can't report yourself", "fieldError": "user_id"})
+			return
+		}
+		if user, err := mongodb.FindUserById(ctx, payload.UserID); err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+			return
+		}
+	}
+
+	err := mongodb.InsertReport(ctx, report)
+	if errors.Is(err, mongodb.ErrReportExists) {
+		c.JSON(http.StatusOK, gin.H{"message": "You already reported this, the moderators will review it"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not file report"})
+		return
+	}
+	logging.FromGin(c).Info("Report filed", "report_id", report.ID, "reported_user_id", report.ReportedUserID, "reason", report.Reason)
+	c.JSON(http.StatusCreated, gin.H{"message": "Report sent to the moderators", "id": report.ID})
+}
@@ -0,0 +1,60 @@
+package outbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// HeaderSignature carries Sign's result on every outbound callback
+const HeaderSignature = "X-Webhook-Signature"
+
+// NewClient returns an HTTP client for calls to user-supplied URLs (webhooks, bot
+// callbacks). It refuses loopback and private addresses, after DNS resolution, unless
+// WEBHOOK_ALLOW_PRIVATE_TARGETS=true (local testing), and doesn't follow redirects.
+func NewClient(timeout time.Duration) *http.Client {
+	allowPrivate := os.Getenv("WEBHOOK_ALLOW_PRIVATE_TARGETS") == "true"
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: func(network, address string, _ syscall.RawConn) error {
+		if allowPrivate {
+			return nil
+		}
+		return checkTarget(address)
+	}}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, Proxy: http.ProxyFromEnvironment},
+		// A redirect could point at an address the dialer would refuse by name
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+func checkTarget(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("target %s is not a public address", host)
+	}
+	return nil
+}
+
+// Sign computes the signature header: "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+// Receivers recompute it with their secret and reject stale timestamps to stop replays.
+func Sign(secret string, at time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
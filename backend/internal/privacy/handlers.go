@@ -0,0 +1,198 @@
+package privacy
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/mongodb"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// blockView is a block as listed to the blocker
+type blockView struct {
+	User      *models.UserResponse `json:"user"`
+	BlockedAt time.Time            `json:"blocked_at"`
+}
+
+// ListBlocks lists the users the caller blocked, newest first
+func ListBlocks(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	blocks, err := mongodb.ListBlocks(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list blocked users"})
+		return
+	}
+	ids := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		ids = append(ids, block.BlockedID)
+	}
+	users, err := mongodb.GetUserByIds(c.Request.Context(), ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list blocked users"})
+		return
+	}
+	usersByID := make(map[string]*models.UserResponse, len(users))
+	for _, user := range users {
+		usersByID[user.ID] = user
+	}
+
+	views := make([]blockView, 0, len(blocks))
+	for _, block := range blocks {
+		user := usersByID[block.BlockedID]
+		if user == nil {
+			user = &models.UserResponse{ID: block.BlockedID}
+		}
+		views = append(views, blockView{User: user, BlockedAt: block.CreatedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"blocked": views})
+}
+
+// BlockUser blocks the user in the body's user_id: they can't start a chat with
+// the caller or add them to one, their messages aren't delivered to the caller and
+// neither sees the other online. Direct chats between the two are closed to new
+// messages until the block is lifted, and their contact or pending request is dropped.
+func BlockUser(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		UserID string `json:"user_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	if payload.UserID == principal.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "You can't block yourself", "fieldError": "user_id"})
+		return
+	}
+	blocked, err := mongodb.FindUserById(c.Request.Context(), payload.UserID)
+	if err != nil || blocked == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+
+	created, err := mongodb.InsertBlock(c.Request.Context(), principal.ID, blocked.ID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not block user"})
+		return
+	}
+	if !created {
+		c.JSON(http.StatusOK, gin.H{"message": "User already blocked"})
+		return
+	}
+	if _, err := mongodb.DeleteContact(c.Request.Context(), principal.ID, blocked.ID); err != nil {
+		logging.FromGin(c).Error("Failed to remove contact of blocked user", "blocked_id", blocked.ID, logging.Err(err))
+	}
+	logging.FromGin(c).Info("User blocked", "blocked_id", blocked.ID)
+	c.JSON(http.StatusCreated, gin.H{"message": "User blocked"})
+}
+
+// UnblockUser lifts the caller's block on the user named by :id
+func UnblockUser(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	deleted, err := mongodb.DeleteBlock(c.Request.Context(), principal.ID, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not unblock user"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"message": "User not blocked"})
+		return
+	}
+	logging.FromGin(c).Info("User unblocked", "blocked_id", c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked"})
+}
+
+// withDefaults fills in the settings a user never chose
+func withDefaults(settings models.PrivacySettings) models.PrivacySettings {
+	if settings.AllowMessagesFrom == "" {
+		settings.AllowMessagesFrom = AudienceEveryone
+	}
+	if settings.ShowPresenceTo == "" {
+		settings.ShowPresenceTo = AudienceEveryone
+	}
+	return settings
+}
+
+// GetSettings returns the caller's privacy settings
+func GetSettings(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	user, err := mongodb.FindUserByIdCached(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not load privacy settings"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"privacy": withDefaults(user.Privacy)})
+}
+
+// UpdateSettings changes the caller's privacy settings, settings left out of the body are kept:
+//   - allow_messages_from: everyone, or contacts to refuse new chats from anyone else
+//   - show_presence_to: everyone, contacts or nobody
+func UpdateSettings(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		AllowMessagesFrom *string `json:"allow_messages_from"`
+		ShowPresenceTo    *string `json:"show_presence_to"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	user, err := mongodb.FindUserById(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update privacy settings"})
+		return
+	}
+	settings := withDefaults(user.Privacy)
+	if payload.AllowMessagesFrom != nil {
+		if *payload.AllowMessagesFrom != AudienceEveryone && *payload.AllowMessagesFrom != AudienceContacts {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "allow_messages_from must be everyone or contacts", "fieldError": "allow_messages_from"})
+			return
+		}
+		settings.AllowMessagesFrom = *payload.AllowMessagesFrom
+	}
+	if payload.ShowPresenceTo != nil {
+		switch *payload.ShowPresenceTo {
+		case AudienceEveryone, AudienceContacts, AudienceNobody:
+			settings.ShowPresenceTo = *payload.ShowPresenceTo
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"message": "show_presence_to must be everyone, contacts or nobody", "fieldError": "show_presence_to"})
+			return
+		}
+	}
+
+	if err := mongodb.SetUserPrivacy(c.Request.Context(), principal.ID, settings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update privacy settings"})
+		return
+	}
+	logging.FromGin(c).Info("Privacy settings updated", "allow_messages_from", settings.AllowMessagesFrom, "show_presence_to", settings.ShowPresenceTo)
+	c.JSON(http.StatusOK, gin.H{"privacy": settings})
+}
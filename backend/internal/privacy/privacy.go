@@ -0,0 +1,197 @@
+package privacy
+
+import (
+	"backend/internal/models"
+	"backend/mongodb"
+	"context"
+	"errors"
+	"os"
+)
+
+// Values of the privacy settings, an empty setting means AudienceEveryone
+const (
+	AudienceEveryone = "everyone"
+	AudienceContacts = "contacts"
+	AudienceNobody   = "nobody"
+)
+
+// Errors returned by CanReach
+var (
+	// ErrBlocked means one of the two users blocked the other
+	ErrBlocked = errors.New("user blocked")
+	// ErrContactsOnly means the recipient only accepts chats from contacts
+	ErrContactsOnly = errors.New("recipient accepts contacts only")
+)
+
+// contactsOnly restricts new chats and presence to accepted contacts for every user
+var contactsOnly bool
+
+// Init applies the environment overrides
+//   - CONTACTS_ONLY: "true" to treat every user as if they allowed messages and
+//     presence from their contacts only, bots are exempt
+func Init() {
+	contactsOnly = os.Getenv("CONTACTS_ONLY") == "true"
+}
+
+// ContactsOnly reports whether the workspace restricts chats to accepted contacts
+func ContactsOnly() bool {
+	return contactsOnly
+}
+
+// Contacts returns the users userID accepted as contacts, or who accepted them
+func Contacts(ctx context.Context, userID string) (map[string]bool, error) {
+	accepted, err := mongodb.ListContacts(ctx, userID, mongodb.ContactAccepted)
+	if err != nil {
+		return nil, err
+	}
+	contacts := make(map[string]bool, len(accepted))
+	for _, contact := range accepted {
+		if contact.RequesterID == userID {
+			contacts[contact.AddresseeID] = true
+		} else {
+			contacts[contact.RequesterID] = true
+		}
+	}
+	return contacts, nil
+}
+
+// CanReach reports whether senderID may start a chat with recipientID or add them
+// to one, it returns ErrBlocked or ErrContactsOnly when not. Under the CONTACTS_ONLY
+// policy only contacts may, unless one of the two is a bot.
+func CanReach(ctx context.Context, senderID string, recipientID string) error {
+	blocks, err := mongodb.FindBlocksBetween(ctx, senderID, []string{recipientID})
+	if err != nil {
+		return err
+	}
+	if len(blocks) > 0 {
+		return ErrBlocked
+	}
+
+	recipient, err := mongodb.FindUserByIdCached(ctx, recipientID)
+	if err != nil {
+		return err
+	}
+	// The sender only matters under the CONTACTS_ONLY policy
+	sender := &models.User{ID: senderID}
+	if contactsOnly && !recipient.Bot {
+		if sender, err = mongodb.FindUserByIdCached(ctx, senderID); err != nil {
+			return err
+		}
+	}
+	if !contactRequired(sender, recipient) {
+		return nil
+	}
+
+	contact, err := mongodb.FindContactByPair(ctx, senderID, recipientID)
+	if err != nil {
+		return err
+	}
+	if contact == nil || contact.Status != mongodb.ContactAccepted {
+		return ErrContactsOnly
+	}
+	return nil
+}
+
+// contactRequired reports whether sender must be an accepted contact of recipient
+// to reach them: when the recipient asks for it, or for everyone under CONTACTS_ONLY.
+// Bots can always be reached and reach anyone under the policy.
+func contactRequired(sender *models.User, recipient *models.User) bool {
+	switch {
+	case recipient.Bot:
+		return false
+	case contactsOnly:
+		return !sender.Bot
+	default:
+		return recipient.Privacy.AllowMessagesFrom == AudienceContacts
+	}
+}
+
+// Blocks sorts the blocks between senderID and the members of a chat: blockedBy
+// holds the members who blocked the sender, blocking those the sender blocked
+func Blocks(ctx context.Context, senderID string, members []string) (blockedBy map[string]bool, blocking map[string]bool, err error) {
+	blocks, err := mongodb.FindBlocksBetween(ctx, senderID, members)
+	if err != nil {
+		return nil, nil, err
+	}
+	blockedBy, blocking = sortBlocks(senderID, blocks)
+	return blockedBy, blocking, nil
+}
+
+func sortBlocks(senderID string, blocks []*models.Block) (blockedBy map[string]bool, blocking map[string]bool) {
+	blockedBy, blocking = map[string]bool{}, map[string]bool{}
+	for _, block := range blocks {
+		if block.BlockedID == senderID {
+			blockedBy[block.BlockerID] = true
+		} else {
+			blocking[block.BlockedID] = true
+		}
+	}
+	return blockedBy, blocking
+}
+
+// BlockedIDs returns the users userID blocked
+func BlockedIDs(ctx context.Context, userID string) ([]string, error) {
+	blocks, err := mongodb.ListBlocks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		ids = append(ids, block.BlockedID)
+	}
+	return ids, nil
+}
+
+// PresenceFilter decides which of a set of users may see each other online
+type PresenceFilter struct {
+	blocked  map[[2]string]bool
+	settings map[string]models.PrivacySettings
+	contacts map[[2]string]bool
+}
+
+// NewPresenceFilter loads the blocks, contacts and settings among userIDs, which
+// must include every viewer and every user shown
+func NewPresenceFilter(ctx context.Context, userIDs []string) (*PresenceFilter, error) {
+	blocks, err := mongodb.FindBlocksAmong(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := mongodb.GetUsersPrivacy(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	contacts, err := mongodb.FindContactsAmong(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &PresenceFilter{blocked: map[[2]string]bool{}, settings: settings, contacts: map[[2]string]bool{}}
+	for _, block := range blocks {
+		filter.blocked[[2]string{block.BlockerID, block.BlockedID}] = true
+	}
+	for _, contact := range contacts {
+		filter.contacts[[2]string{contact.RequesterID, contact.AddresseeID}] = true
+		filter.contacts[[2]string{contact.AddresseeID, contact.RequesterID}] = true
+	}
+	return filter, nil
+}
+
+// Visible reports whether viewerID may see that subjectID is online. Blocks hide
+// presence both ways, the CONTACTS_ONLY policy shows it to contacts at most.
+func (f *PresenceFilter) Visible(viewerID string, subjectID string) bool {
+	if viewerID == subjectID {
+		return true
+	}
+	if f.blocked[[2]string{viewerID, subjectID}] || f.blocked[[2]string{subjectID, viewerID}] {
+		return false
+	}
+	switch audience := f.settings[subjectID].ShowPresenceTo; {
+	case audience == AudienceNobody:
+		return false
+	case audience == AudienceContacts, contactsOnly:
+		return f.contacts[[2]string{viewerID, subjectID}]
+	default:
+		return true
+	}
+}
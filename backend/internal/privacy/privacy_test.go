@@ -0,0 +1,137 @@
+package privacy
+
+import (
+	"backend/internal/models"
+	"testing"
+)
+
+func TestSortBlocks(t *testing.T) {
+	blocks := []*models.Block{
+		{BlockerID: "bob", BlockedID: "alice"},
+		{BlockerID: "alice", BlockedID: "carol"},
+		{BlockerID: "dave", BlockedID: "alice"},
+	}
+	blockedBy, blocking := sortBlocks("alice", blocks)
+	if len(blockedBy) != 2 || !blockedBy["bob"] || !blockedBy["dave"] {
+		t.Errorf("blockedBy = %v, want bob and dave", blockedBy)
+	}
+	if len(blocking) != 1 || !blocking["carol"] {
+		t.Errorf("blocking = %v, want carol", blocking)
+	}
+
+	blockedBy, blocking = sortBlocks("alice", nil)
+	if blockedBy == nil || blocking == nil || len(blockedBy)+len(blocking) != 0 {
+		t.Errorf("no blocks gave %v, %v", blockedBy, blocking)
+	}
+}
+
+func TestPresenceHiddenByBlocks(t *testing.T) {
+	filter := &PresenceFilter{
+		blocked:  map[[2]string]bool{{"alice", "bob"}: true},
+		settings: map[string]models.PrivacySettings{},
+		contacts: map[[2]string]bool{},
+	}
+	// A block hides presence both ways
+	if filter.Visible("alice", "bob") || filter.Visible("bob", "alice") {
+		t.Error("presence visible across a block")
+	}
+	if !filter.Visible("alice", "carol") || !filter.Visible("carol", "bob") {
+		t.Error("a block hides presence from other users")
+	}
+	if !filter.Visible("bob", "bob") {
+		t.Error("users don't see themselves")
+	}
+}
+
+func TestPresenceHiddenFromEveryone(t *testing.T) {
+	filter := &PresenceFilter{
+		blocked:  map[[2]string]bool{},
+		settings: map[string]models.PrivacySettings{"bob": {ShowPresenceTo: AudienceNobody}},
+		contacts: map[[2]string]bool{{"alice", "bob"}: true},
+	}
+	if filter.Visible("alice", "bob") {
+		t.Error("presence shown with show_presence_to=nobody")
+	}
+	if !filter.Visible("bob", "alice") {
+		t.Error("hiding one's presence hides others")
+	}
+}
+
+// useContactsOnly sets the CONTACTS_ONLY policy for the test
+func useContactsOnly(t *testing.T, enabled bool) {
+	t.Helper()
+	previous := contactsOnly
+	contactsOnly = enabled
+	t.Cleanup(func() { contactsOnly = previous })
+}
+
+func TestContactRequired(t *testing.T) {
+	alice := &models.User{ID: "alice"}
+	bot := &models.User{ID: "bot", Bot: true}
+	open := &models.User{ID: "bob"}
+	closed := &models.User{ID: "carol", Privacy: models.PrivacySettings{AllowMessagesFrom: AudienceContacts}}
+
+	tests := []struct {
+		name              string
+		contactsOnly      bool
+		sender, recipient *models.User
+		want              bool
+	}{
+		{"recipient open to everyone", false, alice, open, false},
+		{"recipient accepting contacts only", false, alice, closed, true},
+		{"bots follow the recipient's setting", false, bot, closed, true},
+		{"bots can always be reached", false, alice, &models.User{Bot: true, Privacy: closed.Privacy}, false},
+		{"policy applies to open recipients", true, alice, open, true},
+		{"policy exempts bot senders", true, bot, open, false},
+		{"policy exempts bot recipients", true, alice, bot, false},
+	}
+	for _, tt := range tests {
+		useContactsOnly(t, tt.contactsOnly)
+		if got := contactRequired(tt.sender, tt.recipient); got != tt.want {
+			t.Errorf("%s: contactRequired = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPresenceForContacts(t *testing.T) {
+	filter := &PresenceFilter{
+		blocked: map[[2]string]bool{},
+		settings: map[string]models.PrivacySettings{
+			"bob": {ShowPresenceTo: AudienceContacts},
+		},
+		contacts: map[[2]string]bool{{"alice", "bob"}: true, {"bob", "alice"}: true},
+	}
+	useContactsOnly(t, false)
+	if !filter.Visible("alice", "bob") {
+		t.Error("a contact doesn't see bob")
+	}
+	if filter.Visible("carol", "bob") {
+		t.Error("a stranger sees bob, who shows presence to contacts")
+	}
+	if !filter.Visible("carol", "alice") {
+		t.Error("alice shows presence to everyone")
+	}
+
+	// The policy shows presence to contacts at most, even to those open to everyone
+	useContactsOnly(t, true)
+	if filter.Visible("carol", "alice") {
+		t.Error("a stranger sees alice under CONTACTS_ONLY")
+	}
+	if !filter.Visible("bob", "alice") {
+		t.Error("a contact doesn't see alice under CONTACTS_ONLY")
+	}
+}
+
+func TestInitReadsContactsOnly(t *testing.T) {
+	useContactsOnly(t, false)
+	t.Setenv("CONTACTS_ONLY", "true")
+	Init()
+	if !ContactsOnly() {
+		t.Error("CONTACTS_ONLY=true not applied")
+	}
+	t.Setenv("CONTACTS_ONLY", "yes")
+	Init()
+	if ContactsOnly() {
+		t.Error("only \"true\" enables CONTACTS_ONLY")
+	}
+}
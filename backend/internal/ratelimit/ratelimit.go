@@ -0,0 +1,213 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/logging"
+	"backend/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limit is a token bucket: Burst tokens at most, refilled at Rate tokens per second
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseLimit reads limits written as "<count>/<period>", e.g. "10/m", "5/30s" or "100/h".
+// The bucket holds count tokens and refills count tokens per period.
+func ParseLimit(value string) (Limit, error) {
+	count, period, found := strings.Cut(strings.TrimSpace(value), "/")
+	if !found {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected <count>/<period>", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit count %q", count)
+	}
+
+	switch period {
+	case "s":
+		period = "1s"
+	case "m":
+		period = "1m"
+	case "h":
+		period = "1h"
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit period %q", period)
+	}
+
+	return Limit{Rate: float64(burst) / duration.Seconds(), Burst: burst}, nil
+}
+
+// Policy is a named limit applied to keys computed from the request
+type Policy struct {
+	Name  string
+	Limit Limit
+	// Key returns the bucket key for the request, or "" to skip the policy
+	Key func(c *gin.Context) string
+}
+
+// Decision is the outcome of taking a token
+type Decision struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. Take consumes one token from key if available.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Decision, error)
+}
+
+// Policies with their defaults, each can be overridden by the environment variable
+// RATE_LIMIT_<NAME> (e.g. RATE_LIMIT_AUTH_IP=5/m)
+var (
+	// Failed and successful attempts on /login and /register from one address
+	AuthIP = Policy{Name: "auth_ip", Limit: mustParseLimit("20/m"), Key: ByIP}
+	// Login attempts against a single account, keyed by the submitted username or email
+	AuthAccount = Policy{Name: "auth_account", Limit: mustParseLimit("10/m")}
+	// Every REST request from one address
+	RestIP = Policy{Name: "rest_ip", Limit: mustParseLimit("600/m"), Key: ByIP}
+	// Every authenticated REST request from one user
+	RestUser = Policy{Name: "rest_user", Limit: mustParseLimit("300/m"), Key: ByUser}
+	// Inbound socket messages from one user into one chat
+	SocketMessage = Policy{Name: "socket_message", Limit: mustParseLimit("30/10s")}
+	// Posts to one incoming webhook URL
+	IncomingWebhook = Policy{Name: "incoming_webhook", Limit: mustParseLimit("20/m")}
+	// Exports started by one user, each reads a whole chat history
+	Export = Policy{Name: "export", Limit: mustParseLimit("10/h"), Key: ByUser}
+	// Contact requests sent by one user, so nobody can spam the whole directory
+	ContactRequest = Policy{Name: "contact_request", Limit: mustParseLimit("30/h"), Key: ByUser}
+	// Directory searches by one user, low enough that listing every user takes hours
+	DirectorySearch = Policy{Name: "directory_search", Limit: mustParseLimit("30/m"), Key: ByUser}
+	// Reports filed by one user, each lands in the moderators' queue
+	Report = Policy{Name: "report", Limit: mustParseLimit("20/h"), Key: ByUser}
+)
+
+var (
+	store  Store = NewMemoryStore()
+	exempt       = map[string]struct{}{}
+)
+
+func mustParseLimit(value string) Limit {
+	limit, err := ParseLimit(value)
+	if err != nil {
+		panic(err)
+	}
+	return limit
+}
+
+// configure overrides the policy limit from RATE_LIMIT_<NAME> when it is set and valid
+func configure(policy *Policy) {
+	key := "RATE_LIMIT_" + strings.ToUpper(policy.Name)
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	limit, err := ParseLimit(value)
+	if err != nil {
+		slog.Warn("Invalid rate limit, keeping default", "variable", key, logging.Err(err))
+		return
+	}
+	policy.Limit = limit
+}
+
+// Init applies the environment overrides and selects the store:
+// RATE_LIMIT_STORE=mongo shares the buckets between instances, anything else
+// keeps them in memory.
+func Init() {
+	for _, policy := range []*Policy{&AuthIP, &AuthAccount, &RestIP, &RestUser, &SocketMessage, &IncomingWebhook, &Export, &ContactRequest, &DirectorySearch, &Report} {
+		configure(policy)
+	}
+
+	if strings.EqualFold(os.Getenv("RATE_LIMIT_STORE"), "mongo") {
+		store = MongoStore{}
+		slog.Info("Rate limiter using shared MongoDB store")
+	}
+}
+
+// SetStore replaces the bucket store
+func SetStore(s Store) {
+	store = s
+}
+
+// Exempt excludes paths from Middleware, e.g. the health probes
+func Exempt(paths ...string) {
+	for _, path := range paths {
+		exempt[path] = struct{}{}
+	}
+}
+
+// ByIP keys a request by client address, X-Forwarded-For only counts when the
+// request comes from one of the proxies trusted by the router
+func ByIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// ByUser keys a request by the authenticated user, skipping anonymous requests
+func ByUser(c *gin.Context) string {
+	return c.GetString(logging.KeyUserID)
+}
+
+// Allow takes a token for key under policy. The stores take tokens atomically, so
+// an error means the store is unreachable and fails open: a limiter outage must
+// not take the chat down with it.
+func Allow(ctx context.Context, policy Policy, key string) Decision {
+	decision, err := store.Take(ctx, policy.Name+":"+key, policy.Limit, time.Now())
+	if err != nil {
+		logging.FromContext(ctx).Warn("Rate limiter unavailable", "policy", policy.Name, logging.Err(err))
+		return Decision{Allowed: true}
+	}
+	if !decision.Allowed {
+		metrics.RateLimited.WithLabelValues(policy.Name).Inc()
+	}
+	return decision
+}
+
+// Middleware enforces policies in order and answers 429 on the first one exhausted
+func Middleware(policies ...Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, skip := exempt[c.Request.URL.Path]; skip || c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		for _, policy := range policies {
+			if policy.Key == nil {
+				continue
+			}
+			key := policy.Key(c)
+			if key == "" {
+				continue
+			}
+			if decision := Allow(c.Request.Context(), policy, key); !decision.Allowed {
+				Reject(c, decision.RetryAfter)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// Reject answers 429 with a Retry-After header in whole seconds
+func Reject(c *gin.Context, retryAfter time.Duration) {
+	seconds := RetryAfterSeconds(retryAfter)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"message": "Too many requests, try again later", "retry_after": seconds})
+	c.Abort()
+}
+
+// RetryAfterSeconds rounds up to at least one second
+func RetryAfterSeconds(retryAfter time.Duration) int {
+	return int(math.Max(1, math.Ceil(retryAfter.Seconds())))
+}
@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Limit
+	}{
+		{"10/m", Limit{Rate: 10.0 / 60, Burst: 10}},
+		{"5/30s", Limit{Rate: 5.0 / 30, Burst: 5}},
+		{"100/h", Limit{Rate: 100.0 / 3600, Burst: 100}},
+		{" 3/s ", Limit{Rate: 3, Burst: 3}},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.value)
+		if err != nil {
+			t.Errorf("ParseLimit(%q) error: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLimit(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "10", "0/m", "-1/m", "x/m", "10/", "10/0s", "10/-1m", "10/week"} {
+		if _, err := ParseLimit(value); err == nil {
+			t.Errorf("ParseLimit(%q) accepted", value)
+		}
+	}
+}
+
+func TestMemoryStoreBurstThenRefill(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Rate: 1, Burst: 3}
+	now := time.Unix(1700000000, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if decision, _ := store.Take(ctx, "k", limit, now); !decision.Allowed {
+			t.Fatalf("take %d refused within the burst", i+1)
+		}
+	}
+	decision, _ := store.Take(ctx, "k", limit, now)
+	if decision.Allowed {
+		t.Fatal("take past the burst allowed")
+	}
+	if decision.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %v, want 1s", decision.RetryAfter)
+	}
+
+	// Half a token is not enough, the wait shrinks accordingly
+	decision, _ = store.Take(ctx, "k", limit, now.Add(500*time.Millisecond))
+	if decision.Allowed || decision.RetryAfter != 500*time.Millisecond {
+		t.Errorf("after 500ms: %+v, want refused with 500ms to wait", decision)
+	}
+	if decision, _ = store.Take(ctx, "k", limit, now.Add(time.Second)); !decision.Allowed {
+		t.Error("refused once a token was refilled")
+	}
+
+	// Other keys have their own bucket
+	if decision, _ = store.Take(ctx, "other", limit, now); !decision.Allowed {
+		t.Error("a new key did not start full")
+	}
+}
+
+func TestMemoryStoreNeverRefillsPastBurstOrBackwards(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Rate: 1, Burst: 2}
+	now := time.Unix(1700000000, 0)
+	ctx := context.Background()
+
+	store.Take(ctx, "k", limit, now)
+	store.Take(ctx, "k", limit, now)
+	// A clock running behind must not hand out tokens
+	if decision, _ := store.Take(ctx, "k", limit, now.Add(-time.Hour)); decision.Allowed {
+		t.Error("allowed with a clock running backwards")
+	}
+
+	// A long idle period only refills up to the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if decision, _ := store.Take(ctx, "k", limit, later); !decision.Allowed {
+			t.Fatalf("take %d refused after idling", i+1)
+		}
+	}
+	if decision, _ := store.Take(ctx, "k", limit, later); decision.Allowed {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Decision, error) {
+	return Decision{}, errors.New("store unreachable")
+}
+
+// withStore swaps the package store for the duration of a test
+func withStore(t *testing.T, s Store) {
+	t.Helper()
+	previous := store
+	SetStore(s)
+	t.Cleanup(func() { SetStore(previous) })
+}
+
+func TestAllowFailsOpen(t *testing.T) {
+	withStore(t, failingStore{})
+	policy := Policy{Name: "test", Limit: Limit{Rate: 1, Burst: 1}}
+	for i := 0; i < 3; i++ {
+		if decision := Allow(context.Background(), policy, "k"); !decision.Allowed {
+			t.Fatal("refused while the store is unreachable")
+		}
+	}
+}
+
+func newRouter(t *testing.T, policies ...Policy) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	withStore(t, NewMemoryStore())
+	r := gin.New()
+	if err := r.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	r.Use(Middleware(policies...))
+	r.GET("/ping", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.GET("/health", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	return r
+}
+
+func get(r http.Handler, path string, remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestMiddlewareRejectsWithRetryAfter(t *testing.T) {
+	r := newRouter(t, Policy{Name: "test", Limit: Limit{Rate: 0.1, Burst: 2}, Key: ByIP})
+
+	for i := 0; i < 2; i++ {
+		if code := get(r, "/ping", "192.0.2.1:1234", "").Code; code != http.StatusNoContent {
+			t.Fatalf("request %d answered %d", i+1, code)
+		}
+	}
+	recorder := get(r, "/ping", "192.0.2.1:1234", "")
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst answered %d", recorder.Code)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %q, want 10", got)
+	}
+	if code := get(r, "/ping", "192.0.2.2:1234", "").Code; code != http.StatusNoContent {
+		t.Errorf("another address answered %d", code)
+	}
+}
+
+func TestMiddlewareSkipsExemptPaths(t *testing.T) {
+	r := newRouter(t, Policy{Name: "test", Limit: Limit{Rate: 0.1, Burst: 1}, Key: ByIP})
+	Exempt("/health")
+	t.Cleanup(func() { delete(exempt, "/health") })
+
+	for i := 0; i < 3; i++ {
+		if code := get(r, "/health", "192.0.2.1:1234", "").Code; code != http.StatusNoContent {
+			t.Fatalf("exempt path answered %d", code)
+		}
+	}
+}
+
+func TestByIPOnlyTrustsConfiguredProxies(t *testing.T) {
+	r := newRouter(t, Policy{Name: "test", Limit: Limit{Rate: 0.1, Burst: 1}, Key: ByIP})
+
+	// A client can't pick a fresh bucket by forging the header
+	get(r, "/ping", "192.0.2.1:1234", "198.51.100.1")
+	if code := get(r, "/ping", "192.0.2.1:1234", "198.51.100.2").Code; code != http.StatusTooManyRequests {
+		t.Errorf("forged X-Forwarded-For answered %d, want 429", code)
+	}
+
+	// Behind the trusted proxy each client has its own bucket
+	if code := get(r, "/ping", "10.0.0.1:1234", "198.51.100.1").Code; code != http.StatusNoContent {
+		t.Errorf("first client behind the proxy answered %d", code)
+	}
+	if code := get(r, "/ping", "10.0.0.1:1234", "198.51.100.2").Code; code != http.StatusNoContent {
+		t.Errorf("second client behind the proxy answered %d", code)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := map[time.Duration]int{0: 1, 200 * time.Millisecond: 1, time.Second: 1, 1500 * time.Millisecond: 2, time.Minute: 60}
+	for retryAfter, want := range tests {
+		if got := RetryAfterSeconds(retryAfter); got != want {
+			t.Errorf("RetryAfterSeconds(%v) = %d, want %d", retryAfter, got, want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"backend/mongodb"
+)
+
+// refill returns the tokens in a bucket after elapsed time and whether one can be
+// taken, along with the wait until the next token
+func refill(tokens float64, elapsed time.Duration, limit Limit) (float64, Decision) {
+	// Clocks of different instances may disagree slightly, never refill backwards
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tokens = math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*limit.Rate)
+	if tokens >= 1 {
+		return tokens - 1, Decision{Allowed: true}
+	}
+	wait := time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	return tokens, Decision{Allowed: false, RetryAfter: wait}
+}
+
+// idleTTL is how long an untouched bucket is kept: by then it is full again
+func idleTTL(limit Limit) time.Duration {
+	return time.Duration(float64(limit.Burst)/limit.Rate*float64(time.Second)) + time.Minute
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	expiresAt time.Time
+}
+
+// MemoryStore keeps buckets in process, suitable for a single instance
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+// Take implements Store
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Decision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop full buckets once a minute so the map doesn't grow with every address seen
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.After(b.expiresAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		s.buckets[key] = b
+	}
+
+	tokens, decision := refill(b.tokens, now.Sub(b.updatedAt), limit)
+	b.tokens = tokens
+	b.updatedAt = now
+	b.expiresAt = now.Add(idleTTL(limit))
+	return decision, nil
+}
+
+// MongoStore keeps buckets in MongoDB so every instance shares them
+type MongoStore struct{}
+
+// Take implements Store
+func (MongoStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Decision, error) {
+	tokens, allowed, err := mongodb.TakeRateLimitToken(ctx, key, limit.Rate, limit.Burst, now, idleTTL(limit))
+	if err != nil {
+		return Decision{}, err
+	}
+	if allowed {
+		return Decision{Allowed: true}, nil
+	}
+	return Decision{Allowed: false, RetryAfter: time.Duration((1 - tokens) / limit.Rate * float64(time.Second))}, nil
+}
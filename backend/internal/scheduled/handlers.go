@@ -0,0 +1,218 @@
+package scheduled
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/mongodb"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Messages can't be scheduled further ahead than this
+	maxScheduleAhead  = 365 * 24 * time.Hour
+	maxPendingPerUser = 100
+)
+
+var listableStatuses = []string{"", mongodb.ScheduledPending, mongodb.ScheduledSending, mongodb.ScheduledSent, mongodb.ScheduledCanceled, mongodb.ScheduledFailed}
+
+// validateContent trims the content and returns an error message when it can't be sent
+func validateContent(content string) (string, string) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return "", "content is required"
+	}
+	if len(content) > messages.MaxMessageLength {
+		return "", fmt.Sprintf("content can be at most %d characters", messages.MaxMessageLength)
+	}
+	return content, ""
+}
+
+// validateSendAt returns an error message when sendAt isn't in the allowed window
+func validateSendAt(sendAt time.Time, now time.Time) string {
+	if !sendAt.After(now) {
+		return "send_at must be in the future"
+	}
+	if sendAt.Sub(now) > maxScheduleAhead {
+		return "send_at can be at most a year ahead"
+	}
+	return ""
+}
+
+// ownScheduledMessage loads the scheduled message named by :id if the caller wrote it, answering 404 otherwise
+func ownScheduledMessage(c *gin.Context, principal *auth.Principal) *models.ScheduledMessage {
+	scheduled, err := mongodb.FindScheduledMessageById(c.Request.Context(), c.Param("id"))
+	if err != nil || scheduled == nil || scheduled.Sender != principal.ID {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Scheduled message not found"})
+		return nil
+	}
+	return scheduled
+}
+
+// CreateScheduledMessage schedules a message to the chat :id, sent at send_at (RFC 3339)
+func CreateScheduledMessage(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		Content string    `json:"content"`
+		SendAt  time.Time `json:"send_at"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	now := time.Now()
+	content, problem := validateContent(payload.Content)
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": problem, "fieldError": "content"})
+		return
+	}
+	if problem := validateSendAt(payload.SendAt, now); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": problem, "fieldError": "send_at"})
+		return
+	}
+
+	chatID := c.Param("id")
+	if chat, err := mongodb.FindUserChat(c.Request.Context(), chatID, principal.ID); err != nil || chat == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Chat not found"})
+		return
+	}
+	pending, err := mongodb.CountPendingScheduledMessages(c.Request.Context(), principal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not schedule message"})
+		return
+	}
+	if pending >= maxPendingPerUser {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("You can have at most %d scheduled messages", maxPendingPerUser)})
+		return
+	}
+
+	scheduled := &models.ScheduledMessage{
+		ChatID:        chatID,
+		Sender:        principal.ID,
+		Content:       content,
+		SendAt:        payload.SendAt.UTC(),
+		Status:        mongodb.ScheduledPending,
+		NextAttemptAt: payload.SendAt.UTC(),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := mongodb.InsertScheduledMessage(c.Request.Context(), scheduled); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not schedule message"})
+		return
+	}
+
+	logging.FromGin(c).Info("Message scheduled", "scheduled_id", scheduled.ID, logging.KeyChatID, chatID)
+	c.JSON(http.StatusCreated, scheduled)
+}
+
+// ListScheduledMessages lists the caller's scheduled messages, filtered by ?chat_id= and ?status=
+func ListScheduledMessages(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	status := c.Query("status")
+	if !slices.Contains(listableStatuses, status) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown status: " + status})
+		return
+	}
+	scheduled, err := mongodb.ListScheduledMessages(c.Request.Context(), principal.ID, c.Query("chat_id"), status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list scheduled messages"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"scheduled_messages": scheduled})
+}
+
+// UpdateScheduledMessage changes the content and/or send_at of a pending message
+func UpdateScheduledMessage(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+	if ownScheduledMessage(c, principal) == nil {
+		return
+	}
+
+	var payload struct {
+		Content *string    `json:"content"`
+		SendAt  *time.Time `json:"send_at"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	if payload.Content == nil && payload.SendAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Nothing to update"})
+		return
+	}
+
+	now := time.Now()
+	if payload.Content != nil {
+		content, problem := validateContent(*payload.Content)
+		if problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": problem, "fieldError": "content"})
+			return
+		}
+		payload.Content = &content
+	}
+	if payload.SendAt != nil {
+		if problem := validateSendAt(*payload.SendAt, now); problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": problem, "fieldError": "send_at"})
+			return
+		}
+		sendAt := payload.SendAt.UTC()
+		payload.SendAt = &sendAt
+	}
+
+	updated, err := mongodb.UpdatePendingScheduledMessage(c.Request.Context(), c.Param("id"), payload.Content, payload.SendAt, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update scheduled message"})
+		return
+	}
+	if updated == nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "The message is no longer pending"})
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// CancelScheduledMessage cancels a pending message
+func CancelScheduledMessage(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+	if ownScheduledMessage(c, principal) == nil {
+		return
+	}
+
+	now := time.Now()
+	canceled, err := mongodb.CancelScheduledMessage(c.Request.Context(), c.Param("id"), now, now.Add(retention))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not cancel scheduled message"})
+		return
+	}
+	if !canceled {
+		c.JSON(http.StatusConflict, gin.H{"message": "The message is no longer pending"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled message canceled"})
+}
@@ -0,0 +1,144 @@
+package scheduled
+
+import (
+	"backend/internal/logging"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/internal/tracing"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Scheduler settings, see Init for the environment overrides
+var (
+	// How often the due messages are looked up, a message is sent at most this late
+	pollInterval = 2 * time.Second
+	// Sends that fail because the message couldn't be stored are retried this many times
+	maxAttempts = 3
+	retryDelay  = 30 * time.Second
+	// A message claimed this long ago without an outcome was interrupted by a crash
+	staleAfter = 2 * time.Minute
+	// How long sent, canceled and failed messages stay listed
+	retention = 30 * 24 * time.Hour
+)
+
+var (
+	stop = make(chan struct{})
+	wg   sync.WaitGroup
+)
+
+// Init applies the environment overrides and starts the scheduler
+//   - SCHEDULED_POLL_INTERVAL, SCHEDULED_RETENTION
+//
+// Every instance runs a scheduler; a message is claimed atomically in MongoDB
+// before it is sent, so it is sent by exactly one of them.
+func Init() {
+	pollInterval = utils.GetEnvDuration("SCHEDULED_POLL_INTERVAL", pollInterval)
+	retention = utils.GetEnvDuration("SCHEDULED_RETENTION", retention)
+
+	wg.Add(1)
+	go worker()
+}
+
+// Shutdown stops the scheduler, waiting for the send in progress until ctx expires.
+// Pending messages stay in MongoDB for the next instance.
+func Shutdown(ctx context.Context) error {
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func worker() {
+	defer wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if failed, err := mongodb.FailStaleScheduledMessages(context.Background(), now.Add(-staleAfter), now, now.Add(retention)); err != nil {
+			slog.Warn("Could not check interrupted scheduled messages", logging.Err(err))
+		} else if failed > 0 {
+			slog.Warn("Scheduled messages interrupted while sending", "count", failed)
+		}
+
+		// Send every due message, then sleep until the next poll
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			scheduled, err := mongodb.ClaimScheduledMessage(context.Background(), time.Now())
+			if err != nil {
+				slog.Warn("Could not claim scheduled message", logging.Err(err))
+				break
+			}
+			if scheduled == nil {
+				break
+			}
+			send(scheduled)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send delivers a claimed message through messages.SendMessage, as if the sender
+// had posted it now, and records the outcome
+func send(scheduled *models.ScheduledMessage) {
+	ctx, span := tracing.Tracer().Start(context.Background(), "scheduled.send")
+	defer span.End()
+	span.SetAttributes(attribute.String(logging.KeyChatID, scheduled.ChatID), attribute.Int("scheduled.attempt", scheduled.Attempts))
+	logger := slog.With("scheduled_id", scheduled.ID, logging.KeyChatID, scheduled.ChatID)
+	ctx = logging.WithContext(ctx, logger)
+
+	message, err := messages.SendMessage(ctx, scheduled.ChatID, models.Message{Sender: scheduled.Sender, Content: scheduled.Content})
+	now := time.Now()
+	if err == nil {
+		complete(ctx, logger, scheduled, mongodb.ScheduledSent, message.ID, "", now, now)
+		return
+	}
+	tracing.RecordError(span, err)
+
+	status := failedStatus(err, scheduled.Attempts)
+	logger.Warn("Scheduled message not sent", "status", status, logging.Err(err))
+	complete(ctx, logger, scheduled, status, "", err.Error(), now, now.Add(retryDelay))
+}
+
+// failedStatus is the status of a message whose send failed with err after attempts.
+// Only storage failures are worth retrying, the sender left the chat, was
+// disabled or muted otherwise.
+func failedStatus(err error, attempts int) string {
+	if errors.Is(err, messages.ErrMessageNotStored) && attempts < maxAttempts {
+		return mongodb.ScheduledPending
+	}
+	return mongodb.ScheduledFailed
+}
+
+func complete(ctx context.Context, logger *slog.Logger, scheduled *models.ScheduledMessage, status string, messageID string, sendError string, now time.Time, next time.Time) {
+	if err := mongodb.CompleteScheduledMessage(ctx, scheduled.ID, status, messageID, sendError, now, next, now.Add(retention)); err != nil {
+		logger.Error("Could not record scheduled message outcome", logging.Err(err))
+	}
+}
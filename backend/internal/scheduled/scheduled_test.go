@@ -0,0 +1,66 @@
+package scheduled
+
+import (
+	"backend/internal/messages"
+	"backend/mongodb"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateContent(t *testing.T) {
+	content, problem := validateContent("  hello \n")
+	if content != "hello" || problem != "" {
+		t.Errorf("validateContent = %q, %q, want the trimmed content", content, problem)
+	}
+	if _, problem := validateContent(strings.Repeat("a", messages.MaxMessageLength)); problem != "" {
+		t.Errorf("content of the maximum length refused: %s", problem)
+	}
+	for _, content := range []string{"", " \t\n", strings.Repeat("a", messages.MaxMessageLength+1)} {
+		if _, problem := validateContent(content); problem == "" {
+			t.Errorf("validateContent accepted %d characters", len(content))
+		}
+	}
+}
+
+func TestValidateSendAt(t *testing.T) {
+	now := time.Date(2024, 3, 12, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		sendAt time.Time
+		ok     bool
+	}{
+		{now.Add(time.Second), true},
+		{now.Add(maxScheduleAhead), true},
+		{now, false},
+		{now.Add(-time.Minute), false},
+		{now.Add(maxScheduleAhead + time.Second), false},
+	}
+	for _, tt := range tests {
+		if problem := validateSendAt(tt.sendAt, now); (problem == "") != tt.ok {
+			t.Errorf("validateSendAt(now%+v) = %q, want ok %v", tt.sendAt.Sub(now), problem, tt.ok)
+		}
+	}
+}
+
+func TestFailedStatus(t *testing.T) {
+	notStored := fmt.Errorf("send: %w", messages.ErrMessageNotStored)
+	tests := []struct {
+		err      error
+		attempts int
+		want     string
+	}{
+		{notStored, 1, mongodb.ScheduledPending},
+		{notStored, maxAttempts - 1, mongodb.ScheduledPending},
+		{notStored, maxAttempts, mongodb.ScheduledFailed},
+		{messages.ErrBlocked, 1, mongodb.ScheduledFailed},
+		{messages.ErrChatNotFound, 1, mongodb.ScheduledFailed},
+		{errors.New("muted"), 1, mongodb.ScheduledFailed},
+	}
+	for _, tt := range tests {
+		if got := failedStatus(tt.err, tt.attempts); got != tt.want {
+			t.Errorf("failedStatus(%v, %d) = %s, want %s", tt.err, tt.attempts, got, tt.want)
+		}
+	}
+}
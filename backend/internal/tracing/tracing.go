@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "backend"
+
+// ServiceName is reported on every span, configurable with OTEL_SERVICE_NAME
+func ServiceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	if name := os.Getenv("APP_NAME"); name != "" {
+		return name
+	}
+	return "chat-backend"
+}
+
+// Init installs the global tracer provider and W3C propagators.
+// Spans are exported over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT (or the
+// traces-specific variant) is set; the exporter reads the rest of the standard
+// OTEL_EXPORTER_OTLP_* variables itself. Without an endpoint tracing is a no-op
+// but trace context is still propagated. The returned function flushes and stops
+// the provider.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return InitWithExporter(exporter, sdktrace.WithBatcher(exporter)), nil
+}
+
+// InitWithExporter installs a tracer provider that sends spans to exporter.
+// Without extra options spans are exported synchronously, which is what tests
+// want when passing a tracetest.InMemoryExporter.
+func InitWithExporter(exporter sdktrace.SpanExporter, opts ...sdktrace.TracerProviderOption) func(context.Context) error {
+	if len(opts) == 0 {
+		opts = []sdktrace.TracerProviderOption{sdktrace.WithSyncer(exporter)}
+	}
+	opts = append(opts, sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(ServiceName()))))
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown
+}
+
+// Tracer returns the application tracer from the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Inject serialises the span context of ctx into a map suitable for a JSON envelope
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx carrying the remote span context found in carrier, if any
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// RecordError marks span as failed when err is not nil
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,110 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func newExporter(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown := InitWithExporter(exporter)
+	t.Cleanup(func() { _ = shutdown(context.Background()) })
+	return exporter
+}
+
+func TestInitWithExporterExportsEndedSpans(t *testing.T) {
+	t.Setenv("OTEL_SERVICE_NAME", "chat-test")
+	exporter := newExporter(t)
+
+	_, span := Tracer().Start(context.Background(), "ws.write")
+	if got := len(exporter.GetSpans()); got != 0 {
+		t.Fatalf("spans exported before End: %d", got)
+	}
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, want 1", len(spans))
+	}
+	if spans[0].Name != "ws.write" {
+		t.Errorf("span name = %q, want ws.write", spans[0].Name)
+	}
+	if spans[0].InstrumentationScope.Name != instrumentationName {
+		t.Errorf("scope = %q, want %q", spans[0].InstrumentationScope.Name, instrumentationName)
+	}
+	found := false
+	for _, attr := range spans[0].Resource.Attributes() {
+		if attr.Key == semconv.ServiceNameKey && attr.Value.AsString() == "chat-test" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("resource %v lacks service.name=chat-test", spans[0].Resource.Attributes())
+	}
+}
+
+func TestInjectExtractContinuesTheTrace(t *testing.T) {
+	exporter := newExporter(t)
+
+	ctx, parent := Tracer().Start(context.Background(), "ws.message")
+	carrier := Inject(ctx)
+	parent.End()
+	if carrier["traceparent"] == "" {
+		t.Fatalf("carrier %v has no traceparent", carrier)
+	}
+
+	// The carrier crosses a JSON envelope, the receiving side starts from a fresh context
+	_, child := Tracer().Start(Extract(context.Background(), carrier), "broadcast")
+	child.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	if spans[1].SpanContext.TraceID() != spans[0].SpanContext.TraceID() {
+		t.Errorf("child trace %s, want %s", spans[1].SpanContext.TraceID(), spans[0].SpanContext.TraceID())
+	}
+	if spans[1].Parent.SpanID() != spans[0].SpanContext.SpanID() {
+		t.Errorf("child parent %s, want %s", spans[1].Parent.SpanID(), spans[0].SpanContext.SpanID())
+	}
+}
+
+func TestInjectWithoutSpanIsEmpty(t *testing.T) {
+	newExporter(t)
+
+	if carrier := Inject(context.Background()); carrier != nil {
+		t.Errorf("Inject() = %v, want nil", carrier)
+	}
+	ctx := context.Background()
+	if got := Extract(ctx, nil); got != ctx {
+		t.Error("Extract(nil) returned a new context")
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	exporter := newExporter(t)
+
+	_, ok := Tracer().Start(context.Background(), "ok")
+	RecordError(ok, nil)
+	ok.End()
+	_, failed := Tracer().Start(context.Background(), "failed")
+	RecordError(failed, errors.New("receiver answered 500"))
+	failed.End()
+
+	spans := exporter.GetSpans()
+	if spans[0].Status.Code != codes.Unset || len(spans[0].Events) != 0 {
+		t.Errorf("nil error recorded: status %v, events %v", spans[0].Status, spans[0].Events)
+	}
+	if spans[1].Status.Code != codes.Error || spans[1].Status.Description != "receiver answered 500" {
+		t.Errorf("status = %v, want error", spans[1].Status)
+	}
+	if len(spans[1].Events) != 1 || spans[1].Events[0].Name != "exception" {
+		t.Errorf("events = %v, want one exception", spans[1].Events)
+	}
+}
@@ -0,0 +1,197 @@
+package webhooks
+
+import (
+	"backend/internal/auth"
+	"backend/internal/events"
+	"backend/internal/logging"
+	"backend/internal/models"
+	"backend/mongodb"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// subscribableEvents are the event types a webhook can ask for, "*" is every type.
+// There is no edit event: messages can't be edited, only removed (message.deleted).
+var subscribableEvents = []string{"*", events.MessageNew, events.MessagesExpired, events.MessageDeleted, events.ChatCreated, events.ChatMemberAdded, events.PresenceOnline, events.PresenceOffline}
+
+// ownedWebhook loads the webhook named by :id if the caller created it or manages
+// every webhook, answering 404 otherwise
+func ownedWebhook(c *gin.Context) *models.Webhook {
+	principal := auth.CurrentPrincipal(c)
+	webhook, err := mongodb.FindWebhookById(c.Request.Context(), c.Param("id"))
+	if err != nil || webhook == nil || principal == nil ||
+		(webhook.CreatedBy != principal.ID && !principal.Can(auth.PermManageWebhooks)) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Webhook not found"})
+		return nil
+	}
+	return webhook
+}
+
+// CreateWebhook registers a webhook on a chat the caller is in, or workspace-wide
+// for admins when chat_id is empty. The signing secret is only returned here.
+func CreateWebhook(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	var payload struct {
+		URL    string   `json:"url"`
+		ChatID string   `json:"chat_id"`
+		Events []string `json:"events"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+
+	target, err := url.Parse(payload.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "A valid http(s) URL is required", "fieldError": "url"})
+		return
+	}
+	if len(payload.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "At least one event is required", "fieldError": "events"})
+		return
+	}
+	for _, event := range payload.Events {
+		if !slices.Contains(subscribableEvents, event) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown event: " + event, "fieldError": "events"})
+			return
+		}
+	}
+
+	if payload.ChatID == "" {
+		if !principal.Can(auth.PermManageWebhooks) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "Only admins can create workspace webhooks"})
+			return
+		}
+	} else if chat, err := mongodb.FindUserChat(c.Request.Context(), payload.ChatID, principal.ID); err != nil || chat == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Chat not found", "fieldError": "chat_id"})
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create webhook"})
+		return
+	}
+
+	webhook := &models.Webhook{
+		ChatID:    payload.ChatID,
+		URL:       target.String(),
+		Secret:    "whsec_" + hex.EncodeToString(secret),
+		Events:    payload.Events,
+		CreatedBy: principal.ID,
+		CreatedAt: time.Now(),
+		Active:    true,
+	}
+	if err := mongodb.InsertWebhook(c.Request.Context(), webhook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create webhook"})
+		return
+	}
+
+	logging.FromGin(c).Info("Webhook created", "webhook_id", webhook.ID, logging.KeyChatID, webhook.ChatID)
+	c.JSON(http.StatusCreated, gin.H{"webhook": webhook, "secret": webhook.Secret})
+}
+
+// ListWebhooks lists the caller's webhooks, or every webhook for admins with ?all=true
+func ListWebhooks(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return
+	}
+
+	createdBy := principal.ID
+	if c.Query("all") == "true" && principal.Can(auth.PermManageWebhooks) {
+		createdBy = ""
+	}
+	webhooks, err := mongodb.ListWebhooks(c.Request.Context(), createdBy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list webhooks"})
+		return
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// DeleteWebhook removes a webhook and its pending deliveries
+func DeleteWebhook(c *gin.Context) {
+	webhook := ownedWebhook(c)
+	if webhook == nil {
+		return
+	}
+	if err := mongodb.DeleteWebhook(c.Request.Context(), webhook.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete webhook"})
+		return
+	}
+
+	logging.FromGin(c).Info("Webhook deleted", "webhook_id", webhook.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// EnableWebhook reactivates a webhook disabled after repeated failures
+func EnableWebhook(c *gin.Context) {
+	webhook := ownedWebhook(c)
+	if webhook == nil {
+		return
+	}
+	if err := mongodb.EnableWebhook(c.Request.Context(), webhook.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not enable webhook"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook enabled"})
+}
+
+// ListDeliveries returns the delivery log of a webhook, newest first
+func ListDeliveries(c *gin.Context) {
+	webhook := ownedWebhook(c)
+	if webhook == nil {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid limit value. Limit should be > 0 and <= 100."})
+		return
+	}
+	deliveries, err := mongodb.ListWebhookDeliveries(c.Request.Context(), webhook.ID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list deliveries"})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// PingWebhook queues a ping event, to check a receiver and its signature verification
+func PingWebhook(c *gin.Context) {
+	webhook := ownedWebhook(c)
+	if webhook == nil {
+		return
+	}
+	if !webhook.Active {
+		c.JSON(http.StatusConflict, gin.H{"message": "Webhook is disabled"})
+		return
+	}
+
+	event := events.Event{
+		ID:         strconv.FormatInt(time.Now().UnixNano(), 36),
+		Type:       EventPing,
+		ChatID:     webhook.ChatID,
+		ActorID:    auth.CurrentPrincipal(c).ID,
+		OccurredAt: time.Now(),
+	}
+	if err := queue(c.Request.Context(), []*models.Webhook{webhook}, event); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not queue ping"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Ping queued", "event_id": event.ID})
+}
@@ -0,0 +1,279 @@
+package webhooks
+
+import (
+	"backend/internal/auth"
+	"backend/internal/logging"
+	"backend/internal/messages"
+	"backend/internal/models"
+	"backend/internal/ratelimit"
+	"backend/mongodb"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MessageTypeWebhook is the type of messages posted through an incoming webhook
+const MessageTypeWebhook = "webhook"
+
+const (
+	maxAttachments     = 10
+	maxDisplayNameLen  = 64
+	maxAttachmentField = 2000
+)
+
+var attachmentColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// incomingPayload is a Slack-style webhook body
+type incomingPayload struct {
+	Text        string                     `json:"text"`
+	Username    string                     `json:"username"`
+	IconURL     string                     `json:"icon_url"`
+	Attachments []models.MessageAttachment `json:"attachments"`
+}
+
+func hashHookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func isHTTPURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// validate checks the payload and returns the offending field
+func (p *incomingPayload) validate() (string, error) {
+	p.Text = strings.TrimSpace(p.Text)
+	p.Username = strings.TrimSpace(p.Username)
+	if p.Text == "" && len(p.Attachments) == 0 {
+		return "text", errors.New("text or attachments are required")
+	}
+	if len(p.Text) > messages.MaxMessageLength {
+		return "text", fmt.Errorf("text is limited to %d characters", messages.MaxMessageLength)
+	}
+	if len(p.Username) > maxDisplayNameLen {
+		return "username", fmt.Errorf("username is limited to %d characters", maxDisplayNameLen)
+	}
+	if p.IconURL != "" && !isHTTPURL(p.IconURL) {
+		return "icon_url", errors.New("icon_url must be an http(s) URL")
+	}
+	if len(p.Attachments) > maxAttachments {
+		return "attachments", fmt.Errorf("at most %d attachments are allowed", maxAttachments)
+	}
+	for _, attachment := range p.Attachments {
+		if attachment.Title == "" && attachment.Text == "" && attachment.ImageURL == "" {
+			return "attachments", errors.New("attachments need a title, text or image_url")
+		}
+		if len(attachment.Title) > maxAttachmentField || len(attachment.Text) > maxAttachmentField {
+			return "attachments", fmt.Errorf("attachment fields are limited to %d characters", maxAttachmentField)
+		}
+		if (attachment.TitleLink != "" && !isHTTPURL(attachment.TitleLink)) || (attachment.ImageURL != "" && !isHTTPURL(attachment.ImageURL)) {
+			return "attachments", errors.New("attachment links must be http(s) URLs")
+		}
+		if attachment.Color != "" && !attachmentColor.MatchString(attachment.Color) {
+			return "attachments", errors.New("attachment color must be #rrggbb")
+		}
+	}
+	return "", nil
+}
+
+// content is the text stored as the message content, so chat previews work for attachment-only posts
+func (p *incomingPayload) content() string {
+	if p.Text != "" {
+		return p.Text
+	}
+	first := p.Attachments[0]
+	if first.Title != "" {
+		return first.Title
+	}
+	return first.Text
+}
+
+// ReceiveIncomingWebhook is the public endpoint behind every incoming webhook URL.
+// The message is sent on behalf of the member who created the webhook.
+func ReceiveIncomingWebhook(c *gin.Context) {
+	hook, err := mongodb.FindIncomingWebhookByHash(c.Request.Context(), hashHookToken(c.Param("token")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong"})
+		return
+	}
+	if hook == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Unknown webhook"})
+		return
+	}
+
+	if decision := ratelimit.Allow(c.Request.Context(), ratelimit.IncomingWebhook, hook.ID); !decision.Allowed {
+		ratelimit.Reject(c, decision.RetryAfter)
+		return
+	}
+
+	var payload incomingPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	if field, err := payload.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "fieldError": field})
+		return
+	}
+
+	displayName := payload.Username
+	if displayName == "" {
+		displayName = hook.Name
+	}
+	messageType := MessageTypeWebhook
+	message, err := messages.SendMessage(c.Request.Context(), hook.ChatID, models.Message{
+		Sender:      hook.CreatedBy,
+		Content:     payload.content(),
+		Type:        &messageType,
+		WebhookID:   hook.ID,
+		DisplayName: displayName,
+		AvatarURL:   payload.IconURL,
+		Attachments: payload.Attachments,
+	})
+	switch {
+	case errors.Is(err, messages.ErrChatNotFound):
+		// The creator is no longer in the chat
+		c.JSON(http.StatusGone, gin.H{"message": "This webhook's chat is no longer available"})
+		return
+	case errors.Is(err, messages.ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"message": "This chat is closed to new messages by a block"})
+		return
+	case errors.Is(err, messages.ErrMuted):
+		c.JSON(http.StatusForbidden, gin.H{"message": "The creator of this webhook is muted"})
+		return
+	case errors.Is(err, messages.ErrSenderDisabled):
+		// The creator's account was disabled or deleted, it won't come back on its own
+		c.JSON(http.StatusGone, gin.H{"message": "The creator of this webhook is no longer active"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to send message"})
+		return
+	}
+
+	if err := mongodb.TouchIncomingWebhook(c.Request.Context(), hook.ID, time.Now()); err != nil {
+		logging.FromGin(c).Warn("Could not record incoming webhook use", logging.Err(err))
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "id": message.ID})
+}
+
+// incomingWebhookURL is the absolute URL of a token, based on PUBLIC_BASE_URL
+// or the address the request came in on
+func incomingWebhookURL(c *gin.Context, token string) string {
+	base := strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+	if base == "" {
+		scheme := "http"
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + c.Request.Host
+	}
+	return base + "/hooks/" + token
+}
+
+// memberChat returns the chat named by :id if the caller is a member, answering 404 otherwise
+func memberChat(c *gin.Context) *models.Chat {
+	principal := auth.CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "User not authorized"})
+		return nil
+	}
+	chat, err := mongodb.FindUserChat(c.Request.Context(), c.Param("id"), principal.ID)
+	if err != nil || chat == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Chat not found"})
+		return nil
+	}
+	return chat
+}
+
+// CreateIncomingWebhook creates a webhook URL posting into a chat. The URL holds
+// the secret token and is only returned by this call.
+func CreateIncomingWebhook(c *gin.Context) {
+	chat := memberChat(c)
+	if chat == nil {
+		return
+	}
+
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input"})
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" || len(payload.Name) > maxDisplayNameLen {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Name is required (%d characters at most)", maxDisplayNameLen), "fieldError": "name"})
+		return
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create webhook"})
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	hook := &models.IncomingWebhook{
+		ChatID:    chat.ID,
+		Name:      payload.Name,
+		TokenHash: hashHookToken(token),
+		CreatedBy: auth.CurrentPrincipal(c).ID,
+		CreatedAt: time.Now(),
+	}
+	if err := mongodb.InsertIncomingWebhook(c.Request.Context(), hook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create webhook"})
+		return
+	}
+
+	logging.FromGin(c).Info("Incoming webhook created", "webhook_id", hook.ID, logging.KeyChatID, chat.ID)
+	c.JSON(http.StatusCreated, gin.H{"webhook": hook, "url": incomingWebhookURL(c, token)})
+}
+
+// ListIncomingWebhooks lists the incoming webhooks of a chat, without their URLs
+func ListIncomingWebhooks(c *gin.Context) {
+	chat := memberChat(c)
+	if chat == nil {
+		return
+	}
+
+	hooks, err := mongodb.ListIncomingWebhooks(c.Request.Context(), chat.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not list webhooks"})
+		return
+	}
+	c.JSON(http.StatusOK, hooks)
+}
+
+// DeleteIncomingWebhook revokes an incoming webhook, any member of its chat may do it
+func DeleteIncomingWebhook(c *gin.Context) {
+	principal := auth.CurrentPrincipal(c)
+	hook, err := mongodb.FindIncomingWebhookById(c.Request.Context(), c.Param("id"))
+	if err != nil || hook == nil || principal == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Webhook not found"})
+		return
+	}
+	if chat, err := mongodb.FindUserChat(c.Request.Context(), hook.ChatID, principal.ID); err != nil || chat == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Webhook not found"})
+		return
+	}
+
+	if err := mongodb.DeleteIncomingWebhook(c.Request.Context(), hook.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete webhook"})
+		return
+	}
+
+	logging.FromGin(c).Info("Incoming webhook deleted", "webhook_id", hook.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
@@ -0,0 +1,311 @@
+package webhooks
+
+import (
+	"backend/internal/events"
+	"backend/internal/logging"
+	"backend/internal/metrics"
+	"backend/internal/models"
+	"backend/internal/outbound"
+	"backend/internal/tracing"
+	"backend/internal/utils"
+	"backend/mongodb"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers sent with every delivery, along with outbound.HeaderSignature
+const (
+	HeaderEvent    = "X-Webhook-Event"
+	HeaderDelivery = "X-Webhook-Delivery"
+	HeaderWebhook  = "X-Webhook-Id"
+)
+
+// EventPing is queued by the ping endpoint to check a receiver
+const EventPing = "ping"
+
+// Delivery settings, see Init for the environment overrides
+var (
+	// Attempts per delivery before it is marked failed
+	maxAttempts = 8
+	// Failed attempts in a row, over any deliveries, before the webhook is disabled
+	disableAfter = 20
+	// The wait after the first failed attempt, doubled with every further attempt up to backoffMax
+	backoffBase = 10 * time.Second
+	backoffMax  = time.Hour
+	// How long the delivery log is kept
+	logRetention = 7 * 24 * time.Hour
+
+	requestTimeout = 10 * time.Second
+	pollInterval   = 2 * time.Second
+	workers        = 2
+)
+
+var (
+	client *http.Client
+
+	// wake nudges the workers when a delivery is queued on this instance
+	wake = make(chan struct{}, 1)
+	stop = make(chan struct{})
+	wg   sync.WaitGroup
+)
+
+// Init applies the environment overrides, subscribes to chat events and starts the delivery workers
+//   - WEBHOOK_MAX_ATTEMPTS, WEBHOOK_DISABLE_AFTER
+//   - WEBHOOK_BACKOFF_BASE, WEBHOOK_BACKOFF_MAX, WEBHOOK_LOG_RETENTION
+//   - WEBHOOK_ALLOW_PRIVATE_TARGETS: "true" to deliver to loopback and private addresses, see outbound.NewClient
+func Init() {
+	maxAttempts = utils.GetEnvInt("WEBHOOK_MAX_ATTEMPTS", maxAttempts)
+	disableAfter = utils.GetEnvInt("WEBHOOK_DISABLE_AFTER", disableAfter)
+	backoffBase = utils.GetEnvDuration("WEBHOOK_BACKOFF_BASE", backoffBase)
+	backoffMax = utils.GetEnvDuration("WEBHOOK_BACKOFF_MAX", backoffMax)
+	logRetention = utils.GetEnvDuration("WEBHOOK_LOG_RETENTION", logRetention)
+	client = outbound.NewClient(requestTimeout)
+
+	events.Subscribe(enqueueEvent)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go worker()
+	}
+}
+
+// Shutdown stops the workers, waiting for in-flight attempts until ctx expires.
+// Queued deliveries stay in MongoDB for the next instance.
+func Shutdown(ctx context.Context) error {
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueueEvent queues a delivery of event for every matching webhook. The webhooks
+// of a chat only receive its events while their creator is still a member.
+func enqueueEvent(ctx context.Context, event events.Event) {
+	webhooks, err := mongodb.FindWebhooksForEvent(ctx, event.ChatID, event.Type)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not find webhooks for event", "event_type", event.Type, logging.Err(err))
+		return
+	}
+	if webhooks, err = withMemberCreators(ctx, webhooks); err != nil {
+		logging.FromContext(ctx).Warn("Could not check webhook creators", "event_type", event.Type, logging.Err(err))
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	if err := queue(ctx, webhooks, event); err != nil {
+		logging.FromContext(ctx).Warn("Could not queue webhook deliveries", "event_type", event.Type, logging.Err(err))
+	}
+}
+
+// withMemberCreators drops the chat webhooks whose creator left the chat,
+// workspace webhooks are kept
+func withMemberCreators(ctx context.Context, webhooks []*models.Webhook) ([]*models.Webhook, error) {
+	kept := make([]*models.Webhook, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		if webhook.ChatID != "" {
+			member, err := mongodb.IsChatMember(ctx, webhook.ChatID, webhook.CreatedBy)
+			if err != nil {
+				return nil, err
+			}
+			if !member {
+				continue
+			}
+		}
+		kept = append(kept, webhook)
+	}
+	return kept, nil
+}
+
+func queue(ctx context.Context, webhooks []*models.Webhook, event events.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not encode event: %v", err)
+	}
+
+	now := time.Now()
+	deliveries := make([]*models.WebhookDelivery, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		deliveries = append(deliveries, &models.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Payload:       string(payload),
+			Status:        mongodb.DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			ExpiresAt:     now.Add(logRetention),
+		})
+	}
+	if err := mongodb.InsertWebhookDeliveries(ctx, deliveries); err != nil {
+		return err
+	}
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func worker() {
+	defer wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain every due delivery, then sleep until nudged or the next poll
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			delivery, err := mongodb.ClaimWebhookDelivery(context.Background(), time.Now(), requestTimeout+time.Minute)
+			if err != nil {
+				slog.Warn("Could not claim webhook delivery", logging.Err(err))
+				break
+			}
+			if delivery == nil {
+				break
+			}
+			attempt(delivery)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// attempt sends a delivery once and schedules the retry or records the outcome
+func attempt(delivery *models.WebhookDelivery) {
+	ctx, span := tracing.Tracer().Start(context.Background(), "webhooks.deliver",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("webhook.id", delivery.WebhookID),
+			attribute.String("webhook.event", delivery.EventType),
+			attribute.Int("webhook.attempt", delivery.Attempts+1),
+		))
+	defer span.End()
+	logger := slog.With("webhook_id", delivery.WebhookID, "delivery_id", delivery.ID)
+
+	now := time.Now()
+	webhook, err := mongodb.FindWebhookById(ctx, delivery.WebhookID)
+	if err != nil {
+		logger.Warn("Could not load webhook", logging.Err(err))
+		return // The lease expires and the delivery is claimed again
+	}
+	if webhook == nil || !webhook.Active {
+		complete(ctx, logger, delivery, mongodb.DeliveryFailed, 0, "webhook disabled", now, now)
+		return
+	}
+	// Deliveries queued before the creator left the chat are dropped too
+	if webhook.ChatID != "" {
+		member, err := mongodb.IsChatMember(ctx, webhook.ChatID, webhook.CreatedBy)
+		if err != nil {
+			logger.Warn("Could not check webhook creator", logging.Err(err))
+			return
+		}
+		if !member {
+			complete(ctx, logger, delivery, mongodb.DeliveryFailed, 0, "creator left the chat", now, now)
+			return
+		}
+	}
+
+	statusCode, err := send(ctx, webhook, delivery, now)
+	if err == nil {
+		metrics.WebhookAttempts.WithLabelValues(metrics.WebhookDelivered).Inc()
+		complete(ctx, logger, delivery, mongodb.DeliveryDelivered, statusCode, "", now, now)
+		if _, err := mongodb.RecordWebhookAttempt(ctx, webhook.ID, true, disableAfter, now); err != nil {
+			logger.Warn("Could not record webhook attempt", logging.Err(err))
+		}
+		return
+	}
+	tracing.RecordError(span, err)
+
+	status := mongodb.DeliveryPending
+	if delivery.Attempts+1 >= maxAttempts {
+		status = mongodb.DeliveryFailed
+		metrics.WebhookAttempts.WithLabelValues(metrics.WebhookFailed).Inc()
+	} else {
+		metrics.WebhookAttempts.WithLabelValues(metrics.WebhookRetried).Inc()
+	}
+	complete(ctx, logger, delivery, status, statusCode, err.Error(), now, now.Add(backoff(delivery.Attempts+1)))
+
+	disabled, recordErr := mongodb.RecordWebhookAttempt(ctx, webhook.ID, false, disableAfter, now)
+	if recordErr != nil {
+		logger.Warn("Could not record webhook attempt", logging.Err(recordErr))
+	} else if disabled {
+		logger.Warn("Webhook disabled after repeated failures", "failures", disableAfter)
+	}
+}
+
+func complete(ctx context.Context, logger *slog.Logger, delivery *models.WebhookDelivery, status string, statusCode int, attemptError string, now time.Time, next time.Time) {
+	if err := mongodb.CompleteWebhookDelivery(ctx, delivery.ID, status, statusCode, attemptError, now, next); err != nil {
+		logger.Warn("Could not update webhook delivery", logging.Err(err))
+	}
+}
+
+// send posts the payload, any answer other than 2xx is a failure
+func send(ctx context.Context, webhook *models.Webhook, delivery *models.WebhookDelivery, now time.Time) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "chat-webhooks/1.0")
+	request.Header.Set(outbound.HeaderSignature, outbound.Sign(webhook.Secret, now, []byte(delivery.Payload)))
+	request.Header.Set(HeaderEvent, delivery.EventType)
+	request.Header.Set(HeaderDelivery, delivery.ID)
+	request.Header.Set(HeaderWebhook, webhook.ID)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// backoff is the wait before the next attempt after the given number of attempts,
+// with up to 20% jitter so that retries of one outage don't arrive together
+func backoff(attempts int) time.Duration {
+	delay := backoffBase
+	for i := 1; i < attempts && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	return delay + time.Duration(mathrand.Int63n(int64(delay)/5+1))
+}
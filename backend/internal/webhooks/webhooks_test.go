@@ -0,0 +1,193 @@
+package webhooks
+
+import (
+	"backend/internal/models"
+	"backend/internal/outbound"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useClient delivers through a client built with the given private target setting
+func useClient(t *testing.T, allowPrivate bool) {
+	t.Helper()
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_TARGETS", strconv.FormatBool(allowPrivate))
+	previous := client
+	client = outbound.NewClient(requestTimeout)
+	t.Cleanup(func() { client = previous })
+}
+
+// receiver is a local webhook endpoint that checks the signature of what it receives
+type receiver struct {
+	server *httptest.Server
+	secret string
+	status int
+
+	mu       sync.Mutex
+	received []*http.Request
+	bodies   []string
+	verified []bool
+}
+
+func newReceiver(t *testing.T, secret string, status int) *receiver {
+	t.Helper()
+	r := &receiver{secret: secret, status: status}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		r.mu.Lock()
+		r.received = append(r.received, request)
+		r.bodies = append(r.bodies, string(body))
+		r.verified = append(r.verified, r.verify(request.Header.Get(outbound.HeaderSignature), body))
+		r.mu.Unlock()
+		if r.status == http.StatusFound {
+			w.Header().Set("Location", "http://169.254.169.254/")
+		}
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// verify recomputes the signature the way the documentation tells receivers to
+func (r *receiver) verify(header string, body []byte) bool {
+	timestamp, signature, ok := strings.Cut(header, ",")
+	if !ok || !strings.HasPrefix(timestamp, "t=") || !strings.HasPrefix(signature, "v1=") {
+		return false
+	}
+	timestamp = strings.TrimPrefix(timestamp, "t=")
+	mac := hmac.New(sha256.New, []byte(r.secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hmac.Equal([]byte(strings.TrimPrefix(signature, "v1=")), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
+
+func newDelivery(url string, secret string) (*models.Webhook, *models.WebhookDelivery) {
+	webhook := &models.Webhook{ID: "webhook-1", URL: url, Secret: secret}
+	delivery := &models.WebhookDelivery{ID: "delivery-1", EventType: "message.created", Payload: `{"event":"message.created"}`}
+	return webhook, delivery
+}
+
+func TestSendSignsTheDelivery(t *testing.T) {
+	useClient(t, true)
+	r := newReceiver(t, "s3cret", http.StatusNoContent)
+	webhook, delivery := newDelivery(r.server.URL, "s3cret")
+	now := time.Unix(1700000000, 0)
+
+	status, err := send(context.Background(), webhook, delivery, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", status)
+	}
+	if len(r.received) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(r.received))
+	}
+	request := r.received[0]
+	if r.bodies[0] != delivery.Payload {
+		t.Errorf("body = %q", r.bodies[0])
+	}
+	if !r.verified[0] {
+		t.Errorf("signature %q doesn't verify", request.Header.Get(outbound.HeaderSignature))
+	}
+	if got := request.Header.Get(outbound.HeaderSignature); !strings.HasPrefix(got, "t=1700000000,") {
+		t.Errorf("signature %q isn't stamped with the attempt time", got)
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		HeaderEvent:    "message.created",
+		HeaderDelivery: "delivery-1",
+		HeaderWebhook:  "webhook-1",
+	}
+	for name, want := range headers {
+		if got := request.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSendSignatureNeedsTheSecret(t *testing.T) {
+	useClient(t, true)
+	r := newReceiver(t, "receiver-secret", http.StatusOK)
+	webhook, delivery := newDelivery(r.server.URL, "another-secret")
+
+	if _, err := send(context.Background(), webhook, delivery, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if r.verified[0] {
+		t.Error("a signature made with another secret verified")
+	}
+}
+
+func TestSendFailsOnErrorAnswers(t *testing.T) {
+	useClient(t, true)
+	for _, want := range []int{http.StatusBadRequest, http.StatusGone, http.StatusInternalServerError} {
+		r := newReceiver(t, "s3cret", want)
+		webhook, delivery := newDelivery(r.server.URL, "s3cret")
+
+		status, err := send(context.Background(), webhook, delivery, time.Now())
+		if err == nil {
+			t.Errorf("answer %d counted as delivered", want)
+		}
+		// The status is kept in the delivery log
+		if status != want {
+			t.Errorf("status = %d, want %d", status, want)
+		}
+	}
+}
+
+func TestSendDoesNotFollowRedirects(t *testing.T) {
+	useClient(t, true)
+	r := newReceiver(t, "s3cret", http.StatusFound)
+	webhook, delivery := newDelivery(r.server.URL, "s3cret")
+
+	status, err := send(context.Background(), webhook, delivery, time.Now())
+	if err == nil || status != http.StatusFound {
+		t.Errorf("redirect gave %d, %v, want a failed 302", status, err)
+	}
+	if len(r.received) != 1 {
+		t.Errorf("receiver got %d requests, want 1", len(r.received))
+	}
+}
+
+func TestSendRefusesPrivateTargets(t *testing.T) {
+	useClient(t, false)
+	r := newReceiver(t, "s3cret", http.StatusOK)
+	webhook, delivery := newDelivery(r.server.URL, "s3cret")
+
+	status, err := send(context.Background(), webhook, delivery, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("delivery to a loopback receiver: %v", err)
+	}
+	if status != 0 || len(r.received) != 0 {
+		t.Errorf("loopback receiver was reached")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  backoffBase,
+		2:  2 * backoffBase,
+		3:  4 * backoffBase,
+		10: backoffMax,
+		50: backoffMax,
+	} {
+		for i := 0; i < 20; i++ {
+			got := backoff(attempts)
+			// Up to 20% jitter on top of the wait
+			if got < want || got > want+want/5 {
+				t.Errorf("backoff(%d) = %v, want %v to %v", attempts, got, want, want+want/5)
+				break
+			}
+		}
+	}
+}
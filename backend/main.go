@@ -1,22 +1,41 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"backend/internal/account"
+	"backend/internal/admin"
 	"backend/internal/auth"
+	"backend/internal/contacts"
+	"backend/internal/directory"
+	"backend/internal/export"
 	"backend/internal/handlers"
+	"backend/internal/health"
+	"backend/internal/importer"
+	"backend/internal/logging"
+	"backend/internal/mailer"
 	"backend/internal/messages"
+	"backend/internal/metrics"
+	"backend/internal/moderation"
+	"backend/internal/privacy"
+	"backend/internal/ratelimit"
+	"backend/internal/scheduled"
+	"backend/internal/tracing"
+	"backend/internal/utils"
+	"backend/internal/webhooks"
 	"backend/mongodb"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 func loadEnvFile() {
@@ -38,22 +57,81 @@ func loadEnvFile() {
 
 	err := godotenv.Load(envFile)
 	if err != nil {
-		log.Fatalf("Error loading .env file for environment %s: %v", appEnv, err)
+		logging.Fatal("Error loading .env file", "environment", appEnv, logging.Err(err))
 	}
 
-	fmt.Printf("Loaded environment configuration from %s\n", envFile)
+	slog.Info("Loaded environment configuration", "file", envFile)
 }
 
 func main() {
 	// Load environment variables
 	loadEnvFile()
+	logging.Init()
+
+	// Initialize tracing, spans are exported only when an OTLP endpoint is configured
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", logging.Err(err))
+	}
 
 	// Initialize MongoDB connection
 	mongodb.InitMongoDB()
+	health.RegisterCheck("mongodb", mongodb.Ping)
+
+	// JWT signing keys, generated and rotated in MongoDB
+	if err := auth.InitKeys(context.Background()); err != nil {
+		logging.Fatal("Failed to initialize JWT signing keys", logging.Err(err))
+	}
+
+	// Email notifications and login brute-force protection
+	mailer.Init()
+	auth.InitLockout()
+	auth.InitRoles(context.Background())
+
+	// Outgoing webhooks, delivered from a queue in MongoDB
+	webhooks.Init()
+
+	// Scheduled messages, sent by whichever instance claims them first
+	scheduled.Init()
+
+	// Disappearing messages and the workspace retention limit
+	messages.InitRetention()
+
+	// Moderation frames and disconnections for the sockets of the other instances
+	messages.InitRelay()
+
+	// Background exports, stored in GridFS until they expire
+	export.Init()
+
+	// Account deletions, carried out once their grace period is over
+	if err := account.Init(); err != nil {
+		logging.Fatal("Failed to initialize account deletion", logging.Err(err))
+	}
+
+	// Slack and WhatsApp history imports
+	importer.Init()
+
+	// Workspace wide contacts only policy
+	privacy.Init()
+
+	// Rate limiter policies and store, the probes are never limited
+	ratelimit.Init()
+	ratelimit.Exempt("/healthz", "/readyz", "/metrics", "/.well-known/jwks.json")
 
 	// Create a Gin router instance
-	r := gin.Default()
-	r.Use(auth.JWTMiddleware) // Apply JWT middleware globally
+	// gin.Default's logger is replaced by the structured request logger
+	r := gin.New()
+	// X-Forwarded-For is only believed from the proxies listed in TRUSTED_PROXIES
+	// (comma separated addresses or CIDRs), the client address is used otherwise
+	if err := r.SetTrustedProxies(utils.GetEnvList("TRUSTED_PROXIES")); err != nil {
+		logging.Fatal("Invalid TRUSTED_PROXIES", logging.Err(err))
+	}
+	r.Use(gin.Recovery())
+	r.Use(otelgin.Middleware(tracing.ServiceName())) // Start the request span first so logs carry its trace ID
+	r.Use(logging.Middleware)
+	r.Use(metrics.GinMiddleware) // Record latency before auth so rejected requests are counted too
+	r.Use(auth.JWTMiddleware)    // Apply JWT middleware globally
+	r.Use(ratelimit.Middleware(ratelimit.RestIP, ratelimit.RestUser))
 	//config := cors.DefaultConfig()
 	//allowOrigin := os.Getenv("ALLOW_ORIGIN")
 	config := cors.Config{
@@ -76,20 +154,120 @@ func main() {
 
 	// Routes for HTTP-based interactions
 	r.GET("/hello", handlers.HelloWorld)
+	r.GET("/healthz", health.Healthz)
+	r.GET("/readyz", health.Readyz)
+	r.GET("/metrics", metrics.Handler())
+	r.GET("/.well-known/jwks.json", auth.JWKS)
+
+	r.POST("/register", ratelimit.Middleware(ratelimit.AuthIP), auth.Register)
+	r.POST("/login", ratelimit.Middleware(ratelimit.AuthIP), auth.Login)
+	r.POST("/login/mfa", ratelimit.Middleware(ratelimit.AuthIP), auth.VerifyMFALogin)
+
+	// OpenID Connect single sign-on
+	r.GET("/auth/oidc/login", ratelimit.Middleware(ratelimit.AuthIP), auth.OIDCLogin)
+	r.GET("/auth/oidc/callback", ratelimit.Middleware(ratelimit.AuthIP), auth.OIDCCallback)
 
-	r.POST("/register", auth.Register)
-	r.POST("/login", auth.Login)
+	// Two-factor authentication management
+	r.POST("/mfa/enroll", auth.EnrollMFA)
+	r.POST("/mfa/confirm", auth.ConfirmMFA)
+	r.POST("/mfa/disable", auth.DisableMFA)
+	r.POST("/mfa/recovery-codes", auth.RegenerateRecoveryCodes)
 
 	r.GET("/getChats", messages.GetChats)
 	r.GET("/getChatById", messages.GetChatsById)
 	r.GET("/getMessageChat", messages.GetMessageChat)
 	r.POST("/createChat", messages.CreateChat)
+	r.POST("/chats/:id/messages", messages.PostMessage)
+	r.PUT("/chats/:id/retention", messages.SetChatRetention)
+
+	// Exports
+	r.GET("/chats/:id/export", ratelimit.Middleware(ratelimit.Export), export.ExportChat)
+	r.GET("/exports", export.ListExports)
+	r.GET("/exports/:id", export.GetExport)
+	r.GET("/exports/:id/download", export.DownloadExport)
+
+	// Personal data: download and account deletion
+	r.POST("/account/export", ratelimit.Middleware(ratelimit.Export), export.ExportAccount)
+	r.GET("/account/deletion", account.GetDeletion)
+	r.POST("/account/deletion", account.RequestDeletion)
+	r.DELETE("/account/deletion", account.CancelDeletion)
+
+	// Scheduled messages
+	r.GET("/scheduled", scheduled.ListScheduledMessages)
+	r.POST("/chats/:id/scheduled", scheduled.CreateScheduledMessage)
+	r.PATCH("/scheduled/:id", scheduled.UpdateScheduledMessage)
+	r.DELETE("/scheduled/:id", scheduled.CancelScheduledMessage)
+
+	// Personal access tokens and bot accounts
+	r.GET("/tokens", auth.ListAPITokens)
+	r.POST("/tokens", auth.CreateAPIToken)
+	r.DELETE("/tokens/:id", auth.RevokeAPIToken)
+	r.GET("/bots", auth.ListBots)
+	r.POST("/bots", auth.CreateBot)
+	r.GET("/bots/:id/commands", messages.ListBotCommands)
+	r.POST("/bots/:id/commands", messages.CreateBotCommand)
+	r.DELETE("/bots/:id/commands/:name", messages.DeleteBotCommand)
+
+	// Outgoing webhooks
+	r.GET("/webhooks", webhooks.ListWebhooks)
+	r.POST("/webhooks", webhooks.CreateWebhook)
+	r.DELETE("/webhooks/:id", webhooks.DeleteWebhook)
+	r.POST("/webhooks/:id/enable", webhooks.EnableWebhook)
+	r.POST("/webhooks/:id/ping", webhooks.PingWebhook)
+	r.GET("/webhooks/:id/deliveries", webhooks.ListDeliveries)
+
+	// Incoming webhooks
+	r.POST("/hooks/:token", webhooks.ReceiveIncomingWebhook)
+	r.GET("/chats/:id/incoming-webhooks", webhooks.ListIncomingWebhooks)
+	r.POST("/chats/:id/incoming-webhooks", webhooks.CreateIncomingWebhook)
+	r.DELETE("/incoming-webhooks/:id", webhooks.DeleteIncomingWebhook)
 
 	// WebSocket route for chat messages
 	r.GET("/ws", messages.HandleWebSocket)
 
 	r.GET("/onlineUsers", messages.OnlineUsers)
 
+	// User directory and the caller's display name
+	r.GET("/users/search", ratelimit.Middleware(ratelimit.DirectorySearch), directory.Search)
+	r.PUT("/profile", directory.UpdateProfile)
+
+	// Reports to the moderators
+	r.POST("/reports", ratelimit.Middleware(ratelimit.Report), moderation.CreateReport)
+
+	// Blocks and privacy settings
+	r.GET("/blocks", privacy.ListBlocks)
+	r.POST("/blocks", privacy.BlockUser)
+	r.DELETE("/blocks/:id", privacy.UnblockUser)
+	r.GET("/privacy", privacy.GetSettings)
+	r.PUT("/privacy", privacy.UpdateSettings)
+
+	// Contacts and contact requests
+	r.GET("/contacts", contacts.ListContacts)
+	r.DELETE("/contacts/:id", contacts.RemoveContact)
+	r.GET("/contacts/requests", contacts.ListRequests)
+	r.POST("/contacts/requests", ratelimit.Middleware(ratelimit.ContactRequest), contacts.SendRequest)
+	r.POST("/contacts/requests/:id/accept", contacts.AcceptRequest)
+	r.POST("/contacts/requests/:id/decline", contacts.DeclineRequest)
+	r.DELETE("/contacts/requests/:id", contacts.CancelRequest)
+
+	// Administration, each route requires a permission granted by a role
+	adminRoutes := r.Group("/admin")
+	adminRoutes.GET("/users", auth.RequirePermission(auth.PermViewUsers), admin.ListUsers)
+	adminRoutes.GET("/users/:id", auth.RequirePermission(auth.PermViewUsers), admin.GetUser)
+	adminRoutes.POST("/users/:id/disable", auth.RequirePermission(auth.PermManageUsers), admin.DisableUser)
+	adminRoutes.POST("/users/:id/enable", auth.RequirePermission(auth.PermManageUsers), admin.EnableUser)
+	adminRoutes.POST("/users/:id/reset-password", auth.RequirePermission(auth.PermManageUsers), admin.ResetPassword)
+	adminRoutes.POST("/users/:id/unlock", auth.RequirePermission(auth.PermManageUsers), auth.UnlockUser)
+	adminRoutes.PUT("/users/:id/roles", auth.RequirePermission(auth.PermManageRoles), admin.SetRoles)
+	adminRoutes.GET("/chats/:id", auth.RequirePermission(auth.PermInspectChats), admin.GetChat)
+	adminRoutes.GET("/connections", auth.RequirePermission(auth.PermViewConnections), admin.Connections)
+	adminRoutes.POST("/imports", auth.RequirePermission(auth.PermImportChats), importer.Import)
+	adminRoutes.GET("/reports", auth.RequirePermission(auth.PermModerate), moderation.ListReports)
+	adminRoutes.GET("/reports/:id", auth.RequirePermission(auth.PermModerate), moderation.GetReport)
+	adminRoutes.POST("/reports/:id/resolve", auth.RequirePermission(auth.PermModerate), moderation.ResolveReport)
+	adminRoutes.POST("/users/:id/unmute", auth.RequirePermission(auth.PermModerate), moderation.Unmute)
+	adminRoutes.GET("/moderation/actions", auth.RequirePermission(auth.PermModerate), moderation.ListActions)
+
 	// Start HTTP server
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%s", os.Getenv("PORT")),
@@ -100,9 +278,9 @@ func main() {
 
 	// Start the server in a goroutine
 	go func() {
-		fmt.Println("Starting server on port", os.Getenv("PORT"))
+		slog.Info("Starting server", "port", os.Getenv("PORT"))
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal("ListenAndServe(): ", err)
+			logging.Fatal("ListenAndServe()", logging.Err(err))
 		}
 	}()
 
@@ -111,10 +289,36 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
-	// Graceful shutdown: shut down the server and MongoDB connection
-	fmt.Println("Shutting down server...")
-	if err := server.Close(); err != nil {
-		log.Fatal("Server close:", err)
+	// Graceful shutdown: fail readiness first, drain WebSocket clients,
+	// then shut down the server and MongoDB connection
+	slog.Info("Shutting down server")
+	health.SetShuttingDown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), utils.GetEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second))
+	defer cancel()
+
+	// Hijacked WebSocket connections are not tracked by server.Shutdown, drain them first
+	if err := messages.Shutdown(ctx); err != nil {
+		slog.Warn("WebSocket drain", logging.Err(err))
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Server shutdown", logging.Err(err))
+	}
+	// Unsent webhook deliveries stay queued in MongoDB
+	if err := webhooks.Shutdown(ctx); err != nil {
+		slog.Warn("Webhook workers shutdown", logging.Err(err))
+	}
+	if err := scheduled.Shutdown(ctx); err != nil {
+		slog.Warn("Scheduler shutdown", logging.Err(err))
+	}
+	if err := export.Shutdown(ctx); err != nil {
+		slog.Warn("Export worker shutdown", logging.Err(err))
+	}
+	if err := account.Shutdown(ctx); err != nil {
+		slog.Warn("Account deletion worker shutdown", logging.Err(err))
 	}
 	mongodb.CloseMongoDB()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("Tracing shutdown", logging.Err(err))
+	}
 }
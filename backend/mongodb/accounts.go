@@ -0,0 +1,260 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MessageTypeDeleted replaces the type of the messages of a deleted account
+const MessageTypeDeleted = "deleted"
+
+// ScheduleUserDeletion records a deletion request carried out at scheduledAt
+func ScheduleUserDeletion(ctx context.Context, userID string, requestedAt time.Time, scheduledAt time.Time) error {
+	ctx, end := startOp(ctx, "ScheduleUserDeletion")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{"$set": bson.M{"deletion_requested_at": requestedAt, "deletion_scheduled_at": scheduledAt}})
+}
+
+// CancelUserDeletion withdraws a deletion request and reports whether one was
+// pending; a deletion already in progress can't be cancelled
+func CancelUserDeletion(ctx context.Context, userID string) (bool, error) {
+	ctx, end := startOp(ctx, "CancelUserDeletion")
+	defer end()
+	defer InvalidateUser(userID)
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return false, fmt.Errorf("invalid user ID format: %v", err)
+	}
+	result, err := usersCollection.UpdateOne(ctx,
+		bson.M{
+			"_id":                    userObjectID,
+			"deletion_scheduled_at":  bson.M{"$exists": true},
+			"deletion_claimed_until": bson.M{"$exists": false},
+			"deleted_at":             bson.M{"$exists": false},
+		},
+		bson.M{"$unset": bson.M{"deletion_requested_at": "", "deletion_scheduled_at": ""}})
+	if err != nil {
+		return false, fmt.Errorf("error cancelling deletion: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// ClaimUserDeletion atomically takes the next account due for deletion for lease,
+// so a single instance deletes it. An interrupted deletion is claimed again once
+// the lease has passed. It returns nil when no account is due.
+func ClaimUserDeletion(ctx context.Context, now time.Time, lease time.Duration) (*models.User, error) {
+	ctx, end := startOp(ctx, "ClaimUserDeletion")
+	defer end()
+
+	filter := bson.M{
+		"deletion_scheduled_at": bson.M{"$lte": now},
+		"deleted_at":            bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"deletion_claimed_until": bson.M{"$exists": false}},
+			{"deletion_claimed_until": bson.M{"$lt": now}},
+		},
+	}
+	var user models.User
+	err := usersCollection.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"deletion_claimed_until": now.Add(lease)}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error claiming account deletion: %v", err)
+	}
+	InvalidateUser(user.ID)
+	return &user, nil
+}
+
+// AnonymiseUser strips every personal field of a deleted account and disables it.
+// The record stays so that the IDs in chats and messages still resolve.
+func AnonymiseUser(ctx context.Context, userID string, now time.Time) error {
+	ctx, end := startOp(ctx, "AnonymiseUser")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{
+		"$set": bson.M{
+			"username":    "deleted-" + userID,
+			"email":       "",
+			"password":    "",
+			"disabled":    true,
+			"disabled_at": now,
+			"deleted_at":  now,
+		},
+		"$unset": bson.M{
+			"roles":                  "",
+			"mfa_enabled":            "",
+			"mfa_secret":             "",
+			"mfa_pending_secret":     "",
+			"mfa_recovery_codes":     "",
+			"mfa_last_step":          "",
+			"oidc_identities":        "",
+			"deletion_claimed_until": "",
+			"display_name":           "",
+			"search_names":           "",
+		},
+	})
+}
+
+// FindChatsOfUser returns the chats a user is a member of
+func FindChatsOfUser(ctx context.Context, userID string) ([]*models.Chat, error) {
+	ctx, end := startOp(ctx, "FindChatsOfUser")
+	defer end()
+
+	cursor, err := chatsCollection.Find(ctx, bson.M{"users": userID}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding chats: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	chats := []*models.Chat{}
+	if err := cursor.All(ctx, &chats); err != nil {
+		return nil, fmt.Errorf("error decoding chats: %v", err)
+	}
+	return chats, nil
+}
+
+// RemoveUserFromChats takes a user out of every chat
+func RemoveUserFromChats(ctx context.Context, userID string) error {
+	ctx, end := startOp(ctx, "RemoveUserFromChats")
+	defer end()
+
+	if _, err := chatsCollection.UpdateMany(ctx, bson.M{"users": userID}, bson.M{"$pull": bson.M{"users": userID}}); err != nil {
+		return fmt.Errorf("error removing user from chats: %v", err)
+	}
+	return nil
+}
+
+// StreamMessagesBySender calls fn for every message a user sent, oldest first
+func StreamMessagesBySender(ctx context.Context, senderID string, fn func(message *models.Message) error) error {
+	ctx, end := startOp(ctx, "StreamMessagesBySender")
+	defer end()
+
+	cursor, err := messagesCollection.Find(ctx, bson.M{"sender": senderID},
+		options.Find().SetSort(bson.D{{Key: "sent_at", Value: 1}, {Key: "_id", Value: 1}}).SetBatchSize(500))
+	if err != nil {
+		return fmt.Errorf("failed to retrieve messages: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var message models.Message
+		if err := cursor.Decode(&message); err != nil {
+			return fmt.Errorf("error decoding message: %v", err)
+		}
+		if err := fn(&message); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// FindChatIdsWithMessagesFrom returns the chats holding messages of a sender
+func FindChatIdsWithMessagesFrom(ctx context.Context, senderID string) ([]string, error) {
+	ctx, end := startOp(ctx, "FindChatIdsWithMessagesFrom")
+	defer end()
+
+	values, err := messagesCollection.Distinct(ctx, "chat_id", bson.M{"sender": senderID})
+	if err != nil {
+		return nil, fmt.Errorf("error finding chats of sender: %v", err)
+	}
+	chatIDs := make([]string, 0, len(values))
+	for _, value := range values {
+		if chatID, ok := value.(string); ok {
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	return chatIDs, nil
+}
+
+// TombstoneMessagesBySender empties every message of a sender, keeping its place in the history
+func TombstoneMessagesBySender(ctx context.Context, senderID string) (int64, error) {
+	ctx, end := startOp(ctx, "TombstoneMessagesBySender")
+	defer end()
+
+	result, err := messagesCollection.UpdateMany(ctx, bson.M{"sender": senderID}, bson.M{
+		"$set":   bson.M{"content": "", "type": MessageTypeDeleted},
+		"$unset": bson.M{"attachments": "", "display_name": "", "avatar_url": ""},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error tombstoning messages: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeleteMessagesBySender deletes every message of a sender
+func DeleteMessagesBySender(ctx context.Context, senderID string) (int64, error) {
+	ctx, end := startOp(ctx, "DeleteMessagesBySender")
+	defer end()
+
+	result, err := messagesCollection.DeleteMany(ctx, bson.M{"sender": senderID})
+	if err != nil {
+		return 0, fmt.Errorf("error deleting messages: %v", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// DeleteUserData removes what a user created besides messages: API tokens,
+// webhooks, incoming webhooks, bot commands of their bots, pending scheduled
+// messages, blocks made by or against them, contacts and contact requests and
+// export jobs with their files
+func DeleteUserData(ctx context.Context, userID string, botIDs []string) error {
+	ctx, end := startOp(ctx, "DeleteUserData")
+	defer end()
+
+	tokenOwners := append([]string{userID}, botIDs...)
+	if _, err := apiTokensCollection.DeleteMany(ctx, bson.M{"user_id": bson.M{"$in": tokenOwners}}); err != nil {
+		return fmt.Errorf("error deleting api tokens: %v", err)
+	}
+	if _, err := webhooksCollection.DeleteMany(ctx, bson.M{"created_by": userID}); err != nil {
+		return fmt.Errorf("error deleting webhooks: %v", err)
+	}
+	if _, err := incomingWebhooksCollection.DeleteMany(ctx, bson.M{"created_by": userID}); err != nil {
+		return fmt.Errorf("error deleting incoming webhooks: %v", err)
+	}
+	if len(botIDs) > 0 {
+		if _, err := botCommandsCollection.DeleteMany(ctx, bson.M{"bot_id": bson.M{"$in": botIDs}}); err != nil {
+			return fmt.Errorf("error deleting bot commands: %v", err)
+		}
+	}
+	if _, err := scheduledMessagesCollection.DeleteMany(ctx, bson.M{"sender": userID}); err != nil {
+		return fmt.Errorf("error deleting scheduled messages: %v", err)
+	}
+	if _, err := blocksCollection.DeleteMany(ctx, bson.M{"$or": []bson.M{{"blocker_id": userID}, {"blocked_id": userID}}}); err != nil {
+		return fmt.Errorf("error deleting blocks: %v", err)
+	}
+	if _, err := contactsCollection.DeleteMany(ctx, bson.M{"$or": []bson.M{{"requester_id": userID}, {"addressee_id": userID}}}); err != nil {
+		return fmt.Errorf("error deleting contacts: %v", err)
+	}
+
+	cursor, err := exportJobsCollection.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return fmt.Errorf("error finding export jobs: %v", err)
+	}
+	jobs := []*models.ExportJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return fmt.Errorf("error decoding export jobs: %v", err)
+	}
+	for _, job := range jobs {
+		if job.FileID != "" {
+			if err := DeleteExportFile(ctx, job.FileID); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := exportJobsCollection.DeleteMany(ctx, bson.M{"user_id": userID}); err != nil {
+		return fmt.Errorf("error deleting export jobs: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SearchUsers pages through the users whose username or email contains query,
+// sorted by username. An empty query lists every user.
+func SearchUsers(ctx context.Context, query string, limit int, page int) ([]*models.User, int64, error) {
+	ctx, end := startOp(ctx, "SearchUsers")
+	defer end()
+
+	filter := bson.M{}
+	if query != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(query), Options: "i"}
+		filter = bson.M{"$or": []bson.M{{"username": pattern}, {"email": pattern}}}
+	}
+
+	total, err := usersCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting users: %v", err)
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.M{"username": 1}).
+		SetSkip(int64((page - 1) * limit)).
+		SetLimit(int64(limit))
+	cursor, err := usersCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching users: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	users := []*models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, 0, fmt.Errorf("error decoding users: %v", err)
+	}
+	return users, total, nil
+}
+
+// SetUserDisabled disables or re-enables an account
+func SetUserDisabled(ctx context.Context, userID string, disabled bool, now time.Time) error {
+	ctx, end := startOp(ctx, "SetUserDisabled")
+	defer end()
+
+	if disabled {
+		return updateUser(ctx, userID, bson.M{"$set": bson.M{"disabled": true, "disabled_at": now}})
+	}
+	return updateUser(ctx, userID, bson.M{"$unset": bson.M{"disabled": "", "disabled_at": ""}})
+}
+
+// SetUserPassword replaces the password hash of a user and ends their sessions
+func SetUserPassword(ctx context.Context, userID string, passwordHash string) error {
+	ctx, end := startOp(ctx, "SetUserPassword")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{"$set": bson.M{"password": passwordHash}, "$inc": bson.M{"session_generation": 1}})
+}
+
+// SetUserRoles replaces the roles of a user
+func SetUserRoles(ctx context.Context, userID string, roles []string) error {
+	ctx, end := startOp(ctx, "SetUserRoles")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{"$set": bson.M{"roles": roles}})
+}
+
+// AddUserRoleByUsername grants a role to the user with this username, reporting
+// false if there is no such user
+func AddUserRoleByUsername(ctx context.Context, username string, role string) (bool, error) {
+	ctx, end := startOp(ctx, "AddUserRoleByUsername")
+	defer end()
+
+	user, err := FindUserByUsername(ctx, username, false)
+	if err != nil {
+		return false, err
+	}
+	if user == nil {
+		return false, nil
+	}
+	if err := updateUser(ctx, user.ID, bson.M{"$addToSet": bson.M{"roles": role}}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AddUserRole grants a role to a user, reporting false if there is no such user
+func AddUserRole(ctx context.Context, userID string, role string) (bool, error) {
+	ctx, end := startOp(ctx, "AddUserRole")
+	defer end()
+
+	user, err := FindUserById(ctx, userID)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := updateUser(ctx, user.ID, bson.M{"$addToSet": bson.M{"roles": role}}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// HasUserWithRole reports whether any user holds role
+func HasUserWithRole(ctx context.Context, role string) (bool, error) {
+	ctx, end := startOp(ctx, "HasUserWithRole")
+	defer end()
+
+	count, err := usersCollection.CountDocuments(ctx, bson.M{"roles": role}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("error counting users: %v", err)
+	}
+	return count > 0, nil
+}
+
+// FindChatById returns a chat whoever its members are, for administration
+func FindChatById(ctx context.Context, chatID string) (*models.Chat, error) {
+	ctx, end := startOp(ctx, "FindChatById")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat ID format: %v", err)
+	}
+
+	var chat models.Chat
+	if err := chatsCollection.FindOne(ctx, bson.M{"_id": chatObjectID}).Decode(&chat); err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
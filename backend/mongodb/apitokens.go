@@ -0,0 +1,120 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InsertAPIToken stores a new token and sets its ID
+func InsertAPIToken(ctx context.Context, token *models.APIToken) error {
+	ctx, end := startOp(ctx, "InsertAPIToken")
+	defer end()
+
+	result, err := apiTokensCollection.InsertOne(ctx, token)
+	if err != nil {
+		return fmt.Errorf("error inserting api token: %v", err)
+	}
+	if objectID, ok := result.InsertedID.(primitive.ObjectID); ok {
+		token.ID = objectID.Hex()
+	}
+	return nil
+}
+
+// FindAPITokenByHash returns the token with this hash, or nil if there is none
+func FindAPITokenByHash(ctx context.Context, hash string) (*models.APIToken, error) {
+	ctx, end := startOp(ctx, "FindAPITokenByHash")
+	defer end()
+
+	var token models.APIToken
+	err := apiTokensCollection.FindOne(ctx, bson.M{"hash": hash}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding api token: %v", err)
+	}
+	return &token, nil
+}
+
+// ListAPITokens returns the tokens acting as any of userIDs, newest first
+func ListAPITokens(ctx context.Context, userIDs []string) ([]*models.APIToken, error) {
+	ctx, end := startOp(ctx, "ListAPITokens")
+	defer end()
+
+	cursor, err := apiTokensCollection.Find(ctx,
+		bson.M{"user_id": bson.M{"$in": userIDs}},
+		options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing api tokens: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	tokens := []*models.APIToken{}
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, fmt.Errorf("error decoding api tokens: %v", err)
+	}
+	return tokens, nil
+}
+
+// DeleteAPIToken revokes a token acting as any of userIDs, reporting false if there was none
+func DeleteAPIToken(ctx context.Context, tokenID string, userIDs []string) (bool, error) {
+	ctx, end := startOp(ctx, "DeleteAPIToken")
+	defer end()
+
+	tokenObjectID, err := primitive.ObjectIDFromHex(tokenID)
+	if err != nil {
+		return false, fmt.Errorf("invalid token ID format: %v", err)
+	}
+	result, err := apiTokensCollection.DeleteOne(ctx, bson.M{"_id": tokenObjectID, "user_id": bson.M{"$in": userIDs}})
+	if err != nil {
+		return false, fmt.Errorf("error deleting api token: %v", err)
+	}
+	return result.DeletedCount == 1, nil
+}
+
+// TouchAPIToken records a use of the token, at most once per interval to spare writes
+func TouchAPIToken(ctx context.Context, tokenID string, now time.Time, interval time.Duration) error {
+	ctx, end := startOp(ctx, "TouchAPIToken")
+	defer end()
+
+	tokenObjectID, err := primitive.ObjectIDFromHex(tokenID)
+	if err != nil {
+		return fmt.Errorf("invalid token ID format: %v", err)
+	}
+	filter := bson.M{
+		"_id": tokenObjectID,
+		"$or": []bson.M{
+			{"last_used_at": bson.M{"$exists": false}},
+			{"last_used_at": bson.M{"$lt": now.Add(-interval)}},
+		},
+	}
+	if _, err := apiTokensCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"last_used_at": now}}); err != nil {
+		return fmt.Errorf("error updating api token: %v", err)
+	}
+	return nil
+}
+
+// FindBotsByOwner returns the bot accounts created by a user
+func FindBotsByOwner(ctx context.Context, ownerID string) ([]*models.User, error) {
+	ctx, end := startOp(ctx, "FindBotsByOwner")
+	defer end()
+
+	cursor, err := usersCollection.Find(ctx, bson.M{"bot": true, "bot_owner": ownerID}, options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing bots: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	bots := []*models.User{}
+	if err := cursor.All(ctx, &bots); err != nil {
+		return nil, fmt.Errorf("error decoding bots: %v", err)
+	}
+	return bots, nil
+}
@@ -0,0 +1,161 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InsertBlock records that blockerID blocks blockedID and reports whether the
+// block is new, blocking twice is a no-op
+func InsertBlock(ctx context.Context, blockerID string, blockedID string, now time.Time) (bool, error) {
+	ctx, end := startOp(ctx, "InsertBlock")
+	defer end()
+
+	result, err := blocksCollection.UpdateOne(ctx,
+		bson.M{"blocker_id": blockerID, "blocked_id": blockedID},
+		bson.M{"$setOnInsert": bson.M{"created_at": now}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return false, fmt.Errorf("error inserting block: %v", err)
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+// DeleteBlock lifts a block and reports whether there was one
+func DeleteBlock(ctx context.Context, blockerID string, blockedID string) (bool, error) {
+	ctx, end := startOp(ctx, "DeleteBlock")
+	defer end()
+
+	result, err := blocksCollection.DeleteOne(ctx, bson.M{"blocker_id": blockerID, "blocked_id": blockedID})
+	if err != nil {
+		return false, fmt.Errorf("error deleting block: %v", err)
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// ListBlocks returns the blocks made by blockerID, newest first
+func ListBlocks(ctx context.Context, blockerID string) ([]*models.Block, error) {
+	ctx, end := startOp(ctx, "ListBlocks")
+	defer end()
+
+	cursor, err := blocksCollection.Find(ctx, bson.M{"blocker_id": blockerID}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding blocks: %v", err)
+	}
+	blocks := []*models.Block{}
+	if err := cursor.All(ctx, &blocks); err != nil {
+		return nil, fmt.Errorf("error decoding blocks: %v", err)
+	}
+	return blocks, nil
+}
+
+// FindBlocksBetween returns the blocks in either direction between userID and any of others
+func FindBlocksBetween(ctx context.Context, userID string, others []string) ([]*models.Block, error) {
+	ctx, end := startOp(ctx, "FindBlocksBetween")
+	defer end()
+
+	blocks := []*models.Block{}
+	if len(others) == 0 {
+		return blocks, nil
+	}
+	filter := bson.M{"$or": []bson.M{
+		{"blocker_id": userID, "blocked_id": bson.M{"$in": others}},
+		{"blocked_id": userID, "blocker_id": bson.M{"$in": others}},
+	}}
+	cursor, err := blocksCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error finding blocks: %v", err)
+	}
+	if err := cursor.All(ctx, &blocks); err != nil {
+		return nil, fmt.Errorf("error decoding blocks: %v", err)
+	}
+	return blocks, nil
+}
+
+// FindBlockedUserIDs returns the users userID blocked or was blocked by
+func FindBlockedUserIDs(ctx context.Context, userID string) ([]string, error) {
+	ctx, end := startOp(ctx, "FindBlockedUserIDs")
+	defer end()
+
+	cursor, err := blocksCollection.Find(ctx, bson.M{"$or": []bson.M{{"blocker_id": userID}, {"blocked_id": userID}}})
+	if err != nil {
+		return nil, fmt.Errorf("error finding blocks: %v", err)
+	}
+	blocks := []*models.Block{}
+	if err := cursor.All(ctx, &blocks); err != nil {
+		return nil, fmt.Errorf("error decoding blocks: %v", err)
+	}
+	ids := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.BlockerID == userID {
+			ids = append(ids, block.BlockedID)
+		} else {
+			ids = append(ids, block.BlockerID)
+		}
+	}
+	return ids, nil
+}
+
+// FindBlocksAmong returns the blocks where both users are in userIDs
+func FindBlocksAmong(ctx context.Context, userIDs []string) ([]*models.Block, error) {
+	ctx, end := startOp(ctx, "FindBlocksAmong")
+	defer end()
+
+	blocks := []*models.Block{}
+	if len(userIDs) < 2 {
+		return blocks, nil
+	}
+	cursor, err := blocksCollection.Find(ctx, bson.M{"blocker_id": bson.M{"$in": userIDs}, "blocked_id": bson.M{"$in": userIDs}})
+	if err != nil {
+		return nil, fmt.Errorf("error finding blocks: %v", err)
+	}
+	if err := cursor.All(ctx, &blocks); err != nil {
+		return nil, fmt.Errorf("error decoding blocks: %v", err)
+	}
+	return blocks, nil
+}
+
+// SetUserPrivacy replaces the privacy settings of a user
+func SetUserPrivacy(ctx context.Context, userID string, settings models.PrivacySettings) error {
+	ctx, end := startOp(ctx, "SetUserPrivacy")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{"$set": bson.M{"privacy": settings}})
+}
+
+// GetUsersPrivacy returns the privacy settings of the given users, users without
+// settings are left out
+func GetUsersPrivacy(ctx context.Context, userIDs []string) (map[string]models.PrivacySettings, error) {
+	ctx, end := startOp(ctx, "GetUsersPrivacy")
+	defer end()
+
+	objectIDs, err := convertToObjectIDs(userIDs)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"_id": bson.M{"$in": objectIDs}, "privacy": bson.M{"$exists": true}}
+	cursor, err := usersCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"privacy": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding privacy settings: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	settings := make(map[string]models.PrivacySettings)
+	for cursor.Next(ctx) {
+		var user struct {
+			ID      primitive.ObjectID     `bson:"_id"`
+			Privacy models.PrivacySettings `bson:"privacy"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			return nil, fmt.Errorf("error decoding privacy settings: %v", err)
+		}
+		settings[user.ID.Hex()] = user.Privacy
+	}
+	return settings, cursor.Err()
+}
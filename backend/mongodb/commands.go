@@ -0,0 +1,123 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrCommandTaken is returned by InsertBotCommand when the bot already has a command with this name
+var ErrCommandTaken = errors.New("command name already registered")
+
+// SetChatTopic sets the topic of a chat, an empty topic clears it
+func SetChatTopic(ctx context.Context, chatID string, topic string) error {
+	ctx, end := startOp(ctx, "SetChatTopic")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID format: %v", err)
+	}
+	update := bson.M{"$set": bson.M{"topic": topic}}
+	if topic == "" {
+		update = bson.M{"$unset": bson.M{"topic": ""}}
+	}
+	if _, err := chatsCollection.UpdateOne(ctx, bson.M{"_id": chatObjectID}, update); err != nil {
+		return fmt.Errorf("error updating chat topic: %v", err)
+	}
+	return nil
+}
+
+// AddChatMember adds a user to a chat and records when they joined, it is a no-op
+// if the user is already a member
+func AddChatMember(ctx context.Context, chatID string, userID string, joinedAt time.Time) error {
+	ctx, end := startOp(ctx, "AddChatMember")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID format: %v", err)
+	}
+	_, err = chatsCollection.UpdateOne(ctx, bson.M{"_id": chatObjectID, "users": bson.M{"$ne": userID}}, bson.M{
+		"$push": bson.M{"users": userID},
+		"$set":  bson.M{"joined_at." + userID: joinedAt},
+	})
+	if err != nil {
+		return fmt.Errorf("error adding chat member: %v", err)
+	}
+	return nil
+}
+
+// InsertBotCommand registers a bot command and sets its ID
+func InsertBotCommand(ctx context.Context, command *models.BotCommand) error {
+	ctx, end := startOp(ctx, "InsertBotCommand")
+	defer end()
+
+	result, err := botCommandsCollection.InsertOne(ctx, command)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCommandTaken
+	}
+	if err != nil {
+		return fmt.Errorf("error inserting bot command: %v", err)
+	}
+	if objectID, ok := result.InsertedID.(primitive.ObjectID); ok {
+		command.ID = objectID.Hex()
+	}
+	return nil
+}
+
+// FindBotCommandByName returns the command with this name if one of botIDs owns it,
+// or nil if there is none. When several of the bots have it, the first registered wins.
+func FindBotCommandByName(ctx context.Context, name string, botIDs []string) (*models.BotCommand, error) {
+	ctx, end := startOp(ctx, "FindBotCommandByName")
+	defer end()
+
+	var command models.BotCommand
+	filter := bson.M{"name": name, "bot_id": bson.M{"$in": botIDs}}
+	err := botCommandsCollection.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})).Decode(&command)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding bot command: %v", err)
+	}
+	return &command, nil
+}
+
+// ListBotCommands returns the commands of the given bots sorted by name
+func ListBotCommands(ctx context.Context, botIDs []string) ([]*models.BotCommand, error) {
+	ctx, end := startOp(ctx, "ListBotCommands")
+	defer end()
+
+	filter := bson.M{"bot_id": bson.M{"$in": botIDs}}
+	cursor, err := botCommandsCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing bot commands: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	commands := []*models.BotCommand{}
+	if err := cursor.All(ctx, &commands); err != nil {
+		return nil, fmt.Errorf("error decoding bot commands: %v", err)
+	}
+	return commands, nil
+}
+
+// DeleteBotCommand removes a command of a bot and reports whether it existed
+func DeleteBotCommand(ctx context.Context, botID string, name string) (bool, error) {
+	ctx, end := startOp(ctx, "DeleteBotCommand")
+	defer end()
+
+	result, err := botCommandsCollection.DeleteOne(ctx, bson.M{"bot_id": botID, "name": name})
+	if err != nil {
+		return false, fmt.Errorf("error deleting bot command: %v", err)
+	}
+	return result.DeletedCount > 0, nil
+}
@@ -0,0 +1,167 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of a contact
+const (
+	ContactPending  = "pending"
+	ContactAccepted = "accepted"
+)
+
+// ErrContactExists is returned by InsertContactRequest when the two users already
+// have a request or a contact
+var ErrContactExists = errors.New("contact or request already exists")
+
+// ContactPair is the key shared by the two users of a contact, whoever asked first
+func ContactPair(userID string, otherID string) string {
+	if userID > otherID {
+		userID, otherID = otherID, userID
+	}
+	return userID + ":" + otherID
+}
+
+// InsertContactRequest stores a pending request and sets its ID
+func InsertContactRequest(ctx context.Context, contact *models.Contact) error {
+	ctx, end := startOp(ctx, "InsertContactRequest")
+	defer end()
+
+	contact.Pair = ContactPair(contact.RequesterID, contact.AddresseeID)
+	result, err := contactsCollection.InsertOne(ctx, contact)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrContactExists
+	}
+	if err != nil {
+		return fmt.Errorf("error inserting contact request: %v", err)
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		contact.ID = id.Hex()
+	}
+	return nil
+}
+
+// FindContactByPair returns the request or contact between two users, nil if there is none
+func FindContactByPair(ctx context.Context, userID string, otherID string) (*models.Contact, error) {
+	ctx, end := startOp(ctx, "FindContactByPair")
+	defer end()
+
+	var contact models.Contact
+	err := contactsCollection.FindOne(ctx, bson.M{"pair": ContactPair(userID, otherID)}).Decode(&contact)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding contact: %v", err)
+	}
+	return &contact, nil
+}
+
+// AcceptContactRequest accepts a pending request addressed to addresseeID, it
+// returns nil when there is no such request
+func AcceptContactRequest(ctx context.Context, requestID string, addresseeID string, now time.Time) (*models.Contact, error) {
+	ctx, end := startOp(ctx, "AcceptContactRequest")
+	defer end()
+
+	requestObjectID, err := primitive.ObjectIDFromHex(requestID)
+	if err != nil {
+		return nil, nil
+	}
+	filter := bson.M{"_id": requestObjectID, "addressee_id": addresseeID, "status": ContactPending}
+	update := bson.M{"$set": bson.M{"status": ContactAccepted, "accepted_at": now}}
+
+	var contact models.Contact
+	err = contactsCollection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&contact)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error accepting contact request: %v", err)
+	}
+	return &contact, nil
+}
+
+// DeleteContactRequest removes a pending request where userID is the requester
+// (asRequester) or the addressee, and returns it; nil when there is no such request
+func DeleteContactRequest(ctx context.Context, requestID string, userID string, asRequester bool) (*models.Contact, error) {
+	ctx, end := startOp(ctx, "DeleteContactRequest")
+	defer end()
+
+	requestObjectID, err := primitive.ObjectIDFromHex(requestID)
+	if err != nil {
+		return nil, nil
+	}
+	filter := bson.M{"_id": requestObjectID, "status": ContactPending, "addressee_id": userID}
+	if asRequester {
+		filter = bson.M{"_id": requestObjectID, "status": ContactPending, "requester_id": userID}
+	}
+
+	var contact models.Contact
+	err = contactsCollection.FindOneAndDelete(ctx, filter).Decode(&contact)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error deleting contact request: %v", err)
+	}
+	return &contact, nil
+}
+
+// DeleteContact removes the contact or pending request between two users and
+// reports whether there was one
+func DeleteContact(ctx context.Context, userID string, otherID string) (bool, error) {
+	ctx, end := startOp(ctx, "DeleteContact")
+	defer end()
+
+	result, err := contactsCollection.DeleteOne(ctx, bson.M{"pair": ContactPair(userID, otherID)})
+	if err != nil {
+		return false, fmt.Errorf("error deleting contact: %v", err)
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// ListContacts returns the requests and contacts of a user with the given status, newest first
+func ListContacts(ctx context.Context, userID string, status string) ([]*models.Contact, error) {
+	ctx, end := startOp(ctx, "ListContacts")
+	defer end()
+
+	filter := bson.M{"status": status, "$or": []bson.M{{"requester_id": userID}, {"addressee_id": userID}}}
+	cursor, err := contactsCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding contacts: %v", err)
+	}
+	contacts := []*models.Contact{}
+	if err := cursor.All(ctx, &contacts); err != nil {
+		return nil, fmt.Errorf("error decoding contacts: %v", err)
+	}
+	return contacts, nil
+}
+
+// FindContactsAmong returns the accepted contacts where both users are in userIDs
+func FindContactsAmong(ctx context.Context, userIDs []string) ([]*models.Contact, error) {
+	ctx, end := startOp(ctx, "FindContactsAmong")
+	defer end()
+
+	contacts := []*models.Contact{}
+	if len(userIDs) < 2 {
+		return contacts, nil
+	}
+	filter := bson.M{"status": ContactAccepted, "requester_id": bson.M{"$in": userIDs}, "addressee_id": bson.M{"$in": userIDs}}
+	cursor, err := contactsCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error finding contacts: %v", err)
+	}
+	if err := cursor.All(ctx, &contacts); err != nil {
+		return nil, fmt.Errorf("error decoding contacts: %v", err)
+	}
+	return contacts, nil
+}
@@ -0,0 +1,12 @@
+package mongodb
+
+import "testing"
+
+func TestContactPair(t *testing.T) {
+	if ContactPair("alice", "bob") != ContactPair("bob", "alice") {
+		t.Error("the pair depends on who asked first")
+	}
+	if ContactPair("alice", "bob") == ContactPair("alice", "carol") {
+		t.Error("different users share a pair")
+	}
+}
@@ -0,0 +1,145 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SearchNames returns the lowercased names a user is found by in the directory:
+// the username, the display name and each word of it
+func SearchNames(username string, displayName string) []string {
+	names := []string{strings.ToLower(username)}
+	seen := map[string]bool{names[0]: true}
+	if displayName != "" {
+		for _, name := range append([]string{strings.ToLower(displayName)}, strings.Fields(strings.ToLower(displayName))...) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// SetDisplayName changes the display name of a user, an empty name removes it
+func SetDisplayName(ctx context.Context, user *models.User, displayName string) error {
+	ctx, end := startOp(ctx, "SetDisplayName")
+	defer end()
+
+	update := bson.M{"$set": bson.M{"search_names": SearchNames(user.Username, displayName)}}
+	if displayName == "" {
+		update["$unset"] = bson.M{"display_name": ""}
+	} else {
+		update["$set"].(bson.M)["display_name"] = displayName
+	}
+	return updateUser(ctx, user.ID, update)
+}
+
+// directoryFilter selects the users listed in the directory, leaving out disabled
+// users, bots and the users in excludeIDs, whose search names match names
+func directoryFilter(names interface{}, excludeIDs []string) (bson.M, error) {
+	excluded, err := convertToObjectIDs(excludeIDs)
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{
+		"search_names": names,
+		"disabled":     bson.M{"$ne": true},
+		"bot":          bson.M{"$ne": true},
+		"_id":          bson.M{"$nin": excluded},
+	}, nil
+}
+
+// directoryNames matches the users with a search name equal to query, or when
+// exact is false the others with a search name starting with it
+func directoryNames(query string, exact bool) interface{} {
+	if exact {
+		return query
+	}
+	return bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query)}, "$ne": query}
+}
+
+// CountDirectoryMatches returns how many users listed in the directory have a
+// search name equal to query, and how many others have one starting with it
+func CountDirectoryMatches(ctx context.Context, query string, excludeIDs []string) (int64, int64, error) {
+	ctx, end := startOp(ctx, "CountDirectoryMatches")
+	defer end()
+
+	counts := [2]int64{}
+	for i, exact := range []bool{true, false} {
+		filter, err := directoryFilter(directoryNames(query, exact), excludeIDs)
+		if err != nil {
+			return 0, 0, err
+		}
+		counts[i], err = usersCollection.CountDocuments(ctx, filter)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error counting directory matches: %v", err)
+		}
+	}
+	return counts[0], counts[1], nil
+}
+
+// FindDirectoryMatches returns a page of the users counted by CountDirectoryMatches,
+// the exact or the prefix matches, sorted by username
+func FindDirectoryMatches(ctx context.Context, query string, exact bool, excludeIDs []string, skip int64, limit int64) ([]*models.User, error) {
+	ctx, end := startOp(ctx, "FindDirectoryMatches")
+	defer end()
+
+	filter, err := directoryFilter(directoryNames(query, exact), excludeIDs)
+	if err != nil {
+		return nil, err
+	}
+	return findDirectoryUsers(ctx, filter, options.Find().SetSort(bson.M{"username": 1}).SetSkip(skip).SetLimit(limit))
+}
+
+// FindDirectoryCandidates returns up to limit users listed in the directory with a
+// search name starting with prefix but none starting with query, sorted by username.
+// They are the candidates for near matches of query.
+func FindDirectoryCandidates(ctx context.Context, prefix string, query string, excludeIDs []string, limit int) ([]*models.User, error) {
+	ctx, end := startOp(ctx, "FindDirectoryCandidates")
+	defer end()
+
+	filter, err := directoryFilter(bson.M{
+		"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)},
+		"$not":   primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query)},
+	}, excludeIDs)
+	if err != nil {
+		return nil, err
+	}
+	return findDirectoryUsers(ctx, filter, options.Find().SetSort(bson.M{"username": 1}).SetLimit(int64(limit)))
+}
+
+func findDirectoryUsers(ctx context.Context, filter bson.M, findOptions *options.FindOptions) ([]*models.User, error) {
+	findOptions.SetProjection(bson.M{"username": 1, "display_name": 1, "search_names": 1})
+	cursor, err := usersCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error searching the directory: %v", err)
+	}
+	users := []*models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("error decoding users: %v", err)
+	}
+	return users, nil
+}
+
+// backfillSearchNames lists the accounts created before the directory existed
+func backfillSearchNames(ctx context.Context) error {
+	filter := bson.M{
+		"search_names": bson.M{"$exists": false},
+		"bot":          bson.M{"$ne": true},
+		"placeholder":  bson.M{"$ne": true},
+		"deleted_at":   bson.M{"$exists": false},
+	}
+	update := bson.A{bson.M{"$set": bson.M{"search_names": bson.A{bson.M{"$toLower": "$username"}}}}}
+	if _, err := usersCollection.UpdateMany(ctx, filter, update); err != nil {
+		return fmt.Errorf("error backfilling search names: %v", err)
+	}
+	return nil
+}
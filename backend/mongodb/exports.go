@@ -0,0 +1,270 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of an export job
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// StreamChatMessages calls fn for every message of a chat, oldest first, without
+// loading the history in memory. With attachmentsOnly, only messages that have
+// attachments are visited.
+func StreamChatMessages(ctx context.Context, chatID string, since time.Time, attachmentsOnly bool, fn func(message *models.Message) error) error {
+	ctx, end := startOp(ctx, "StreamChatMessages")
+	defer end()
+
+	filter := bson.M{"chat_id": chatID}
+	if !since.IsZero() {
+		filter["sent_at"] = bson.M{"$gte": since}
+	}
+	if attachmentsOnly {
+		filter["attachments.0"] = bson.M{"$exists": true}
+	}
+	cursor, err := messagesCollection.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "sent_at", Value: 1}, {Key: "_id", Value: 1}}).SetBatchSize(500))
+	if err != nil {
+		return fmt.Errorf("failed to retrieve messages: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var message models.Message
+		if err := cursor.Decode(&message); err != nil {
+			return fmt.Errorf("error decoding message: %v", err)
+		}
+		if err := fn(&message); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// CountChatMessages counts the messages stored for a chat
+func CountChatMessages(ctx context.Context, chatID string) (int64, error) {
+	ctx, end := startOp(ctx, "CountChatMessages")
+	defer end()
+
+	count, err := messagesCollection.CountDocuments(ctx, bson.M{"chat_id": chatID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count messages: %v", err)
+	}
+	return count, nil
+}
+
+// InsertExportJob stores a new export job and sets its ID
+func InsertExportJob(ctx context.Context, job *models.ExportJob) error {
+	ctx, end := startOp(ctx, "InsertExportJob")
+	defer end()
+
+	result, err := exportJobsCollection.InsertOne(ctx, job)
+	if err != nil {
+		return fmt.Errorf("error inserting export job: %v", err)
+	}
+	if objectID, ok := result.InsertedID.(primitive.ObjectID); ok {
+		job.ID = objectID.Hex()
+	}
+	return nil
+}
+
+// FindExportJobById returns an export job, or nil if there is none
+func FindExportJobById(ctx context.Context, jobID string) (*models.ExportJob, error) {
+	ctx, end := startOp(ctx, "FindExportJobById")
+	defer end()
+
+	jobObjectID, err := primitive.ObjectIDFromHex(jobID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export ID format: %v", err)
+	}
+	var job models.ExportJob
+	err = exportJobsCollection.FindOne(ctx, bson.M{"_id": jobObjectID}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding export job: %v", err)
+	}
+	return &job, nil
+}
+
+// ListExportJobs returns the export jobs of a user, newest first
+func ListExportJobs(ctx context.Context, userID string) ([]*models.ExportJob, error) {
+	ctx, end := startOp(ctx, "ListExportJobs")
+	defer end()
+
+	cursor, err := exportJobsCollection.Find(ctx, bson.M{"user_id": userID}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing export jobs: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	jobs := []*models.ExportJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("error decoding export jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+// CountActiveExportJobs counts the jobs of a user that are pending or running
+func CountActiveExportJobs(ctx context.Context, userID string) (int64, error) {
+	ctx, end := startOp(ctx, "CountActiveExportJobs")
+	defer end()
+
+	count, err := exportJobsCollection.CountDocuments(ctx, bson.M{"user_id": userID, "status": bson.M{"$in": []string{ExportPending, ExportRunning}}})
+	if err != nil {
+		return 0, fmt.Errorf("error counting export jobs: %v", err)
+	}
+	return count, nil
+}
+
+// ClaimExportJob atomically moves the oldest pending job to "running", so only one
+// instance builds it. It returns nil when there is no pending job.
+func ClaimExportJob(ctx context.Context, now time.Time) (*models.ExportJob, error) {
+	ctx, end := startOp(ctx, "ClaimExportJob")
+	defer end()
+
+	var job models.ExportJob
+	err := exportJobsCollection.FindOneAndUpdate(ctx,
+		bson.M{"status": ExportPending},
+		bson.M{"$set": bson.M{"status": ExportRunning, "claimed_at": now}},
+		options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}).SetReturnDocument(options.After)).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error claiming export job: %v", err)
+	}
+	return &job, nil
+}
+
+// CompleteExportJob records the archive of a finished job, or the error of a failed one
+func CompleteExportJob(ctx context.Context, job *models.ExportJob, now time.Time) error {
+	ctx, end := startOp(ctx, "CompleteExportJob")
+	defer end()
+
+	jobObjectID, err := primitive.ObjectIDFromHex(job.ID)
+	if err != nil {
+		return fmt.Errorf("invalid export ID format: %v", err)
+	}
+	set := bson.M{
+		"status":       job.Status,
+		"file_id":      job.FileID,
+		"file_name":    job.FileName,
+		"size":         job.Size,
+		"error":        job.Error,
+		"completed_at": now,
+		"expires_at":   job.ExpiresAt,
+	}
+	_, err = exportJobsCollection.UpdateOne(ctx, bson.M{"_id": jobObjectID}, bson.M{"$set": set, "$unset": bson.M{"claimed_at": ""}})
+	if err != nil {
+		return fmt.Errorf("error updating export job: %v", err)
+	}
+	return nil
+}
+
+// RequeueStaleExportJobs puts back the jobs claimed before claimedBefore by an
+// instance that stopped, building an export twice is harmless
+func RequeueStaleExportJobs(ctx context.Context, claimedBefore time.Time) (int64, error) {
+	ctx, end := startOp(ctx, "RequeueStaleExportJobs")
+	defer end()
+
+	result, err := exportJobsCollection.UpdateMany(ctx,
+		bson.M{"status": ExportRunning, "claimed_at": bson.M{"$lt": claimedBefore}},
+		bson.M{"$set": bson.M{"status": ExportPending}, "$unset": bson.M{"claimed_at": ""}})
+	if err != nil {
+		return 0, fmt.Errorf("error requeuing export jobs: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeleteExpiredExportJobs removes the jobs past their expiry along with their files
+// and returns how many were removed
+func DeleteExpiredExportJobs(ctx context.Context, now time.Time) (int, error) {
+	ctx, end := startOp(ctx, "DeleteExpiredExportJobs")
+	defer end()
+
+	cursor, err := exportJobsCollection.Find(ctx, bson.M{"expires_at": bson.M{"$lt": now}})
+	if err != nil {
+		return 0, fmt.Errorf("error finding expired export jobs: %v", err)
+	}
+	jobs := []*models.ExportJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return 0, fmt.Errorf("error decoding export jobs: %v", err)
+	}
+
+	for _, job := range jobs {
+		if job.FileID != "" {
+			if err := DeleteExportFile(ctx, job.FileID); err != nil {
+				return 0, err
+			}
+		}
+		jobObjectID, err := primitive.ObjectIDFromHex(job.ID)
+		if err != nil {
+			continue
+		}
+		if _, err := exportJobsCollection.DeleteOne(ctx, bson.M{"_id": jobObjectID}); err != nil {
+			return 0, fmt.Errorf("error deleting export job: %v", err)
+		}
+	}
+	return len(jobs), nil
+}
+
+// CreateExportFile opens a new file in the exports bucket, the caller writes the
+// archive and closes it, or aborts it on error
+func CreateExportFile(ctx context.Context, fileName string) (*gridfs.UploadStream, string, error) {
+	_, end := startOp(ctx, "CreateExportFile")
+	defer end()
+
+	upload, err := exportFiles.OpenUploadStream(fileName)
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating export file: %v", err)
+	}
+	fileID, _ := upload.FileID.(primitive.ObjectID)
+	return upload, fileID.Hex(), nil
+}
+
+// OpenExportFile opens a stored export for reading and returns its size
+func OpenExportFile(ctx context.Context, fileID string) (io.ReadCloser, int64, error) {
+	_, end := startOp(ctx, "OpenExportFile")
+	defer end()
+
+	fileObjectID, err := primitive.ObjectIDFromHex(fileID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid file ID format: %v", err)
+	}
+	download, err := exportFiles.OpenDownloadStream(fileObjectID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening export file: %v", err)
+	}
+	return download, download.GetFile().Length, nil
+}
+
+// DeleteExportFile removes a stored export, a file that is already gone is not an error
+func DeleteExportFile(ctx context.Context, fileID string) error {
+	_, end := startOp(ctx, "DeleteExportFile")
+	defer end()
+
+	fileObjectID, err := primitive.ObjectIDFromHex(fileID)
+	if err != nil {
+		return fmt.Errorf("invalid file ID format: %v", err)
+	}
+	if err := exportFiles.Delete(fileObjectID); err != nil && err != gridfs.ErrFileNotFound {
+		return fmt.Errorf("error deleting export file: %v", err)
+	}
+	return nil
+}
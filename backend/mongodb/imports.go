@@ -0,0 +1,128 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FindUserByImportKey returns the user created for an imported participant, nil if there is none
+func FindUserByImportKey(ctx context.Context, importKey string) (*models.User, error) {
+	ctx, end := startOp(ctx, "FindUserByImportKey")
+	defer end()
+
+	var user models.User
+	err := usersCollection.FindOne(ctx, bson.M{"import_key": importKey}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding user: %v", err)
+	}
+	return &user, nil
+}
+
+// UpsertPlaceholderUser returns the placeholder of an imported participant,
+// creating it with username if it doesn't exist yet
+func UpsertPlaceholderUser(ctx context.Context, importKey string, username string, now time.Time) (*models.User, error) {
+	ctx, end := startOp(ctx, "UpsertPlaceholderUser")
+	defer end()
+
+	update := bson.M{"$setOnInsert": bson.M{
+		"username":    username,
+		"password":    "",
+		"email":       "",
+		"mfa_enabled": false,
+		"disabled":    true,
+		"disabled_at": now,
+		"placeholder": true,
+	}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var user models.User
+	if err := usersCollection.FindOneAndUpdate(ctx, bson.M{"import_key": importKey}, update, opts).Decode(&user); err != nil {
+		return nil, fmt.Errorf("error creating placeholder user: %v", err)
+	}
+	return &user, nil
+}
+
+// UpsertImportedChat returns the chat imported from sourceID, creating it if needed,
+// and adds members to it
+func UpsertImportedChat(ctx context.Context, chat *models.Chat) (*models.Chat, error) {
+	ctx, end := startOp(ctx, "UpsertImportedChat")
+	defer end()
+
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"count_messages": 0,
+			"created_by":     chat.CreatedBy,
+			"created_at":     chat.CreatedAt,
+			"topic":          chat.Topic,
+		},
+		"$addToSet": bson.M{"users": bson.M{"$each": chat.Users}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var imported models.Chat
+	if err := chatsCollection.FindOneAndUpdate(ctx, bson.M{"source_id": chat.SourceID}, update, opts).Decode(&imported); err != nil {
+		return nil, fmt.Errorf("error importing chat: %v", err)
+	}
+	return &imported, nil
+}
+
+// InsertImportedMessages stores the messages whose SourceID isn't stored yet and
+// returns how many were new
+func InsertImportedMessages(ctx context.Context, messages []models.Message) (int, error) {
+	ctx, end := startOp(ctx, "InsertImportedMessages")
+	defer end()
+
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	writes := make([]mongo.WriteModel, 0, len(messages))
+	for _, message := range messages {
+		raw, err := bson.Marshal(message)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding message: %v", err)
+		}
+		var document bson.M
+		if err := bson.Unmarshal(raw, &document); err != nil {
+			return 0, fmt.Errorf("error encoding message: %v", err)
+		}
+		// The upsert takes the source_id from the filter and gets a fresh _id
+		delete(document, "_id")
+		delete(document, "source_id")
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"source_id": message.SourceID}).
+			SetUpdate(bson.M{"$setOnInsert": document}).
+			SetUpsert(true))
+	}
+
+	result, err := messagesCollection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, fmt.Errorf("error importing messages: %v", err)
+	}
+	return int(result.UpsertedCount), nil
+}
+
+// SetChatCreatedAt moves the creation date of a chat back to at, it is never moved forward
+func SetChatCreatedAt(ctx context.Context, chatID string, at time.Time) error {
+	ctx, end := startOp(ctx, "SetChatCreatedAt")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID format: %v", err)
+	}
+	if _, err := chatsCollection.UpdateOne(ctx, bson.M{"_id": chatObjectID}, bson.M{"$min": bson.M{"created_at": at}}); err != nil {
+		return fmt.Errorf("error updating chat: %v", err)
+	}
+	return nil
+}
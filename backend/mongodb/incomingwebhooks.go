@@ -0,0 +1,130 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InsertIncomingWebhook stores a new incoming webhook and sets its ID
+func InsertIncomingWebhook(ctx context.Context, hook *models.IncomingWebhook) error {
+	ctx, end := startOp(ctx, "InsertIncomingWebhook")
+	defer end()
+
+	result, err := incomingWebhooksCollection.InsertOne(ctx, hook)
+	if err != nil {
+		return fmt.Errorf("error inserting incoming webhook: %v", err)
+	}
+	if objectID, ok := result.InsertedID.(primitive.ObjectID); ok {
+		hook.ID = objectID.Hex()
+	}
+	return nil
+}
+
+// FindIncomingWebhookByHash returns the incoming webhook with this token hash, or nil if there is none
+func FindIncomingWebhookByHash(ctx context.Context, tokenHash string) (*models.IncomingWebhook, error) {
+	ctx, end := startOp(ctx, "FindIncomingWebhookByHash")
+	defer end()
+
+	var hook models.IncomingWebhook
+	err := incomingWebhooksCollection.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&hook)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding incoming webhook: %v", err)
+	}
+	return &hook, nil
+}
+
+// FindIncomingWebhookById returns an incoming webhook, or nil if there is none
+func FindIncomingWebhookById(ctx context.Context, hookID string) (*models.IncomingWebhook, error) {
+	ctx, end := startOp(ctx, "FindIncomingWebhookById")
+	defer end()
+
+	hookObjectID, err := primitive.ObjectIDFromHex(hookID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook ID format: %v", err)
+	}
+	var hook models.IncomingWebhook
+	err = incomingWebhooksCollection.FindOne(ctx, bson.M{"_id": hookObjectID}).Decode(&hook)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding incoming webhook: %v", err)
+	}
+	return &hook, nil
+}
+
+// ListIncomingWebhooks returns the incoming webhooks of a chat, newest first
+func ListIncomingWebhooks(ctx context.Context, chatID string) ([]*models.IncomingWebhook, error) {
+	ctx, end := startOp(ctx, "ListIncomingWebhooks")
+	defer end()
+
+	cursor, err := incomingWebhooksCollection.Find(ctx, bson.M{"chat_id": chatID}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing incoming webhooks: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	hooks := []*models.IncomingWebhook{}
+	if err := cursor.All(ctx, &hooks); err != nil {
+		return nil, fmt.Errorf("error decoding incoming webhooks: %v", err)
+	}
+	return hooks, nil
+}
+
+// DeleteIncomingWebhook removes an incoming webhook, its URL stops working immediately
+func DeleteIncomingWebhook(ctx context.Context, hookID string) error {
+	ctx, end := startOp(ctx, "DeleteIncomingWebhook")
+	defer end()
+
+	hookObjectID, err := primitive.ObjectIDFromHex(hookID)
+	if err != nil {
+		return fmt.Errorf("invalid webhook ID format: %v", err)
+	}
+	if _, err := incomingWebhooksCollection.DeleteOne(ctx, bson.M{"_id": hookObjectID}); err != nil {
+		return fmt.Errorf("error deleting incoming webhook: %v", err)
+	}
+	return nil
+}
+
+// TouchIncomingWebhook records the last post through the webhook
+func TouchIncomingWebhook(ctx context.Context, hookID string, now time.Time) error {
+	ctx, end := startOp(ctx, "TouchIncomingWebhook")
+	defer end()
+
+	hookObjectID, err := primitive.ObjectIDFromHex(hookID)
+	if err != nil {
+		return fmt.Errorf("invalid webhook ID format: %v", err)
+	}
+	if _, err := incomingWebhooksCollection.UpdateOne(ctx, bson.M{"_id": hookObjectID}, bson.M{"$set": bson.M{"last_used_at": now}}); err != nil {
+		return fmt.Errorf("error updating incoming webhook: %v", err)
+	}
+	return nil
+}
+
+// ListIncomingWebhooksCreatedBy returns the incoming webhooks a user created, newest first
+func ListIncomingWebhooksCreatedBy(ctx context.Context, userID string) ([]*models.IncomingWebhook, error) {
+	ctx, end := startOp(ctx, "ListIncomingWebhooksCreatedBy")
+	defer end()
+
+	cursor, err := incomingWebhooksCollection.Find(ctx, bson.M{"created_by": userID}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing incoming webhooks: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	hooks := []*models.IncomingWebhook{}
+	if err := cursor.All(ctx, &hooks); err != nil {
+		return nil, fmt.Errorf("error decoding incoming webhooks: %v", err)
+	}
+	return hooks, nil
+}
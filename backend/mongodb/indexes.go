@@ -0,0 +1,145 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureIndexes creates the indexes the repository functions rely on.
+// CreateMany is a no-op for indexes that already exist with the same definition.
+func ensureIndexes(ctx context.Context) error {
+	indexes := map[*mongo.Collection][]mongo.IndexModel{
+		// Expired buckets are full again, MongoDB removes them on its own
+		rateLimitsCollection: {
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Failure counters are forgotten once their window (or lock) has passed
+		loginAttemptsCollection: {
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Abandoned authorization requests
+		oidcFlowsCollection: {
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Keys are dropped once no token signed with them can still be valid
+		signingKeysCollection: {
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Tokens are looked up by hash on every request; expired ones are removed
+		apiTokensCollection: {
+			{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		webhooksCollection: {
+			{Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "active", Value: 1}}},
+		},
+		// The worker polls due deliveries; the log is kept until expires_at
+		webhookDeliveriesCollection: {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+			{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		incomingWebhooksCollection: {
+			{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "chat_id", Value: 1}}},
+		},
+		// A bot registers a name once, other bots may reuse it: commands are
+		// resolved among the bots that are members of the chat
+		botCommandsCollection: {
+			{Keys: bson.D{{Key: "bot_id", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		// The scheduler polls due messages; finished ones are kept until expires_at
+		scheduledMessagesCollection: {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+			{Keys: bson.D{{Key: "sender", Value: 1}, {Key: "send_at", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// History is read per chat in time order; the retention purger deletes by age.
+		// Imported messages and chats are unique per source so an import can be re-run.
+		messagesCollection: {
+			{Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "sent_at", Value: -1}}},
+			{Keys: bson.D{{Key: "sent_at", Value: 1}}},
+			{Keys: bson.D{{Key: "source_id", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		},
+		chatsCollection: {
+			{Keys: bson.D{{Key: "message_ttl", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "purged_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "source_id", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		},
+		// Jobs are claimed by status; expired ones are removed with their file by the export worker
+		exportJobsCollection: {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}},
+		},
+		// A user blocks another at most once; blocks are looked up from both sides
+		blocksCollection: {
+			{Keys: bson.D{{Key: "blocker_id", Value: 1}, {Key: "blocked_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "blocked_id", Value: 1}}},
+		},
+		// One request or contact per pair of users, listed from either side
+		contactsCollection: {
+			{Keys: bson.D{{Key: "pair", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "requester_id", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "addressee_id", Value: 1}, {Key: "status", Value: 1}}},
+		},
+		// The queue is read by status in arrival order; a user reports the same
+		// message or user at most once while the report is open
+		reportsCollection: {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+			{Keys: bson.D{{Key: "reported_user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "reporter_id", Value: 1}, {Key: "reported_user_id", Value: 1}, {Key: "message_id", Value: 1}},
+				Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"status": "open"})},
+		},
+		moderationActionsCollection: {
+			{Keys: bson.D{{Key: "target_user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "moderator_id", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		},
+		// Every instance polls the recent frames; they are only kept a little longer
+		relayedFramesCollection: {
+			{Keys: bson.D{{Key: "created_at", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		usersCollection: {
+			{Keys: bson.D{{Key: "oidc_identities.issuer", Value: 1}, {Key: "oidc_identities.subject", Value: 1}}},
+			{Keys: bson.D{{Key: "bot_owner", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "import_key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+			// Directory searches match a prefix of the lowercased names
+			{Keys: bson.D{{Key: "search_names", Value: 1}}},
+		},
+	}
+
+	// Command names used to be unique across every bot
+	if err := dropIndex(ctx, botCommandsCollection, "name_1"); err != nil {
+		return err
+	}
+
+	for collection, models := range indexes {
+		if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("failed to create indexes on %s: %v", collection.Name(), err)
+		}
+	}
+	return nil
+}
+
+// dropIndex removes an index that is no longer wanted, it is a no-op if the index
+// or the collection doesn't exist
+func dropIndex(ctx context.Context, collection *mongo.Collection, name string) error {
+	_, err := collection.Indexes().DropOne(ctx, name)
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && (commandErr.Code == 26 || commandErr.Code == 27) {
+		// NamespaceNotFound, IndexNotFound
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to drop index %s on %s: %v", name, collection.Name(), err)
+	}
+	return nil
+}
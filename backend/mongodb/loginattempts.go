@@ -0,0 +1,105 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReserveLoginAttempt counts an attempt on key as a failure before it is checked,
+// unless key is locked or the progressive delay since its last attempt hasn't
+// passed. The delay after n failures is baseDelay doubled n-1 times, up to maxDelay.
+// Checking and counting in a single update keeps parallel attempts from slipping
+// through the delay. It returns the record and whether the attempt was reserved.
+func ReserveLoginAttempt(ctx context.Context, key string, now time.Time, window time.Duration, baseDelay time.Duration, maxDelay time.Duration) (*models.LoginAttempts, bool, error) {
+	ctx, end := startOp(ctx, "ReserveLoginAttempt")
+	defer end()
+
+	allowed := bson.M{"$and": bson.A{
+		bson.M{"$lte": bson.A{bson.M{"$ifNull": bson.A{"$next_attempt_at", now}}, now}},
+		bson.M{"$lte": bson.A{bson.M{"$ifNull": bson.A{"$locked_until", now}}, now}},
+	}}
+	failures := bson.M{"$ifNull": bson.A{"$failures", 0}}
+	delay := bson.M{"$min": bson.A{maxDelay.Milliseconds(),
+		bson.M{"$multiply": bson.A{baseDelay.Milliseconds(), bson.M{"$pow": bson.A{2, failures}}}}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"reserved": allowed}}},
+		{{Key: "$set", Value: bson.M{
+			"failures":        bson.M{"$cond": bson.A{"$reserved", bson.M{"$add": bson.A{failures, 1}}, failures}},
+			"last_failure_at": bson.M{"$cond": bson.A{"$reserved", now, "$last_failure_at"}},
+			"next_attempt_at": bson.M{"$cond": bson.A{"$reserved", bson.M{"$add": bson.A{now, delay}}, "$next_attempt_at"}},
+			"expires_at":      bson.M{"$max": bson.A{now.Add(window), "$expires_at"}},
+		}}},
+	}
+	findOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var attempts struct {
+		models.LoginAttempts `bson:",inline"`
+		Reserved             bool `bson:"reserved"`
+	}
+	err := loginAttemptsCollection.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline, findOptions).Decode(&attempts)
+	if mongo.IsDuplicateKeyError(err) {
+		// A parallel attempt created the record first, it exists now
+		err = loginAttemptsCollection.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline, findOptions).Decode(&attempts)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error reserving login attempt: %v", err)
+	}
+	return &attempts.LoginAttempts, attempts.Reserved, nil
+}
+
+// ReleaseLoginAttempt takes back a reserved attempt that turned out to be valid,
+// the next attempt is allowed from nextAttemptAt at the latest
+func ReleaseLoginAttempt(ctx context.Context, key string, nextAttemptAt time.Time) error {
+	ctx, end := startOp(ctx, "ReleaseLoginAttempt")
+	defer end()
+
+	_, err := loginAttemptsCollection.UpdateOne(ctx,
+		bson.M{"_id": key, "failures": bson.M{"$gt": 0}},
+		bson.M{
+			"$inc": bson.M{"failures": -1},
+			"$min": bson.M{"next_attempt_at": nextAttemptAt},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error releasing login attempt: %v", err)
+	}
+	return nil
+}
+
+// LockLogin locks key until the given time, keeping the record at least that long
+func LockLogin(ctx context.Context, key string, until time.Time) error {
+	ctx, end := startOp(ctx, "LockLogin")
+	defer end()
+
+	_, err := loginAttemptsCollection.UpdateOne(ctx,
+		bson.M{"_id": key},
+		bson.M{
+			"$set": bson.M{"locked_until": until},
+			"$max": bson.M{"expires_at": until},
+			"$inc": bson.M{"lockouts": 1},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("error locking login: %v", err)
+	}
+	return nil
+}
+
+// ResetLoginAttempts clears failures and any lock on key
+func ResetLoginAttempts(ctx context.Context, key string) error {
+	ctx, end := startOp(ctx, "ResetLoginAttempts")
+	defer end()
+
+	_, err := loginAttemptsCollection.DeleteOne(ctx, bson.M{"_id": key})
+	if err != nil {
+		return fmt.Errorf("error resetting login attempts: %v", err)
+	}
+	return nil
+}
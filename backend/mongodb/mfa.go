@@ -0,0 +1,109 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SetUserMFAPendingSecret stores a TOTP secret awaiting confirmation
+func SetUserMFAPendingSecret(ctx context.Context, userID string, secret string) error {
+	ctx, end := startOp(ctx, "SetUserMFAPendingSecret")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{"$set": bson.M{"mfa_pending_secret": secret}})
+}
+
+// EnableUserMFA promotes the confirmed secret and stores the hashed recovery codes
+func EnableUserMFA(ctx context.Context, userID string, secret string, recoveryCodeHashes []string, step int64) error {
+	ctx, end := startOp(ctx, "EnableUserMFA")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{
+		"$set": bson.M{
+			"mfa_enabled":        true,
+			"mfa_secret":         secret,
+			"mfa_recovery_codes": recoveryCodeHashes,
+			"mfa_last_step":      step,
+		},
+		"$unset": bson.M{"mfa_pending_secret": ""},
+	})
+}
+
+// DisableUserMFA removes the secret and every recovery code
+func DisableUserMFA(ctx context.Context, userID string) error {
+	ctx, end := startOp(ctx, "DisableUserMFA")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{
+		"$set":   bson.M{"mfa_enabled": false},
+		"$unset": bson.M{"mfa_secret": "", "mfa_pending_secret": "", "mfa_recovery_codes": "", "mfa_last_step": ""},
+	})
+}
+
+// ReplaceUserRecoveryCodes replaces the hashed recovery codes
+func ReplaceUserRecoveryCodes(ctx context.Context, userID string, recoveryCodeHashes []string) error {
+	ctx, end := startOp(ctx, "ReplaceUserRecoveryCodes")
+	defer end()
+
+	return updateUser(ctx, userID, bson.M{"$set": bson.M{"mfa_recovery_codes": recoveryCodeHashes}})
+}
+
+// ConsumeUserRecoveryCode removes a recovery code hash, reporting false if it
+// wasn't there: concurrent logins can't both use the same code
+func ConsumeUserRecoveryCode(ctx context.Context, userID string, codeHash string) (bool, error) {
+	ctx, end := startOp(ctx, "ConsumeUserRecoveryCode")
+	defer end()
+	defer InvalidateUser(userID)
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return false, fmt.Errorf("invalid user ID format: %v", err)
+	}
+	result, err := usersCollection.UpdateOne(ctx,
+		bson.M{"_id": userObjectID, "mfa_recovery_codes": codeHash},
+		bson.M{"$pull": bson.M{"mfa_recovery_codes": codeHash}})
+	if err != nil {
+		return false, fmt.Errorf("error consuming recovery code: %v", err)
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// AdvanceUserMFAStep records the TOTP time step just used, reporting false if that
+// step (or a later one) was already used: a code can only log in once
+func AdvanceUserMFAStep(ctx context.Context, userID string, step int64) (bool, error) {
+	ctx, end := startOp(ctx, "AdvanceUserMFAStep")
+	defer end()
+	defer InvalidateUser(userID)
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return false, fmt.Errorf("invalid user ID format: %v", err)
+	}
+	result, err := usersCollection.UpdateOne(ctx,
+		bson.M{"_id": userObjectID, "mfa_last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"mfa_last_step": step}})
+	if err != nil {
+		return false, fmt.Errorf("error updating mfa step: %v", err)
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func updateUser(ctx context.Context, userID string, update bson.M) error {
+	defer InvalidateUser(userID)
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user ID format: %v", err)
+	}
+	result, err := usersCollection.UpdateOne(ctx, bson.M{"_id": userObjectID}, update)
+	if err != nil {
+		return fmt.Errorf("error updating user: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
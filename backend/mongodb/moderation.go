@@ -0,0 +1,300 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of a report
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// ErrReportExists is returned by InsertReport when the reporter already has an
+// open report on the same message or user
+var ErrReportExists = errors.New("report already open")
+
+// InsertReport stores an open report and sets its ID
+func InsertReport(ctx context.Context, report *models.Report) error {
+	ctx, end := startOp(ctx, "InsertReport")
+	defer end()
+
+	report.Status = ReportOpen
+	result, err := reportsCollection.InsertOne(ctx, report)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrReportExists
+	}
+	if err != nil {
+		return fmt.Errorf("error inserting report: %v", err)
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		report.ID = id.Hex()
+	}
+	return nil
+}
+
+// ListReports pages through the reports with the given status, oldest first
+func ListReports(ctx context.Context, status string, limit int, page int) ([]*models.Report, int64, error) {
+	ctx, end := startOp(ctx, "ListReports")
+	defer end()
+
+	filter := bson.M{"status": status}
+	total, err := reportsCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting reports: %v", err)
+	}
+	findOptions := options.Find().
+		SetSort(bson.M{"created_at": 1}).
+		SetSkip(int64((page - 1) * limit)).
+		SetLimit(int64(limit))
+	cursor, err := reportsCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error finding reports: %v", err)
+	}
+	reports := []*models.Report{}
+	if err := cursor.All(ctx, &reports); err != nil {
+		return nil, 0, fmt.Errorf("error decoding reports: %v", err)
+	}
+	return reports, total, nil
+}
+
+// ListReportsByReporter returns the reports filed by a user, newest first
+func ListReportsByReporter(ctx context.Context, reporterID string) ([]*models.Report, error) {
+	ctx, end := startOp(ctx, "ListReportsByReporter")
+	defer end()
+
+	cursor, err := reportsCollection.Find(ctx, bson.M{"reporter_id": reporterID}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding reports: %v", err)
+	}
+	reports := []*models.Report{}
+	if err := cursor.All(ctx, &reports); err != nil {
+		return nil, fmt.Errorf("error decoding reports: %v", err)
+	}
+	return reports, nil
+}
+
+// FindReportById returns a report, nil if there is none
+func FindReportById(ctx context.Context, reportID string) (*models.Report, error) {
+	ctx, end := startOp(ctx, "FindReportById")
+	defer end()
+
+	reportObjectID, err := primitive.ObjectIDFromHex(reportID)
+	if err != nil {
+		return nil, nil
+	}
+	var report models.Report
+	err = reportsCollection.FindOne(ctx, bson.M{"_id": reportObjectID}).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding report: %v", err)
+	}
+	return &report, nil
+}
+
+// CountReportsAgainst counts the reports ever filed against a user
+func CountReportsAgainst(ctx context.Context, userID string) (int64, error) {
+	ctx, end := startOp(ctx, "CountReportsAgainst")
+	defer end()
+
+	count, err := reportsCollection.CountDocuments(ctx, bson.M{"reported_user_id": userID})
+	if err != nil {
+		return 0, fmt.Errorf("error counting reports: %v", err)
+	}
+	return count, nil
+}
+
+// CloseReport gives an open report its final status and reports whether it was still open
+func CloseReport(ctx context.Context, reportID string, status string, moderatorID string, action string, now time.Time) (bool, error) {
+	ctx, end := startOp(ctx, "CloseReport")
+	defer end()
+
+	reportObjectID, err := primitive.ObjectIDFromHex(reportID)
+	if err != nil {
+		return false, nil
+	}
+	result, err := reportsCollection.UpdateOne(ctx,
+		bson.M{"_id": reportObjectID, "status": ReportOpen},
+		bson.M{"$set": bson.M{"status": status, "resolved_by": moderatorID, "action": action, "resolved_at": now}})
+	if err != nil {
+		return false, fmt.Errorf("error closing report: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// CloseReportsOnMessage resolves the other open reports on a message once it is deleted
+func CloseReportsOnMessage(ctx context.Context, messageID string, moderatorID string, action string, now time.Time) error {
+	ctx, end := startOp(ctx, "CloseReportsOnMessage")
+	defer end()
+
+	_, err := reportsCollection.UpdateMany(ctx,
+		bson.M{"message_id": messageID, "status": ReportOpen},
+		bson.M{"$set": bson.M{"status": ReportResolved, "resolved_by": moderatorID, "action": action, "resolved_at": now}})
+	if err != nil {
+		return fmt.Errorf("error closing reports: %v", err)
+	}
+	return nil
+}
+
+// FindMessageById returns a message, nil if there is none
+func FindMessageById(ctx context.Context, messageID string) (*models.Message, error) {
+	ctx, end := startOp(ctx, "FindMessageById")
+	defer end()
+
+	messageObjectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, nil
+	}
+	var message models.Message
+	err = messagesCollection.FindOne(ctx, bson.M{"_id": messageObjectID}).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding message: %v", err)
+	}
+	return &message, nil
+}
+
+// FindMessagesAround returns up to count messages of a chat sent before at and up
+// to count sent after it, in time order
+func FindMessagesAround(ctx context.Context, chatID string, at time.Time, count int) (before []*models.Message, after []*models.Message, err error) {
+	ctx, end := startOp(ctx, "FindMessagesAround")
+	defer end()
+
+	before, after = []*models.Message{}, []*models.Message{}
+	cursor, err := messagesCollection.Find(ctx, bson.M{"chat_id": chatID, "sent_at": bson.M{"$lt": at}},
+		options.Find().SetSort(bson.M{"sent_at": -1}).SetLimit(int64(count)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error finding messages: %v", err)
+	}
+	if err := cursor.All(ctx, &before); err != nil {
+		return nil, nil, fmt.Errorf("error decoding messages: %v", err)
+	}
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	cursor, err = messagesCollection.Find(ctx, bson.M{"chat_id": chatID, "sent_at": bson.M{"$gt": at}},
+		options.Find().SetSort(bson.M{"sent_at": 1}).SetLimit(int64(count)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error finding messages: %v", err)
+	}
+	if err := cursor.All(ctx, &after); err != nil {
+		return nil, nil, fmt.Errorf("error decoding messages: %v", err)
+	}
+	return before, after, nil
+}
+
+// TombstoneMessage empties a message, keeping its place in the history, and
+// reports whether it was found
+func TombstoneMessage(ctx context.Context, messageID string) (bool, error) {
+	ctx, end := startOp(ctx, "TombstoneMessage")
+	defer end()
+
+	messageObjectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return false, nil
+	}
+	result, err := messagesCollection.UpdateOne(ctx, bson.M{"_id": messageObjectID}, bson.M{
+		"$set":   bson.M{"content": "", "type": MessageTypeDeleted},
+		"$unset": bson.M{"attachments": "", "display_name": "", "avatar_url": ""},
+	})
+	if err != nil {
+		return false, fmt.Errorf("error tombstoning message: %v", err)
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// SetUserMutedUntil mutes a user until the given time, nil lifts the mute
+func SetUserMutedUntil(ctx context.Context, userID string, until *time.Time) error {
+	ctx, end := startOp(ctx, "SetUserMutedUntil")
+	defer end()
+
+	if until == nil {
+		return updateUser(ctx, userID, bson.M{"$unset": bson.M{"muted_until": ""}})
+	}
+	return updateUser(ctx, userID, bson.M{"$set": bson.M{"muted_until": *until}})
+}
+
+// FindSenderState reads whether a user is disabled and until when they are muted,
+// bypassing the user cache so moderation takes effect on every instance at once.
+// It returns nil if there is no such user.
+func FindSenderState(ctx context.Context, userID string) (*models.User, error) {
+	ctx, end := startOp(ctx, "FindSenderState")
+	defer end()
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, nil
+	}
+	var user models.User
+	err = usersCollection.FindOne(ctx, bson.M{"_id": userObjectID},
+		options.FindOne().SetProjection(bson.M{"disabled": 1, "muted_until": 1})).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding sender: %v", err)
+	}
+	return &user, nil
+}
+
+// InsertModerationAction appends an entry to the audit trail
+func InsertModerationAction(ctx context.Context, action *models.ModerationAction) error {
+	ctx, end := startOp(ctx, "InsertModerationAction")
+	defer end()
+
+	result, err := moderationActionsCollection.InsertOne(ctx, action)
+	if err != nil {
+		return fmt.Errorf("error inserting moderation action: %v", err)
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		action.ID = id.Hex()
+	}
+	return nil
+}
+
+// ListModerationActions pages through the audit trail, newest first, optionally
+// limited to one target user and one moderator
+func ListModerationActions(ctx context.Context, targetUserID string, moderatorID string, limit int, page int) ([]*models.ModerationAction, int64, error) {
+	ctx, end := startOp(ctx, "ListModerationActions")
+	defer end()
+
+	filter := bson.M{}
+	if targetUserID != "" {
+		filter["target_user_id"] = targetUserID
+	}
+	if moderatorID != "" {
+		filter["moderator_id"] = moderatorID
+	}
+	total, err := moderationActionsCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting moderation actions: %v", err)
+	}
+	findOptions := options.Find().
+		SetSort(bson.M{"created_at": -1}).
+		SetSkip(int64((page - 1) * limit)).
+		SetLimit(int64(limit))
+	cursor, err := moderationActionsCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error finding moderation actions: %v", err)
+	}
+	actions := []*models.ModerationAction{}
+	if err := cursor.All(ctx, &actions); err != nil {
+		return nil, 0, fmt.Errorf("error decoding moderation actions: %v", err)
+	}
+	return actions, total, nil
+}
@@ -1,10 +1,14 @@
 package mongodb
 
 import (
+	"backend/internal/logging"
+	"backend/internal/metrics"
 	"backend/internal/models"
+	"backend/internal/tracing"
+	"backend/internal/utils"
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"os"
 	"time"
@@ -13,7 +17,10 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Global variable to hold the MongoDB client
@@ -21,26 +28,45 @@ var Client *mongo.Client
 var usersCollection *mongo.Collection
 var chatsCollection *mongo.Collection
 var messagesCollection *mongo.Collection
+var rateLimitsCollection *mongo.Collection
+var loginAttemptsCollection *mongo.Collection
+var oidcFlowsCollection *mongo.Collection
+var signingKeysCollection *mongo.Collection
+var apiTokensCollection *mongo.Collection
+var webhooksCollection *mongo.Collection
+var webhookDeliveriesCollection *mongo.Collection
+var incomingWebhooksCollection *mongo.Collection
+var botCommandsCollection *mongo.Collection
+var scheduledMessagesCollection *mongo.Collection
+var exportJobsCollection *mongo.Collection
+var blocksCollection *mongo.Collection
+var contactsCollection *mongo.Collection
+var reportsCollection *mongo.Collection
+var moderationActionsCollection *mongo.Collection
+var relayedFramesCollection *mongo.Collection
+
+// exportFiles stores the finished export archives
+var exportFiles *gridfs.Bucket
 
 // InitMongoDB initializes the MongoDB connection and assigns it to the global Client variable
 func InitMongoDB() {
 	// Load environment variables from .env file
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		logging.Fatal("Error loading .env file", logging.Err(err))
 	}
 
 	// Get MongoDB connection details from environment variables
 	mongoURI := os.Getenv("MONGO_URI")
 	if mongoURI == "" {
-		log.Fatal("MONGO_URI is not set in environment variables")
+		logging.Fatal("MONGO_URI is not set in environment variables")
 	}
 
 	mongoUser := os.Getenv("MONGO_USER")
 	mongoPassword := os.Getenv("MONGO_PASSWORD")
 
-	// Set up client options
-	clientOptions := options.Client().ApplyURI(mongoURI)
+	// Set up client options, the monitor emits a span per MongoDB command
+	clientOptions := options.Client().ApplyURI(mongoURI).SetMonitor(otelmongo.NewMonitor())
 
 	// If authentication is required, set up the credentials
 	if mongoUser != "" && mongoPassword != "" {
@@ -54,7 +80,7 @@ func InitMongoDB() {
 	var errConnect error
 	Client, errConnect = mongo.Connect(context.Background(), clientOptions)
 	if errConnect != nil {
-		log.Fatal("Failed to connect to MongoDB:", errConnect)
+		logging.Fatal("Failed to connect to MongoDB", logging.Err(errConnect))
 	}
 
 	// Ping MongoDB to ensure the connection is established
@@ -62,45 +88,88 @@ func InitMongoDB() {
 	defer cancel()
 	err = Client.Ping(ctx, nil)
 	if err != nil {
-		log.Fatal("Failed to ping MongoDB:", err)
+		logging.Fatal("Failed to ping MongoDB", logging.Err(err))
 	}
 
 	// Select the database and initialize the usersCollection
 	dbName := os.Getenv("DB_NAME") // Get the database name from environment variable
 	if dbName == "" {
-		log.Fatal("DB_NAME is not set in environment variables")
+		logging.Fatal("DB_NAME is not set in environment variables")
 	}
 
 	usersCollection = Client.Database(dbName).Collection("users")       // Set the users collection
 	chatsCollection = Client.Database(dbName).Collection("chats")       // Set the chats collection
 	messagesCollection = Client.Database(dbName).Collection("messages") // Set the chats collection
+	rateLimitsCollection = Client.Database(dbName).Collection("rate_limits")
+	loginAttemptsCollection = Client.Database(dbName).Collection("login_attempts")
+	oidcFlowsCollection = Client.Database(dbName).Collection("oidc_flows")
+	signingKeysCollection = Client.Database(dbName).Collection("signing_keys")
+	apiTokensCollection = Client.Database(dbName).Collection("api_tokens")
+	webhooksCollection = Client.Database(dbName).Collection("webhooks")
+	webhookDeliveriesCollection = Client.Database(dbName).Collection("webhook_deliveries")
+	incomingWebhooksCollection = Client.Database(dbName).Collection("incoming_webhooks")
+	botCommandsCollection = Client.Database(dbName).Collection("bot_commands")
+	scheduledMessagesCollection = Client.Database(dbName).Collection("scheduled_messages")
+	exportJobsCollection = Client.Database(dbName).Collection("export_jobs")
+	blocksCollection = Client.Database(dbName).Collection("blocks")
+	contactsCollection = Client.Database(dbName).Collection("contacts")
+	reportsCollection = Client.Database(dbName).Collection("reports")
+	moderationActionsCollection = Client.Database(dbName).Collection("moderation_actions")
+	relayedFramesCollection = Client.Database(dbName).Collection("relayed_frames")
+	exportFiles, err = gridfs.NewBucket(Client.Database(dbName), options.GridFSBucket().SetName("exports"))
+	if err != nil {
+		logging.Fatal("Failed to open the exports bucket", logging.Err(err))
+	}
+
+	UserCacheTTL = utils.GetEnvDuration("USER_CACHE_TTL", UserCacheTTL)
+
+	if err := ensureIndexes(ctx); err != nil {
+		logging.Fatal("Failed to create MongoDB indexes", logging.Err(err))
+	}
+	if err := backfillSearchNames(ctx); err != nil {
+		logging.Fatal("Failed to list existing users in the directory", logging.Err(err))
+	}
 
-	fmt.Println("Connected to MongoDB and initialized users collection!")
+	slog.Info("Connected to MongoDB and initialized collections", "database", dbName)
+}
+
+// startOp starts a span named after the repository function and returns a
+// function that ends it and records the operation latency
+func startOp(ctx context.Context, operation string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracing.Tracer().Start(ctx, "mongodb."+operation, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, func() {
+		span.End()
+		metrics.ObserveMongo(operation, start)
+	}
 }
 
 // GetDatabase returns a MongoDB database by name
 func GetDatabase(dbName string) *mongo.Database {
 	if Client == nil {
-		log.Fatal("MongoDB client is not initialized")
+		logging.Fatal("MongoDB client is not initialized")
 	}
 	return Client.Database(dbName)
 }
 
-func GetUserByIds(userIds []string) ([]*models.UserResponse, error) {
+func GetUserByIds(ctx context.Context, userIds []string) ([]*models.UserResponse, error) {
+	ctx, end := startOp(ctx, "GetUserByIds")
+	defer end()
+
 	objectIds, err := convertToObjectIDs(userIds)
 	if err != nil {
 		return nil, fmt.Errorf("invalid chat ID format: %v", err)
 	}
 	filter := bson.M{"_id": bson.M{"$in": objectIds}}
 
-	cursor, err := usersCollection.Find(context.Background(), filter)
+	cursor, err := usersCollection.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(context.Background())
+	defer cursor.Close(ctx)
 
 	var users []*models.UserResponse
-	if err := cursor.All(context.Background(), &users); err != nil {
+	if err := cursor.All(ctx, &users); err != nil {
 		return nil, err
 	}
 
@@ -125,21 +194,32 @@ func convertToObjectIDs(stringIds []string) ([]primitive.ObjectID, error) {
 	return objectIDs, nil
 }
 
+// Ping checks that the MongoDB primary is reachable
+func Ping(ctx context.Context) error {
+	if Client == nil {
+		return fmt.Errorf("mongodb client is not initialized")
+	}
+	return Client.Ping(ctx, nil)
+}
+
 // CloseMongoDB gracefully closes the MongoDB client
 func CloseMongoDB() {
 	if Client != nil {
 		err := Client.Disconnect(context.Background())
 		if err != nil {
-			log.Fatal("Failed to disconnect from MongoDB:", err)
+			logging.Fatal("Failed to disconnect from MongoDB", logging.Err(err))
 		}
-		fmt.Println("MongoDB connection closed")
+		slog.Info("MongoDB connection closed")
 	}
 }
 
-func FindUserByEmailRegistration(email string) (*models.User, error) {
+func FindUserByEmailRegistration(ctx context.Context, email string) (*models.User, error) {
+	ctx, end := startOp(ctx, "FindUserByEmailRegistration")
+	defer end()
+
 	var user models.User
 	// Use bson.M{} to search for the user by username
-	err := usersCollection.FindOne(context.Background(), bson.M{"email": email}).Decode(&user)
+	err := usersCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
@@ -149,10 +229,13 @@ func FindUserByEmailRegistration(email string) (*models.User, error) {
 	return &user, nil
 }
 
-func FindUserByUsername(username string, returnErrorIfNotFound bool) (*models.User, error) {
+func FindUserByUsername(ctx context.Context, username string, returnErrorIfNotFound bool) (*models.User, error) {
+	ctx, end := startOp(ctx, "FindUserByUsername")
+	defer end()
+
 	var user models.User
 	// Search for the user by username
-	err := usersCollection.FindOne(context.Background(), bson.M{"username": username}).Decode(&user)
+	err := usersCollection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			if returnErrorIfNotFound {
@@ -165,11 +248,14 @@ func FindUserByUsername(username string, returnErrorIfNotFound bool) (*models.Us
 	return &user, nil
 }
 
-func FindUserByUsernameOrEmail(usernameOrEmail string) (*models.User, error) {
+func FindUserByUsernameOrEmail(ctx context.Context, usernameOrEmail string) (*models.User, error) {
+	ctx, end := startOp(ctx, "FindUserByUsernameOrEmail")
+	defer end()
+
 	var user models.User
 	// Use bson.M{} to search for the user by username or email
 	err := usersCollection.FindOne(
-		context.Background(),
+		ctx,
 		bson.M{
 			"$or": []interface{}{
 				bson.M{"username": usernameOrEmail},
@@ -187,9 +273,17 @@ func FindUserByUsernameOrEmail(usernameOrEmail string) (*models.User, error) {
 }
 
 // CreateUser inserts a new user into the MongoDB collection
-func CreateUser(user models.User) (string, error) {
+func CreateUser(ctx context.Context, user models.User) (string, error) {
+	ctx, end := startOp(ctx, "CreateUser")
+	defer end()
+
+	// Bots and placeholders aren't listed in the directory
+	if !user.Bot && !user.Placeholder {
+		user.SearchNames = SearchNames(user.Username, user.DisplayName)
+	}
+
 	// Insert the User into the collection
-	data, err := usersCollection.InsertOne(context.Background(), user)
+	data, err := usersCollection.InsertOne(ctx, user)
 	if err != nil {
 		return "", fmt.Errorf("error inserting user: %v", err)
 	}
@@ -201,20 +295,23 @@ func CreateUser(user models.User) (string, error) {
 	return id.Hex(), nil
 }
 
-func GetUserChatsWithMessages(userID string) ([]*models.Chat, error) {
+func GetUserChatsWithMessages(ctx context.Context, userID string) ([]*models.Chat, error) {
+	ctx, end := startOp(ctx, "GetUserChatsWithMessages")
+	defer end()
+
 	var chats []*models.Chat
 
 	// Find documents in the chats collection where "users" contains the userID
 	cursor, err := chatsCollection.Find(
-		context.Background(),
+		ctx,
 		bson.M{"users": bson.M{"$in": []string{userID}}, "count_messages": bson.M{"$gt": 0}})
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(context.Background())
+	defer cursor.Close(ctx)
 
 	// Directly decode the entire cursor into the slice
-	if err := cursor.All(context.Background(), &chats); err != nil {
+	if err := cursor.All(ctx, &chats); err != nil {
 		return nil, err
 	}
 
@@ -224,7 +321,10 @@ func GetUserChatsWithMessages(userID string) ([]*models.Chat, error) {
 	return chats, nil
 }
 
-func GetUserChatById(userID string, chatID string) (*models.Chat, error) {
+func GetUserChatById(ctx context.Context, userID string, chatID string) (*models.Chat, error) {
+	ctx, end := startOp(ctx, "GetUserChatById")
+	defer end()
+
 	chatIDObjectId, err := primitive.ObjectIDFromHex(chatID)
 	if err != nil {
 		return nil, fmt.Errorf("invalid chat ID format: %v", err)
@@ -234,7 +334,7 @@ func GetUserChatById(userID string, chatID string) (*models.Chat, error) {
 
 	// Find a document in chats collection where id matches and user is in users array
 	errQuery := chatsCollection.FindOne(
-		context.Background(),
+		ctx,
 		bson.M{
 			"_id":   chatIDObjectId,
 			"users": bson.M{"$in": []string{userID}},
@@ -250,31 +350,62 @@ func GetUserChatById(userID string, chatID string) (*models.Chat, error) {
 	return &chat, nil
 }
 
-func FindChatByUsers(userIDs []string) (*models.Chat, error) {
+func FindChatByUsers(ctx context.Context, userIDs []string) (*models.Chat, error) {
+	ctx, end := startOp(ctx, "FindChatByUsers")
+	defer end()
+
 	var chat models.Chat
-	filter := bson.M{"users": bson.M{"$all": userIDs}}
-	err := chatsCollection.FindOne(context.Background(), filter).Decode(&chat)
+	// Exactly these users, group chats that also contain them don't count
+	filter := bson.M{"users": bson.M{"$all": userIDs, "$size": len(userIDs)}}
+	err := chatsCollection.FindOne(ctx, filter).Decode(&chat)
 	if err == mongo.ErrNoDocuments {
 		return nil, nil
 	}
 	return &chat, err
 }
 
-func FindUserChat(chatID string, userID string) (*models.Chat, error) {
+func FindUserChat(ctx context.Context, chatID string, userID string) (*models.Chat, error) {
+	ctx, end := startOp(ctx, "FindUserChat")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat ID format: %v", err)
+	}
+
 	var chat models.Chat
 	filter := bson.M{
-		"_id":   chatID,
+		"_id":   chatObjectID,
 		"users": bson.M{"$in": []string{userID}},
 	}
-	err := chatsCollection.FindOne(context.Background(), filter).Decode(&chat)
+	err = chatsCollection.FindOne(ctx, filter).Decode(&chat)
 	return &chat, err
 }
 
-func CreateChat(chat *models.Chat) (*models.Chat, error) {
+// IsChatMember reports whether a user is a member of a chat
+func IsChatMember(ctx context.Context, chatID string, userID string) (bool, error) {
+	ctx, end := startOp(ctx, "IsChatMember")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return false, fmt.Errorf("invalid chat ID format: %v", err)
+	}
+	count, err := chatsCollection.CountDocuments(ctx, bson.M{"_id": chatObjectID, "users": userID}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("error checking chat membership: %v", err)
+	}
+	return count > 0, nil
+}
+
+func CreateChat(ctx context.Context, chat *models.Chat) (*models.Chat, error) {
+	ctx, end := startOp(ctx, "CreateChat")
+	defer end()
+
 	// Ensure the ID is empty (MongoDB generates it automatically)
 
 	// Insert the chat into the MongoDB collection
-	result, err := chatsCollection.InsertOne(context.Background(), chat)
+	result, err := chatsCollection.InsertOne(ctx, chat)
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert chat: %v", err)
 	}
@@ -288,8 +419,11 @@ func CreateChat(chat *models.Chat) (*models.Chat, error) {
 	return chat, nil
 }
 
-func SaveMessage(message *models.Message) (*models.Message, error) {
-	result, err := messagesCollection.InsertOne(context.Background(), message)
+func SaveMessage(ctx context.Context, message *models.Message) (*models.Message, error) {
+	ctx, end := startOp(ctx, "SaveMessage")
+	defer end()
+
+	result, err := messagesCollection.InsertOne(ctx, message)
 	if err != nil {
 		return nil, fmt.Errorf("failed to save message: %v", err)
 	}
@@ -300,41 +434,36 @@ func SaveMessage(message *models.Message) (*models.Message, error) {
 	return message, err
 }
 
-func UpdateChat(chat *models.Chat) error {
-	chatID, err := primitive.ObjectIDFromHex(chat.ID)
-	if err != nil {
-		return fmt.Errorf("invalid chat ID format: %v", err)
-	}
-
-	filter := bson.M{"_id": chatID}
+// UpdateChatLastMessage records a new message in the summary of its chat, only the
+// last message fields and the count are written so concurrent changes to the
+// members, topic or settings of the chat are kept
+func UpdateChatLastMessage(ctx context.Context, message *models.Message, at time.Time) error {
+	ctx, end := startOp(ctx, "UpdateChatLastMessage")
+	defer end()
 
-	// Convert struct to bson.M and exclude _id
-	chatBSON, err := bson.Marshal(chat)
+	chatID, err := primitive.ObjectIDFromHex(message.ChatID)
 	if err != nil {
-		return err
-	}
-
-	var updateDoc bson.M
-	err = bson.Unmarshal(chatBSON, &updateDoc)
-	if err != nil {
-		return err
+		return fmt.Errorf("invalid chat ID format: %v", err)
 	}
-
-	// Remove the _id field from the update document
-	delete(updateDoc, "_id")
-
-	update := bson.M{"$set": updateDoc}
-
-	_, err = chatsCollection.UpdateOne(context.Background(), filter, update)
+	_, err = chatsCollection.UpdateOne(ctx, bson.M{"_id": chatID}, bson.M{
+		"$set": bson.M{
+			"last_message":    message.Content,
+			"last_message_id": message.ID,
+			"last_message_by": message.Sender,
+			"last_message_at": at,
+		},
+		"$inc": bson.M{"count_messages": 1},
+	})
 	if err != nil {
-		log.Printf("Error updating chat: %v", err)
-		return err
+		return fmt.Errorf("error updating chat: %v", err)
 	}
-
 	return nil
 }
 
-func FindUserById(userID string) (*models.User, error) {
+func FindUserById(ctx context.Context, userID string) (*models.User, error) {
+	ctx, end := startOp(ctx, "FindUserById")
+	defer end()
+
 	var user models.User
 	userObjectId, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
@@ -342,7 +471,7 @@ func FindUserById(userID string) (*models.User, error) {
 	}
 
 	filter := bson.M{"_id": userObjectId}
-	err = usersCollection.FindOne(context.Background(), filter).Decode(&user)
+	err = usersCollection.FindOne(ctx, filter).Decode(&user)
 	if err != nil {
 		return nil, err
 	}
@@ -350,11 +479,22 @@ func FindUserById(userID string) (*models.User, error) {
 	return &user, nil
 }
 
-func GetChatMessages(chatID string, limit int, page int) ([]*models.Message, int, error) {
+// GetChatMessages pages through the messages of a chat, newest first, leaving out
+// the messages of excludeSenders
+func GetChatMessages(ctx context.Context, chatID string, since time.Time, limit int, page int, excludeSenders []string) ([]*models.Message, int, error) {
+	ctx, end := startOp(ctx, "GetChatMessages")
+	defer end()
+
 	skip := (page - 1) * limit
 	filter := bson.M{"chat_id": chatID}
+	if !since.IsZero() {
+		filter["sent_at"] = bson.M{"$gte": since}
+	}
+	if len(excludeSenders) > 0 {
+		filter["sender"] = bson.M{"$nin": excludeSenders}
+	}
 
-	totalMessages, err := messagesCollection.CountDocuments(context.Background(), filter)
+	totalMessages, err := messagesCollection.CountDocuments(ctx, filter)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to count messages: %v", err)
 	}
@@ -367,14 +507,14 @@ func GetChatMessages(chatID string, limit int, page int) ([]*models.Message, int
 	options.SetLimit(int64(limit))
 	options.SetSkip(int64(skip))
 
-	cursor, err := messagesCollection.Find(context.Background(), filter, options)
+	cursor, err := messagesCollection.Find(ctx, filter, options)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to retrieve messages: %v", err)
 	}
-	defer cursor.Close(context.Background())
+	defer cursor.Close(ctx)
 
 	var messages []*models.Message
-	if err := cursor.All(context.Background(), &messages); err != nil {
+	if err := cursor.All(ctx, &messages); err != nil {
 		return nil, 0, err
 	}
 
@@ -384,7 +524,10 @@ func GetChatMessages(chatID string, limit int, page int) ([]*models.Message, int
 	return messages, totalPages, nil
 }
 
-func GetChatByIdAndSender(chatID string, senderID string) (*models.Chat, error) {
+func GetChatByIdAndSender(ctx context.Context, chatID string, senderID string) (*models.Chat, error) {
+	ctx, end := startOp(ctx, "GetChatByIdAndSender")
+	defer end()
+
 	var chat models.Chat
 
 	// Convert the chatID string to an ObjectId
@@ -397,7 +540,7 @@ func GetChatByIdAndSender(chatID string, senderID string) (*models.Chat, error)
 	filter := bson.M{"_id": chatObjectID, "users": senderID}
 
 	// Find the chat by its ID
-	err = chatsCollection.FindOne(context.Background(), filter).Decode(&chat)
+	err = chatsCollection.FindOne(ctx, filter).Decode(&chat)
 	if err != nil {
 		// If no chat is found or there's an error, return it
 		return nil, err
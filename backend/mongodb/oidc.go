@@ -0,0 +1,76 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SaveOIDCFlow stores the state of an authorization request until the callback
+func SaveOIDCFlow(ctx context.Context, flow *models.OIDCFlow) error {
+	ctx, end := startOp(ctx, "SaveOIDCFlow")
+	defer end()
+
+	if _, err := oidcFlowsCollection.InsertOne(ctx, flow); err != nil {
+		return fmt.Errorf("failed to save oidc flow: %v", err)
+	}
+	return nil
+}
+
+// ConsumeOIDCFlow returns and deletes the flow for state, so a callback can only be
+// processed once. It returns nil when the state is unknown or already used.
+func ConsumeOIDCFlow(ctx context.Context, state string) (*models.OIDCFlow, error) {
+	ctx, end := startOp(ctx, "ConsumeOIDCFlow")
+	defer end()
+
+	var flow models.OIDCFlow
+	err := oidcFlowsCollection.FindOneAndDelete(ctx, bson.M{"_id": state}).Decode(&flow)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume oidc flow: %v", err)
+	}
+	return &flow, nil
+}
+
+// FindUserByOIDCIdentity returns the user linked to the issuer and subject, or nil
+func FindUserByOIDCIdentity(ctx context.Context, issuer string, subject string) (*models.User, error) {
+	ctx, end := startOp(ctx, "FindUserByOIDCIdentity")
+	defer end()
+
+	var user models.User
+	err := usersCollection.FindOne(ctx, bson.M{
+		"oidc_identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}},
+	}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding user: %v", err)
+	}
+	return &user, nil
+}
+
+// LinkUserOIDCIdentity attaches an external identity to an existing user
+func LinkUserOIDCIdentity(ctx context.Context, userID string, identity models.OIDCIdentity) error {
+	ctx, end := startOp(ctx, "LinkUserOIDCIdentity")
+	defer end()
+	defer InvalidateUser(userID)
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user ID format: %v", err)
+	}
+	_, err = usersCollection.UpdateOne(ctx,
+		bson.M{"_id": userObjectID},
+		bson.M{"$push": bson.M{"oidc_identities": identity}})
+	if err != nil {
+		return fmt.Errorf("error linking identity: %v", err)
+	}
+	return nil
+}
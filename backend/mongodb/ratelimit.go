@@ -0,0 +1,56 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type rateLimitBucket struct {
+	Key       string    `bson:"_id"`
+	Tokens    float64   `bson:"tokens"`
+	Allowed   bool      `bson:"allowed"`
+	UpdatedAt time.Time `bson:"updated_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// TakeRateLimitToken refills the shared token bucket key at rate tokens per second
+// up to burst, a new bucket starts full, and takes a token if one is available. The
+// whole transition is a single pipeline update so racing instances never lose a
+// take. It returns the tokens left and whether a token was taken.
+func TakeRateLimitToken(ctx context.Context, key string, rate float64, burst int, now time.Time, ttl time.Duration) (float64, bool, error) {
+	ctx, end := startOp(ctx, "TakeRateLimitToken")
+	defer end()
+
+	// Clocks of different instances may disagree slightly, never refill backwards
+	elapsed := bson.M{"$max": bson.A{0, bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}}, 1000}}}}
+	refilled := bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$tokens", burst}}, bson.M{"$multiply": bson.A{elapsed, rate}}}}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"refilled": refilled}}},
+		{{Key: "$set", Value: bson.M{
+			"allowed":    bson.M{"$gte": bson.A{"$refilled", 1}},
+			"tokens":     bson.M{"$cond": bson.A{bson.M{"$gte": bson.A{"$refilled", 1}}, bson.M{"$subtract": bson.A{"$refilled", 1}}, "$refilled"}},
+			"updated_at": now,
+			"expires_at": now.Add(ttl),
+		}}},
+		{{Key: "$unset", Value: "refilled"}},
+	}
+	findOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var bucket rateLimitBucket
+	err := rateLimitsCollection.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline, findOptions).Decode(&bucket)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another instance created the bucket first, it exists now
+		err = rateLimitsCollection.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline, findOptions).Decode(&bucket)
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to update rate limit bucket: %v", err)
+	}
+	return bucket.Tokens, bucket.Allowed, nil
+}
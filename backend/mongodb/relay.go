@@ -0,0 +1,41 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InsertRelayedFrame queues a frame for the other instances
+func InsertRelayedFrame(ctx context.Context, frame *models.RelayedFrame) error {
+	ctx, end := startOp(ctx, "InsertRelayedFrame")
+	defer end()
+
+	if _, err := relayedFramesCollection.InsertOne(ctx, frame); err != nil {
+		return fmt.Errorf("error inserting relayed frame: %v", err)
+	}
+	return nil
+}
+
+// FindRelayedFramesSince returns the frames queued after since, oldest first
+func FindRelayedFramesSince(ctx context.Context, since time.Time) ([]*models.RelayedFrame, error) {
+	ctx, end := startOp(ctx, "FindRelayedFramesSince")
+	defer end()
+
+	cursor, err := relayedFramesCollection.Find(ctx, bson.M{"created_at": bson.M{"$gt": since}},
+		options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding relayed frames: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	frames := []*models.RelayedFrame{}
+	if err := cursor.All(ctx, &frames); err != nil {
+		return nil, fmt.Errorf("error decoding relayed frames: %v", err)
+	}
+	return frames, nil
+}
@@ -0,0 +1,157 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SetChatMessageTTL sets the age at which the messages of a chat disappear, 0 keeps them
+func SetChatMessageTTL(ctx context.Context, chatID string, ttl time.Duration) error {
+	ctx, end := startOp(ctx, "SetChatMessageTTL")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID format: %v", err)
+	}
+	update := bson.M{"$set": bson.M{"message_ttl": int64(ttl.Seconds())}}
+	if ttl <= 0 {
+		update = bson.M{"$unset": bson.M{"message_ttl": ""}}
+	}
+	if _, err := chatsCollection.UpdateOne(ctx, bson.M{"_id": chatObjectID}, update); err != nil {
+		return fmt.Errorf("error updating chat retention: %v", err)
+	}
+	return nil
+}
+
+// FindChatsWithMessageTTL returns the chats whose messages disappear
+func FindChatsWithMessageTTL(ctx context.Context) ([]*models.Chat, error) {
+	ctx, end := startOp(ctx, "FindChatsWithMessageTTL")
+	defer end()
+
+	cursor, err := chatsCollection.Find(ctx, bson.M{"message_ttl": bson.M{"$gt": 0}},
+		options.Find().SetProjection(bson.M{"_id": 1, "users": 1, "message_ttl": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding chats with retention: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	chats := []*models.Chat{}
+	if err := cursor.All(ctx, &chats); err != nil {
+		return nil, fmt.Errorf("error decoding chats: %v", err)
+	}
+	return chats, nil
+}
+
+// MarkChatPurged records that the messages of a chat sent before cutoff were deleted at now
+func MarkChatPurged(ctx context.Context, chatID string, cutoff time.Time, now time.Time) error {
+	ctx, end := startOp(ctx, "MarkChatPurged")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID format: %v", err)
+	}
+	_, err = chatsCollection.UpdateOne(ctx, bson.M{"_id": chatObjectID}, bson.M{
+		"$max": bson.M{"expired_before": cutoff, "purged_at": now},
+	})
+	if err != nil {
+		return fmt.Errorf("error marking chat purged: %v", err)
+	}
+	return nil
+}
+
+// FindChatsPurgedSince returns the members and latest purge cutoff of the chats purged after since
+func FindChatsPurgedSince(ctx context.Context, since time.Time) ([]*models.Chat, error) {
+	ctx, end := startOp(ctx, "FindChatsPurgedSince")
+	defer end()
+
+	cursor, err := chatsCollection.Find(ctx, bson.M{"purged_at": bson.M{"$gt": since}},
+		options.Find().SetProjection(bson.M{"_id": 1, "users": 1, "expired_before": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding purged chats: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	chats := []*models.Chat{}
+	if err := cursor.All(ctx, &chats); err != nil {
+		return nil, fmt.Errorf("error decoding chats: %v", err)
+	}
+	return chats, nil
+}
+
+// FindChatIdsWithMessagesBefore returns the chats holding messages sent before a time
+func FindChatIdsWithMessagesBefore(ctx context.Context, before time.Time) ([]string, error) {
+	ctx, end := startOp(ctx, "FindChatIdsWithMessagesBefore")
+	defer end()
+
+	values, err := messagesCollection.Distinct(ctx, "chat_id", bson.M{"sent_at": bson.M{"$lt": before}})
+	if err != nil {
+		return nil, fmt.Errorf("error finding chats with old messages: %v", err)
+	}
+	chatIDs := make([]string, 0, len(values))
+	for _, value := range values {
+		if chatID, ok := value.(string); ok {
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	return chatIDs, nil
+}
+
+// DeleteMessagesBefore deletes the messages sent before a time, in one chat or in
+// every chat when chatID is empty, and returns how many were deleted
+func DeleteMessagesBefore(ctx context.Context, chatID string, before time.Time) (int64, error) {
+	ctx, end := startOp(ctx, "DeleteMessagesBefore")
+	defer end()
+
+	filter := bson.M{"sent_at": bson.M{"$lt": before}}
+	if chatID != "" {
+		filter["chat_id"] = chatID
+	}
+	result, err := messagesCollection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting messages: %v", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// RefreshChatSummary recomputes the message count and the last message fields of a
+// chat from the messages it still has
+func RefreshChatSummary(ctx context.Context, chatID string) error {
+	ctx, end := startOp(ctx, "RefreshChatSummary")
+	defer end()
+
+	chatObjectID, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID format: %v", err)
+	}
+	count, err := messagesCollection.CountDocuments(ctx, bson.M{"chat_id": chatID})
+	if err != nil {
+		return fmt.Errorf("error counting messages: %v", err)
+	}
+
+	set := bson.M{"count_messages": count, "last_message": nil, "last_message_id": nil, "last_message_by": nil, "last_message_at": nil}
+	var last models.Message
+	err = messagesCollection.FindOne(ctx, bson.M{"chat_id": chatID}, options.FindOne().SetSort(bson.M{"sent_at": -1})).Decode(&last)
+	switch {
+	case err == nil:
+		set["last_message"] = last.Content
+		set["last_message_id"] = last.ID
+		set["last_message_by"] = last.Sender
+		set["last_message_at"] = last.SentAt
+	case err != mongo.ErrNoDocuments:
+		return fmt.Errorf("error finding last message: %v", err)
+	}
+
+	if _, err := chatsCollection.UpdateOne(ctx, bson.M{"_id": chatObjectID}, bson.M{"$set": set}); err != nil {
+		return fmt.Errorf("error updating chat: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of a scheduled message
+const (
+	ScheduledPending  = "pending"
+	ScheduledSending  = "sending"
+	ScheduledSent     = "sent"
+	ScheduledCanceled = "canceled"
+	ScheduledFailed   = "failed"
+)
+
+// InsertScheduledMessage stores a new scheduled message and sets its ID
+func InsertScheduledMessage(ctx context.Context, scheduled *models.ScheduledMessage) error {
+	ctx, end := startOp(ctx, "InsertScheduledMessage")
+	defer end()
+
+	result, err := scheduledMessagesCollection.InsertOne(ctx, scheduled)
+	if err != nil {
+		return fmt.Errorf("error inserting scheduled message: %v", err)
+	}
+	if objectID, ok := result.InsertedID.(primitive.ObjectID); ok {
+		scheduled.ID = objectID.Hex()
+	}
+	return nil
+}
+
+// FindScheduledMessageById returns a scheduled message, or nil if there is none
+func FindScheduledMessageById(ctx context.Context, scheduledID string) (*models.ScheduledMessage, error) {
+	ctx, end := startOp(ctx, "FindScheduledMessageById")
+	defer end()
+
+	scheduledObjectID, err := primitive.ObjectIDFromHex(scheduledID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scheduled message ID format: %v", err)
+	}
+	var scheduled models.ScheduledMessage
+	err = scheduledMessagesCollection.FindOne(ctx, bson.M{"_id": scheduledObjectID}).Decode(&scheduled)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding scheduled message: %v", err)
+	}
+	return &scheduled, nil
+}
+
+// ListScheduledMessages returns the scheduled messages of a sender, optionally
+// restricted to a chat and a status, soonest first
+func ListScheduledMessages(ctx context.Context, senderID string, chatID string, status string) ([]*models.ScheduledMessage, error) {
+	ctx, end := startOp(ctx, "ListScheduledMessages")
+	defer end()
+
+	filter := bson.M{"sender": senderID}
+	if chatID != "" {
+		filter["chat_id"] = chatID
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	cursor, err := scheduledMessagesCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"send_at": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing scheduled messages: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	scheduled := []*models.ScheduledMessage{}
+	if err := cursor.All(ctx, &scheduled); err != nil {
+		return nil, fmt.Errorf("error decoding scheduled messages: %v", err)
+	}
+	return scheduled, nil
+}
+
+// CountPendingScheduledMessages counts the messages a sender still has waiting
+func CountPendingScheduledMessages(ctx context.Context, senderID string) (int64, error) {
+	ctx, end := startOp(ctx, "CountPendingScheduledMessages")
+	defer end()
+
+	count, err := scheduledMessagesCollection.CountDocuments(ctx, bson.M{"sender": senderID, "status": ScheduledPending})
+	if err != nil {
+		return 0, fmt.Errorf("error counting scheduled messages: %v", err)
+	}
+	return count, nil
+}
+
+// UpdatePendingScheduledMessage changes the content and/or time of a message that
+// hasn't been picked up yet, and returns the updated message, or nil if it is no
+// longer pending
+func UpdatePendingScheduledMessage(ctx context.Context, scheduledID string, content *string, sendAt *time.Time, now time.Time) (*models.ScheduledMessage, error) {
+	ctx, end := startOp(ctx, "UpdatePendingScheduledMessage")
+	defer end()
+
+	scheduledObjectID, err := primitive.ObjectIDFromHex(scheduledID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scheduled message ID format: %v", err)
+	}
+	set := bson.M{"updated_at": now}
+	if content != nil {
+		set["content"] = *content
+	}
+	if sendAt != nil {
+		set["send_at"] = *sendAt
+		set["next_attempt_at"] = *sendAt
+	}
+
+	var scheduled models.ScheduledMessage
+	err = scheduledMessagesCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": scheduledObjectID, "status": ScheduledPending},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&scheduled)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error updating scheduled message: %v", err)
+	}
+	return &scheduled, nil
+}
+
+// CancelScheduledMessage cancels a pending message and reports whether it was still pending
+func CancelScheduledMessage(ctx context.Context, scheduledID string, now time.Time, expiresAt time.Time) (bool, error) {
+	ctx, end := startOp(ctx, "CancelScheduledMessage")
+	defer end()
+
+	scheduledObjectID, err := primitive.ObjectIDFromHex(scheduledID)
+	if err != nil {
+		return false, fmt.Errorf("invalid scheduled message ID format: %v", err)
+	}
+	result, err := scheduledMessagesCollection.UpdateOne(ctx,
+		bson.M{"_id": scheduledObjectID, "status": ScheduledPending},
+		bson.M{"$set": bson.M{"status": ScheduledCanceled, "updated_at": now, "expires_at": expiresAt}})
+	if err != nil {
+		return false, fmt.Errorf("error canceling scheduled message: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// ClaimScheduledMessage atomically moves the most overdue pending message to
+// "sending", so only one instance ever sends it. It returns nil when none is due.
+func ClaimScheduledMessage(ctx context.Context, now time.Time) (*models.ScheduledMessage, error) {
+	ctx, end := startOp(ctx, "ClaimScheduledMessage")
+	defer end()
+
+	filter := bson.M{"status": ScheduledPending, "next_attempt_at": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"status": ScheduledSending, "claimed_at": now}, "$inc": bson.M{"attempts": 1}}
+	findOptions := options.FindOneAndUpdate().
+		SetSort(bson.M{"next_attempt_at": 1}).
+		SetReturnDocument(options.After)
+
+	var scheduled models.ScheduledMessage
+	err := scheduledMessagesCollection.FindOneAndUpdate(ctx, filter, update, findOptions).Decode(&scheduled)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error claiming scheduled message: %v", err)
+	}
+	return &scheduled, nil
+}
+
+// CompleteScheduledMessage records the outcome of a send. status is ScheduledPending
+// to retry at nextAttemptAt, or one of the final statuses.
+func CompleteScheduledMessage(ctx context.Context, scheduledID string, status string, messageID string, sendError string, now time.Time, nextAttemptAt time.Time, expiresAt time.Time) error {
+	ctx, end := startOp(ctx, "CompleteScheduledMessage")
+	defer end()
+
+	scheduledObjectID, err := primitive.ObjectIDFromHex(scheduledID)
+	if err != nil {
+		return fmt.Errorf("invalid scheduled message ID format: %v", err)
+	}
+	set := bson.M{"status": status, "updated_at": now, "last_error": sendError, "next_attempt_at": nextAttemptAt}
+	if status != ScheduledPending {
+		set["expires_at"] = expiresAt
+	}
+	if status == ScheduledSent {
+		set["sent_at"] = now
+		set["message_id"] = messageID
+	}
+	_, err = scheduledMessagesCollection.UpdateOne(ctx,
+		bson.M{"_id": scheduledObjectID, "status": ScheduledSending},
+		bson.M{"$set": set, "$unset": bson.M{"claimed_at": ""}})
+	if err != nil {
+		return fmt.Errorf("error updating scheduled message: %v", err)
+	}
+	return nil
+}
+
+// FailStaleScheduledMessages marks as failed the messages claimed before claimedBefore
+// that never completed, their instance stopped mid-send. They are not retried because
+// the message may already have been sent.
+func FailStaleScheduledMessages(ctx context.Context, claimedBefore time.Time, now time.Time, expiresAt time.Time) (int64, error) {
+	ctx, end := startOp(ctx, "FailStaleScheduledMessages")
+	defer end()
+
+	result, err := scheduledMessagesCollection.UpdateMany(ctx,
+		bson.M{"status": ScheduledSending, "claimed_at": bson.M{"$lt": claimedBefore}},
+		bson.M{
+			"$set":   bson.M{"status": ScheduledFailed, "last_error": "interrupted while sending", "updated_at": now, "expires_at": expiresAt},
+			"$unset": bson.M{"claimed_at": ""},
+		})
+	if err != nil {
+		return 0, fmt.Errorf("error failing stale scheduled messages: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,42 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InsertSigningKey stores a new JWT signing key
+func InsertSigningKey(ctx context.Context, key *models.SigningKey) error {
+	ctx, end := startOp(ctx, "InsertSigningKey")
+	defer end()
+
+	if _, err := signingKeysCollection.InsertOne(ctx, key); err != nil {
+		return fmt.Errorf("failed to insert signing key: %v", err)
+	}
+	return nil
+}
+
+// GetActiveSigningKeys returns the keys still valid for verification at now, newest first
+func GetActiveSigningKeys(ctx context.Context, now time.Time) ([]*models.SigningKey, error) {
+	ctx, end := startOp(ctx, "GetActiveSigningKeys")
+	defer end()
+
+	cursor, err := signingKeysCollection.Find(ctx,
+		bson.M{"expires_at": bson.M{"$gt": now}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve signing keys: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var keys []*models.SigningKey
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
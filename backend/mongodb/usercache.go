@@ -0,0 +1,62 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"sync"
+	"time"
+)
+
+// UserCacheTTL bounds how stale a cached user can be on other instances,
+// writes made through this package evict the entry right away
+var UserCacheTTL = 30 * time.Second
+
+type cachedUser struct {
+	user      models.User
+	expiresAt time.Time
+}
+
+var userCache = struct {
+	sync.Mutex
+	entries map[string]cachedUser
+}{entries: map[string]cachedUser{}}
+
+// FindUserByIdCached is FindUserById served from a short-lived in-memory cache.
+// The caller gets its own copy and may modify it.
+func FindUserByIdCached(ctx context.Context, userID string) (*models.User, error) {
+	now := time.Now()
+
+	userCache.Lock()
+	entry, ok := userCache.entries[userID]
+	userCache.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		user := entry.user
+		return &user, nil
+	}
+
+	user, err := FindUserById(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	userCache.Lock()
+	// Drop expired entries now and then so deleted or idle users don't pile up
+	if len(userCache.entries) >= 10000 {
+		for id, cached := range userCache.entries {
+			if now.After(cached.expiresAt) {
+				delete(userCache.entries, id)
+			}
+		}
+	}
+	userCache.entries[userID] = cachedUser{user: *user, expiresAt: now.Add(UserCacheTTL)}
+	userCache.Unlock()
+
+	return user, nil
+}
+
+// InvalidateUser evicts a user from the cache after a change to their record
+func InvalidateUser(userID string) {
+	userCache.Lock()
+	delete(userCache.entries, userID)
+	userCache.Unlock()
+}
@@ -0,0 +1,272 @@
+package mongodb
+
+import (
+	"backend/internal/models"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// InsertWebhook stores a new webhook and sets its ID
+func InsertWebhook(ctx context.Context, webhook *models.Webhook) error {
+	ctx, end := startOp(ctx, "InsertWebhook")
+	defer end()
+
+	result, err := webhooksCollection.InsertOne(ctx, webhook)
+	if err != nil {
+		return fmt.Errorf("error inserting webhook: %v", err)
+	}
+	if objectID, ok := result.InsertedID.(primitive.ObjectID); ok {
+		webhook.ID = objectID.Hex()
+	}
+	return nil
+}
+
+// FindWebhookById returns a webhook, or nil if there is none
+func FindWebhookById(ctx context.Context, webhookID string) (*models.Webhook, error) {
+	ctx, end := startOp(ctx, "FindWebhookById")
+	defer end()
+
+	webhookObjectID, err := primitive.ObjectIDFromHex(webhookID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook ID format: %v", err)
+	}
+	var webhook models.Webhook
+	err = webhooksCollection.FindOne(ctx, bson.M{"_id": webhookObjectID}).Decode(&webhook)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding webhook: %v", err)
+	}
+	return &webhook, nil
+}
+
+// ListWebhooks returns the webhooks created by a user, or every webhook when createdBy is empty
+func ListWebhooks(ctx context.Context, createdBy string) ([]*models.Webhook, error) {
+	ctx, end := startOp(ctx, "ListWebhooks")
+	defer end()
+
+	filter := bson.M{}
+	if createdBy != "" {
+		filter["created_by"] = createdBy
+	}
+	cursor, err := webhooksCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing webhooks: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	webhooks := []*models.Webhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		return nil, fmt.Errorf("error decoding webhooks: %v", err)
+	}
+	return webhooks, nil
+}
+
+// FindWebhooksForEvent returns the active webhooks subscribed to eventType, either
+// on chatID or workspace-wide
+func FindWebhooksForEvent(ctx context.Context, chatID string, eventType string) ([]*models.Webhook, error) {
+	ctx, end := startOp(ctx, "FindWebhooksForEvent")
+	defer end()
+
+	chatIDs := []string{""}
+	if chatID != "" {
+		chatIDs = append(chatIDs, chatID)
+	}
+	cursor, err := webhooksCollection.Find(ctx, bson.M{
+		"active":  true,
+		"chat_id": bson.M{"$in": chatIDs},
+		"events":  bson.M{"$in": []string{eventType, "*"}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error finding webhooks: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	webhooks := []*models.Webhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		return nil, fmt.Errorf("error decoding webhooks: %v", err)
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook and its delivery log
+func DeleteWebhook(ctx context.Context, webhookID string) error {
+	ctx, end := startOp(ctx, "DeleteWebhook")
+	defer end()
+
+	webhookObjectID, err := primitive.ObjectIDFromHex(webhookID)
+	if err != nil {
+		return fmt.Errorf("invalid webhook ID format: %v", err)
+	}
+	if _, err := webhooksCollection.DeleteOne(ctx, bson.M{"_id": webhookObjectID}); err != nil {
+		return fmt.Errorf("error deleting webhook: %v", err)
+	}
+	if _, err := webhookDeliveriesCollection.DeleteMany(ctx, bson.M{"webhook_id": webhookID}); err != nil {
+		return fmt.Errorf("error deleting webhook deliveries: %v", err)
+	}
+	return nil
+}
+
+// EnableWebhook reactivates a webhook and forgets its failures
+func EnableWebhook(ctx context.Context, webhookID string) error {
+	ctx, end := startOp(ctx, "EnableWebhook")
+	defer end()
+
+	webhookObjectID, err := primitive.ObjectIDFromHex(webhookID)
+	if err != nil {
+		return fmt.Errorf("invalid webhook ID format: %v", err)
+	}
+	_, err = webhooksCollection.UpdateOne(ctx, bson.M{"_id": webhookObjectID}, bson.M{
+		"$set":   bson.M{"active": true, "consecutive_failures": 0},
+		"$unset": bson.M{"disabled_at": "", "disabled_reason": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("error enabling webhook: %v", err)
+	}
+	return nil
+}
+
+// RecordWebhookAttempt resets the failure count on success, or increments it and
+// disables the webhook once it reaches disableAfter. It reports whether the
+// webhook was disabled by this call.
+func RecordWebhookAttempt(ctx context.Context, webhookID string, success bool, disableAfter int, now time.Time) (bool, error) {
+	ctx, end := startOp(ctx, "RecordWebhookAttempt")
+	defer end()
+
+	webhookObjectID, err := primitive.ObjectIDFromHex(webhookID)
+	if err != nil {
+		return false, fmt.Errorf("invalid webhook ID format: %v", err)
+	}
+	if success {
+		_, err := webhooksCollection.UpdateOne(ctx, bson.M{"_id": webhookObjectID}, bson.M{"$set": bson.M{"consecutive_failures": 0}})
+		if err != nil {
+			return false, fmt.Errorf("error updating webhook: %v", err)
+		}
+		return false, nil
+	}
+
+	_, err = webhooksCollection.UpdateOne(ctx, bson.M{"_id": webhookObjectID}, bson.M{"$inc": bson.M{"consecutive_failures": 1}})
+	if err != nil {
+		return false, fmt.Errorf("error updating webhook: %v", err)
+	}
+	// Only the attempt crossing the threshold disables it
+	result, err := webhooksCollection.UpdateOne(ctx,
+		bson.M{"_id": webhookObjectID, "active": true, "consecutive_failures": bson.M{"$gte": disableAfter}},
+		bson.M{"$set": bson.M{
+			"active":          false,
+			"disabled_at":     now,
+			"disabled_reason": fmt.Sprintf("%d consecutive failed deliveries", disableAfter),
+		}})
+	if err != nil {
+		return false, fmt.Errorf("error disabling webhook: %v", err)
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// InsertWebhookDeliveries queues deliveries
+func InsertWebhookDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) error {
+	ctx, end := startOp(ctx, "InsertWebhookDeliveries")
+	defer end()
+
+	documents := make([]interface{}, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		documents = append(documents, delivery)
+	}
+	if _, err := webhookDeliveriesCollection.InsertMany(ctx, documents); err != nil {
+		return fmt.Errorf("error queuing webhook deliveries: %v", err)
+	}
+	return nil
+}
+
+// ClaimWebhookDelivery leases the next due delivery so that a single instance
+// attempts it. The lease lets another instance retry if this one dies mid-attempt.
+func ClaimWebhookDelivery(ctx context.Context, now time.Time, lease time.Duration) (*models.WebhookDelivery, error) {
+	ctx, end := startOp(ctx, "ClaimWebhookDelivery")
+	defer end()
+
+	filter := bson.M{
+		"status":          DeliveryPending,
+		"next_attempt_at": bson.M{"$lte": now},
+		"$or": []bson.M{
+			{"locked_until": bson.M{"$exists": false}},
+			{"locked_until": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"locked_until": now.Add(lease)}}
+	findOptions := options.FindOneAndUpdate().
+		SetSort(bson.M{"next_attempt_at": 1}).
+		SetReturnDocument(options.After)
+
+	var delivery models.WebhookDelivery
+	err := webhookDeliveriesCollection.FindOneAndUpdate(ctx, filter, update, findOptions).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error claiming webhook delivery: %v", err)
+	}
+	return &delivery, nil
+}
+
+// CompleteWebhookDelivery records an attempt. status is DeliveryPending to retry at
+// nextAttemptAt, or one of the final statuses.
+func CompleteWebhookDelivery(ctx context.Context, deliveryID string, status string, statusCode int, attemptError string, now time.Time, nextAttemptAt time.Time) error {
+	ctx, end := startOp(ctx, "CompleteWebhookDelivery")
+	defer end()
+
+	deliveryObjectID, err := primitive.ObjectIDFromHex(deliveryID)
+	if err != nil {
+		return fmt.Errorf("invalid delivery ID format: %v", err)
+	}
+	set := bson.M{
+		"status":           status,
+		"last_attempt_at":  now,
+		"last_status_code": statusCode,
+		"last_error":       attemptError,
+		"next_attempt_at":  nextAttemptAt,
+	}
+	if status == DeliveryDelivered {
+		set["delivered_at"] = now
+	}
+	_, err = webhookDeliveriesCollection.UpdateOne(ctx,
+		bson.M{"_id": deliveryObjectID},
+		bson.M{"$set": set, "$inc": bson.M{"attempts": 1}, "$unset": bson.M{"locked_until": ""}})
+	if err != nil {
+		return fmt.Errorf("error updating webhook delivery: %v", err)
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns the latest deliveries of a webhook, newest first
+func ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]*models.WebhookDelivery, error) {
+	ctx, end := startOp(ctx, "ListWebhookDeliveries")
+	defer end()
+
+	cursor, err := webhookDeliveriesCollection.Find(ctx,
+		bson.M{"webhook_id": webhookID},
+		options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, fmt.Errorf("error listing webhook deliveries: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []*models.WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, fmt.Errorf("error decoding webhook deliveries: %v", err)
+	}
+	return deliveries, nil
+}